@@ -2,20 +2,29 @@ package main
 
 import (
 	"context"
+	"egobackend/internal/apperr"
 	"egobackend/internal/auth"
+	"egobackend/internal/backplane"
 	"egobackend/internal/database"
+	"egobackend/internal/engine"
 	"egobackend/internal/handlers"
+	"egobackend/internal/mailer"
 	"egobackend/internal/models"
 	"egobackend/internal/storage"
 	"egobackend/internal/websocket"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
+	"github.com/google/uuid"
 	"github.com/joho/godotenv"
 )
 
@@ -26,34 +35,225 @@ func CoopMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func startFileCleanupRoutine(db *database.DB, s3Service *storage.S3Service) {
-	log.Println("[CLEANUP] Запуск фонового процесса очистки старых файлов из S3...")
+// startFileCleanupRoutine удаляет просроченные токены из писем и
+// сохраненные вложения старше retention вместе с их объектами в S3.
+// Нулевой retention хранит вложения бессрочно. Непривязанные вложения
+// убирает reconcileAttachments.
+func startFileCleanupRoutine(db *database.DB, s3Service *storage.S3Service, retention time.Duration) {
 	ticker := time.NewTicker(24 * time.Hour)
 	defer ticker.Stop()
 
 	for range ticker.C {
-		log.Println("[CLEANUP] Выполняется плановая очистка старых файлов (старше 24 часов) из S3...")
+		if removed, err := db.DeleteExpiredUserTokens(); err != nil {
+			log.Printf("!!! [CLEANUP] ОШИБКА при удалении просроченных токенов: %v", err)
+		} else if removed > 0 {
+			log.Printf("[CLEANUP] Удалено %d просроченных или использованных токенов.", removed)
+		}
+		if retention > 0 {
+			deleteExpiredAttachments(db, s3Service, retention)
+		}
+	}
+}
 
-		deletedURIs, err := db.DeleteOldFileAttachments(24 * time.Hour)
+func deleteExpiredAttachments(db *database.DB, s3Service *storage.S3Service, retention time.Duration) {
+	for {
+		uris, err := db.DeleteExpiredCommittedAttachments(retention, 500)
 		if err != nil {
 			log.Printf("!!! [CLEANUP] ОШИБКА во время удаления записей из БД: %v", err)
-			continue
+			return
+		}
+		if len(uris) == 0 {
+			return
 		}
+		log.Printf("[CLEANUP] Удалено %d вложений старше %s, удаляю их объекты из S3...", len(uris), retention)
+		if err := s3Service.DeleteFiles(context.Background(), uris); err != nil {
+			log.Printf("!!! [CLEANUP] ОШИБКА при удалении объектов S3, они будут найдены как осиротевшие: %v", err)
+			return
+		}
+	}
+}
 
-		if len(deletedURIs) == 0 {
-			log.Println("[CLEANUP] Старых файлов для удаления не найдено.")
+func startAccountPurgeRoutine(db *database.DB, s3Service *storage.S3Service) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		userIDs, err := db.GetUsersDueForPurge(20)
+		if err != nil {
+			log.Printf("!!! [PURGE] ОШИБКА при поиске аккаунтов для очистки: %v", err)
 			continue
 		}
+		for _, userID := range userIDs {
+			if err := purgeAccount(db, s3Service, userID); err != nil {
+				log.Printf("!!! [PURGE] Очистка аккаунта %d прервана, продолжим в следующий раз: %v", userID, err)
+				continue
+			}
+			log.Printf("[PURGE] Аккаунт %d и все его данные удалены.", userID)
+		}
+	}
+}
+
+// attachmentCommitGrace — сколько вложение может оставаться без лога. С
+// запасом больше самого долгого запуска, чтобы сверка не удалила файл, лог
+// которого еще пишется.
+const attachmentCommitGrace = time.Hour
 
-		log.Printf("[CLEANUP] Найдено %d записей в БД для удаления. Начинаю удаление объектов из S3...", len(deletedURIs))
+func startAttachmentReconcileRoutine(db *database.DB, s3Service *storage.S3Service) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		reconcileAttachments(db, s3Service)
+	}
+}
 
-		err = s3Service.DeleteFiles(context.Background(), deletedURIs)
+// reconcileAttachments убирает следы запросов, не дошедших до сохранения
+// лога: вложения, которые так и не привязались к логу, и объекты S3 без
+// строки в file_attachments (например, если удаление объекта на прошлом
+// проходе не удалось).
+func reconcileAttachments(db *database.DB, s3Service *storage.S3Service) {
+	for {
+		uris, err := db.DeleteStaleUnlinkedAttachments(attachmentCommitGrace, 500)
 		if err != nil {
-			log.Printf("!!! [CLEANUP] ОШИБКА при удалении файлов из S3: %v", err)
-		} else {
-			log.Printf("[CLEANUP] Очистка S3 завершена. Успешно удалено %d объектов.", len(deletedURIs))
+			log.Printf("!!! [RECONCILE] ОШИБКА при удалении непривязанных вложений: %v", err)
+			return
+		}
+		if len(uris) == 0 {
+			break
+		}
+		log.Printf("[RECONCILE] Удалено %d вложений без лога, удаляю их объекты из S3...", len(uris))
+		if err := s3Service.DeleteFiles(context.Background(), uris); err != nil {
+			log.Printf("!!! [RECONCILE] ОШИБКА при удалении объектов S3, они будут найдены как осиротевшие: %v", err)
+			break
+		}
+	}
+
+	err := s3Service.ListFilesOlderThan(context.Background(), attachmentCommitGrace, func(keys []string) error {
+		orphans, err := db.FindOrphanFileURIs(attachmentKeys(keys))
+		if err != nil {
+			return err
+		}
+		if len(orphans) == 0 {
+			return nil
+		}
+		log.Printf("[RECONCILE] Найдено %d объектов S3 без записи в БД, удаляю...", len(orphans))
+		return s3Service.DeleteFiles(context.Background(), orphans)
+	})
+	if err != nil {
+		log.Printf("!!! [RECONCILE] ОШИБКА при поиске осиротевших объектов S3: %v", err)
+	}
+}
+
+// attachmentKeys оставляет только ключи вида <uuid><расширение>, которые
+// создает процессор: остальные объекты бакета сверка не трогает.
+func attachmentKeys(keys []string) []string {
+	var result []string
+	for _, key := range keys {
+		if _, err := uuid.Parse(strings.TrimSuffix(key, filepath.Ext(key))); err == nil {
+			result = append(result, key)
 		}
 	}
+	return result
+}
+
+// purgeAccount можно безопасно перезапускать: объекты S3 удаляются раньше
+// строк в БД, поэтому после сбоя следующий проход найдет оставшиеся файлы.
+func purgeAccount(db *database.DB, s3Service *storage.S3Service, userID int) error {
+	for {
+		uris, err := db.GetUserFileURIs(userID, 500)
+		if err != nil {
+			return err
+		}
+		if len(uris) == 0 {
+			break
+		}
+		if err := s3Service.DeleteFiles(context.Background(), uris); err != nil {
+			return err
+		}
+		if err := db.DeleteFileAttachmentsByURI(uris); err != nil {
+			return err
+		}
+	}
+	return db.HardDeleteUser(userID)
+}
+
+// restoreLoginLockouts переносит активные блокировки из БД в лимитер:
+// при старте, чтобы перезапуск не снимал их, и периодически, чтобы
+// блокировка с одной реплики действовала на всех.
+func restoreLoginLockouts(db database.UserStore, limiter *auth.LoginLimiter) {
+	stored, err := db.GetLoginLockouts(true, 1000)
+	if err != nil {
+		log.Printf("!!! [LOCKOUT] Не удалось загрузить блокировки входа: %v", err)
+		return
+	}
+	lockouts := make([]auth.Lockout, len(stored))
+	for i, l := range stored {
+		lockouts[i] = auth.Lockout{Scope: l.Scope, Subject: l.Subject, FailedAttempts: l.FailedAttempts, LockedUntil: l.LockedUntil}
+	}
+	if restored := limiter.Restore(lockouts); restored > 0 {
+		log.Printf("[LOCKOUT] Загружено %d блокировок входа из БД.", restored)
+	}
+}
+
+func startLoginLimiterCleanupRoutine(db database.UserStore, limiter *auth.LoginLimiter) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		restoreLoginLockouts(db, limiter)
+		if removed := limiter.Prune(); removed > 0 {
+			log.Printf("[CLEANUP] Удалено %d устаревших записей о попытках входа.", removed)
+		}
+	}
+}
+
+// newEngineBackends выбирает, через что движок думает и пишет ответ.
+// LLM_BACKEND=openai — напрямую через OpenAI-совместимый API; Python при
+// этом необязателен и нужен только для инструментов, названий и сводок.
+func newEngineBackends(llmBackend, pythonBackendURL string) (engine.Backends, error) {
+	var backends engine.Backends
+	if pythonBackendURL != "" {
+		pythonClient, err := engine.NewPythonClient(pythonBackendURL)
+		if err != nil {
+			return backends, fmt.Errorf("неверный PYTHON_BACKEND_URL: %w", err)
+		}
+		go pythonClient.RunHealthChecks()
+		backends = engine.NewPythonBackends(pythonClient)
+	}
+
+	switch llmBackend {
+	case "", "python":
+		return backends, nil
+	case "openai":
+		model := os.Getenv("OPENAI_MODEL")
+		if model == "" {
+			return backends, fmt.Errorf("OPENAI_MODEL не установлен")
+		}
+		baseURL := os.Getenv("OPENAI_BASE_URL")
+		if baseURL == "" {
+			baseURL = "https://api.openai.com/v1"
+		}
+		openAI := engine.NewOpenAIBackend(baseURL, os.Getenv("OPENAI_API_KEY"), model)
+		backends.Thinker = openAI
+		backends.Synthesizer = openAI
+		log.Printf("LLM-бэкенд: OpenAI-совместимый API %s, модель %s", baseURL, model)
+		return backends, nil
+	default:
+		return backends, fmt.Errorf("неизвестный LLM_BACKEND %q", llmBackend)
+	}
+}
+
+func getEnvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Внимание: переменная %s='%s' не является числом, используется %d", key, value, fallback)
+		return fallback
+	}
+	return parsed
 }
 
 func main() {
@@ -72,7 +272,11 @@ func main() {
 	}
 
 	pythonBackendURL := os.Getenv("PYTHON_BACKEND_URL")
-	if dbPath == "" || serverAddr == "" || jwtSecret == "" || pythonBackendURL == "" || s3Config.Endpoint == "" || s3Config.Region == "" || s3Config.KeyID == "" || s3Config.AppKey == "" || s3Config.Bucket == "" {
+	llmBackend := os.Getenv("LLM_BACKEND")
+	if llmBackend != "openai" && pythonBackendURL == "" {
+		log.Fatal("Критическая ошибка: PYTHON_BACKEND_URL не установлен")
+	}
+	if dbPath == "" || serverAddr == "" || jwtSecret == "" || s3Config.Endpoint == "" || s3Config.Region == "" || s3Config.KeyID == "" || s3Config.AppKey == "" || s3Config.Bucket == "" {
 		log.Fatal("Критическая ошибка: одна или несколько переменных окружения не установлены")
 	}
 
@@ -90,18 +294,78 @@ func main() {
 		log.Fatalf("Критическая ошибка! Не удалось создать S3 сервис: %v", err)
 	}
 
-	go startFileCleanupRoutine(db, s3Service)
+	go startFileCleanupRoutine(db, s3Service, time.Duration(getEnvInt("ATTACHMENT_RETENTION_HOURS", 24))*time.Hour)
+	go startAccountPurgeRoutine(db, s3Service)
+	go startAttachmentReconcileRoutine(db, s3Service)
 
 	authSvc, err := auth.NewAuthService(jwtSecret)
 	if err != nil {
 		log.Fatalf("Критическая ошибка: не удалось создать сервис аутентификации: %v", err)
 	}
 
-	hub := websocket.NewHub()
+	auth.SetBcryptConcurrency(getEnvInt("BCRYPT_MAX_CONCURRENCY", 4))
+	limiterConfig := auth.DefaultLimiterConfig()
+	limiterConfig.UsernameMaxFailures = getEnvInt("LOGIN_MAX_FAILURES_PER_USER", limiterConfig.UsernameMaxFailures)
+	limiterConfig.IPMaxFailures = getEnvInt("LOGIN_MAX_FAILURES_PER_IP", limiterConfig.IPMaxFailures)
+	limiterConfig.LockoutDuration = time.Duration(getEnvInt("LOGIN_LOCKOUT_MINUTES", int(limiterConfig.LockoutDuration/time.Minute))) * time.Minute
+	loginLimiter := auth.NewLoginLimiter(limiterConfig)
+	restoreLoginLockouts(db, loginLimiter)
+	go startLoginLimiterCleanupRoutine(db, loginLimiter)
+
+	trustedProxies, ok := os.LookupEnv("TRUSTED_PROXIES")
+	if !ok {
+		trustedProxies = handlers.DefaultTrustedProxies
+	}
+	if err := handlers.SetTrustedProxies(trustedProxies); err != nil {
+		log.Fatalf("Критическая ошибка: TRUSTED_PROXIES: %v", err)
+	}
+
+	var bp backplane.Backplane = backplane.NewMemory()
+	if os.Getenv("WS_BACKPLANE") == "postgres" {
+		if db.Dialect() != database.Postgres {
+			log.Fatal("Критическая ошибка: WS_BACKPLANE=postgres требует DATABASE_URL с PostgreSQL")
+		}
+		pgBackplane, err := backplane.NewPostgres(dbPath, db)
+		if err != nil {
+			log.Fatalf("Критическая ошибка! Не удалось запустить Postgres backplane: %v", err)
+		}
+		bp = pgBackplane
+	}
+	defer bp.Close()
+
+	hub, err := websocket.NewHub(bp, getEnvInt("WS_MAX_RUNS_PER_CLIENT", 3), os.Getenv("WS_SYNC_STREAMS") == "true")
+	if err != nil {
+		log.Fatalf("Критическая ошибка! Не удалось создать WebSocket хаб: %v", err)
+	}
 	go hub.Run()
 
-	authHandler := &handlers.AuthHandler{DB: db, AuthService: authSvc}
-	sessionHandler := &handlers.SessionHandler{DB: db}
+	appBaseURL := os.Getenv("APP_BASE_URL")
+	if appBaseURL == "" {
+		appBaseURL = "http://localhost"
+	}
+
+	authHandler := &handlers.AuthHandler{
+		DB:                       db,
+		AuthService:              authSvc,
+		Limiter:                  loginLimiter,
+		Mailer:                   mailer.NewFromEnv(),
+		AppBaseURL:               appBaseURL,
+		RequireEmailVerification: os.Getenv("EMAIL_VERIFICATION_REQUIRED") == "true",
+	}
+	sessionHandler := &handlers.SessionHandler{DB: db, Events: hub}
+	adminHandler := &handlers.AdminHandler{DB: db, Limiter: loginLimiter}
+	backends, err := newEngineBackends(llmBackend, pythonBackendURL)
+	if err != nil {
+		log.Fatalf("Критическая ошибка! Не удалось настроить LLM-бэкенд: %v", err)
+	}
+	memoryHandler := &handlers.MemoryHandler{DB: db}
+	presetHandler := &handlers.PresetHandler{DB: db}
+	accountHandler := &handlers.AccountHandler{
+		DB:               db,
+		S3Service:        s3Service,
+		PurgeGracePeriod: time.Duration(getEnvInt("ACCOUNT_PURGE_GRACE_DAYS", 30)) * 24 * time.Hour,
+		Auth:             authHandler,
+	}
 
 	r := chi.NewRouter()
 	corsMiddleware := cors.New(cors.Options{
@@ -121,11 +385,23 @@ func main() {
 	r.Post("/auth/login", authHandler.Login)
 	r.Post("/auth/google", authHandler.GoogleLogin)
 	r.Post("/auth/refresh", authHandler.Refresh)
+	r.Post("/auth/password-reset/request", authHandler.RequestPasswordReset)
+	r.Post("/auth/password-reset/confirm", authHandler.ConfirmPasswordReset)
+	r.Post("/auth/verify-email", authHandler.VerifyEmail)
 
 	r.Group(func(r chi.Router) {
 		r.Use(authHandler.AuthMiddleware)
 
 		r.Get("/me", authHandler.Me)
+		r.Patch("/me", authHandler.UpdateProfile)
+		r.Post("/me/password", authHandler.ChangePassword)
+		r.Post("/me/verify-email/resend", authHandler.ResendVerificationEmail)
+		r.Get("/me/export", accountHandler.ExportData)
+		r.Delete("/me", accountHandler.DeleteAccount)
+		r.Get("/me/memories", memoryHandler.ListMemories)
+		r.Post("/me/memories", memoryHandler.CreateMemory)
+		r.Patch("/me/memories/{memoryID}", memoryHandler.UpdateMemory)
+		r.Delete("/me/memories/{memoryID}", memoryHandler.DeleteMemory)
 
 		r.Get("/sessions", sessionHandler.GetSessions)
 		r.Get("/sessions/{sessionID}", sessionHandler.GetSession)
@@ -133,14 +409,30 @@ func main() {
 		r.Delete("/sessions/{sessionID}", sessionHandler.DeleteSession)
 		r.Patch("/sessions/{sessionID}", sessionHandler.UpdateSession)
 		r.Patch("/logs/{logID}", sessionHandler.EditLog)
+		r.Get("/logs/{logID}/trace", sessionHandler.GetLogTrace)
+		r.Post("/logs/{logID}/feedback", sessionHandler.SubmitLogFeedback)
+
+		r.Get("/modes", handlers.ListModes)
+
+		r.Get("/presets", presetHandler.ListPresets)
+		r.Post("/presets", presetHandler.CreatePreset)
+		r.Patch("/presets/{presetID}", presetHandler.UpdatePreset)
+		r.Delete("/presets/{presetID}", presetHandler.DeletePreset)
+
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(handlers.AdminOnly)
+			r.Get("/lockouts", adminHandler.GetLockouts)
+			r.Delete("/lockouts/{lockoutID}", adminHandler.ClearLockout)
+			r.Get("/feedback/stats", adminHandler.GetFeedbackStats)
+		})
 
 		r.Get("/ws", func(w http.ResponseWriter, r *http.Request) {
 			user, ok := r.Context().Value(handlers.UserContextKey).(*models.User)
 			if !ok {
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				handlers.RespondWithError(w, r, apperr.New(apperr.Unauthorized))
 				return
 			}
-			websocket.ServeWs(hub, w, r, user, db, pythonBackendURL, s3Service)
+			websocket.ServeWs(hub, w, r, user, db, backends, s3Service)
 		})
 	})
 
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"egobackend/internal/protocol"
+)
+
+func main() {
+	out := flag.String("o", "protocol.schema.json", "куда записать JSON Schema")
+	flag.Parse()
+
+	schema, err := protocol.GenerateSchema()
+	if err != nil {
+		log.Fatalf("Не удалось построить схему протокола: %v", err)
+	}
+	if err := os.WriteFile(*out, append(schema, '\n'), 0o644); err != nil {
+		log.Fatalf("Не удалось записать схему: %v", err)
+	}
+	log.Printf("Схема протокола v%d записана в %s", protocol.Version, *out)
+}
@@ -0,0 +1,194 @@
+// Package apperr описывает ошибки, которые видит клиент: стабильный
+// машиночитаемый код, HTTP-статус и сообщение из каталога i18n. Внутренние
+// подробности (тексты ответов Python, ошибки БД) хранятся в Err/Detail и
+// попадают только в лог.
+package apperr
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"egobackend/internal/i18n"
+)
+
+type Code string
+
+const (
+	Internal             Code = "internal"
+	BadRequest           Code = "bad_request"
+	InvalidID            Code = "invalid_id"
+	NothingToUpdate      Code = "nothing_to_update"
+	EmptyQuery           Code = "empty_query"
+	Unauthorized         Code = "unauthorized"
+	TokenMissing         Code = "token_missing"
+	InvalidToken         Code = "invalid_token"
+	InvalidGoogleToken   Code = "invalid_google_token"
+	Forbidden            Code = "forbidden"
+	AdminOnly            Code = "admin_only"
+	AccountDeleted       Code = "account_deleted"
+	UserNotFound         Code = "user_not_found"
+	CredentialsRequired  Code = "credentials_required"
+	InvalidCredentials   Code = "invalid_credentials"
+	WrongPassword        Code = "wrong_password"
+	ReauthRequired       Code = "reauth_required"
+	PasswordTooShort     Code = "password_too_short"
+	UsernameTaken        Code = "username_taken"
+	EmailTaken           Code = "email_taken"
+	EmailRequired        Code = "email_required"
+	EmailInvalid         Code = "email_invalid"
+	EmailMissing         Code = "email_missing"
+	EmailNotVerified     Code = "email_not_verified"
+	EmailAlreadyVerified Code = "email_already_verified"
+	InvalidLink          Code = "invalid_link"
+	TooManyAttempts      Code = "too_many_attempts"
+	ServerBusy           Code = "server_busy"
+	SessionNotFound      Code = "session_not_found"
+	LogNotFound          Code = "log_not_found"
+	LockoutNotFound      Code = "lockout_not_found"
+	MemoryNotFound       Code = "memory_not_found"
+	MemoryLimitReached   Code = "memory_limit_reached"
+	MemoryTooLong        Code = "memory_too_long"
+	PresetNotFound       Code = "preset_not_found"
+	PresetNameRequired   Code = "preset_name_required"
+	PresetTooLong        Code = "preset_too_long"
+	UnknownMode          Code = "unknown_mode"
+	InvalidRating        Code = "invalid_rating"
+	UnknownReason        Code = "unknown_reason"
+	FeedbackTooLong      Code = "feedback_too_long"
+	InvalidTimeWindow    Code = "invalid_time_window"
+	StreamingUnsupported Code = "streaming_unsupported"
+	FileTooLarge         Code = "file_too_large"
+	QuotaExceeded        Code = "quota_exceeded"
+	PythonUnavailable    Code = "python_unavailable"
+	GenerationFailed     Code = "generation_failed"
+	ToolFailed           Code = "tool_failed"
+	ProtocolUnsupported  Code = "protocol_unsupported"
+	RunIDRequired        Code = "run_id_required"
+	UnsupportedLocale    Code = "unsupported_locale"
+)
+
+var statuses = map[Code]int{
+	Internal:             http.StatusInternalServerError,
+	BadRequest:           http.StatusBadRequest,
+	InvalidID:            http.StatusBadRequest,
+	NothingToUpdate:      http.StatusBadRequest,
+	EmptyQuery:           http.StatusBadRequest,
+	Unauthorized:         http.StatusUnauthorized,
+	TokenMissing:         http.StatusUnauthorized,
+	InvalidToken:         http.StatusUnauthorized,
+	InvalidGoogleToken:   http.StatusUnauthorized,
+	Forbidden:            http.StatusForbidden,
+	AdminOnly:            http.StatusForbidden,
+	AccountDeleted:       http.StatusForbidden,
+	UserNotFound:         http.StatusUnauthorized,
+	CredentialsRequired:  http.StatusBadRequest,
+	InvalidCredentials:   http.StatusUnauthorized,
+	WrongPassword:        http.StatusForbidden,
+	ReauthRequired:       http.StatusBadRequest,
+	PasswordTooShort:     http.StatusBadRequest,
+	UsernameTaken:        http.StatusConflict,
+	EmailTaken:           http.StatusConflict,
+	EmailRequired:        http.StatusBadRequest,
+	EmailInvalid:         http.StatusBadRequest,
+	EmailMissing:         http.StatusBadRequest,
+	EmailNotVerified:     http.StatusForbidden,
+	EmailAlreadyVerified: http.StatusConflict,
+	InvalidLink:          http.StatusBadRequest,
+	TooManyAttempts:      http.StatusTooManyRequests,
+	ServerBusy:           http.StatusServiceUnavailable,
+	SessionNotFound:      http.StatusNotFound,
+	LogNotFound:          http.StatusNotFound,
+	LockoutNotFound:      http.StatusNotFound,
+	MemoryNotFound:       http.StatusNotFound,
+	MemoryLimitReached:   http.StatusConflict,
+	MemoryTooLong:        http.StatusBadRequest,
+	PresetNotFound:       http.StatusNotFound,
+	PresetNameRequired:   http.StatusBadRequest,
+	PresetTooLong:        http.StatusBadRequest,
+	UnknownMode:          http.StatusBadRequest,
+	InvalidRating:        http.StatusBadRequest,
+	UnknownReason:        http.StatusBadRequest,
+	FeedbackTooLong:      http.StatusBadRequest,
+	InvalidTimeWindow:    http.StatusBadRequest,
+	StreamingUnsupported: http.StatusInternalServerError,
+	FileTooLarge:         http.StatusRequestEntityTooLarge,
+	QuotaExceeded:        http.StatusTooManyRequests,
+	PythonUnavailable:    http.StatusServiceUnavailable,
+	GenerationFailed:     http.StatusBadGateway,
+	ToolFailed:           http.StatusBadGateway,
+	ProtocolUnsupported:  http.StatusBadRequest,
+	RunIDRequired:        http.StatusBadRequest,
+	UnsupportedLocale:    http.StatusBadRequest,
+}
+
+// Error — ошибка с кодом для клиента. Args подставляются в сообщение
+// каталога, Detail и Err предназначены только для логов.
+type Error struct {
+	Code   Code
+	Args   []interface{}
+	Detail string
+	Err    error
+}
+
+func New(code Code, args ...interface{}) *Error {
+	return &Error{Code: code, Args: args}
+}
+
+func Wrap(code Code, err error) *Error {
+	return &Error{Code: code, Err: err}
+}
+
+// WithDetail добавляет внутреннее пояснение для лога.
+func (e *Error) WithDetail(format string, args ...interface{}) *Error {
+	e.Detail = fmt.Sprintf(format, args...)
+	return e
+}
+
+func (e *Error) Error() string {
+	parts := []string{string(e.Code)}
+	if e.Detail != "" {
+		parts = append(parts, e.Detail)
+	}
+	if e.Err != nil {
+		parts = append(parts, e.Err.Error())
+	}
+	return strings.Join(parts, ": ")
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Status() int {
+	if status, ok := statuses[e.Code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// Message возвращает текст для пользователя на языке locale.
+func (e *Error) Message(locale i18n.Locale) string {
+	key := "error." + string(e.Code)
+	if !i18n.Has(key) {
+		key = "error." + string(Internal)
+	}
+	return i18n.T(locale, key, e.Args...)
+}
+
+// From приводит любую ошибку к *Error. Неизвестные ошибки становятся
+// Internal, а их текст остается во внутренних деталях.
+func From(err error) *Error {
+	var appErr *Error
+	if errors.As(err, &appErr) {
+		return appErr
+	}
+	return Wrap(Internal, err)
+}
+
+// Is сообщает, есть ли в цепочке err ошибка с кодом code.
+func Is(err error, code Code) bool {
+	var appErr *Error
+	return errors.As(err, &appErr) && appErr.Code == code
+}
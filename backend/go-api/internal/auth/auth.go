@@ -2,6 +2,10 @@ package auth
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
@@ -12,6 +16,39 @@ import (
 	"google.golang.org/api/idtoken"
 )
 
+var ErrHashingBusy = errors.New("сервер перегружен проверками паролей, попробуйте позже")
+
+const bcryptCost = 14
+
+var (
+	bcryptSlots       = make(chan struct{}, 4)
+	bcryptWaitTimeout = 10 * time.Second
+)
+
+// SetBcryptConcurrency ограничивает число одновременных операций bcrypt.
+// Вызывать до старта сервера.
+func SetBcryptConcurrency(n int) {
+	if n < 1 {
+		n = 1
+	}
+	bcryptSlots = make(chan struct{}, n)
+}
+
+func acquireBcryptSlot() bool {
+	timer := time.NewTimer(bcryptWaitTimeout)
+	defer timer.Stop()
+	select {
+	case bcryptSlots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func releaseBcryptSlot() {
+	<-bcryptSlots
+}
+
 type AuthService struct {
 	jwtSecret []byte
 }
@@ -24,7 +61,11 @@ func NewAuthService(secret string) (*AuthService, error) {
 }
 
 func HashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
+	if !acquireBcryptSlot() {
+		return "", ErrHashingBusy
+	}
+	defer releaseBcryptSlot()
+	bytes, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
 	if err != nil {
 		log.Printf("Что-то пошло не так при хешировании пароля: %v", err)
 		return "", err
@@ -32,33 +73,63 @@ func HashPassword(password string) (string, error) {
 	return string(bytes), nil
 }
 
-func CheckPasswordHash(password, hash string) bool {
+func CheckPasswordHash(password, hash string) (bool, error) {
+	if !acquireBcryptSlot() {
+		return false, ErrHashingBusy
+	}
+	defer releaseBcryptSlot()
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err == nil
+	return err == nil, nil
+}
+
+// GenerateOpaqueToken создает одноразовый токен для писем. Пользователю
+// уходит сам токен, в БД хранится только его хеш.
+func GenerateOpaqueToken() (token string, hash string, err error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(buf)
+	return token, HashOpaqueToken(token), nil
 }
 
-func (s *AuthService) CreateAccessToken(username, role string) (string, error) {
+func HashOpaqueToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// TokenClaims — данные проверенного токена. Version сравнивается с
+// users.token_version: после смены пароля версия растет, и выданные раньше
+// токены перестают приниматься. У старых токенов без версии она равна 0.
+type TokenClaims struct {
+	Username string
+	Version  int
+}
+
+func (s *AuthService) CreateAccessToken(username, role string, version int) (string, error) {
 	claims := jwt.MapClaims{
 		"sub":  username,
 		"iat":  time.Now().Unix(),
 		"exp":  time.Now().Add(time.Hour * 24).Unix(), // Живет 24 часа
 		"role": role,
+		"ver":  version,
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString(s.jwtSecret)
 }
 
-func (s *AuthService) CreateRefreshToken(username string) (string, error) {
+func (s *AuthService) CreateRefreshToken(username string, version int) (string, error) {
 	claims := jwt.MapClaims{
 		"sub": username,
 		"iat": time.Now().Unix(),
 		"exp": time.Now().Add(time.Hour * 24 * 30).Unix(), // Живет 30 дней
+		"ver": version,
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString(s.jwtSecret)
 }
 
-func (s *AuthService) ValidateJWT(tokenString string) (string, error) {
+func (s *AuthService) ValidateJWT(tokenString string) (*TokenClaims, error) {
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("неожиданный алгоритм подписи: %v", token.Header["alg"])
@@ -67,16 +138,20 @@ func (s *AuthService) ValidateJWT(tokenString string) (string, error) {
 	})
 
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
 		if username, ok := claims["sub"].(string); ok {
-			return username, nil
+			result := &TokenClaims{Username: username}
+			if version, ok := claims["ver"].(float64); ok {
+				result.Version = int(version)
+			}
+			return result, nil
 		}
 	}
 
-	return "", errors.New("невалидный токен")
+	return nil, errors.New("невалидный токен")
 }
 
 func (s *AuthService) ValidateGoogleJWT(googletoken, audience string) (string, error) {
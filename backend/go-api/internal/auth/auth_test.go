@@ -0,0 +1,27 @@
+package auth
+
+import "testing"
+
+func TestTokenVersion(t *testing.T) {
+	service, err := NewAuthService("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refresh, err := service.CreateRefreshToken("alice", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := service.ValidateJWT(refresh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Username != "alice" || claims.Version != 3 {
+		t.Errorf("claims = %+v", claims)
+	}
+
+	other, _ := NewAuthService("other-secret")
+	if _, err := other.ValidateJWT(refresh); err == nil {
+		t.Error("токен с чужой подписью принят")
+	}
+}
@@ -0,0 +1,222 @@
+package auth
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	ScopeIP       = "ip"
+	ScopeUsername = "username"
+)
+
+type LimiterConfig struct {
+	FreeAttempts        int
+	BaseDelay           time.Duration
+	MaxDelay            time.Duration
+	UsernameMaxFailures int
+	IPMaxFailures       int
+	LockoutDuration     time.Duration
+	FailureWindow       time.Duration
+}
+
+func DefaultLimiterConfig() LimiterConfig {
+	return LimiterConfig{
+		FreeAttempts:        3,
+		BaseDelay:           time.Second,
+		MaxDelay:            time.Minute,
+		UsernameMaxFailures: 10,
+		IPMaxFailures:       50,
+		LockoutDuration:     15 * time.Minute,
+		FailureWindow:       30 * time.Minute,
+	}
+}
+
+// Lockout описывает блокировку, которую лимитер только что выставил.
+type Lockout struct {
+	Scope          string
+	Subject        string
+	FailedAttempts int
+	LockedUntil    time.Time
+}
+
+type attemptState struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+// LoginLimiter считает неудачные попытки входа по IP и по имени пользователя,
+// растягивает паузу между попытками экспоненциально и блокирует ключ целиком
+// после превышения порога.
+type LoginLimiter struct {
+	mu       sync.Mutex
+	cfg      LimiterConfig
+	attempts map[string]*attemptState
+	now      func() time.Time
+}
+
+func NewLoginLimiter(cfg LimiterConfig) *LoginLimiter {
+	return &LoginLimiter{
+		cfg:      cfg,
+		attempts: make(map[string]*attemptState),
+		now:      time.Now,
+	}
+}
+
+func limiterKey(scope, subject string) string {
+	return scope + ":" + subject
+}
+
+// Check возвращает, сколько клиент должен подождать до следующей попытки.
+// Ноль означает, что попытку можно выполнять. Пустые ip/username пропускаются.
+func (l *LoginLimiter) Check(ip, username string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	var wait time.Duration
+	for _, key := range l.keys(ip, username) {
+		state, ok := l.attempts[key]
+		if !ok {
+			continue
+		}
+		if d := state.blockedUntil.Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// RegisterFailure фиксирует неудачную попытку и возвращает блокировки,
+// которые были выставлены именно этой попыткой.
+func (l *LoginLimiter) RegisterFailure(ip, username string) []Lockout {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	var lockouts []Lockout
+	for _, scope := range []string{ScopeIP, ScopeUsername} {
+		subject := ip
+		maxFailures := l.cfg.IPMaxFailures
+		if scope == ScopeUsername {
+			subject = username
+			maxFailures = l.cfg.UsernameMaxFailures
+		}
+		if subject == "" {
+			continue
+		}
+
+		key := limiterKey(scope, subject)
+		state, ok := l.attempts[key]
+		if !ok || now.Sub(state.lastFailure) > l.cfg.FailureWindow {
+			state = &attemptState{}
+			l.attempts[key] = state
+		}
+		state.failures++
+		state.lastFailure = now
+
+		if maxFailures > 0 && state.failures >= maxFailures {
+			state.blockedUntil = now.Add(l.cfg.LockoutDuration)
+			lockouts = append(lockouts, Lockout{
+				Scope:          scope,
+				Subject:        subject,
+				FailedAttempts: state.failures,
+				LockedUntil:    state.blockedUntil,
+			})
+			continue
+		}
+
+		if state.failures >= l.cfg.FreeAttempts {
+			state.blockedUntil = now.Add(l.backoff(state.failures - l.cfg.FreeAttempts))
+		}
+	}
+	return lockouts
+}
+
+// RegisterSuccess сбрасывает счетчик для имени пользователя. Счетчик IP
+// не трогаем, иначе перебор по разным аккаунтам с одного адреса
+// обнулялся бы каждым удачным входом атакующего в свой аккаунт.
+func (l *LoginLimiter) RegisterSuccess(username string) {
+	if username == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.attempts, limiterKey(ScopeUsername, username))
+}
+
+// Restore применяет блокировки, сохраненные в БД: после перезапуска или
+// с других реплик. Истекшие пропускаются, более поздняя блокировка в
+// памяти не укорачивается.
+func (l *LoginLimiter) Restore(lockouts []Lockout) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	restored := 0
+	for _, lockout := range lockouts {
+		if !lockout.LockedUntil.After(now) {
+			continue
+		}
+		key := limiterKey(lockout.Scope, lockout.Subject)
+		state, ok := l.attempts[key]
+		if !ok {
+			state = &attemptState{}
+			l.attempts[key] = state
+		}
+		if !lockout.LockedUntil.After(state.blockedUntil) {
+			continue
+		}
+		state.blockedUntil = lockout.LockedUntil
+		state.failures = max(state.failures, lockout.FailedAttempts)
+		if lockedAt := lockout.LockedUntil.Add(-l.cfg.LockoutDuration); lockedAt.After(state.lastFailure) {
+			state.lastFailure = lockedAt
+		}
+		restored++
+	}
+	return restored
+}
+
+// Reset снимает блокировку и обнуляет счетчик для ключа.
+func (l *LoginLimiter) Reset(scope, subject string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.attempts, limiterKey(scope, subject))
+}
+
+// Prune удаляет записи, у которых истекли и окно неудачных попыток, и блокировка.
+func (l *LoginLimiter) Prune() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	removed := 0
+	for key, state := range l.attempts {
+		if now.Sub(state.lastFailure) > l.cfg.FailureWindow && now.After(state.blockedUntil) {
+			delete(l.attempts, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (l *LoginLimiter) backoff(step int) time.Duration {
+	delay := time.Duration(float64(l.cfg.BaseDelay) * math.Pow(2, float64(step)))
+	if delay <= 0 || delay > l.cfg.MaxDelay {
+		return l.cfg.MaxDelay
+	}
+	return delay
+}
+
+func (l *LoginLimiter) keys(ip, username string) []string {
+	var keys []string
+	if ip != "" {
+		keys = append(keys, limiterKey(ScopeIP, ip))
+	}
+	if username != "" {
+		keys = append(keys, limiterKey(ScopeUsername, username))
+	}
+	return keys
+}
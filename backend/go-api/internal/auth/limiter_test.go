@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeClock struct{ now time.Time }
+
+func (c *fakeClock) advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func newTestLimiter(cfg LimiterConfig) (*LoginLimiter, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)}
+	limiter := NewLoginLimiter(cfg)
+	limiter.now = func() time.Time { return clock.now }
+	return limiter, clock
+}
+
+func testConfig() LimiterConfig {
+	return LimiterConfig{
+		FreeAttempts:        3,
+		BaseDelay:           time.Second,
+		MaxDelay:            10 * time.Second,
+		UsernameMaxFailures: 10,
+		IPMaxFailures:       20,
+		LockoutDuration:     15 * time.Minute,
+		FailureWindow:       30 * time.Minute,
+	}
+}
+
+func TestLimiterBackoff(t *testing.T) {
+	limiter, _ := newTestLimiter(testConfig())
+
+	// Первые FreeAttempts-1 ошибок проходят без паузы, дальше пауза
+	// удваивается и упирается в MaxDelay.
+	want := []time.Duration{0, 0, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, w := range want {
+		if lockouts := limiter.RegisterFailure("10.0.0.1", "alice"); len(lockouts) != 0 {
+			t.Fatalf("попытка %d: неожиданная блокировка %+v", i+1, lockouts)
+		}
+		if got := limiter.Check("10.0.0.1", "alice"); got != w {
+			t.Errorf("после %d ошибок пауза %v, want %v", i+1, got, w)
+		}
+	}
+	if got := limiter.Check("10.0.0.2", "bob"); got != 0 {
+		t.Errorf("другие ключи не должны ждать: %v", got)
+	}
+}
+
+func TestLimiterLockout(t *testing.T) {
+	cfg := testConfig()
+	limiter, clock := newTestLimiter(cfg)
+
+	var lockouts []Lockout
+	for i := 0; i < cfg.UsernameMaxFailures; i++ {
+		// Без адреса считается только имя пользователя.
+		lockouts = limiter.RegisterFailure("", "alice")
+		clock.advance(time.Second)
+	}
+	if len(lockouts) != 1 || lockouts[0].Scope != ScopeUsername || lockouts[0].Subject != "alice" || lockouts[0].FailedAttempts != cfg.UsernameMaxFailures {
+		t.Fatalf("lockouts = %+v", lockouts)
+	}
+	if got := limiter.Check("10.0.0.9", "alice"); got <= cfg.MaxDelay || got > cfg.LockoutDuration {
+		t.Errorf("блокировка должна длиться около LockoutDuration, осталось %v", got)
+	}
+
+	limiter.Reset(ScopeUsername, "alice")
+	if got := limiter.Check("", "alice"); got != 0 {
+		t.Errorf("после Reset пауза %v", got)
+	}
+}
+
+func TestLimiterExpiry(t *testing.T) {
+	cfg := testConfig()
+	limiter, clock := newTestLimiter(cfg)
+
+	for i := 0; i < cfg.UsernameMaxFailures; i++ {
+		limiter.RegisterFailure("", "alice")
+	}
+	clock.advance(cfg.LockoutDuration + time.Second)
+	if got := limiter.Check("", "alice"); got != 0 {
+		t.Errorf("блокировка не истекла: %v", got)
+	}
+
+	// После окна FailureWindow счетчик начинается заново.
+	clock.advance(cfg.FailureWindow)
+	if lockouts := limiter.RegisterFailure("", "alice"); len(lockouts) != 0 {
+		t.Errorf("счетчик не сброшен после окна: %+v", lockouts)
+	}
+	if got := limiter.Check("", "alice"); got != 0 {
+		t.Errorf("первая ошибка нового окна не должна давать паузу: %v", got)
+	}
+
+	clock.advance(cfg.FailureWindow + time.Second)
+	if removed := limiter.Prune(); removed != 1 {
+		t.Errorf("Prune() = %d, want 1", removed)
+	}
+}
+
+func TestLimiterSuccessKeepsIPCounter(t *testing.T) {
+	limiter, _ := newTestLimiter(testConfig())
+	for i := 0; i < 4; i++ {
+		limiter.RegisterFailure("10.0.0.1", "alice")
+	}
+	limiter.RegisterSuccess("alice")
+	if got := limiter.Check("", "alice"); got != 0 {
+		t.Errorf("счетчик имени не сброшен: %v", got)
+	}
+	if got := limiter.Check("10.0.0.1", ""); got == 0 {
+		t.Error("удачный вход не должен сбрасывать счетчик IP")
+	}
+}
+
+func TestLimiterRestore(t *testing.T) {
+	cfg := testConfig()
+	limiter, clock := newTestLimiter(cfg)
+
+	restored := limiter.Restore([]Lockout{
+		{Scope: ScopeUsername, Subject: "alice", FailedAttempts: 10, LockedUntil: clock.now.Add(5 * time.Minute)},
+		{Scope: ScopeIP, Subject: "10.0.0.1", FailedAttempts: 20, LockedUntil: clock.now.Add(-time.Minute)},
+	})
+	if restored != 1 {
+		t.Errorf("Restore() = %d, want 1: истекшие блокировки пропускаются", restored)
+	}
+	if got := limiter.Check("", "alice"); got != 5*time.Minute {
+		t.Errorf("восстановленная блокировка: %v", got)
+	}
+	if got := limiter.Check("10.0.0.1", ""); got != 0 {
+		t.Errorf("истекшая блокировка восстановлена: %v", got)
+	}
+
+	// Повторная загрузка той же или более ранней блокировки ничего не меняет.
+	if restored := limiter.Restore([]Lockout{{Scope: ScopeUsername, Subject: "alice", LockedUntil: clock.now.Add(time.Minute)}}); restored != 0 {
+		t.Errorf("более ранняя блокировка укоротила текущую")
+	}
+
+	clock.advance(5*time.Minute + time.Second)
+	if got := limiter.Check("", "alice"); got != 0 {
+		t.Errorf("восстановленная блокировка не истекла: %v", got)
+	}
+}
@@ -0,0 +1,53 @@
+package backplane
+
+import (
+	"context"
+	"sync"
+)
+
+const (
+	ChannelUserEvents = "ego_user_events"
+	ChannelRunControl = "ego_run_control"
+)
+
+type Handler func(payload []byte)
+
+// Backplane связывает экземпляры API между собой. Каждое опубликованное
+// сообщение получают все подписчики канала на всех узлах, включая
+// отправителя.
+type Backplane interface {
+	Publish(ctx context.Context, channel string, payload []byte) error
+	Subscribe(channel string, handler Handler) error
+	Close() error
+}
+
+// Memory годится для одного экземпляра API и для тестов.
+type Memory struct {
+	mu       sync.RWMutex
+	handlers map[string][]Handler
+}
+
+func NewMemory() *Memory {
+	return &Memory{handlers: make(map[string][]Handler)}
+}
+
+func (m *Memory) Publish(ctx context.Context, channel string, payload []byte) error {
+	m.mu.RLock()
+	handlers := m.handlers[channel]
+	m.mu.RUnlock()
+	for _, handler := range handlers {
+		handler(payload)
+	}
+	return nil
+}
+
+func (m *Memory) Subscribe(channel string, handler Handler) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers[channel] = append(m.handlers[channel], handler)
+	return nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
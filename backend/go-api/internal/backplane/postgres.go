@@ -0,0 +1,147 @@
+package backplane
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"egobackend/internal/database"
+
+	"github.com/lib/pq"
+)
+
+// maxNotifyPayload оставляет запас до лимита NOTIFY в 8000 байт. Более
+// крупные сообщения кладутся в backplane_messages, а по NOTIFY уходит
+// только ссылка на строку.
+const maxNotifyPayload = 7000
+
+type notifyEnvelope struct {
+	Inline json.RawMessage `json:"i,omitempty"`
+	RefID  int64           `json:"r,omitempty"`
+}
+
+// Postgres реализует Backplane поверх LISTEN/NOTIFY той же базы, что и
+// основное хранилище.
+type Postgres struct {
+	db       *database.DB
+	listener *pq.Listener
+
+	mu       sync.RWMutex
+	handlers map[string][]Handler
+	done     chan struct{}
+}
+
+func NewPostgres(dbURL string, db *database.DB) (*Postgres, error) {
+	listener := pq.NewListener(dbURL, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("!!! [BACKPLANE] Событие слушателя Postgres %d: %v", ev, err)
+		}
+		if ev == pq.ListenerEventReconnected {
+			log.Println("[BACKPLANE] Слушатель Postgres переподключился. Сообщения за время разрыва потеряны.")
+		}
+	})
+	if err := listener.Ping(); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("не удалось подключить слушатель Postgres: %w", err)
+	}
+
+	p := &Postgres{
+		db:       db,
+		listener: listener,
+		handlers: make(map[string][]Handler),
+		done:     make(chan struct{}),
+	}
+	go p.dispatch()
+	go p.cleanupRoutine()
+	log.Println("[BACKPLANE] Используется Postgres LISTEN/NOTIFY.")
+	return p, nil
+}
+
+func (p *Postgres) Publish(ctx context.Context, channel string, payload []byte) error {
+	envelope := notifyEnvelope{Inline: payload}
+	if len(payload) > maxNotifyPayload {
+		refID, err := p.db.SaveBackplaneMessage(channel, payload)
+		if err != nil {
+			return fmt.Errorf("не удалось сохранить крупное сообщение: %w", err)
+		}
+		envelope = notifyEnvelope{RefID: refID}
+	}
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.ExecContext(ctx, `SELECT pg_notify($1, $2)`, channel, string(data))
+	return err
+}
+
+func (p *Postgres) Subscribe(channel string, handler Handler) error {
+	p.mu.Lock()
+	_, listening := p.handlers[channel]
+	p.handlers[channel] = append(p.handlers[channel], handler)
+	p.mu.Unlock()
+	if listening {
+		return nil
+	}
+	return p.listener.Listen(channel)
+}
+
+func (p *Postgres) Close() error {
+	close(p.done)
+	return p.listener.Close()
+}
+
+func (p *Postgres) dispatch() {
+	for {
+		select {
+		case <-p.done:
+			return
+		case n, ok := <-p.listener.Notify:
+			if !ok {
+				return
+			}
+			if n == nil {
+				continue
+			}
+			payload, err := p.resolve(n.Extra)
+			if err != nil {
+				log.Printf("!!! [BACKPLANE] Не удалось разобрать сообщение из канала %s: %v", n.Channel, err)
+				continue
+			}
+			p.mu.RLock()
+			handlers := p.handlers[n.Channel]
+			p.mu.RUnlock()
+			for _, handler := range handlers {
+				handler(payload)
+			}
+		}
+	}
+}
+
+func (p *Postgres) resolve(extra string) ([]byte, error) {
+	var envelope notifyEnvelope
+	if err := json.Unmarshal([]byte(extra), &envelope); err != nil {
+		return nil, err
+	}
+	if envelope.RefID == 0 {
+		return envelope.Inline, nil
+	}
+	return p.db.GetBackplaneMessage(envelope.RefID)
+}
+
+func (p *Postgres) cleanupRoutine() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			if err := p.db.DeleteBackplaneMessagesBefore(time.Now().UTC().Add(-5 * time.Minute)); err != nil {
+				log.Printf("!!! [BACKPLANE] Ошибка очистки сохраненных сообщений: %v", err)
+			}
+		}
+	}
+}
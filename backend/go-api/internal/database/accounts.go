@@ -0,0 +1,94 @@
+package database
+
+import (
+	"egobackend/internal/models"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// SoftDeleteUser помечает аккаунт удаленным. Повторный вызов не сдвигает
+// уже назначенную дату очистки.
+func (db *DB) SoftDeleteUser(userID int, gracePeriod time.Duration) (*models.User, error) {
+	now := time.Now().UTC()
+	query := `UPDATE users
+              SET deleted_at = COALESCE(deleted_at, $1), purge_after = COALESCE(purge_after, $2)
+              WHERE id = $3 RETURNING *`
+	var user models.User
+	err := db.Get(&user, query, now, now.Add(gracePeriod), userID)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (db *DB) GetUsersDueForPurge(limit int) ([]int, error) {
+	var ids []int
+	query := `SELECT id FROM users WHERE deleted_at IS NOT NULL AND purge_after <= $1 ORDER BY purge_after LIMIT $2`
+	err := db.Select(&ids, query, time.Now().UTC(), limit)
+	return ids, err
+}
+
+func (db *DB) GetUserFileURIs(userID int, limit int) ([]string, error) {
+	var uris []string
+	query := `SELECT file_uri FROM file_attachments WHERE user_id = $1 ORDER BY id LIMIT $2`
+	err := db.Select(&uris, query, userID, limit)
+	return uris, err
+}
+
+func (db *DB) DeleteFileAttachmentsByURI(uris []string) error {
+	if len(uris) == 0 {
+		return nil
+	}
+	query, args, err := sqlx.In("DELETE FROM file_attachments WHERE file_uri IN (?)", uris)
+	if err != nil {
+		return err
+	}
+	query = db.Rebind(query)
+	_, err = db.Exec(query, args...)
+	return err
+}
+
+// HardDeleteUser удаляет строку пользователя; сессии, логи и вложения
+// уходят каскадом. Только для уже помеченных аккаунтов.
+func (db *DB) HardDeleteUser(userID int) error {
+	query := `DELETE FROM users WHERE id = $1 AND deleted_at IS NOT NULL`
+	_, err := db.Exec(query, userID)
+	return err
+}
+
+func (db *DB) GetUserFileAttachments(userID int) ([]models.FileAttachment, error) {
+	var attachments []models.FileAttachment
+	query := `SELECT ` + fileAttachmentColumns + ` FROM file_attachments WHERE user_id = $1 ORDER BY id`
+	err := db.Select(&attachments, query, userID)
+	return attachments, err
+}
+
+// GetUserLogAttachments возвращает вложения всех логов пользователя по ID
+// лога. Один файл может быть приложен к нескольким логам.
+func (db *DB) GetUserLogAttachments(userID int) (map[int][]models.FileAttachment, error) {
+	var rows []struct {
+		LogID int `db:"attached_to"`
+		models.FileAttachment
+	}
+	query := `SELECT rla.request_log_id AS attached_to, ` + fileAttachmentColumnsFA + `
+              FROM request_log_attachments rla
+              JOIN file_attachments fa ON fa.id = rla.file_id
+              WHERE fa.user_id = $1
+              ORDER BY rla.request_log_id, rla.position`
+	if err := db.Select(&rows, query, userID); err != nil {
+		return nil, err
+	}
+	attachmentsMap := make(map[int][]models.FileAttachment)
+	for _, row := range rows {
+		attachmentsMap[row.LogID] = append(attachmentsMap[row.LogID], row.FileAttachment)
+	}
+	return attachmentsMap, nil
+}
+
+func (db *DB) GetAllSessionLogs(sessionID int) ([]models.RequestLog, error) {
+	var logs []models.RequestLog
+	query := `SELECT * FROM request_logs WHERE session_id = $1 ORDER BY timestamp ASC`
+	err := db.Select(&logs, query, sessionID)
+	return logs, err
+}
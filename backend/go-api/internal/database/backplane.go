@@ -0,0 +1,21 @@
+package database
+
+import "time"
+
+func (db *DB) SaveBackplaneMessage(channel string, payload []byte) (int64, error) {
+	query := `INSERT INTO backplane_messages (channel, payload, created_at) VALUES ($1, $2, $3) RETURNING id`
+	var id int64
+	err := db.QueryRow(query, channel, payload, time.Now().UTC()).Scan(&id)
+	return id, err
+}
+
+func (db *DB) GetBackplaneMessage(id int64) ([]byte, error) {
+	var payload []byte
+	err := db.Get(&payload, `SELECT payload FROM backplane_messages WHERE id = $1`, id)
+	return payload, err
+}
+
+func (db *DB) DeleteBackplaneMessagesBefore(cutoff time.Time) error {
+	_, err := db.Exec(`DELETE FROM backplane_messages WHERE created_at < $1`, cutoff)
+	return err
+}
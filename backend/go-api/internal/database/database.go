@@ -1,15 +1,22 @@
 package database
 
 import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
 	"log"
 	"os"
+	"regexp"
+	"strings"
 
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 )
 
 type DB struct {
 	*sqlx.DB
+	dialect Dialect
 }
 
 func New() (*DB, error) {
@@ -17,18 +24,36 @@ func New() (*DB, error) {
 	if dbURL == "" {
 		log.Fatal("Критическая ошибка: переменная окружения DATABASE_URL не установлена")
 	}
+	return Open(dbURL)
+}
 
-	db, err := sqlx.Connect("postgres", dbURL)
+// Open подключается к базе, выбирая драйвер по схеме адреса.
+func Open(dbURL string) (*DB, error) {
+	dialect, dsn, err := parseDatabaseURL(dbURL)
 	if err != nil {
 		return nil, err
 	}
 
+	db, err := sqlx.Connect(string(dialect), dsn)
+	if err != nil {
+		return nil, err
+	}
+	if dialect == SQLite {
+		// SQLite допускает одного писателя: одно соединение избавляет от
+		// ошибок "database is locked" без очередей на стороне приложения.
+		db.SetMaxOpenConns(1)
+	}
+
 	if err := db.Ping(); err != nil {
 		return nil, err
 	}
 
-	log.Println("Успешное подключение к БД PostgreSQL")
-	return &DB{db}, nil
+	if dialect == SQLite {
+		log.Println("Успешное подключение к БД SQLite")
+	} else {
+		log.Println("Успешное подключение к БД PostgreSQL")
+	}
+	return &DB{DB: db, dialect: dialect}, nil
 }
 
 func (db *DB) Migrate() error {
@@ -59,8 +84,7 @@ func (db *DB) Migrate() error {
 			prompt_tokens INTEGER NOT NULL DEFAULT 0,
 			completion_tokens INTEGER NOT NULL DEFAULT 0,
 			total_tokens INTEGER NOT NULL DEFAULT 0,
-			timestamp TIMESTAMPTZ NOT NULL DEFAULT NOW(),
-			attached_file_ids TEXT
+			timestamp TIMESTAMPTZ NOT NULL DEFAULT NOW()
 		);`,
 
 		`CREATE TABLE IF NOT EXISTS file_attachments (
@@ -74,14 +98,250 @@ func (db *DB) Migrate() error {
 			status TEXT NOT NULL,
 			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
 		);`,
+
+		`CREATE TABLE IF NOT EXISTS login_lockouts (
+			id SERIAL PRIMARY KEY,
+			scope TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			failed_attempts INTEGER NOT NULL,
+			locked_until TIMESTAMPTZ NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			cleared_at TIMESTAMPTZ,
+			cleared_by INTEGER REFERENCES users(id) ON DELETE SET NULL
+		);`,
+
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS email TEXT;`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified BOOLEAN NOT NULL DEFAULT FALSE;`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS purge_after TIMESTAMPTZ;`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS locale TEXT;`,
+		`ALTER TABLE chat_sessions ADD COLUMN IF NOT EXISTS title_edited BOOLEAN NOT NULL DEFAULT FALSE;`,
+		`ALTER TABLE chat_sessions ADD COLUMN IF NOT EXISTS summary TEXT;`,
+		`ALTER TABLE chat_sessions ADD COLUMN IF NOT EXISTS summary_log_id INTEGER;`,
+		`ALTER TABLE request_logs ADD COLUMN IF NOT EXISTS pinned BOOLEAN NOT NULL DEFAULT FALSE;`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email ON users (LOWER(email)) WHERE email IS NOT NULL;`,
+
+		`CREATE TABLE IF NOT EXISTS user_tokens (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			purpose TEXT NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			expires_at TIMESTAMPTZ NOT NULL,
+			used_at TIMESTAMPTZ,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);`,
+
+		`CREATE TABLE IF NOT EXISTS backplane_messages (
+			id BIGSERIAL PRIMARY KEY,
+			channel TEXT NOT NULL,
+			payload BYTEA NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);`,
+
+		`CREATE TABLE IF NOT EXISTS user_memories (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			content TEXT NOT NULL,
+			source TEXT NOT NULL DEFAULT 'user', -- 'user' или 'assistant'
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);`,
+
+		`CREATE INDEX IF NOT EXISTS idx_user_memories_user ON user_memories (user_id);`,
+
+		`CREATE TABLE IF NOT EXISTS instruction_presets (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			name TEXT NOT NULL,
+			instructions TEXT NOT NULL,
+			shared BOOLEAN NOT NULL DEFAULT FALSE, -- виден всем пользователям, создают только администраторы
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);`,
+
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS default_preset_id INTEGER REFERENCES instruction_presets(id) ON DELETE SET NULL;`,
+		`CREATE INDEX IF NOT EXISTS idx_login_lockouts_active ON login_lockouts (locked_until) WHERE cleared_at IS NULL;`,
+
+		// Вложения до появления статусов pending/committed.
+		`UPDATE file_attachments SET status = 'committed' WHERE status = 'uploaded' AND request_log_id IS NOT NULL;`,
+		`UPDATE file_attachments SET status = 'pending' WHERE status = 'uploaded';`,
+		`CREATE INDEX IF NOT EXISTS idx_file_attachments_unlinked ON file_attachments (created_at) WHERE request_log_id IS NULL;`,
+
+		`CREATE TABLE IF NOT EXISTS request_log_attachments (
+			request_log_id INTEGER NOT NULL REFERENCES request_logs(id) ON DELETE CASCADE,
+			file_id INTEGER NOT NULL REFERENCES file_attachments(id) ON DELETE CASCADE,
+			position INTEGER NOT NULL DEFAULT 0, -- порядок файлов в сообщении
+			PRIMARY KEY (request_log_id, file_id)
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_request_log_attachments_file ON request_log_attachments (file_id);`,
+
+		`CREATE TABLE IF NOT EXISTS thought_steps (
+			id SERIAL PRIMARY KEY,
+			request_log_id INTEGER NOT NULL REFERENCES request_logs(id) ON DELETE CASCADE,
+			position INTEGER NOT NULL,
+			iteration INTEGER NOT NULL,
+			kind TEXT NOT NULL, -- thought, tool_output, tool_error или system_error
+			header TEXT,
+			content TEXT,
+			confidence DOUBLE PRECISION,
+			tool_name TEXT,
+			query TEXT,
+			output TEXT,
+			duration_ms INTEGER NOT NULL DEFAULT 0,
+			error TEXT
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_thought_steps_log ON thought_steps (request_log_id, position);`,
+
+		`ALTER TABLE request_logs ADD COLUMN IF NOT EXISTS mode TEXT;`,
+		`CREATE TABLE IF NOT EXISTS log_feedback (
+			id SERIAL PRIMARY KEY,
+			request_log_id INTEGER NOT NULL REFERENCES request_logs(id) ON DELETE CASCADE,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			rating INTEGER NOT NULL, -- 1 или -1
+			comment TEXT,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			UNIQUE (request_log_id, user_id)
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_log_feedback_updated ON log_feedback (updated_at);`,
+		`CREATE TABLE IF NOT EXISTS log_feedback_reasons (
+			feedback_id INTEGER NOT NULL REFERENCES log_feedback(id) ON DELETE CASCADE,
+			reason TEXT NOT NULL,
+			PRIMARY KEY (feedback_id, reason)
+		);`,
+
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS token_version INTEGER NOT NULL DEFAULT 0;`,
+
+		// Уникален только подтвержденный адрес: неподтвержденным чужой адрес
+		// не занять, а владелец забирает его при подтверждении.
+		`DROP INDEX IF EXISTS idx_users_email;`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_users_verified_email ON users (LOWER(email)) WHERE email IS NOT NULL AND email_verified;`,
+
+		// Связь вложений с логами — только request_log_attachments. Старые
+		// ссылки из file_attachments.request_log_id переносятся и обнуляются.
+		`INSERT INTO request_log_attachments (request_log_id, file_id, position)
+			SELECT request_log_id, id, 0 FROM file_attachments WHERE request_log_id IS NOT NULL
+			ON CONFLICT DO NOTHING;`,
+		`UPDATE file_attachments SET request_log_id = NULL WHERE request_log_id IS NOT NULL;`,
+		`DROP INDEX IF EXISTS idx_file_attachments_unlinked;`,
+		`CREATE INDEX IF NOT EXISTS idx_file_attachments_created ON file_attachments (created_at);`,
+
+		// Сводка помнит, какие сообщения в нее вошли. Одной границы
+		// summary_log_id мало: открепленное ниже нее сообщение не попадало в
+		// сводку никогда. Старые границы переносятся и обнуляются.
+		`ALTER TABLE chat_sessions ADD COLUMN IF NOT EXISTS summary_version INTEGER NOT NULL DEFAULT 0;`,
+		`CREATE TABLE IF NOT EXISTS session_summary_logs (
+			session_id INTEGER NOT NULL REFERENCES chat_sessions(id) ON DELETE CASCADE,
+			request_log_id INTEGER NOT NULL REFERENCES request_logs(id) ON DELETE CASCADE,
+			PRIMARY KEY (session_id, request_log_id)
+		);`,
+		`INSERT INTO session_summary_logs (session_id, request_log_id)
+			SELECT rl.session_id, rl.id FROM request_logs rl
+			JOIN chat_sessions cs ON cs.id = rl.session_id
+			WHERE cs.summary_log_id IS NOT NULL AND rl.id <= cs.summary_log_id
+			ON CONFLICT DO NOTHING;`,
+		`UPDATE chat_sessions SET summary_log_id = NULL WHERE summary_log_id IS NOT NULL;`,
 	}
 
 	for _, schema := range schemas {
+		if db.dialect == SQLite {
+			var skip bool
+			schema, skip = db.sqliteSchema(schema)
+			if skip {
+				continue
+			}
+		}
 		if _, err := db.Exec(schema); err != nil {
 			log.Printf("Предупреждение при выполнении миграции: %v. Возможно, таблица уже существует в правильном формате.", err)
 		}
 	}
 
+	if err := db.migrateAttachedFileIDs(); err != nil {
+		return err
+	}
+
 	log.Println("Миграция всех таблиц завершена")
 	return nil
 }
+
+var (
+	sqliteTypes = strings.NewReplacer(
+		"BIGSERIAL PRIMARY KEY", "INTEGER PRIMARY KEY AUTOINCREMENT",
+		"SERIAL PRIMARY KEY", "INTEGER PRIMARY KEY AUTOINCREMENT",
+		"TIMESTAMPTZ", "TIMESTAMP",
+		"DEFAULT NOW()", "DEFAULT CURRENT_TIMESTAMP",
+		"BYTEA", "BLOB",
+	)
+	addColumnIfNotExists = regexp.MustCompile(`^ALTER TABLE (\w+) ADD COLUMN IF NOT EXISTS (\w+) `)
+)
+
+// sqliteSchema переводит миграцию PostgreSQL для SQLite. SQLite не знает
+// ADD COLUMN IF NOT EXISTS, поэтому наличие колонки проверяется заранее;
+// skip означает, что колонка уже есть.
+func (db *DB) sqliteSchema(schema string) (string, bool) {
+	schema = sqliteTypes.Replace(schema)
+	m := addColumnIfNotExists.FindStringSubmatch(schema)
+	if m == nil {
+		return schema, false
+	}
+	exists, err := db.hasColumn(m[1], m[2])
+	if err != nil {
+		log.Printf("Предупреждение при проверке колонки %s.%s: %v", m[1], m[2], err)
+	}
+	return strings.Replace(schema, "IF NOT EXISTS ", "", 1), exists
+}
+
+func (db *DB) hasColumn(table, column string) (bool, error) {
+	query := `SELECT COUNT(*) > 0 FROM information_schema.columns
+              WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2`
+	if db.dialect == SQLite {
+		query = `SELECT COUNT(*) > 0 FROM pragma_table_info($1) WHERE name = $2`
+	}
+	var exists bool
+	err := db.Get(&exists, query, table, column)
+	return exists, err
+}
+
+// migrateAttachedFileIDs переносит JSON-массив request_logs.attached_file_ids
+// в request_log_attachments и удаляет колонку. Ссылки на уже удаленные
+// файлы пропускаются. Колонка удаляется только после переноса всех логов,
+// поэтому прерванную миграцию можно просто запустить снова.
+func (db *DB) migrateAttachedFileIDs() error {
+	exists, err := db.hasColumn("request_logs", "attached_file_ids")
+	if err != nil || !exists {
+		return err
+	}
+
+	var rows []struct {
+		ID      int64          `db:"id"`
+		FileIDs sql.NullString `db:"attached_file_ids"`
+	}
+	err = db.Select(&rows, `SELECT id, attached_file_ids FROM request_logs
+                            WHERE attached_file_ids IS NOT NULL AND attached_file_ids NOT IN ('', '[]')`)
+	if err != nil {
+		return fmt.Errorf("чтение attached_file_ids: %w", err)
+	}
+	migrated := 0
+	for _, row := range rows {
+		var fileIDs []int64
+		if err := json.Unmarshal([]byte(row.FileIDs.String), &fileIDs); err != nil {
+			log.Printf("Предупреждение: attached_file_ids лога %d не разобран и пропущен: %v", row.ID, err)
+			continue
+		}
+		for position, fileID := range fileIDs {
+			_, err := db.Exec(`INSERT INTO request_log_attachments (request_log_id, file_id, position)
+                               SELECT CAST($1 AS INTEGER), id, CAST($3 AS INTEGER) FROM file_attachments WHERE id = $2
+                               ON CONFLICT DO NOTHING`, row.ID, fileID, position)
+			if err != nil {
+				return fmt.Errorf("перенос вложений лога %d: %w", row.ID, err)
+			}
+		}
+		migrated++
+	}
+
+	if _, err := db.Exec(`ALTER TABLE request_logs DROP COLUMN attached_file_ids`); err != nil {
+		return fmt.Errorf("удаление attached_file_ids: %w", err)
+	}
+	log.Printf("Вложения %d логов перенесены в request_log_attachments", migrated)
+	return nil
+}
@@ -1,9 +1,9 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"egobackend/internal/models"
-	"encoding/json"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -13,7 +13,7 @@ func (db *DB) GetSessionHistory(sessionID int, limit int) ([]models.RequestLog,
 	var logs []models.RequestLog
 	query := `
         SELECT id, session_id, user_query, ego_thoughts_json, final_response, 
-               prompt_tokens, completion_tokens, total_tokens, attached_file_ids, timestamp 
+               prompt_tokens, completion_tokens, total_tokens, pinned, timestamp 
         FROM request_logs 
         WHERE session_id = $1 
         ORDER BY timestamp DESC 
@@ -35,23 +35,30 @@ func (db *DB) GetSessionHistory(sessionID int, limit int) ([]models.RequestLog,
 	return logs, attachmentsMap, nil
 }
 
-func (db *DB) GetSessionHistoryBefore(sessionID int, beforeTime time.Time, limit int) ([]models.RequestLog, map[int][]models.FileAttachment, error) {
+// GetContextHistory возвращает последние limit сообщений сессии и все
+// закрепленные сообщения в хронологическом порядке. Если before задан,
+// учитываются только сообщения до него — так собирается история для
+// регенерации.
+func (db *DB) GetContextHistory(sessionID int, before time.Time, limit int) ([]models.RequestLog, map[int][]models.FileAttachment, error) {
 	var logs []models.RequestLog
+	timeFilter := ""
+	args := []interface{}{sessionID, limit}
+	if !before.IsZero() {
+		timeFilter = " AND timestamp < $3"
+		args = append(args, before)
+	}
 	query := `
-        SELECT id, session_id, user_query, ego_thoughts_json, final_response, attached_file_ids, timestamp
+        SELECT id, session_id, user_query, ego_thoughts_json, final_response, pinned, timestamp
         FROM request_logs
-        WHERE session_id = $1 AND timestamp < $2
-        ORDER BY timestamp DESC
-        LIMIT $3`
-	err := db.Select(&logs, query, sessionID, beforeTime, limit)
+        WHERE session_id = $1` + timeFilter + ` AND (pinned OR id IN (
+            SELECT id FROM request_logs WHERE session_id = $1` + timeFilter + ` ORDER BY timestamp DESC LIMIT $2
+        ))
+        ORDER BY timestamp ASC`
+	err := db.Select(&logs, query, args...)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	for i, j := 0, len(logs)-1; i < j; i, j = i+1, j-1 {
-		logs[i], logs[j] = logs[j], logs[i]
-	}
-
 	attachmentsMap, err := db.getAttachmentsForLogs(logs)
 	if err != nil {
 		return logs, nil, err
@@ -61,47 +68,50 @@ func (db *DB) GetSessionHistoryBefore(sessionID int, beforeTime time.Time, limit
 }
 
 func (db *DB) getAttachmentsForLogs(logs []models.RequestLog) (map[int][]models.FileAttachment, error) {
+	attachmentsMap := make(map[int][]models.FileAttachment)
 	if len(logs) == 0 {
-		return make(map[int][]models.FileAttachment), nil
+		return attachmentsMap, nil
 	}
 
-	attachmentsMap := make(map[int][]models.FileAttachment)
-	var allFileIDs []int64
-	logIDMap := make(map[int64]int)
-
-	for _, log := range logs {
-		var fileIDs []int64
-		if log.AttachedFileIDs != "" && log.AttachedFileIDs != "[]" {
-			if err := json.Unmarshal([]byte(log.AttachedFileIDs), &fileIDs); err == nil {
-				allFileIDs = append(allFileIDs, fileIDs...)
-				for _, fileID := range fileIDs {
-					logIDMap[fileID] = log.ID
-				}
-			}
-		}
+	logIDs := make([]int, 0, len(logs))
+	for _, l := range logs {
+		logIDs = append(logIDs, l.ID)
 	}
-
-	if len(allFileIDs) > 0 {
-		var attachments []models.FileAttachment
-		q, args, err := sqlx.In("SELECT id, session_id, user_id, file_name, file_uri, mime_type, status, created_at, request_log_id FROM file_attachments WHERE id IN (?)", allFileIDs)
-		if err != nil {
-			return nil, err
-		}
-		q = db.Rebind(q)
-		err = db.Select(&attachments, q, args...)
-		if err != nil {
-			return nil, err
-		}
-		for _, att := range attachments {
-			if logID, ok := logIDMap[att.ID]; ok {
-				attachmentsMap[logID] = append(attachmentsMap[logID], att)
-			}
-		}
+	var rows []struct {
+		LogID int `db:"attached_to"`
+		models.FileAttachment
+	}
+	q, args, err := sqlx.In(`
+        SELECT rla.request_log_id AS attached_to, `+fileAttachmentColumnsFA+`
+        FROM request_log_attachments rla
+        JOIN file_attachments fa ON fa.id = rla.file_id
+        WHERE rla.request_log_id IN (?)
+        ORDER BY rla.request_log_id, rla.position`, logIDs)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Select(&rows, db.Rebind(q), args...); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		attachmentsMap[row.LogID] = append(attachmentsMap[row.LogID], row.FileAttachment)
 	}
-
 	return attachmentsMap, nil
 }
 
+// GetRequestLogAttachments возвращает файлы сообщения в том порядке, в
+// котором они были приложены.
+func (db *DB) GetRequestLogAttachments(logID int64) ([]models.FileAttachment, error) {
+	attachments := []models.FileAttachment{}
+	query := `
+        SELECT ` + fileAttachmentColumnsFA + ` FROM request_log_attachments rla
+        JOIN file_attachments fa ON fa.id = rla.file_id
+        WHERE rla.request_log_id = $1
+        ORDER BY rla.position`
+	err := db.Select(&attachments, query, logID)
+	return attachments, err
+}
+
 func (db *DB) GetRequestLogByID(logID int64, userID int) (*models.RequestLog, error) {
 	var log models.RequestLog
 	query := `
@@ -123,24 +133,91 @@ func (db *DB) UpdateRequestLogQuery(logID int64, userID int, newQuery string) er
 	return err
 }
 
-func (db *DB) UpdateRequestLogResponse(logID int64, thoughtsJSON string, finalResponse string) error {
+func (db *DB) SetRequestLogPinned(logID int64, userID int, pinned bool) error {
 	query := `
-        UPDATE request_logs
-        SET ego_thoughts_json = $1, final_response = $2, timestamp = $3
-        WHERE id = $4`
-	_, err := db.Exec(query, thoughtsJSON, finalResponse, time.Now().UTC(), logID)
+        UPDATE request_logs SET pinned = $1
+        WHERE id = $2 AND session_id IN (SELECT id FROM chat_sessions WHERE user_id = $3)`
+	_, err := db.Exec(query, pinned, logID, userID)
 	return err
 }
 
+// UpdateRequestLogResponse сохраняет результат регенерации: новый ответ и
+// трасса заменяют старые в одной транзакции. Оценки относились к старому
+// ответу, поэтому они удаляются.
+func (db *DB) UpdateRequestLogResponse(logID int64, mode string, thoughtsJSON string, finalResponse string, trace []models.ThoughtStep) error {
+	tx, err := db.BeginTxx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+        UPDATE request_logs
+        SET ego_thoughts_json = $1, final_response = $2, timestamp = $3, mode = $4
+        WHERE id = $5`
+	if _, err := tx.Exec(db.rebind(query), thoughtsJSON, finalResponse, time.Now().UTC(), mode, logID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(db.rebind(`DELETE FROM thought_steps WHERE request_log_id = $1`), logID); err != nil {
+		return err
+	}
+	if err := db.insertThoughtSteps(tx, logID, trace); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(db.rebind(`DELETE FROM log_feedback WHERE request_log_id = $1`), logID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *DB) insertThoughtSteps(tx *sqlx.Tx, logID int64, trace []models.ThoughtStep) error {
+	query := db.rebind(`INSERT INTO thought_steps (
+                            request_log_id, position, iteration, kind, header, content, confidence,
+                            tool_name, query, output, duration_ms, error
+                        ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`)
+	for position, step := range trace {
+		_, err := tx.Exec(query, logID, position, step.Iteration, step.Kind, step.Header, step.Content, step.Confidence,
+			step.ToolName, step.Query, step.Output, step.DurationMS, step.Error)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetThoughtTrace возвращает шаги рассуждения лога по порядку. Для логов,
+// сохраненных до появления thought_steps, список пуст.
+func (db *DB) GetThoughtTrace(logID int64) ([]models.ThoughtStep, error) {
+	steps := []models.ThoughtStep{}
+	query := `SELECT position, iteration, kind, header, content, confidence, tool_name, query, output, duration_ms, error
+              FROM thought_steps WHERE request_log_id = $1 ORDER BY position`
+	err := db.Select(&steps, query, logID)
+	return steps, err
+}
+
 func (db *DB) SaveRequestLog(logEntry *models.RequestLog) (int64, error) {
+	return db.SaveRequestLogWithFiles(logEntry, nil, nil)
+}
+
+// SaveRequestLogWithFiles сохраняет лог с трассой рассуждения и в той же
+// транзакции привязывает к нему вложения через request_log_attachments.
+// Новые файлы переходят из pending в committed, а уже сохраненные файлы
+// того же пользователя можно приложить к еще одному сообщению.
+func (db *DB) SaveRequestLogWithFiles(logEntry *models.RequestLog, fileIDs []int64, trace []models.ThoughtStep) (int64, error) {
+	tx, err := db.BeginTxx(context.Background(), nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
 	query := `INSERT INTO request_logs (
 				  session_id, user_query, ego_thoughts_json, final_response, 
-				  prompt_tokens, completion_tokens, total_tokens, attached_file_ids, timestamp
+				  prompt_tokens, completion_tokens, total_tokens, timestamp, mode
 			  ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`
 
 	var logID int64
-	err := db.QueryRow(
-		query,
+	err = tx.QueryRow(
+		db.rebind(query),
 		logEntry.SessionID,
 		logEntry.UserQuery,
 		logEntry.EgoThoughtsJSON,
@@ -148,9 +225,35 @@ func (db *DB) SaveRequestLog(logEntry *models.RequestLog) (int64, error) {
 		logEntry.PromptTokens,
 		logEntry.CompletionTokens,
 		logEntry.TotalTokens,
-		logEntry.AttachedFileIDs,
 		logEntry.Timestamp,
+		logEntry.Mode,
 	).Scan(&logID)
+	if err != nil {
+		return 0, err
+	}
+
+	// Чужое вложение и вложение, которое уже удалила сверка, пропускаются.
+	for position, fileID := range fileIDs {
+		res, err := tx.Exec(db.rebind(`UPDATE file_attachments SET status = $1
+                                       WHERE id = $2 AND user_id = (SELECT user_id FROM chat_sessions WHERE id = $3)`),
+			models.AttachmentStatusCommitted, fileID, logEntry.SessionID)
+		if err != nil {
+			return 0, err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		_, err = tx.Exec(db.rebind(`INSERT INTO request_log_attachments (request_log_id, file_id, position) VALUES ($1, $2, $3)
+                                    ON CONFLICT DO NOTHING`),
+			logID, fileID, position)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := db.insertThoughtSteps(tx, logID, trace); err != nil {
+		return 0, err
+	}
 
-	return logID, err
+	return logID, tx.Commit()
 }
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"egobackend/internal/models"
 	"fmt"
@@ -16,10 +17,14 @@ func (db *DB) GetUserSessions(userID int) ([]models.ChatSession, error) {
 	return sessions, err
 }
 
-func (db *DB) DeleteSession(sessionID, userID int) error {
+func (db *DB) DeleteSession(sessionID, userID int) (bool, error) {
 	query := `DELETE FROM chat_sessions WHERE id = $1 AND user_id = $2`
-	_, err := db.Exec(query, sessionID, userID)
-	return err
+	result, err := db.Exec(query, sessionID, userID)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
 }
 
 func (db *DB) CheckSessionOwnership(sessionID, userID int) (bool, error) {
@@ -48,9 +53,6 @@ func (db *DB) GetOrCreateSession(sessionIDStr string, title string, userID int,
 	}
 
 	log.Printf("Создание новой сессии для пользователя %d с заголовком '%s'", userID, title)
-	if mode == "" {
-		mode = "default"
-	}
 	session := models.ChatSession{
 		UserID:    userID,
 		Title:     title,
@@ -85,8 +87,75 @@ func (db *DB) GetSessionByID(sessionID, userID int) (*models.ChatSession, error)
 	return &session, err
 }
 
+// UpdateSessionMode меняет режим сессии. Режим проверяется по реестру
+// modes до вызова.
+func (db *DB) UpdateSessionMode(sessionID, userID int, mode string) error {
+	query := `UPDATE chat_sessions SET mode = $1 WHERE id = $2 AND user_id = $3`
+	_, err := db.Exec(query, mode, sessionID, userID)
+	return err
+}
+
+// UpdateSessionTitle меняет название по запросу пользователя. После этого
+// автоматическое название сессии больше не присваивается.
 func (db *DB) UpdateSessionTitle(sessionID, userID int, title string) error {
-	query := `UPDATE chat_sessions SET title = $1 WHERE id = $2 AND user_id = $3`
+	query := `UPDATE chat_sessions SET title = $1, title_edited = TRUE WHERE id = $2 AND user_id = $3`
 	_, err := db.Exec(query, title, sessionID, userID)
 	return err
 }
+
+// SetGeneratedSessionTitle сохраняет сгенерированное название, если
+// пользователь еще не переименовал сессию. Возвращает nil, если
+// название не изменилось.
+func (db *DB) SetGeneratedSessionTitle(sessionID int, title string) (*models.ChatSession, error) {
+	var session models.ChatSession
+	query := `UPDATE chat_sessions SET title = $1 WHERE id = $2 AND NOT title_edited
+		RETURNING id, user_id, title, mode, custom_instructions, created_at`
+	err := db.Get(&session, query, title, sessionID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (db *DB) GetSessionSummary(sessionID int) (models.SessionSummary, error) {
+	var summary models.SessionSummary
+	query := `SELECT COALESCE(summary, '') AS summary, summary_version FROM chat_sessions WHERE id = $1`
+	if err := db.Get(&summary, query, sessionID); err != nil {
+		return summary, err
+	}
+	query = `SELECT request_log_id FROM session_summary_logs WHERE session_id = $1 ORDER BY request_log_id`
+	err := db.Select(&summary.LogIDs, query, sessionID)
+	return summary, err
+}
+
+// UpdateSessionSummary сохраняет сводку и добавляет logIDs к вошедшим в нее
+// сообщениям, если с чтения версии version сводку никто не менял: фоновые
+// обновления могут завершиться в любом порядке. Чужие логи пропускаются.
+func (db *DB) UpdateSessionSummary(sessionID int, summary string, version int, logIDs []int) error {
+	tx, err := db.BeginTxx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE chat_sessions SET summary = $1, summary_version = summary_version + 1 WHERE id = $2 AND summary_version = $3`
+	result, err := tx.Exec(db.rebind(query), summary, sessionID, version)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+	query = `INSERT INTO session_summary_logs (session_id, request_log_id)
+		SELECT session_id, id FROM request_logs WHERE id = $1 AND session_id = $2
+		ON CONFLICT DO NOTHING`
+	for _, logID := range logIDs {
+		if _, err := tx.Exec(db.rebind(query), logID, sessionID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
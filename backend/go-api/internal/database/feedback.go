@@ -0,0 +1,143 @@
+package database
+
+import (
+	"context"
+	"egobackend/internal/models"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// SaveLogFeedback создает или заменяет оценку пользователя. Причины
+// перезаписываются целиком в той же транзакции и читаются по алфавиту.
+func (db *DB) SaveLogFeedback(feedback *models.LogFeedback) (*models.LogFeedback, error) {
+	tx, err := db.BeginTxx(context.Background(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var saved models.LogFeedback
+	query := `INSERT INTO log_feedback (request_log_id, user_id, rating, comment, created_at, updated_at)
+              VALUES ($1, $2, $3, $4, $5, $5)
+              ON CONFLICT (request_log_id, user_id)
+              DO UPDATE SET rating = EXCLUDED.rating, comment = EXCLUDED.comment, updated_at = EXCLUDED.updated_at
+              RETURNING *`
+	err = tx.Get(&saved, db.rebind(query), feedback.RequestLogID, feedback.UserID, feedback.Rating, feedback.Comment, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(db.rebind(`DELETE FROM log_feedback_reasons WHERE feedback_id = $1`), saved.ID); err != nil {
+		return nil, err
+	}
+	saved.Reasons = append([]string{}, feedback.Reasons...)
+	sort.Strings(saved.Reasons)
+	for _, reason := range saved.Reasons {
+		_, err := tx.Exec(db.rebind(`INSERT INTO log_feedback_reasons (feedback_id, reason) VALUES ($1, $2)`), saved.ID, reason)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &saved, tx.Commit()
+}
+
+func (db *DB) GetLogFeedback(userID int, logIDs []int) (map[int]models.LogFeedback, error) {
+	feedbackMap := make(map[int]models.LogFeedback)
+	if len(logIDs) == 0 {
+		return feedbackMap, nil
+	}
+
+	var feedback []models.LogFeedback
+	q, args, err := sqlx.In(`SELECT * FROM log_feedback WHERE user_id = ? AND request_log_id IN (?)`, userID, logIDs)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Select(&feedback, db.Rebind(q), args...); err != nil {
+		return nil, err
+	}
+	if len(feedback) == 0 {
+		return feedbackMap, nil
+	}
+
+	feedbackIDs := make([]int, len(feedback))
+	for i, f := range feedback {
+		feedbackIDs[i] = f.ID
+	}
+	var reasons []struct {
+		FeedbackID int    `db:"feedback_id"`
+		Reason     string `db:"reason"`
+	}
+	q, args, err = sqlx.In(`SELECT feedback_id, reason FROM log_feedback_reasons
+                            WHERE feedback_id IN (?) ORDER BY reason`, feedbackIDs)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Select(&reasons, db.Rebind(q), args...); err != nil {
+		return nil, err
+	}
+	byFeedback := make(map[int][]string)
+	for _, r := range reasons {
+		byFeedback[r.FeedbackID] = append(byFeedback[r.FeedbackID], r.Reason)
+	}
+	for _, f := range feedback {
+		f.Reasons = byFeedback[f.ID]
+		if f.Reasons == nil {
+			f.Reasons = []string{}
+		}
+		feedbackMap[f.RequestLogID] = f
+	}
+	return feedbackMap, nil
+}
+
+// feedbackCounts — столбцы models.FeedbackCounts для запросов статистики.
+const feedbackCounts = `COUNT(*) AS total,
+               COALESCE(SUM(CASE WHEN f.rating > 0 THEN 1 ELSE 0 END), 0) AS positive,
+               COALESCE(SUM(CASE WHEN f.rating < 0 THEN 1 ELSE 0 END), 0) AS negative`
+
+// GetFeedbackStats сводит оценки, обновленные в окне [from, to). Режим
+// берется из лога, а для старых логов без режима — из сессии.
+func (db *DB) GetFeedbackStats(from, to time.Time) (*models.FeedbackStats, error) {
+	from, to = from.UTC(), to.UTC()
+	stats := &models.FeedbackStats{
+		From: from, To: to,
+		ByMode: []models.ModeFeedback{}, ByTool: []models.ToolFeedback{}, Reasons: []models.ReasonFeedback{},
+	}
+	window := ` WHERE f.updated_at >= $1 AND f.updated_at < $2 `
+
+	if err := db.Get(&stats.Total, `SELECT `+feedbackCounts+` FROM log_feedback f`+window, from, to); err != nil {
+		return nil, err
+	}
+
+	query := `SELECT COALESCE(rl.mode, cs.mode) AS mode, ` + feedbackCounts + `
+              FROM log_feedback f
+              JOIN request_logs rl ON rl.id = f.request_log_id
+              JOIN chat_sessions cs ON cs.id = rl.session_id` + window + `
+              GROUP BY COALESCE(rl.mode, cs.mode)
+              ORDER BY total DESC, mode`
+	if err := db.Select(&stats.ByMode, query, from, to); err != nil {
+		return nil, err
+	}
+
+	query = `SELECT COALESCE(t.tool_name, '') AS tool, ` + feedbackCounts + `
+             FROM log_feedback f
+             LEFT JOIN (
+                 SELECT DISTINCT request_log_id, tool_name FROM thought_steps WHERE tool_name IS NOT NULL
+             ) t ON t.request_log_id = f.request_log_id` + window + `
+             GROUP BY COALESCE(t.tool_name, '')
+             ORDER BY total DESC, tool`
+	if err := db.Select(&stats.ByTool, query, from, to); err != nil {
+		return nil, err
+	}
+
+	query = `SELECT r.reason, ` + feedbackCounts + `
+             FROM log_feedback_reasons r
+             JOIN log_feedback f ON f.id = r.feedback_id` + window + `
+             GROUP BY r.reason
+             ORDER BY total DESC, r.reason`
+	if err := db.Select(&stats.Reasons, query, from, to); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
@@ -1,14 +1,20 @@
 package database
 
 import (
-	"context"
-	"egobackend/internal/models"
-	"log"
 	"time"
 
+	"egobackend/internal/models"
+
 	"github.com/jmoiron/sqlx"
 )
 
+// Колонки models.FileAttachment. Устаревшая file_attachments.request_log_id
+// не читается: вложения связаны с логами только через request_log_attachments.
+const (
+	fileAttachmentColumns   = `id, session_id, user_id, file_name, file_uri, mime_type, status, created_at`
+	fileAttachmentColumnsFA = `fa.id, fa.session_id, fa.user_id, fa.file_name, fa.file_uri, fa.mime_type, fa.status, fa.created_at`
+)
+
 func (db *DB) SaveFileAttachment(sessionID, userID int, fileName, fileURI, mimeType, status string) (int64, error) {
 	query := `INSERT INTO file_attachments (session_id, user_id, file_name, file_uri, mime_type, status, created_at)
               VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`
@@ -17,65 +23,62 @@ func (db *DB) SaveFileAttachment(sessionID, userID int, fileName, fileURI, mimeT
 	return fileID, err
 }
 
-func (db *DB) AssociateFilesWithRequestLog(logID int64, fileIDs []int64) error {
-	if len(fileIDs) == 0 {
-		return nil
-	}
-
-	tx, err := db.BeginTxx(context.Background(), nil)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if r := recover(); r != nil {
-			tx.Rollback()
-			panic(r)
-		} else if err != nil {
-			log.Printf("!!! DB ОШИБКА: Откат транзакции из-за ошибки: %v", err)
-			tx.Rollback()
-		}
-	}()
-
-	stmt, err := tx.Preparex("UPDATE file_attachments SET request_log_id = $1 WHERE id = $2")
-	if err != nil {
-		return err
-	}
-	defer stmt.Close()
-
-	for _, fileID := range fileIDs {
-		if _, err = stmt.Exec(logID, fileID); err != nil {
-			return err
-		}
-	}
+// DeleteStaleUnlinkedAttachments удаляет вложения старше olderThan, на
+// которые не ссылается ни один лог в request_log_attachments: запрос
+// оборвался между загрузкой файла и сохранением лога. Возвращает ключи S3
+// удаленных строк. Строки удаляются раньше объектов, поэтому вложение,
+// которое в этот момент коммитится, либо останется целиком, либо исчезнет
+// целиком.
+func (db *DB) DeleteStaleUnlinkedAttachments(olderThan time.Duration, limit int) ([]string, error) {
+	query := `DELETE FROM file_attachments WHERE id IN (
+                  SELECT fa.id FROM file_attachments fa
+                  WHERE fa.created_at < $1 AND NOT EXISTS (
+                      SELECT 1 FROM request_log_attachments rla WHERE rla.file_id = fa.id
+                  )
+                  ORDER BY fa.id LIMIT $2
+              ) RETURNING file_uri`
+	var uris []string
+	err := db.Select(&uris, query, time.Now().UTC().Add(-olderThan), limit)
+	return uris, err
+}
 
-	return tx.Commit()
+// DeleteExpiredCommittedAttachments удаляет сохраненные вложения старше
+// olderThan вместе с их связями с логами (срок хранения файлов). Возвращает
+// ключи S3 удаленных строк.
+func (db *DB) DeleteExpiredCommittedAttachments(olderThan time.Duration, limit int) ([]string, error) {
+	query := `DELETE FROM file_attachments WHERE id IN (
+                  SELECT id FROM file_attachments
+                  WHERE status = $1 AND created_at < $2
+                  ORDER BY id LIMIT $3
+              ) RETURNING file_uri`
+	var uris []string
+	err := db.Select(&uris, query, models.AttachmentStatusCommitted, time.Now().UTC().Add(-olderThan), limit)
+	return uris, err
 }
 
-func (db *DB) GetAttachmentsByIDs(ids []int) ([]models.FileAttachment, error) {
-	if len(ids) == 0 {
-		return []models.FileAttachment{}, nil
+// FindOrphanFileURIs возвращает ключи из uris, для которых в
+// file_attachments нет строки.
+func (db *DB) FindOrphanFileURIs(uris []string) ([]string, error) {
+	if len(uris) == 0 {
+		return nil, nil
 	}
-	query, args, err := sqlx.In("SELECT * FROM file_attachments WHERE id IN (?)", ids)
+	query, args, err := sqlx.In("SELECT file_uri FROM file_attachments WHERE file_uri IN (?)", uris)
 	if err != nil {
 		return nil, err
 	}
-	query = db.Rebind(query)
-	var attachments []models.FileAttachment
-	err = db.Select(&attachments, query, args...)
-	if err != nil {
+	var known []string
+	if err := db.Select(&known, db.Rebind(query), args...); err != nil {
 		return nil, err
 	}
-	return attachments, nil
-}
-
-func (db *DB) DeleteOldFileAttachments(maxAge time.Duration) ([]string, error) {
-	cutoffTime := time.Now().UTC().Add(-maxAge)
-	query := `DELETE FROM file_attachments WHERE created_at < $1 RETURNING file_uri`
-
-	var deletedURIs []string
-	err := db.Select(&deletedURIs, query, cutoffTime)
-	if err != nil {
-		return nil, err
+	knownSet := make(map[string]bool, len(known))
+	for _, uri := range known {
+		knownSet[uri] = true
+	}
+	var orphans []string
+	for _, uri := range uris {
+		if !knownSet[uri] {
+			orphans = append(orphans, uri)
+		}
 	}
-	return deletedURIs, nil
+	return orphans, nil
 }
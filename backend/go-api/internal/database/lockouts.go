@@ -0,0 +1,47 @@
+package database
+
+import (
+	"database/sql"
+	"egobackend/internal/models"
+	"time"
+)
+
+func (db *DB) SaveLoginLockout(scope, subject string, failedAttempts int, lockedUntil time.Time) error {
+	query := `INSERT INTO login_lockouts (scope, subject, failed_attempts, locked_until, created_at)
+              VALUES ($1, $2, $3, $4, $5)`
+	_, err := db.Exec(query, scope, subject, failedAttempts, lockedUntil.UTC(), time.Now().UTC())
+	return err
+}
+
+func (db *DB) GetLoginLockouts(activeOnly bool, limit int) ([]models.LoginLockout, error) {
+	var lockouts []models.LoginLockout
+	query := `SELECT * FROM login_lockouts ORDER BY created_at DESC LIMIT $1`
+	args := []interface{}{limit}
+	if activeOnly {
+		query = `SELECT * FROM login_lockouts WHERE cleared_at IS NULL AND locked_until > $1 ORDER BY created_at DESC LIMIT $2`
+		args = []interface{}{time.Now().UTC(), limit}
+	}
+	err := db.Select(&lockouts, query, args...)
+	return lockouts, err
+}
+
+// ClearLoginLockout помечает блокировку снятой и возвращает ее, чтобы
+// вызывающий код мог сбросить состояние лимитера в памяти.
+func (db *DB) ClearLoginLockout(lockoutID, adminID int) (*models.LoginLockout, error) {
+	var lockout models.LoginLockout
+	query := `UPDATE login_lockouts SET cleared_at = $1, cleared_by = $2
+              WHERE id = $3 AND cleared_at IS NULL RETURNING *`
+	err := db.Get(&lockout, query, time.Now().UTC(), adminID, lockoutID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Другие активные записи по тому же ключу тоже теряют смысл.
+	_, err = db.Exec(`UPDATE login_lockouts SET cleared_at = $1, cleared_by = $2
+                      WHERE scope = $3 AND subject = $4 AND cleared_at IS NULL`,
+		time.Now().UTC(), adminID, lockout.Scope, lockout.Subject)
+	return &lockout, err
+}
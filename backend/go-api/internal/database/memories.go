@@ -0,0 +1,57 @@
+package database
+
+import (
+	"database/sql"
+	"egobackend/internal/models"
+	"time"
+)
+
+func (db *DB) GetUserMemories(userID int) ([]models.UserMemory, error) {
+	var memories []models.UserMemory
+	query := `SELECT * FROM user_memories WHERE user_id = $1 ORDER BY updated_at DESC`
+	err := db.Select(&memories, query, userID)
+	return memories, err
+}
+
+func (db *DB) CountUserMemories(userID int) (int, error) {
+	var count int
+	err := db.Get(&count, `SELECT COUNT(*) FROM user_memories WHERE user_id = $1`, userID)
+	return count, err
+}
+
+func (db *DB) CreateUserMemory(userID int, content, source string) (*models.UserMemory, error) {
+	var memory models.UserMemory
+	now := time.Now().UTC()
+	query := `INSERT INTO user_memories (user_id, content, source, created_at, updated_at)
+              VALUES ($1, $2, $3, $4, $4) RETURNING *`
+	err := db.Get(&memory, query, userID, content, source, now)
+	if err != nil {
+		return nil, err
+	}
+	return &memory, nil
+}
+
+// UpdateUserMemory меняет текст записи. Возвращает nil, если записи нет
+// или она принадлежит другому пользователю.
+func (db *DB) UpdateUserMemory(memoryID, userID int, content string) (*models.UserMemory, error) {
+	var memory models.UserMemory
+	query := `UPDATE user_memories SET content = $1, updated_at = $2
+              WHERE id = $3 AND user_id = $4 RETURNING *`
+	err := db.Get(&memory, query, content, time.Now().UTC(), memoryID, userID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &memory, nil
+}
+
+func (db *DB) DeleteUserMemory(memoryID, userID int) (bool, error) {
+	result, err := db.Exec(`DELETE FROM user_memories WHERE id = $1 AND user_id = $2`, memoryID, userID)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
@@ -0,0 +1,1258 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"egobackend/internal/models"
+)
+
+// errConstraint — нарушение уникальности или внешнего ключа в Memory. В
+// PostgreSQL на его месте ошибка драйвера, поэтому вызывающий код
+// проверяет только сам факт ошибки.
+var errConstraint = errors.New("нарушено ограничение хранилища")
+
+type memSession struct {
+	models.ChatSession
+	titleEdited    bool
+	summary        string
+	summaryVersion int
+	summaryLogIDs  []int
+}
+
+type memToken struct {
+	userID    int
+	purpose   string
+	hash      string
+	expiresAt time.Time
+	usedAt    *time.Time
+}
+
+// Memory — хранилище в памяти процесса. Повторяет поведение DB, включая
+// каскадное удаление, и нужно для тестов без PostgreSQL. Данные теряются
+// при перезапуске.
+type Memory struct {
+	mu sync.Mutex
+
+	users    map[int]*models.User
+	sessions map[int]*memSession
+	logs     map[int]*models.RequestLog
+	files    map[int64]*models.FileAttachment
+	logFiles map[int][]int64 // request_log_attachments: файлы лога по порядку
+	traces   map[int][]models.ThoughtStep
+	feedback map[int]*models.LogFeedback
+	tokens   []*memToken
+	lockouts map[int]*models.LoginLockout
+	memories map[int]*models.UserMemory
+	presets  map[int]*models.InstructionPreset
+
+	lastID map[string]int
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		users:    make(map[int]*models.User),
+		sessions: make(map[int]*memSession),
+		logs:     make(map[int]*models.RequestLog),
+		files:    make(map[int64]*models.FileAttachment),
+		logFiles: make(map[int][]int64),
+		traces:   make(map[int][]models.ThoughtStep),
+		feedback: make(map[int]*models.LogFeedback),
+		lockouts: make(map[int]*models.LoginLockout),
+		memories: make(map[int]*models.UserMemory),
+		presets:  make(map[int]*models.InstructionPreset),
+		lastID:   make(map[string]int),
+	}
+}
+
+func (m *Memory) nextID(table string) int {
+	m.lastID[table]++
+	return m.lastID[table]
+}
+
+// memNow и memTime округляют время до микросекунд, как TIMESTAMPTZ.
+func memNow() time.Time {
+	return memTime(time.Now())
+}
+
+func memTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Microsecond)
+}
+
+func copyString(s *string) *string {
+	if s == nil {
+		return nil
+	}
+	v := *s
+	return &v
+}
+
+func copyUser(u *models.User) *models.User {
+	c := *u
+	return &c
+}
+
+func copySession(s *memSession) *models.ChatSession {
+	c := s.ChatSession
+	c.CustomInstructions = copyString(s.CustomInstructions)
+	return &c
+}
+
+func copyLog(l *models.RequestLog) models.RequestLog {
+	c := *l
+	c.FinalResponse = copyString(l.FinalResponse)
+	c.Mode = copyString(l.Mode)
+	return c
+}
+
+// --- Пользователи ---
+
+func (m *Memory) CreateUser(username, hashedPassword, email string) (*models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range m.users {
+		if u.Username == username {
+			return nil, fmt.Errorf("имя %q занято: %w", username, errConstraint)
+		}
+	}
+	user := &models.User{
+		ID:             m.nextID("users"),
+		Username:       username,
+		HashedPassword: hashedPassword,
+		Role:           "user",
+		CreatedAt:      memNow(),
+		Email:          sql.NullString{String: email, Valid: email != ""},
+	}
+	m.users[user.ID] = user
+	return copyUser(user), nil
+}
+
+func (m *Memory) GetUserByUsername(username string) (*models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range m.users {
+		if u.Username == username {
+			return copyUser(u), nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *Memory) GetUserByEmail(email string) (*models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var found *models.User
+	for _, u := range m.users {
+		if !u.Email.Valid || !strings.EqualFold(u.Email.String, email) {
+			continue
+		}
+		if found == nil || u.EmailVerified && !found.EmailVerified || u.EmailVerified == found.EmailVerified && u.ID < found.ID {
+			found = u
+		}
+	}
+	if found == nil {
+		return nil, sql.ErrNoRows
+	}
+	return copyUser(found), nil
+}
+
+func (m *Memory) updateUser(userID int, update func(u *models.User)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if u, ok := m.users[userID]; ok {
+		update(u)
+	}
+}
+
+func (m *Memory) UpdateUserRole(userID int, newRole string) error {
+	m.updateUser(userID, func(u *models.User) { u.Role = newRole })
+	return nil
+}
+
+func (m *Memory) UpdateUserPassword(userID int, hashedPassword string) error {
+	m.updateUser(userID, func(u *models.User) {
+		u.HashedPassword = hashedPassword
+		u.TokenVersion++
+	})
+	return nil
+}
+
+func (m *Memory) UpdateUserLocale(userID int, locale string) error {
+	m.updateUser(userID, func(u *models.User) { u.Locale = sql.NullString{String: locale, Valid: locale != ""} })
+	return nil
+}
+
+func (m *Memory) MarkEmailVerified(userID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[userID]
+	if !ok {
+		return nil
+	}
+	var squatters []*models.User
+	for _, u := range m.users {
+		if u.ID == userID || !user.Email.Valid || !u.Email.Valid || !strings.EqualFold(u.Email.String, user.Email.String) {
+			continue
+		}
+		if u.EmailVerified {
+			return ErrEmailTaken
+		}
+		squatters = append(squatters, u)
+	}
+	for _, u := range squatters {
+		u.Email = sql.NullString{}
+	}
+	user.EmailVerified = true
+	return nil
+}
+
+func (m *Memory) SoftDeleteUser(userID int, gracePeriod time.Duration) (*models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[userID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	now := memNow()
+	if !u.DeletedAt.Valid {
+		u.DeletedAt = sql.NullTime{Time: now, Valid: true}
+	}
+	if !u.PurgeAfter.Valid {
+		u.PurgeAfter = sql.NullTime{Time: now.Add(gracePeriod), Valid: true}
+	}
+	return copyUser(u), nil
+}
+
+func (m *Memory) GetUsersDueForPurge(limit int) ([]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().UTC()
+	var due []*models.User
+	for _, u := range m.users {
+		if u.DeletedAt.Valid && u.PurgeAfter.Valid && !u.PurgeAfter.Time.After(now) {
+			due = append(due, u)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].PurgeAfter.Time.Before(due[j].PurgeAfter.Time) })
+	var ids []int
+	for i, u := range due {
+		if i == limit {
+			break
+		}
+		ids = append(ids, u.ID)
+	}
+	return ids, nil
+}
+
+func (m *Memory) HardDeleteUser(userID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[userID]
+	if !ok || !u.DeletedAt.Valid {
+		return nil
+	}
+	delete(m.users, userID)
+	m.deleteFeedbackLocked(func(f *models.LogFeedback) bool { return f.UserID == userID })
+	for id, s := range m.sessions {
+		if s.UserID == userID {
+			m.deleteSessionLocked(id)
+		}
+	}
+	for id, f := range m.files {
+		if f.UserID == userID {
+			delete(m.files, id)
+		}
+	}
+	kept := m.tokens[:0]
+	for _, t := range m.tokens {
+		if t.userID != userID {
+			kept = append(kept, t)
+		}
+	}
+	m.tokens = kept
+	for id, mem := range m.memories {
+		if mem.UserID == userID {
+			delete(m.memories, id)
+		}
+	}
+	for id, p := range m.presets {
+		if p.UserID == userID {
+			m.deletePresetLocked(id)
+		}
+	}
+	for _, l := range m.lockouts {
+		if l.ClearedBy.Valid && int(l.ClearedBy.Int64) == userID {
+			l.ClearedBy = sql.NullInt64{}
+		}
+	}
+	return nil
+}
+
+// --- Токены ---
+
+func (m *Memory) CreateUserToken(userID int, purpose, tokenHash string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[userID]; !ok {
+		return fmt.Errorf("пользователь %d: %w", userID, errConstraint)
+	}
+	for _, t := range m.tokens {
+		if t.hash == tokenHash {
+			return fmt.Errorf("токен уже существует: %w", errConstraint)
+		}
+	}
+	m.tokens = append(m.tokens, &memToken{userID: userID, purpose: purpose, hash: tokenHash, expiresAt: memNow().Add(ttl)})
+	return nil
+}
+
+func (m *Memory) CheckUserToken(purpose, tokenHash string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := memNow()
+	for _, t := range m.tokens {
+		if t.hash == tokenHash && t.purpose == purpose && t.usedAt == nil && t.expiresAt.After(now) {
+			return t.userID, nil
+		}
+	}
+	return 0, nil
+}
+
+func (m *Memory) ConsumeUserToken(purpose, tokenHash string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := memNow()
+	for _, t := range m.tokens {
+		if t.hash == tokenHash && t.purpose == purpose && t.usedAt == nil && t.expiresAt.After(now) {
+			t.usedAt = &now
+			return t.userID, nil
+		}
+	}
+	return 0, nil
+}
+
+func (m *Memory) InvalidateUserTokens(userID int, purpose string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := memNow()
+	for _, t := range m.tokens {
+		if t.userID == userID && t.purpose == purpose && t.usedAt == nil {
+			t.usedAt = &now
+		}
+	}
+	return nil
+}
+
+func (m *Memory) DeleteExpiredUserTokens() (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cutoff := time.Now().UTC().Add(-24 * time.Hour)
+	var deleted int64
+	kept := m.tokens[:0]
+	for _, t := range m.tokens {
+		if t.expiresAt.Before(cutoff) || (t.usedAt != nil && t.usedAt.Before(cutoff)) {
+			deleted++
+			continue
+		}
+		kept = append(kept, t)
+	}
+	m.tokens = kept
+	return deleted, nil
+}
+
+// --- Блокировки входа ---
+
+func (m *Memory) SaveLoginLockout(scope, subject string, failedAttempts int, lockedUntil time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := m.nextID("login_lockouts")
+	m.lockouts[id] = &models.LoginLockout{
+		ID: id, Scope: scope, Subject: subject, FailedAttempts: failedAttempts,
+		LockedUntil: memTime(lockedUntil), CreatedAt: memNow(),
+	}
+	return nil
+}
+
+func (m *Memory) GetLoginLockouts(activeOnly bool, limit int) ([]models.LoginLockout, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().UTC()
+	var lockouts []models.LoginLockout
+	for _, l := range m.lockouts {
+		if activeOnly && (l.ClearedAt.Valid || !l.LockedUntil.After(now)) {
+			continue
+		}
+		lockouts = append(lockouts, *l)
+	}
+	sort.Slice(lockouts, func(i, j int) bool {
+		if !lockouts[i].CreatedAt.Equal(lockouts[j].CreatedAt) {
+			return lockouts[i].CreatedAt.After(lockouts[j].CreatedAt)
+		}
+		return lockouts[i].ID > lockouts[j].ID
+	})
+	if len(lockouts) > limit {
+		lockouts = lockouts[:limit]
+	}
+	return lockouts, nil
+}
+
+func (m *Memory) ClearLoginLockout(lockoutID, adminID int) (*models.LoginLockout, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lockout, ok := m.lockouts[lockoutID]
+	if !ok || lockout.ClearedAt.Valid {
+		return nil, nil
+	}
+	now := sql.NullTime{Time: memNow(), Valid: true}
+	by := sql.NullInt64{Int64: int64(adminID), Valid: true}
+	lockout.ClearedAt, lockout.ClearedBy = now, by
+	result := *lockout
+	for _, l := range m.lockouts {
+		if l.Scope == lockout.Scope && l.Subject == lockout.Subject && !l.ClearedAt.Valid {
+			l.ClearedAt, l.ClearedBy = now, by
+		}
+	}
+	return &result, nil
+}
+
+// --- Память ---
+
+func (m *Memory) GetUserMemories(userID int) ([]models.UserMemory, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var memories []models.UserMemory
+	for _, mem := range m.memories {
+		if mem.UserID == userID {
+			memories = append(memories, *mem)
+		}
+	}
+	sort.Slice(memories, func(i, j int) bool {
+		if !memories[i].UpdatedAt.Equal(memories[j].UpdatedAt) {
+			return memories[i].UpdatedAt.After(memories[j].UpdatedAt)
+		}
+		return memories[i].ID > memories[j].ID
+	})
+	return memories, nil
+}
+
+func (m *Memory) CountUserMemories(userID int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	count := 0
+	for _, mem := range m.memories {
+		if mem.UserID == userID {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *Memory) CreateUserMemory(userID int, content, source string) (*models.UserMemory, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[userID]; !ok {
+		return nil, fmt.Errorf("пользователь %d: %w", userID, errConstraint)
+	}
+	now := memNow()
+	memory := &models.UserMemory{ID: m.nextID("user_memories"), UserID: userID, Content: content, Source: source, CreatedAt: now, UpdatedAt: now}
+	m.memories[memory.ID] = memory
+	result := *memory
+	return &result, nil
+}
+
+func (m *Memory) UpdateUserMemory(memoryID, userID int, content string) (*models.UserMemory, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	memory, ok := m.memories[memoryID]
+	if !ok || memory.UserID != userID {
+		return nil, nil
+	}
+	memory.Content = content
+	memory.UpdatedAt = memNow()
+	result := *memory
+	return &result, nil
+}
+
+func (m *Memory) DeleteUserMemory(memoryID, userID int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	memory, ok := m.memories[memoryID]
+	if !ok || memory.UserID != userID {
+		return false, nil
+	}
+	delete(m.memories, memoryID)
+	return true, nil
+}
+
+// --- Пресеты ---
+
+func (m *Memory) selectPresets(match func(p *models.InstructionPreset) bool) []models.InstructionPreset {
+	var presets []models.InstructionPreset
+	for _, p := range m.presets {
+		if match(p) {
+			presets = append(presets, *p)
+		}
+	}
+	sort.Slice(presets, func(i, j int) bool {
+		if presets[i].Shared != presets[j].Shared {
+			return !presets[i].Shared
+		}
+		return presets[i].Name < presets[j].Name
+	})
+	return presets
+}
+
+func (m *Memory) GetVisiblePresets(userID int) ([]models.InstructionPreset, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.selectPresets(func(p *models.InstructionPreset) bool { return p.UserID == userID || p.Shared }), nil
+}
+
+func (m *Memory) GetUserPresets(userID int) ([]models.InstructionPreset, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	presets := m.selectPresets(func(p *models.InstructionPreset) bool { return p.UserID == userID })
+	sort.SliceStable(presets, func(i, j int) bool { return presets[i].Name < presets[j].Name })
+	return presets, nil
+}
+
+func (m *Memory) GetVisiblePreset(presetID, userID int) (*models.InstructionPreset, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.presets[presetID]
+	if !ok || (p.UserID != userID && !p.Shared) {
+		return nil, nil
+	}
+	result := *p
+	return &result, nil
+}
+
+func (m *Memory) CreatePreset(userID int, name, instructions string, shared bool) (*models.InstructionPreset, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[userID]; !ok {
+		return nil, fmt.Errorf("пользователь %d: %w", userID, errConstraint)
+	}
+	now := memNow()
+	preset := &models.InstructionPreset{
+		ID: m.nextID("instruction_presets"), UserID: userID, Name: name, Instructions: instructions, Shared: shared,
+		CreatedAt: now, UpdatedAt: now,
+	}
+	m.presets[preset.ID] = preset
+	result := *preset
+	return &result, nil
+}
+
+func (m *Memory) UpdatePreset(preset *models.InstructionPreset) (*models.InstructionPreset, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.presets[preset.ID]
+	if !ok || p.UserID != preset.UserID {
+		return nil, nil
+	}
+	p.Name, p.Instructions, p.Shared, p.UpdatedAt = preset.Name, preset.Instructions, preset.Shared, memNow()
+	result := *p
+	return &result, nil
+}
+
+func (m *Memory) DeletePreset(presetID, userID int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.presets[presetID]
+	if !ok || p.UserID != userID {
+		return false, nil
+	}
+	m.deletePresetLocked(presetID)
+	return true, nil
+}
+
+// deletePresetLocked удаляет пресет и снимает его как пресет по умолчанию
+// (ON DELETE SET NULL).
+func (m *Memory) deletePresetLocked(presetID int) {
+	delete(m.presets, presetID)
+	for _, u := range m.users {
+		if u.DefaultPreset.Valid && int(u.DefaultPreset.Int64) == presetID {
+			u.DefaultPreset = sql.NullInt64{}
+		}
+	}
+}
+
+func (m *Memory) UpdateUserDefaultPreset(userID int, presetID *int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[userID]
+	if !ok {
+		return nil
+	}
+	if presetID == nil {
+		u.DefaultPreset = sql.NullInt64{}
+		return nil
+	}
+	if _, ok := m.presets[*presetID]; !ok {
+		return fmt.Errorf("пресет %d: %w", *presetID, errConstraint)
+	}
+	u.DefaultPreset = sql.NullInt64{Int64: int64(*presetID), Valid: true}
+	return nil
+}
+
+func (m *Memory) GetUserDefaultPreset(userID int) (*models.InstructionPreset, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[userID]
+	if !ok || !u.DefaultPreset.Valid {
+		return nil, nil
+	}
+	p, ok := m.presets[int(u.DefaultPreset.Int64)]
+	if !ok || (p.UserID != userID && !p.Shared) {
+		return nil, nil
+	}
+	result := *p
+	return &result, nil
+}
+
+// --- Сессии ---
+
+func (m *Memory) GetUserSessions(userID int) ([]models.ChatSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var sessions []models.ChatSession
+	for _, s := range m.sessions {
+		if s.UserID == userID {
+			sessions = append(sessions, *copySession(s))
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].CreatedAt.Equal(sessions[j].CreatedAt) {
+			return sessions[i].CreatedAt.After(sessions[j].CreatedAt)
+		}
+		return sessions[i].ID > sessions[j].ID
+	})
+	return sessions, nil
+}
+
+func (m *Memory) DeleteSession(sessionID, userID int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[sessionID]
+	if !ok || s.UserID != userID {
+		return false, nil
+	}
+	m.deleteSessionLocked(sessionID)
+	return true, nil
+}
+
+// deleteSessionLocked удаляет сессию вместе с логами и вложениями.
+func (m *Memory) deleteSessionLocked(sessionID int) {
+	delete(m.sessions, sessionID)
+	for id, l := range m.logs {
+		if l.SessionID == sessionID {
+			delete(m.logs, id)
+			delete(m.logFiles, id)
+			delete(m.traces, id)
+			m.deleteFeedbackLocked(func(f *models.LogFeedback) bool { return f.RequestLogID == id })
+		}
+	}
+	for id, f := range m.files {
+		if f.SessionID == sessionID {
+			delete(m.files, id)
+		}
+	}
+}
+
+func (m *Memory) ownedSession(sessionID, userID int) (*memSession, bool) {
+	s, ok := m.sessions[sessionID]
+	if !ok || s.UserID != userID {
+		return nil, false
+	}
+	return s, true
+}
+
+func (m *Memory) CheckSessionOwnership(sessionID, userID int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.ownedSession(sessionID, userID)
+	return ok, nil
+}
+
+func (m *Memory) GetOrCreateSession(sessionIDStr string, title string, userID int, mode string) (*models.ChatSession, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if sessionIDStr != "" && sessionIDStr != "new" {
+		sessionID, err := strconv.Atoi(sessionIDStr)
+		if err != nil {
+			return nil, false, fmt.Errorf("неверный формат session_id")
+		}
+		if s, ok := m.ownedSession(sessionID, userID); ok {
+			return copySession(s), false, nil
+		}
+	}
+	if _, ok := m.users[userID]; !ok {
+		return nil, false, fmt.Errorf("пользователь %d: %w", userID, errConstraint)
+	}
+	s := &memSession{ChatSession: models.ChatSession{
+		ID: m.nextID("chat_sessions"), UserID: userID, Title: title, Mode: mode, CreatedAt: memNow(),
+	}}
+	m.sessions[s.ID] = s
+	return copySession(s), true, nil
+}
+
+func (m *Memory) updateSession(sessionID, userID int, update func(s *memSession)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.ownedSession(sessionID, userID); ok {
+		update(s)
+	}
+}
+
+func (m *Memory) UpdateSessionInstructions(sessionID, userID int, customInstructions string) error {
+	m.updateSession(sessionID, userID, func(s *memSession) { s.CustomInstructions = &customInstructions })
+	return nil
+}
+
+func (m *Memory) GetSessionByID(sessionID, userID int) (*models.ChatSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.ownedSession(sessionID, userID)
+	if !ok {
+		return nil, nil
+	}
+	return copySession(s), nil
+}
+
+func (m *Memory) UpdateSessionMode(sessionID, userID int, mode string) error {
+	m.updateSession(sessionID, userID, func(s *memSession) { s.Mode = mode })
+	return nil
+}
+
+func (m *Memory) UpdateSessionTitle(sessionID, userID int, title string) error {
+	m.updateSession(sessionID, userID, func(s *memSession) { s.Title, s.titleEdited = title, true })
+	return nil
+}
+
+func (m *Memory) SetGeneratedSessionTitle(sessionID int, title string) (*models.ChatSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[sessionID]
+	if !ok || s.titleEdited {
+		return nil, nil
+	}
+	s.Title = title
+	return copySession(s), nil
+}
+
+func (m *Memory) GetSessionSummary(sessionID int) (models.SessionSummary, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[sessionID]
+	if !ok {
+		return models.SessionSummary{}, sql.ErrNoRows
+	}
+	return models.SessionSummary{Summary: s.summary, Version: s.summaryVersion, LogIDs: slices.Clone(s.summaryLogIDs)}, nil
+}
+
+func (m *Memory) UpdateSessionSummary(sessionID int, summary string, version int, logIDs []int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[sessionID]
+	if !ok || s.summaryVersion != version {
+		return nil
+	}
+	s.summary = summary
+	s.summaryVersion++
+	for _, logID := range logIDs {
+		if l, ok := m.logs[logID]; ok && l.SessionID == sessionID && !slices.Contains(s.summaryLogIDs, logID) {
+			s.summaryLogIDs = append(s.summaryLogIDs, logID)
+		}
+	}
+	slices.Sort(s.summaryLogIDs)
+	return nil
+}
+
+// --- Логи ---
+
+// sessionLogs возвращает логи сессии по возрастанию времени.
+func (m *Memory) sessionLogs(sessionID int) []models.RequestLog {
+	var logs []models.RequestLog
+	for _, l := range m.logs {
+		if l.SessionID == sessionID {
+			logs = append(logs, copyLog(l))
+		}
+	}
+	sort.Slice(logs, func(i, j int) bool {
+		if !logs[i].Timestamp.Equal(logs[j].Timestamp) {
+			return logs[i].Timestamp.Before(logs[j].Timestamp)
+		}
+		return logs[i].ID < logs[j].ID
+	})
+	return logs
+}
+
+func (m *Memory) GetSessionHistory(sessionID int, limit int) ([]models.RequestLog, map[int][]models.FileAttachment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	logs := m.sessionLogs(sessionID)
+	if len(logs) > limit {
+		logs = logs[len(logs)-limit:]
+	}
+	return logs, m.attachmentsForLogs(logs), nil
+}
+
+func (m *Memory) GetContextHistory(sessionID int, before time.Time, limit int) ([]models.RequestLog, map[int][]models.FileAttachment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var candidates []models.RequestLog
+	for _, l := range m.sessionLogs(sessionID) {
+		if before.IsZero() || l.Timestamp.Before(before) {
+			candidates = append(candidates, l)
+		}
+	}
+	recentFrom := len(candidates) - limit
+	var logs []models.RequestLog
+	for i, l := range candidates {
+		if l.Pinned || i >= recentFrom {
+			// Как и в DB, счетчики токенов в контекст не входят.
+			l.PromptTokens, l.CompletionTokens, l.TotalTokens = 0, 0, 0
+			logs = append(logs, l)
+		}
+	}
+	return logs, m.attachmentsForLogs(logs), nil
+}
+
+func (m *Memory) attachmentsForLogs(logs []models.RequestLog) map[int][]models.FileAttachment {
+	attachments := make(map[int][]models.FileAttachment)
+	for _, l := range logs {
+		if files := m.logAttachments(l.ID); len(files) > 0 {
+			attachments[l.ID] = files
+		}
+	}
+	return attachments
+}
+
+// logAttachments пропускает удаленные файлы: в БД их строки в
+// request_log_attachments удаляются каскадом.
+func (m *Memory) logAttachments(logID int) []models.FileAttachment {
+	files := []models.FileAttachment{}
+	for _, id := range m.logFiles[logID] {
+		if f, ok := m.files[id]; ok {
+			files = append(files, *f)
+		}
+	}
+	return files
+}
+
+func (m *Memory) GetAllSessionLogs(sessionID int) ([]models.RequestLog, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sessionLogs(sessionID), nil
+}
+
+func (m *Memory) ownedLog(logID int64, userID int) (*models.RequestLog, bool) {
+	l, ok := m.logs[int(logID)]
+	if !ok {
+		return nil, false
+	}
+	if _, ok := m.ownedSession(l.SessionID, userID); !ok {
+		return nil, false
+	}
+	return l, true
+}
+
+func (m *Memory) GetRequestLogByID(logID int64, userID int) (*models.RequestLog, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.ownedLog(logID, userID)
+	if !ok {
+		return nil, nil
+	}
+	result := copyLog(l)
+	return &result, nil
+}
+
+func (m *Memory) UpdateRequestLogQuery(logID int64, userID int, newQuery string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if l, ok := m.ownedLog(logID, userID); ok {
+		l.UserQuery = newQuery
+	}
+	return nil
+}
+
+func (m *Memory) SetRequestLogPinned(logID int64, userID int, pinned bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if l, ok := m.ownedLog(logID, userID); ok {
+		l.Pinned = pinned
+	}
+	return nil
+}
+
+func (m *Memory) UpdateRequestLogResponse(logID int64, mode string, thoughtsJSON string, finalResponse string, trace []models.ThoughtStep) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if l, ok := m.logs[int(logID)]; ok {
+		l.EgoThoughtsJSON, l.FinalResponse, l.Timestamp, l.Mode = thoughtsJSON, &finalResponse, memNow(), &mode
+		m.traces[l.ID] = copyTrace(trace)
+		m.deleteFeedbackLocked(func(f *models.LogFeedback) bool { return f.RequestLogID == l.ID })
+	}
+	return nil
+}
+
+// copyTrace нумерует шаги так же, как DB, и отвязывает их от вызывающего.
+func copyTrace(trace []models.ThoughtStep) []models.ThoughtStep {
+	steps := make([]models.ThoughtStep, len(trace))
+	for i, step := range trace {
+		steps[i] = step
+		steps[i].Position = i
+		steps[i].Header, steps[i].Content = copyString(step.Header), copyString(step.Content)
+		steps[i].ToolName, steps[i].Query = copyString(step.ToolName), copyString(step.Query)
+		steps[i].Output, steps[i].Error = copyString(step.Output), copyString(step.Error)
+		if step.Confidence != nil {
+			confidence := *step.Confidence
+			steps[i].Confidence = &confidence
+		}
+	}
+	return steps
+}
+
+func (m *Memory) GetThoughtTrace(logID int64) ([]models.ThoughtStep, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return copyTrace(m.traces[int(logID)]), nil
+}
+
+func (m *Memory) SaveRequestLog(logEntry *models.RequestLog) (int64, error) {
+	return m.SaveRequestLogWithFiles(logEntry, nil, nil)
+}
+
+func (m *Memory) SaveRequestLogWithFiles(logEntry *models.RequestLog, fileIDs []int64, trace []models.ThoughtStep) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session, ok := m.sessions[logEntry.SessionID]
+	if !ok {
+		return 0, fmt.Errorf("сессия %d: %w", logEntry.SessionID, errConstraint)
+	}
+	entry := copyLog(logEntry)
+	entry.ID = m.nextID("request_logs")
+	entry.Timestamp = memTime(entry.Timestamp)
+	entry.Pinned = false
+	m.logs[entry.ID] = &entry
+	m.traces[entry.ID] = copyTrace(trace)
+	for _, id := range fileIDs {
+		f, ok := m.files[id]
+		if !ok || f.UserID != session.UserID || slices.Contains(m.logFiles[entry.ID], id) {
+			continue
+		}
+		f.Status = models.AttachmentStatusCommitted
+		m.logFiles[entry.ID] = append(m.logFiles[entry.ID], id)
+	}
+	return int64(entry.ID), nil
+}
+
+// --- Файлы ---
+
+func (m *Memory) SaveFileAttachment(sessionID, userID int, fileName, fileURI, mimeType, status string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.sessions[sessionID]; !ok {
+		return 0, fmt.Errorf("сессия %d: %w", sessionID, errConstraint)
+	}
+	if _, ok := m.users[userID]; !ok {
+		return 0, fmt.Errorf("пользователь %d: %w", userID, errConstraint)
+	}
+	for _, f := range m.files {
+		if f.FileURI == fileURI {
+			return 0, fmt.Errorf("файл %s уже есть: %w", fileURI, errConstraint)
+		}
+	}
+	file := &models.FileAttachment{
+		ID: int64(m.nextID("file_attachments")), SessionID: sessionID, UserID: userID,
+		FileName: fileName, FileURI: fileURI, MimeType: mimeType, Status: status, CreatedAt: memNow(),
+	}
+	m.files[file.ID] = file
+	return file.ID, nil
+}
+
+func (m *Memory) selectFiles(match func(f *models.FileAttachment) bool) []models.FileAttachment {
+	var files []models.FileAttachment
+	for _, f := range m.files {
+		if match(f) {
+			files = append(files, *f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ID < files[j].ID })
+	return files
+}
+
+func (m *Memory) GetRequestLogAttachments(logID int64) ([]models.FileAttachment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.logAttachments(int(logID)), nil
+}
+
+func (m *Memory) GetUserFileAttachments(userID int) ([]models.FileAttachment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.selectFiles(func(f *models.FileAttachment) bool { return f.UserID == userID }), nil
+}
+
+func (m *Memory) GetUserLogAttachments(userID int) (map[int][]models.FileAttachment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	attachments := make(map[int][]models.FileAttachment)
+	for logID := range m.logFiles {
+		for _, f := range m.logAttachments(logID) {
+			if f.UserID == userID {
+				attachments[logID] = append(attachments[logID], f)
+			}
+		}
+	}
+	return attachments, nil
+}
+
+func (m *Memory) GetUserFileURIs(userID int, limit int) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var uris []string
+	for i, f := range m.selectFiles(func(f *models.FileAttachment) bool { return f.UserID == userID }) {
+		if i == limit {
+			break
+		}
+		uris = append(uris, f.FileURI)
+	}
+	return uris, nil
+}
+
+func (m *Memory) DeleteFileAttachmentsByURI(uris []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	remove := make(map[string]bool, len(uris))
+	for _, uri := range uris {
+		remove[uri] = true
+	}
+	for id, f := range m.files {
+		if remove[f.FileURI] {
+			delete(m.files, id)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) DeleteStaleUnlinkedAttachments(olderThan time.Duration, limit int) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cutoff := time.Now().UTC().Add(-olderThan)
+	linked := make(map[int64]bool)
+	for _, ids := range m.logFiles {
+		for _, id := range ids {
+			linked[id] = true
+		}
+	}
+	stale := m.selectFiles(func(f *models.FileAttachment) bool {
+		return !linked[f.ID] && f.CreatedAt.Before(cutoff)
+	})
+	var uris []string
+	for i, f := range stale {
+		if i == limit {
+			break
+		}
+		uris = append(uris, f.FileURI)
+		delete(m.files, f.ID)
+	}
+	return uris, nil
+}
+
+func (m *Memory) DeleteExpiredCommittedAttachments(olderThan time.Duration, limit int) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cutoff := time.Now().UTC().Add(-olderThan)
+	expired := m.selectFiles(func(f *models.FileAttachment) bool {
+		return f.Status == models.AttachmentStatusCommitted && f.CreatedAt.Before(cutoff)
+	})
+	removed := make(map[int64]bool)
+	var uris []string
+	for i, f := range expired {
+		if i == limit {
+			break
+		}
+		uris = append(uris, f.FileURI)
+		removed[f.ID] = true
+		delete(m.files, f.ID)
+	}
+	for logID, ids := range m.logFiles {
+		m.logFiles[logID] = slices.DeleteFunc(ids, func(id int64) bool { return removed[id] })
+	}
+	return uris, nil
+}
+
+func (m *Memory) FindOrphanFileURIs(uris []string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	known := make(map[string]bool, len(m.files))
+	for _, f := range m.files {
+		known[f.FileURI] = true
+	}
+	var orphans []string
+	for _, uri := range uris {
+		if !known[uri] {
+			orphans = append(orphans, uri)
+		}
+	}
+	return orphans, nil
+}
+
+// --- Оценки ---
+
+func (m *Memory) deleteFeedbackLocked(match func(f *models.LogFeedback) bool) {
+	for id, f := range m.feedback {
+		if match(f) {
+			delete(m.feedback, id)
+		}
+	}
+}
+
+func copyFeedback(f *models.LogFeedback) models.LogFeedback {
+	c := *f
+	c.Comment = copyString(f.Comment)
+	c.Reasons = append([]string{}, f.Reasons...)
+	return c
+}
+
+func (m *Memory) SaveLogFeedback(feedback *models.LogFeedback) (*models.LogFeedback, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.logs[feedback.RequestLogID]
+	if !ok {
+		return nil, fmt.Errorf("лог %d: %w", feedback.RequestLogID, errConstraint)
+	}
+	if _, ok := m.users[feedback.UserID]; !ok {
+		return nil, fmt.Errorf("пользователь %d: %w", feedback.UserID, errConstraint)
+	}
+	saved := copyFeedback(feedback)
+	sort.Strings(saved.Reasons)
+	for i := 1; i < len(saved.Reasons); i++ {
+		if saved.Reasons[i] == saved.Reasons[i-1] {
+			return nil, fmt.Errorf("причина %s: %w", saved.Reasons[i], errConstraint)
+		}
+	}
+	now := memNow()
+	saved.ID, saved.CreatedAt, saved.UpdatedAt = 0, now, now
+	for id, f := range m.feedback {
+		if f.RequestLogID == l.ID && f.UserID == feedback.UserID {
+			saved.ID, saved.CreatedAt = id, f.CreatedAt
+		}
+	}
+	if saved.ID == 0 {
+		saved.ID = m.nextID("log_feedback")
+	}
+	m.feedback[saved.ID] = &saved
+	result := copyFeedback(&saved)
+	return &result, nil
+}
+
+func (m *Memory) GetLogFeedback(userID int, logIDs []int) (map[int]models.LogFeedback, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	feedbackMap := make(map[int]models.LogFeedback)
+	wanted := make(map[int]bool, len(logIDs))
+	for _, id := range logIDs {
+		wanted[id] = true
+	}
+	for _, f := range m.feedback {
+		if f.UserID == userID && wanted[f.RequestLogID] {
+			feedbackMap[f.RequestLogID] = copyFeedback(f)
+		}
+	}
+	return feedbackMap, nil
+}
+
+// feedbackGroups считает оценки по группам и упорядочивает их так же, как
+// DB: по убыванию числа оценок, затем по имени.
+type feedbackGroups map[string]*models.FeedbackCounts
+
+func (g feedbackGroups) add(key string, rating int) {
+	counts, ok := g[key]
+	if !ok {
+		counts = &models.FeedbackCounts{}
+		g[key] = counts
+	}
+	countFeedback(counts, rating)
+}
+
+func (g feedbackGroups) sorted() []string {
+	keys := make([]string, 0, len(g))
+	for key := range g {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if g[keys[i]].Total != g[keys[j]].Total {
+			return g[keys[i]].Total > g[keys[j]].Total
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+func countFeedback(counts *models.FeedbackCounts, rating int) {
+	counts.Total++
+	switch {
+	case rating > 0:
+		counts.Positive++
+	case rating < 0:
+		counts.Negative++
+	}
+}
+
+func (m *Memory) GetFeedbackStats(from, to time.Time) (*models.FeedbackStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	from, to = from.UTC(), to.UTC()
+	stats := &models.FeedbackStats{
+		From: from, To: to,
+		ByMode: []models.ModeFeedback{}, ByTool: []models.ToolFeedback{}, Reasons: []models.ReasonFeedback{},
+	}
+	byMode, byTool, byReason := feedbackGroups{}, feedbackGroups{}, feedbackGroups{}
+	for _, f := range m.feedback {
+		if f.UpdatedAt.Before(from) || !f.UpdatedAt.Before(to) {
+			continue
+		}
+		countFeedback(&stats.Total, f.Rating)
+		l := m.logs[f.RequestLogID]
+		mode := m.sessions[l.SessionID].Mode
+		if l.Mode != nil {
+			mode = *l.Mode
+		}
+		byMode.add(mode, f.Rating)
+
+		tools := make(map[string]bool)
+		for _, step := range m.traces[l.ID] {
+			if step.ToolName != nil {
+				tools[*step.ToolName] = true
+			}
+		}
+		if len(tools) == 0 {
+			tools[""] = true
+		}
+		for tool := range tools {
+			byTool.add(tool, f.Rating)
+		}
+		for _, reason := range f.Reasons {
+			byReason.add(reason, f.Rating)
+		}
+	}
+	for _, mode := range byMode.sorted() {
+		stats.ByMode = append(stats.ByMode, models.ModeFeedback{Mode: mode, FeedbackCounts: *byMode[mode]})
+	}
+	for _, tool := range byTool.sorted() {
+		stats.ByTool = append(stats.ByTool, models.ToolFeedback{Tool: tool, FeedbackCounts: *byTool[tool]})
+	}
+	for _, reason := range byReason.sorted() {
+		stats.Reasons = append(stats.Reasons, models.ReasonFeedback{Reason: reason, FeedbackCounts: *byReason[reason]})
+	}
+	return stats, nil
+}
@@ -0,0 +1,12 @@
+package database_test
+
+import (
+	"testing"
+
+	"egobackend/internal/database"
+	"egobackend/internal/database/storetest"
+)
+
+func TestMemoryStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) database.Store { return database.NewMemory() })
+}
@@ -0,0 +1,100 @@
+package database
+
+import (
+	"database/sql"
+	"egobackend/internal/models"
+	"time"
+)
+
+// GetVisiblePresets возвращает пресеты пользователя и общие пресеты,
+// созданные администраторами.
+func (db *DB) GetVisiblePresets(userID int) ([]models.InstructionPreset, error) {
+	var presets []models.InstructionPreset
+	query := `SELECT * FROM instruction_presets WHERE user_id = $1 OR shared ORDER BY shared, name`
+	err := db.Select(&presets, query, userID)
+	return presets, err
+}
+
+func (db *DB) GetUserPresets(userID int) ([]models.InstructionPreset, error) {
+	var presets []models.InstructionPreset
+	query := `SELECT * FROM instruction_presets WHERE user_id = $1 ORDER BY name`
+	err := db.Select(&presets, query, userID)
+	return presets, err
+}
+
+// GetVisiblePreset возвращает пресет, если он принадлежит пользователю или
+// общий, иначе nil.
+func (db *DB) GetVisiblePreset(presetID, userID int) (*models.InstructionPreset, error) {
+	var preset models.InstructionPreset
+	query := `SELECT * FROM instruction_presets WHERE id = $1 AND (user_id = $2 OR shared)`
+	err := db.Get(&preset, query, presetID, userID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &preset, nil
+}
+
+func (db *DB) CreatePreset(userID int, name, instructions string, shared bool) (*models.InstructionPreset, error) {
+	var preset models.InstructionPreset
+	now := time.Now().UTC()
+	query := `INSERT INTO instruction_presets (user_id, name, instructions, shared, created_at, updated_at)
+              VALUES ($1, $2, $3, $4, $5, $5) RETURNING *`
+	err := db.Get(&preset, query, userID, name, instructions, shared, now)
+	if err != nil {
+		return nil, err
+	}
+	return &preset, nil
+}
+
+// UpdatePreset сохраняет изменения пресета. Менять пресет может только его
+// автор; для чужого или несуществующего пресета возвращается nil.
+func (db *DB) UpdatePreset(preset *models.InstructionPreset) (*models.InstructionPreset, error) {
+	var updated models.InstructionPreset
+	query := `UPDATE instruction_presets SET name = $1, instructions = $2, shared = $3, updated_at = $4
+              WHERE id = $5 AND user_id = $6 RETURNING *`
+	err := db.Get(&updated, query, preset.Name, preset.Instructions, preset.Shared, time.Now().UTC(), preset.ID, preset.UserID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+func (db *DB) DeletePreset(presetID, userID int) (bool, error) {
+	result, err := db.Exec(`DELETE FROM instruction_presets WHERE id = $1 AND user_id = $2`, presetID, userID)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+// UpdateUserDefaultPreset задает пресет для новых сессий. nil снимает
+// пресет по умолчанию.
+func (db *DB) UpdateUserDefaultPreset(userID int, presetID *int) error {
+	query := `UPDATE users SET default_preset_id = $1 WHERE id = $2`
+	_, err := db.Exec(query, presetID, userID)
+	return err
+}
+
+// GetUserDefaultPreset возвращает пресет по умолчанию, если он задан и все
+// еще доступен пользователю. Читаем из БД, а не из models.User: у открытого
+// WebSocket-соединения пользователь мог устареть.
+func (db *DB) GetUserDefaultPreset(userID int) (*models.InstructionPreset, error) {
+	var preset models.InstructionPreset
+	query := `SELECT p.* FROM users u JOIN instruction_presets p ON p.id = u.default_preset_id
+              WHERE u.id = $1 AND (p.user_id = u.id OR p.shared)`
+	err := db.Get(&preset, query, userID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &preset, nil
+}
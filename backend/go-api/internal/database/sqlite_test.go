@@ -0,0 +1,21 @@
+package database_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"egobackend/internal/database"
+	"egobackend/internal/database/storetest"
+)
+
+func TestSQLiteStore(t *testing.T) {
+	db, err := database.Open("sqlite://" + filepath.Join(t.TempDir(), "ego.db"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.Migrate(); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	storetest.Run(t, func(t *testing.T) database.Store { return db })
+}
@@ -0,0 +1,123 @@
+package database
+
+import (
+	"time"
+
+	"egobackend/internal/models"
+)
+
+// Интерфейсы хранилища. Их реализуют DB (PostgreSQL или SQLite) и Memory
+// (в памяти, для тестов). Все реализации проходят один набор тестов из
+// пакета storetest, поэтому поведение на границах (nil для чужих записей,
+// sql.ErrNoRows там, где его ждут обработчики) у них одинаковое.
+// Сообщения backplane сюда не входят: они нужны только PostgreSQL-бэкплейну.
+
+// UserStore — пользователи и данные, привязанные к пользователю: токены,
+// блокировки входа, память и пресеты инструкций.
+type UserStore interface {
+	CreateUser(username, hashedPassword, email string) (*models.User, error)
+	// GetUserByUsername и GetUserByEmail возвращают sql.ErrNoRows, если
+	// пользователя нет.
+	GetUserByUsername(username string) (*models.User, error)
+	GetUserByEmail(email string) (*models.User, error)
+	UpdateUserRole(userID int, newRole string) error
+	UpdateUserPassword(userID int, hashedPassword string) error
+	UpdateUserLocale(userID int, locale string) error
+	MarkEmailVerified(userID int) error
+
+	SoftDeleteUser(userID int, gracePeriod time.Duration) (*models.User, error)
+	GetUsersDueForPurge(limit int) ([]int, error)
+	HardDeleteUser(userID int) error
+
+	CreateUserToken(userID int, purpose, tokenHash string, ttl time.Duration) error
+	CheckUserToken(purpose, tokenHash string) (int, error)
+	ConsumeUserToken(purpose, tokenHash string) (int, error)
+	InvalidateUserTokens(userID int, purpose string) error
+	DeleteExpiredUserTokens() (int64, error)
+
+	SaveLoginLockout(scope, subject string, failedAttempts int, lockedUntil time.Time) error
+	GetLoginLockouts(activeOnly bool, limit int) ([]models.LoginLockout, error)
+	ClearLoginLockout(lockoutID, adminID int) (*models.LoginLockout, error)
+
+	GetUserMemories(userID int) ([]models.UserMemory, error)
+	CountUserMemories(userID int) (int, error)
+	CreateUserMemory(userID int, content, source string) (*models.UserMemory, error)
+	UpdateUserMemory(memoryID, userID int, content string) (*models.UserMemory, error)
+	DeleteUserMemory(memoryID, userID int) (bool, error)
+
+	GetVisiblePresets(userID int) ([]models.InstructionPreset, error)
+	GetUserPresets(userID int) ([]models.InstructionPreset, error)
+	GetVisiblePreset(presetID, userID int) (*models.InstructionPreset, error)
+	CreatePreset(userID int, name, instructions string, shared bool) (*models.InstructionPreset, error)
+	UpdatePreset(preset *models.InstructionPreset) (*models.InstructionPreset, error)
+	DeletePreset(presetID, userID int) (bool, error)
+	UpdateUserDefaultPreset(userID int, presetID *int) error
+	GetUserDefaultPreset(userID int) (*models.InstructionPreset, error)
+}
+
+// SessionStore — чаты пользователя и их сводки.
+type SessionStore interface {
+	GetUserSessions(userID int) ([]models.ChatSession, error)
+	DeleteSession(sessionID, userID int) (bool, error)
+	CheckSessionOwnership(sessionID, userID int) (bool, error)
+	GetOrCreateSession(sessionIDStr string, title string, userID int, mode string) (*models.ChatSession, bool, error)
+	UpdateSessionInstructions(sessionID, userID int, customInstructions string) error
+	GetSessionByID(sessionID, userID int) (*models.ChatSession, error)
+	UpdateSessionMode(sessionID, userID int, mode string) error
+	UpdateSessionTitle(sessionID, userID int, title string) error
+	SetGeneratedSessionTitle(sessionID int, title string) (*models.ChatSession, error)
+	GetSessionSummary(sessionID int) (models.SessionSummary, error)
+	// UpdateSessionSummary ничего не меняет, если версия сводки уже не version.
+	UpdateSessionSummary(sessionID int, summary string, version int, logIDs []int) error
+}
+
+// LogStore — сообщения сессий (запрос пользователя, мысли и ответ).
+type LogStore interface {
+	GetSessionHistory(sessionID int, limit int) ([]models.RequestLog, map[int][]models.FileAttachment, error)
+	GetContextHistory(sessionID int, before time.Time, limit int) ([]models.RequestLog, map[int][]models.FileAttachment, error)
+	GetAllSessionLogs(sessionID int) ([]models.RequestLog, error)
+	GetRequestLogByID(logID int64, userID int) (*models.RequestLog, error)
+	UpdateRequestLogQuery(logID int64, userID int, newQuery string) error
+	SetRequestLogPinned(logID int64, userID int, pinned bool) error
+	UpdateRequestLogResponse(logID int64, mode string, thoughtsJSON string, finalResponse string, trace []models.ThoughtStep) error
+	SaveRequestLog(logEntry *models.RequestLog) (int64, error)
+	SaveRequestLogWithFiles(logEntry *models.RequestLog, fileIDs []int64, trace []models.ThoughtStep) (int64, error)
+	GetThoughtTrace(logID int64) ([]models.ThoughtStep, error)
+}
+
+// FileStore — метаданные вложений. Сами файлы лежат в S3.
+type FileStore interface {
+	SaveFileAttachment(sessionID, userID int, fileName, fileURI, mimeType, status string) (int64, error)
+	GetRequestLogAttachments(logID int64) ([]models.FileAttachment, error)
+	GetUserFileAttachments(userID int) ([]models.FileAttachment, error)
+	// GetUserLogAttachments возвращает вложения логов пользователя по ID лога.
+	GetUserLogAttachments(userID int) (map[int][]models.FileAttachment, error)
+	GetUserFileURIs(userID int, limit int) ([]string, error)
+	DeleteFileAttachmentsByURI(uris []string) error
+	DeleteStaleUnlinkedAttachments(olderThan time.Duration, limit int) ([]string, error)
+	DeleteExpiredCommittedAttachments(olderThan time.Duration, limit int) ([]string, error)
+	FindOrphanFileURIs(uris []string) ([]string, error)
+}
+
+// FeedbackStore — оценки ответов и их сводка для администраторов.
+type FeedbackStore interface {
+	// SaveLogFeedback создает или заменяет оценку пользователя для лога.
+	SaveLogFeedback(feedback *models.LogFeedback) (*models.LogFeedback, error)
+	// GetLogFeedback возвращает оценки пользователя по ID логов.
+	GetLogFeedback(userID int, logIDs []int) (map[int]models.LogFeedback, error)
+	GetFeedbackStats(from, to time.Time) (*models.FeedbackStats, error)
+}
+
+// Store объединяет все хранилища.
+type Store interface {
+	UserStore
+	SessionStore
+	LogStore
+	FileStore
+	FeedbackStore
+}
+
+var (
+	_ Store = (*DB)(nil)
+	_ Store = (*Memory)(nil)
+)
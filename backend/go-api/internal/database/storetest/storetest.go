@@ -0,0 +1,1028 @@
+// Package storetest — общий набор тестов для реализаций database.Store.
+// Каждая реализация (PostgreSQL, SQLite, память) запускает Run со своей
+// фабрикой хранилища, поэтому их поведение проверяется одними и теми же
+// тестами.
+//
+// Тесты не рассчитывают на пустое хранилище: пользователи получают
+// уникальные имена, а глобальные выборки проверяются на вхождение. Так
+// набор можно гонять на общей тестовой БД.
+package storetest
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"egobackend/internal/database"
+	"egobackend/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// TestDatabaseEnv — переменная с адресом отдельной тестовой БД PostgreSQL.
+// Тесты создают в ней свои данные и не чистят чужие, но рабочую БД
+// указывать нельзя.
+const TestDatabaseEnv = "TEST_DATABASE_URL"
+
+var (
+	migrateOnce sync.Once
+	migrateErr  error
+)
+
+// OpenPostgres подключается к тестовой БД и один раз за прогон применяет
+// миграции. Если TEST_DATABASE_URL не задан, тест пропускается.
+func OpenPostgres(t testing.TB) *database.DB {
+	t.Helper()
+	dbURL := os.Getenv(TestDatabaseEnv)
+	if dbURL == "" {
+		t.Skipf("%s не задан, тест PostgreSQL пропущен", TestDatabaseEnv)
+	}
+	db, err := database.Open(dbURL)
+	if err != nil {
+		t.Fatalf("подключение к тестовой БД: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	migrateOnce.Do(func() { migrateErr = db.Migrate() })
+	if migrateErr != nil {
+		t.Fatalf("миграция тестовой БД: %v", migrateErr)
+	}
+	return db
+}
+
+// NewUser заводит пользователя с уникальным именем и удаляет его со всеми
+// данными в конце теста.
+func NewUser(t testing.TB, store database.UserStore) *models.User {
+	t.Helper()
+	user, err := store.CreateUser("test_"+uuid.NewString()[:12], "hash", "")
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := store.SoftDeleteUser(user.ID, 0); err == nil {
+			store.HardDeleteUser(user.ID)
+		}
+	})
+	return user
+}
+
+// Run проверяет реализацию хранилища. open вызывается в каждом подтесте.
+func Run(t *testing.T, open func(t *testing.T) database.Store) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s database.Store)
+	}{
+		{"Users", testUsers},
+		{"EmailOwnership", testEmailOwnership},
+		{"AccountDeletion", testAccountDeletion},
+		{"Tokens", testTokens},
+		{"Lockouts", testLockouts},
+		{"Memories", testMemories},
+		{"Presets", testPresets},
+		{"Sessions", testSessions},
+		{"SessionSummary", testSessionSummary},
+		{"Logs", testLogs},
+		{"ContextHistory", testContextHistory},
+		{"Files", testFiles},
+		{"UnlinkedAttachments", testUnlinkedAttachments},
+		{"ThoughtTrace", testThoughtTrace},
+		{"Feedback", testFeedback},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) { tt.fn(t, open(t)) })
+	}
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func contains[T comparable](items []T, item T) bool {
+	for _, v := range items {
+		if v == item {
+			return true
+		}
+	}
+	return false
+}
+
+func unique(prefix string) string {
+	return prefix + uuid.NewString()[:12]
+}
+
+func testUsers(t *testing.T, s database.Store) {
+	email := unique("User_") + "@Example.com"
+	user, err := s.CreateUser(unique("user_"), "hash", email)
+	must(t, err)
+	t.Cleanup(func() {
+		if _, err := s.SoftDeleteUser(user.ID, 0); err == nil {
+			s.HardDeleteUser(user.ID)
+		}
+	})
+	if user.ID == 0 || user.Role != "user" || user.EmailVerified || user.CreatedAt.IsZero() {
+		t.Errorf("new user = %+v", user)
+	}
+
+	if _, err := s.CreateUser(user.Username, "hash", ""); err == nil {
+		t.Error("duplicate username accepted")
+	}
+	if _, err := s.GetUserByUsername(unique("missing_")); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetUserByUsername(missing) err = %v, want sql.ErrNoRows", err)
+	}
+	if _, err := s.GetUserByEmail(unique("missing_") + "@example.com"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetUserByEmail(missing) err = %v, want sql.ErrNoRows", err)
+	}
+	byEmail, err := s.GetUserByEmail(user.Email.String)
+	must(t, err)
+	if byEmail.ID != user.ID {
+		t.Errorf("GetUserByEmail = %d, want %d", byEmail.ID, user.ID)
+	}
+
+	must(t, s.UpdateUserRole(user.ID, "admin"))
+	must(t, s.UpdateUserPassword(user.ID, "new-hash"))
+	must(t, s.UpdateUserLocale(user.ID, "en"))
+	must(t, s.MarkEmailVerified(user.ID))
+	got, err := s.GetUserByUsername(user.Username)
+	must(t, err)
+	if got.Role != "admin" || got.HashedPassword != "new-hash" || got.Locale.String != "en" || !got.EmailVerified || got.TokenVersion != user.TokenVersion+1 {
+		t.Errorf("updated user = %+v", got)
+	}
+	must(t, s.UpdateUserLocale(user.ID, ""))
+	got, err = s.GetUserByUsername(user.Username)
+	must(t, err)
+	if got.Locale.Valid {
+		t.Errorf("locale = %+v, want NULL", got.Locale)
+	}
+}
+
+func testEmailOwnership(t *testing.T, s database.Store) {
+	email := unique("owner_") + "@example.com"
+	newUser := func(email string) *models.User {
+		user, err := s.CreateUser(unique("user_"), "hash", email)
+		must(t, err)
+		t.Cleanup(func() {
+			if _, err := s.SoftDeleteUser(user.ID, 0); err == nil {
+				s.HardDeleteUser(user.ID)
+			}
+		})
+		return user
+	}
+
+	// Неподтвержденный адрес не занимает его.
+	squatter := newUser(email)
+	owner := newUser(strings.ToUpper(email))
+	if got, err := s.GetUserByEmail(email); err != nil || got.ID != squatter.ID {
+		t.Errorf("GetUserByEmail до подтверждения = %+v, %v; want %d", got, err, squatter.ID)
+	}
+
+	must(t, s.MarkEmailVerified(owner.ID))
+	if got, err := s.GetUserByEmail(email); err != nil || got.ID != owner.ID {
+		t.Errorf("GetUserByEmail после подтверждения = %+v, %v; want %d", got, err, owner.ID)
+	}
+	if got, err := s.GetUserByUsername(squatter.Username); err != nil || got.Email.Valid {
+		t.Errorf("адрес не снят с неподтвержденного аккаунта: %+v, %v", got, err)
+	}
+
+	late := newUser(email)
+	if err := s.MarkEmailVerified(late.ID); !errors.Is(err, database.ErrEmailTaken) {
+		t.Errorf("MarkEmailVerified(чужой подтвержденный адрес) err = %v, want ErrEmailTaken", err)
+	}
+	if got, err := s.GetUserByUsername(late.Username); err != nil || got.EmailVerified || got.Email.String != email {
+		t.Errorf("после отказа = %+v, %v", got, err)
+	}
+}
+
+func testAccountDeletion(t *testing.T, s database.Store) {
+	user := NewUser(t, s)
+	session, _, err := s.GetOrCreateSession("", "chat", user.ID, "default")
+	must(t, err)
+
+	must(t, s.HardDeleteUser(user.ID))
+	if _, err := s.GetUserByUsername(user.Username); err != nil {
+		t.Fatalf("HardDeleteUser удалил аккаунт без пометки: %v", err)
+	}
+
+	deleted, err := s.SoftDeleteUser(user.ID, time.Hour)
+	must(t, err)
+	if !deleted.DeletedAt.Valid || !deleted.PurgeAfter.Valid {
+		t.Fatalf("soft deleted user = %+v", deleted)
+	}
+	again, err := s.SoftDeleteUser(user.ID, 0)
+	must(t, err)
+	if !again.PurgeAfter.Time.Equal(deleted.PurgeAfter.Time) {
+		t.Errorf("повторное удаление сдвинуло purge_after: %v -> %v", deleted.PurgeAfter.Time, again.PurgeAfter.Time)
+	}
+	due, err := s.GetUsersDueForPurge(1000)
+	must(t, err)
+	if contains(due, user.ID) {
+		t.Error("пользователь в очереди на очистку до конца грейс-периода")
+	}
+
+	other := NewUser(t, s)
+	_, err = s.SoftDeleteUser(other.ID, 0)
+	must(t, err)
+	due, err = s.GetUsersDueForPurge(1000)
+	must(t, err)
+	if !contains(due, other.ID) {
+		t.Errorf("due = %v, want %d", due, other.ID)
+	}
+
+	must(t, s.HardDeleteUser(user.ID))
+	if _, err := s.GetUserByUsername(user.Username); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("after HardDeleteUser err = %v", err)
+	}
+	if _, err := s.GetSessionSummary(session.ID); err == nil {
+		t.Error("сессия пережила удаление пользователя")
+	}
+	if _, err := s.SoftDeleteUser(user.ID, 0); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("SoftDeleteUser(missing) err = %v, want sql.ErrNoRows", err)
+	}
+}
+
+func testTokens(t *testing.T, s database.Store) {
+	user := NewUser(t, s)
+	hash := unique("token_")
+	must(t, s.CreateUserToken(user.ID, models.TokenPurposePasswordReset, hash, time.Hour))
+	if err := s.CreateUserToken(user.ID, models.TokenPurposePasswordReset, hash, time.Hour); err == nil {
+		t.Error("duplicate token hash accepted")
+	}
+
+	if id, err := s.ConsumeUserToken(models.TokenPurposeEmailVerification, hash); err != nil || id != 0 {
+		t.Errorf("consume with wrong purpose = %d, %v", id, err)
+	}
+	if id, err := s.CheckUserToken(models.TokenPurposeEmailVerification, hash); err != nil || id != 0 {
+		t.Errorf("check with wrong purpose = %d, %v", id, err)
+	}
+	if id, err := s.CheckUserToken(models.TokenPurposePasswordReset, hash); err != nil || id != user.ID {
+		t.Errorf("check = %d, %v, want %d", id, err, user.ID)
+	}
+	if id, err := s.ConsumeUserToken(models.TokenPurposePasswordReset, hash); err != nil || id != user.ID {
+		t.Errorf("consume = %d, %v, want %d", id, err, user.ID)
+	}
+	if id, err := s.ConsumeUserToken(models.TokenPurposePasswordReset, hash); err != nil || id != 0 {
+		t.Errorf("second consume = %d, %v", id, err)
+	}
+	if id, err := s.CheckUserToken(models.TokenPurposePasswordReset, hash); err != nil || id != 0 {
+		t.Errorf("check used = %d, %v", id, err)
+	}
+
+	expired := unique("token_")
+	must(t, s.CreateUserToken(user.ID, models.TokenPurposePasswordReset, expired, -48*time.Hour))
+	if id, err := s.CheckUserToken(models.TokenPurposePasswordReset, expired); err != nil || id != 0 {
+		t.Errorf("check expired = %d, %v", id, err)
+	}
+	if id, err := s.ConsumeUserToken(models.TokenPurposePasswordReset, expired); err != nil || id != 0 {
+		t.Errorf("consume expired = %d, %v", id, err)
+	}
+	deleted, err := s.DeleteExpiredUserTokens()
+	must(t, err)
+	if deleted < 1 {
+		t.Errorf("DeleteExpiredUserTokens = %d, want >= 1", deleted)
+	}
+
+	invalidated := unique("token_")
+	must(t, s.CreateUserToken(user.ID, models.TokenPurposeEmailVerification, invalidated, time.Hour))
+	must(t, s.InvalidateUserTokens(user.ID, models.TokenPurposeEmailVerification))
+	if id, err := s.ConsumeUserToken(models.TokenPurposeEmailVerification, invalidated); err != nil || id != 0 {
+		t.Errorf("consume invalidated = %d, %v", id, err)
+	}
+}
+
+func testLockouts(t *testing.T, s database.Store) {
+	admin := NewUser(t, s)
+	subject := unique("subject_")
+	must(t, s.SaveLoginLockout("user", subject, 5, time.Now().Add(time.Hour)))
+	must(t, s.SaveLoginLockout("user", subject, 10, time.Now().Add(2*time.Hour)))
+	expiredSubject := unique("subject_")
+	must(t, s.SaveLoginLockout("user", expiredSubject, 5, time.Now().Add(-time.Hour)))
+
+	find := func(activeOnly bool, subject string) []models.LoginLockout {
+		lockouts, err := s.GetLoginLockouts(activeOnly, 1000)
+		must(t, err)
+		var found []models.LoginLockout
+		for _, l := range lockouts {
+			if l.Subject == subject {
+				found = append(found, l)
+			}
+		}
+		return found
+	}
+	active := find(true, subject)
+	if len(active) != 2 || active[0].FailedAttempts != 10 {
+		t.Fatalf("active lockouts = %+v, want newest first", active)
+	}
+	if len(find(true, expiredSubject)) != 0 || len(find(false, expiredSubject)) != 1 {
+		t.Error("истекшая блокировка отфильтрована неверно")
+	}
+
+	cleared, err := s.ClearLoginLockout(active[1].ID, admin.ID)
+	must(t, err)
+	if cleared == nil || cleared.Subject != subject {
+		t.Fatalf("cleared = %+v", cleared)
+	}
+	if len(find(true, subject)) != 0 {
+		t.Error("снятие блокировки не сняло остальные записи по тому же ключу")
+	}
+	again, err := s.ClearLoginLockout(active[1].ID, admin.ID)
+	must(t, err)
+	if again != nil {
+		t.Errorf("повторное снятие = %+v, want nil", again)
+	}
+}
+
+func testMemories(t *testing.T, s database.Store) {
+	user := NewUser(t, s)
+	other := NewUser(t, s)
+	first, err := s.CreateUserMemory(user.ID, "любит Go", models.MemorySourceUser)
+	must(t, err)
+	time.Sleep(2 * time.Millisecond)
+	second, err := s.CreateUserMemory(user.ID, "живет в Берлине", models.MemorySourceAssistant)
+	must(t, err)
+	if second.Source != models.MemorySourceAssistant || second.CreatedAt.IsZero() {
+		t.Errorf("memory = %+v", second)
+	}
+
+	memories, err := s.GetUserMemories(user.ID)
+	must(t, err)
+	if len(memories) != 2 || memories[0].ID != second.ID {
+		t.Fatalf("memories = %+v, want newest first", memories)
+	}
+	time.Sleep(2 * time.Millisecond)
+	updated, err := s.UpdateUserMemory(first.ID, user.ID, "любит Go и Rust")
+	must(t, err)
+	if updated == nil || updated.Content != "любит Go и Rust" || !updated.UpdatedAt.After(first.UpdatedAt) {
+		t.Errorf("updated = %+v", updated)
+	}
+	memories, err = s.GetUserMemories(user.ID)
+	must(t, err)
+	if memories[0].ID != first.ID {
+		t.Error("обновленная запись не поднялась наверх")
+	}
+	if foreign, err := s.UpdateUserMemory(first.ID, other.ID, "чужое"); err != nil || foreign != nil {
+		t.Errorf("update by other user = %+v, %v", foreign, err)
+	}
+
+	count, err := s.CountUserMemories(user.ID)
+	must(t, err)
+	if count != 2 {
+		t.Errorf("count = %d", count)
+	}
+	if ok, err := s.DeleteUserMemory(first.ID, other.ID); err != nil || ok {
+		t.Errorf("delete by other user = %v, %v", ok, err)
+	}
+	if ok, err := s.DeleteUserMemory(first.ID, user.ID); err != nil || !ok {
+		t.Errorf("delete = %v, %v", ok, err)
+	}
+	if ok, err := s.DeleteUserMemory(first.ID, user.ID); err != nil || ok {
+		t.Errorf("second delete = %v, %v", ok, err)
+	}
+}
+
+func testPresets(t *testing.T, s database.Store) {
+	user := NewUser(t, s)
+	admin := NewUser(t, s)
+	other := NewUser(t, s)
+	own, err := s.CreatePreset(user.ID, "Б-свой", "кратко", false)
+	must(t, err)
+	shared, err := s.CreatePreset(admin.ID, "А-общий", "подробно", true)
+	must(t, err)
+	private, err := s.CreatePreset(other.ID, "чужой", "секрет", false)
+	must(t, err)
+
+	visible, err := s.GetVisiblePresets(user.ID)
+	must(t, err)
+	var ids []int
+	for _, p := range visible {
+		ids = append(ids, p.ID)
+	}
+	if !contains(ids, own.ID) || !contains(ids, shared.ID) || contains(ids, private.ID) {
+		t.Errorf("visible = %v", ids)
+	}
+	if ids[0] != own.ID {
+		t.Errorf("собственные пресеты должны идти перед общими: %v", ids)
+	}
+	userPresets, err := s.GetUserPresets(user.ID)
+	must(t, err)
+	if len(userPresets) != 1 || userPresets[0].ID != own.ID {
+		t.Errorf("user presets = %+v", userPresets)
+	}
+	if p, err := s.GetVisiblePreset(private.ID, user.ID); err != nil || p != nil {
+		t.Errorf("GetVisiblePreset(private) = %+v, %v", p, err)
+	}
+	if p, err := s.GetVisiblePreset(shared.ID, user.ID); err != nil || p == nil {
+		t.Errorf("GetVisiblePreset(shared) = %+v, %v", p, err)
+	}
+
+	edit := *shared
+	edit.UserID = user.ID
+	edit.Name = "захват"
+	if p, err := s.UpdatePreset(&edit); err != nil || p != nil {
+		t.Errorf("update by non-owner = %+v, %v", p, err)
+	}
+	edit = *own
+	edit.Instructions = "очень кратко"
+	updated, err := s.UpdatePreset(&edit)
+	must(t, err)
+	if updated == nil || updated.Instructions != "очень кратко" {
+		t.Errorf("updated = %+v", updated)
+	}
+
+	must(t, s.UpdateUserDefaultPreset(user.ID, &shared.ID))
+	def, err := s.GetUserDefaultPreset(user.ID)
+	must(t, err)
+	if def == nil || def.ID != shared.ID {
+		t.Errorf("default = %+v", def)
+	}
+	unshare := *shared
+	unshare.Shared = false
+	_, err = s.UpdatePreset(&unshare)
+	must(t, err)
+	if def, err := s.GetUserDefaultPreset(user.ID); err != nil || def != nil {
+		t.Errorf("default after unshare = %+v, %v", def, err)
+	}
+
+	must(t, s.UpdateUserDefaultPreset(user.ID, &own.ID))
+	if ok, err := s.DeletePreset(own.ID, other.ID); err != nil || ok {
+		t.Errorf("delete by other user = %v, %v", ok, err)
+	}
+	if ok, err := s.DeletePreset(own.ID, user.ID); err != nil || !ok {
+		t.Errorf("delete = %v, %v", ok, err)
+	}
+	if def, err := s.GetUserDefaultPreset(user.ID); err != nil || def != nil {
+		t.Errorf("default after delete = %+v, %v", def, err)
+	}
+	got, err := s.GetUserByUsername(user.Username)
+	must(t, err)
+	if got.DefaultPreset.Valid {
+		t.Errorf("default_preset_id = %v, want NULL", got.DefaultPreset)
+	}
+	must(t, s.UpdateUserDefaultPreset(user.ID, nil))
+}
+
+func testSessions(t *testing.T, s database.Store) {
+	user := NewUser(t, s)
+	other := NewUser(t, s)
+
+	first, created, err := s.GetOrCreateSession("", "Первый", user.ID, "default")
+	must(t, err)
+	if !created || first.ID == 0 || first.Title != "Первый" || first.Mode != "default" || first.CustomInstructions != nil {
+		t.Fatalf("created session = %+v, %v", first, created)
+	}
+	time.Sleep(2 * time.Millisecond)
+	second, created, err := s.GetOrCreateSession("new", "Второй", user.ID, "research")
+	must(t, err)
+	if !created {
+		t.Error("session_id=new не создал сессию")
+	}
+	existing, created, err := s.GetOrCreateSession(strconv.Itoa(first.ID), "игнор", user.ID, "deeper")
+	must(t, err)
+	if created || existing.ID != first.ID || existing.Title != "Первый" {
+		t.Errorf("existing = %+v, %v", existing, created)
+	}
+	foreign, created, err := s.GetOrCreateSession(strconv.Itoa(first.ID), "Чужой", other.ID, "default")
+	must(t, err)
+	if !created || foreign.ID == first.ID {
+		t.Errorf("чужая сессия вернулась другому пользователю: %+v", foreign)
+	}
+	if _, _, err := s.GetOrCreateSession("abc", "x", user.ID, "default"); err == nil {
+		t.Error("неверный session_id принят")
+	}
+
+	sessions, err := s.GetUserSessions(user.ID)
+	must(t, err)
+	if len(sessions) != 2 || sessions[0].ID != second.ID {
+		t.Fatalf("sessions = %+v, want newest first", sessions)
+	}
+	if ok, err := s.CheckSessionOwnership(first.ID, other.ID); err != nil || ok {
+		t.Errorf("ownership by other = %v, %v", ok, err)
+	}
+	if ok, err := s.CheckSessionOwnership(first.ID, user.ID); err != nil || !ok {
+		t.Errorf("ownership = %v, %v", ok, err)
+	}
+	if got, err := s.GetSessionByID(first.ID, other.ID); err != nil || got != nil {
+		t.Errorf("GetSessionByID(other) = %+v, %v", got, err)
+	}
+
+	must(t, s.UpdateSessionInstructions(first.ID, user.ID, "на ты"))
+	must(t, s.UpdateSessionMode(first.ID, user.ID, "deeper"))
+	must(t, s.UpdateSessionInstructions(first.ID, other.ID, "чужие"))
+	got, err := s.GetSessionByID(first.ID, user.ID)
+	must(t, err)
+	if got.CustomInstructions == nil || *got.CustomInstructions != "на ты" || got.Mode != "deeper" {
+		t.Errorf("session = %+v", got)
+	}
+
+	titled, err := s.SetGeneratedSessionTitle(first.ID, "Сгенерированное")
+	must(t, err)
+	if titled == nil || titled.Title != "Сгенерированное" {
+		t.Errorf("generated title = %+v", titled)
+	}
+	must(t, s.UpdateSessionTitle(first.ID, user.ID, "Мое"))
+	if titled, err := s.SetGeneratedSessionTitle(first.ID, "Новое"); err != nil || titled != nil {
+		t.Errorf("generated title after rename = %+v, %v", titled, err)
+	}
+	got, err = s.GetSessionByID(first.ID, user.ID)
+	must(t, err)
+	if got.Title != "Мое" {
+		t.Errorf("title = %q", got.Title)
+	}
+
+	logID, err := s.SaveRequestLog(&models.RequestLog{SessionID: first.ID, UserQuery: "q", Timestamp: time.Now().UTC()})
+	must(t, err)
+	if deleted, err := s.DeleteSession(first.ID, other.ID); err != nil || deleted {
+		t.Errorf("DeleteSession(чужая) = %v, %v", deleted, err)
+	}
+	if ok, _ := s.CheckSessionOwnership(first.ID, user.ID); !ok {
+		t.Fatal("чужой пользователь удалил сессию")
+	}
+	if deleted, err := s.DeleteSession(first.ID, user.ID); err != nil || !deleted {
+		t.Errorf("DeleteSession = %v, %v", deleted, err)
+	}
+	if deleted, err := s.DeleteSession(first.ID, user.ID); err != nil || deleted {
+		t.Errorf("повторный DeleteSession = %v, %v", deleted, err)
+	}
+	if got, err := s.GetSessionByID(first.ID, user.ID); err != nil || got != nil {
+		t.Errorf("after delete = %+v, %v", got, err)
+	}
+	if l, err := s.GetRequestLogByID(logID, user.ID); err != nil || l != nil {
+		t.Errorf("лог пережил удаление сессии: %+v, %v", l, err)
+	}
+}
+
+func testSessionSummary(t *testing.T, s database.Store) {
+	user := NewUser(t, s)
+	session, _, err := s.GetOrCreateSession("", "chat", user.ID, "default")
+	must(t, err)
+	other, _, err := s.GetOrCreateSession("", "other", user.ID, "default")
+	must(t, err)
+	ids := saveLogs(t, s, session.ID, "один", "два", "три")
+	foreign := saveLogs(t, s, other.ID, "чужой")
+
+	summary, err := s.GetSessionSummary(session.ID)
+	must(t, err)
+	if summary.Summary != "" || summary.Version != 0 || len(summary.LogIDs) != 0 {
+		t.Errorf("initial summary = %+v", summary)
+	}
+	must(t, s.UpdateSessionSummary(session.ID, "один и три", 0, []int{int(ids[2]), int(ids[0]), int(foreign[0])}))
+	// Обновление, начатое с той же версии, опоздало и ничего не меняет.
+	must(t, s.UpdateSessionSummary(session.ID, "два", 0, []int{int(ids[1])}))
+	summary, err = s.GetSessionSummary(session.ID)
+	must(t, err)
+	if summary.Summary != "один и три" || summary.Version != 1 || !slices.Equal(summary.LogIDs, []int{int(ids[0]), int(ids[2])}) {
+		t.Errorf("summary = %+v, want один и три, version 1, logs %d и %d", summary, ids[0], ids[2])
+	}
+
+	must(t, s.UpdateSessionSummary(session.ID, "все", 1, []int{int(ids[1])}))
+	summary, err = s.GetSessionSummary(session.ID)
+	must(t, err)
+	if summary.Summary != "все" || summary.Version != 2 || len(summary.LogIDs) != 3 {
+		t.Errorf("summary = %+v, want все, version 2, 3 logs", summary)
+	}
+	if _, err := s.GetSessionSummary(-1); err == nil {
+		t.Error("GetSessionSummary(missing) без ошибки")
+	}
+}
+
+// saveLogs сохраняет логи с шагом в секунду, чтобы порядок не зависел от
+// точности часов.
+func saveLogs(t *testing.T, s database.Store, sessionID int, queries ...string) []int64 {
+	t.Helper()
+	base := time.Now().UTC().Add(-time.Hour)
+	var ids []int64
+	for i, q := range queries {
+		response := "ответ на " + q
+		id, err := s.SaveRequestLog(&models.RequestLog{
+			SessionID: sessionID, UserQuery: q, EgoThoughtsJSON: "[]", FinalResponse: &response,
+			PromptTokens: 1, CompletionTokens: 2, TotalTokens: 3,
+			Timestamp: base.Add(time.Duration(i) * time.Second),
+		})
+		must(t, err)
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func testLogs(t *testing.T, s database.Store) {
+	user := NewUser(t, s)
+	other := NewUser(t, s)
+	session, _, err := s.GetOrCreateSession("", "chat", user.ID, "default")
+	must(t, err)
+	ids := saveLogs(t, s, session.ID, "один", "два", "три")
+
+	if _, err := s.SaveRequestLog(&models.RequestLog{SessionID: -1, UserQuery: "q", Timestamp: time.Now()}); err == nil {
+		t.Error("лог без сессии сохранен")
+	}
+
+	entry, err := s.GetRequestLogByID(ids[0], user.ID)
+	must(t, err)
+	if entry == nil || entry.UserQuery != "один" || entry.TotalTokens != 3 || entry.Pinned || *entry.FinalResponse != "ответ на один" {
+		t.Fatalf("log = %+v", entry)
+	}
+	if foreign, err := s.GetRequestLogByID(ids[0], other.ID); err != nil || foreign != nil {
+		t.Errorf("GetRequestLogByID(other) = %+v, %v", foreign, err)
+	}
+
+	must(t, s.UpdateRequestLogQuery(ids[0], other.ID, "чужое"))
+	must(t, s.SetRequestLogPinned(ids[0], other.ID, true))
+	must(t, s.UpdateRequestLogQuery(ids[0], user.ID, "один (правка)"))
+	must(t, s.SetRequestLogPinned(ids[0], user.ID, true))
+	entry, err = s.GetRequestLogByID(ids[0], user.ID)
+	must(t, err)
+	if entry.UserQuery != "один (правка)" || !entry.Pinned {
+		t.Errorf("log = %+v", entry)
+	}
+
+	history, _, err := s.GetSessionHistory(session.ID, 2)
+	must(t, err)
+	if len(history) != 2 || history[0].UserQuery != "два" || history[1].UserQuery != "три" {
+		t.Errorf("history = %+v, want последние два по возрастанию", history)
+	}
+
+	before := time.Now().UTC()
+	must(t, s.UpdateRequestLogResponse(ids[0], "default", `[{"type":"thought"}]`, "новый ответ", nil))
+	all, err := s.GetAllSessionLogs(session.ID)
+	must(t, err)
+	if len(all) != 3 {
+		t.Fatalf("all logs = %d", len(all))
+	}
+	last := all[len(all)-1]
+	if int64(last.ID) != ids[0] || *last.FinalResponse != "новый ответ" || last.EgoThoughtsJSON != `[{"type":"thought"}]` {
+		t.Errorf("регенерированный лог должен стать последним: %+v", all)
+	}
+	if last.Timestamp.Before(before.Add(-time.Second)) {
+		t.Errorf("timestamp не обновлен: %v", last.Timestamp)
+	}
+}
+
+func testContextHistory(t *testing.T, s database.Store) {
+	user := NewUser(t, s)
+	session, _, err := s.GetOrCreateSession("", "chat", user.ID, "default")
+	must(t, err)
+	ids := saveLogs(t, s, session.ID, "1", "2", "3", "4", "5")
+	must(t, s.SetRequestLogPinned(ids[0], user.ID, true))
+
+	queries := func(logs []models.RequestLog) []string {
+		var q []string
+		for _, l := range logs {
+			q = append(q, l.UserQuery)
+		}
+		return q
+	}
+	logs, attachments, err := s.GetContextHistory(session.ID, time.Time{}, 2)
+	must(t, err)
+	if got := queries(logs); len(got) != 3 || got[0] != "1" || got[1] != "4" || got[2] != "5" {
+		t.Errorf("context = %v, want [1 4 5]", got)
+	}
+	if attachments == nil {
+		t.Error("attachments map is nil")
+	}
+
+	fourth, err := s.GetRequestLogByID(ids[3], user.ID)
+	must(t, err)
+	logs, _, err = s.GetContextHistory(session.ID, fourth.Timestamp, 2)
+	must(t, err)
+	if got := queries(logs); len(got) != 3 || got[0] != "1" || got[1] != "2" || got[2] != "3" {
+		t.Errorf("context before 4 = %v, want [1 2 3]", got)
+	}
+}
+
+func testFiles(t *testing.T, s database.Store) {
+	user := NewUser(t, s)
+	session, _, err := s.GetOrCreateSession("", "chat", user.ID, "default")
+	must(t, err)
+	uriA, uriB := unique("a_")+".png", unique("b_")+".txt"
+	fileA, err := s.SaveFileAttachment(session.ID, user.ID, "a.png", uriA, "image/png", models.AttachmentStatusPending)
+	must(t, err)
+	fileB, err := s.SaveFileAttachment(session.ID, user.ID, "b.txt", uriB, "text/plain", models.AttachmentStatusPending)
+	must(t, err)
+	if _, err := s.SaveFileAttachment(session.ID, user.ID, "dup.png", uriA, "image/png", models.AttachmentStatusPending); err == nil {
+		t.Error("duplicate file_uri accepted")
+	}
+
+	// Порядок вложений — порядок в запросе, а не порядок ID.
+	logID, err := s.SaveRequestLogWithFiles(&models.RequestLog{SessionID: session.ID, UserQuery: "файлы", Timestamp: time.Now().UTC()}, []int64{fileB, fileA}, nil)
+	must(t, err)
+
+	attachments, err := s.GetRequestLogAttachments(logID)
+	must(t, err)
+	if len(attachments) != 2 || attachments[0].ID != fileB || attachments[1].ID != fileA {
+		t.Fatalf("attachments = %+v, want [%d %d]", attachments, fileB, fileA)
+	}
+	for _, a := range attachments {
+		if a.Status != models.AttachmentStatusCommitted || a.UserID != user.ID || a.SessionID != session.ID {
+			t.Errorf("attachment = %+v", a)
+		}
+	}
+	plainLog, err := s.SaveRequestLog(&models.RequestLog{SessionID: session.ID, UserQuery: "без файлов", Timestamp: time.Now().UTC()})
+	must(t, err)
+	if empty, err := s.GetRequestLogAttachments(plainLog); err != nil || empty == nil || len(empty) != 0 {
+		t.Errorf("GetRequestLogAttachments(без файлов) = %#v, %v", empty, err)
+	}
+
+	history, byLog, err := s.GetSessionHistory(session.ID, 10)
+	must(t, err)
+	if len(history) != 2 || len(byLog[int(logID)]) != 2 || byLog[int(logID)][0].ID != fileB || len(byLog[int(plainLog)]) != 0 {
+		t.Errorf("history attachments = %+v", byLog)
+	}
+
+	userFiles, err := s.GetUserFileAttachments(user.ID)
+	must(t, err)
+	if len(userFiles) != 2 || userFiles[0].ID != fileA {
+		t.Errorf("user files = %+v", userFiles)
+	}
+	uris, err := s.GetUserFileURIs(user.ID, 1)
+	must(t, err)
+	if len(uris) != 1 || uris[0] != uriA {
+		t.Errorf("uris = %v", uris)
+	}
+
+	must(t, s.DeleteFileAttachmentsByURI([]string{uriA}))
+	must(t, s.DeleteFileAttachmentsByURI(nil))
+	if attachments, err := s.GetRequestLogAttachments(logID); err != nil || len(attachments) != 1 || attachments[0].ID != fileB {
+		t.Errorf("после удаления файла лог ссылается на %+v, %v", attachments, err)
+	}
+	userFiles, err = s.GetUserFileAttachments(user.ID)
+	must(t, err)
+	if len(userFiles) != 1 || userFiles[0].FileURI != uriB {
+		t.Errorf("after delete = %+v", userFiles)
+	}
+}
+
+func testThoughtTrace(t *testing.T, s database.Store) {
+	user := NewUser(t, s)
+	session, _, err := s.GetOrCreateSession("", "chat", user.ID, "default")
+	must(t, err)
+	str := func(v string) *string { return &v }
+	confidence := 0.8
+	trace := []models.ThoughtStep{
+		{Position: 7, Iteration: 1, Kind: models.ThoughtStepThought, Header: str("Поиск"), Content: str("нужно поискать"), Confidence: &confidence, DurationMS: 120},
+		{Iteration: 1, Kind: models.ThoughtStepToolOutput, ToolName: str("Search"), Query: str("Go"), Output: str("результат"), DurationMS: 40},
+		{Iteration: 2, Kind: models.ThoughtStepToolError, ToolName: str("Search"), Query: str("Rust"), Error: str("таймаут")},
+	}
+	logID, err := s.SaveRequestLogWithFiles(&models.RequestLog{SessionID: session.ID, UserQuery: "трасса", Timestamp: time.Now().UTC()}, nil, trace)
+	must(t, err)
+
+	steps, err := s.GetThoughtTrace(logID)
+	must(t, err)
+	if len(steps) != 3 {
+		t.Fatalf("steps = %+v", steps)
+	}
+	for i, step := range steps {
+		if step.Position != i {
+			t.Errorf("steps[%d].Position = %d, шаги нумеруются по порядку", i, step.Position)
+		}
+	}
+	first, tool, failed := steps[0], steps[1], steps[2]
+	if first.Kind != models.ThoughtStepThought || *first.Header != "Поиск" || *first.Content != "нужно поискать" || first.Confidence == nil || *first.Confidence != 0.8 || first.DurationMS != 120 || first.ToolName != nil {
+		t.Errorf("thought step = %+v", first)
+	}
+	if tool.Iteration != 1 || *tool.ToolName != "Search" || *tool.Query != "Go" || *tool.Output != "результат" || tool.Error != nil || tool.Confidence != nil {
+		t.Errorf("tool step = %+v", tool)
+	}
+	if failed.Iteration != 2 || failed.Kind != models.ThoughtStepToolError || *failed.Error != "таймаут" || failed.Output != nil {
+		t.Errorf("tool error step = %+v", failed)
+	}
+
+	// Регенерация заменяет трассу целиком.
+	must(t, s.UpdateRequestLogResponse(logID, "default", "[]", "заново", trace[:1]))
+	steps, err = s.GetThoughtTrace(logID)
+	must(t, err)
+	if len(steps) != 1 || steps[0].Kind != models.ThoughtStepThought {
+		t.Errorf("после регенерации steps = %+v", steps)
+	}
+
+	plainLog, err := s.SaveRequestLog(&models.RequestLog{SessionID: session.ID, UserQuery: "без трассы", Timestamp: time.Now().UTC()})
+	must(t, err)
+	if empty, err := s.GetThoughtTrace(plainLog); err != nil || empty == nil || len(empty) != 0 {
+		t.Errorf("GetThoughtTrace(без трассы) = %#v, %v", empty, err)
+	}
+
+	_, err = s.DeleteSession(session.ID, user.ID)
+	must(t, err)
+	if steps, err := s.GetThoughtTrace(logID); err != nil || len(steps) != 0 {
+		t.Errorf("трасса пережила удаление сессии: %+v, %v", steps, err)
+	}
+}
+
+func testFeedback(t *testing.T, s database.Store) {
+	user, other := NewUser(t, s), NewUser(t, s)
+	sessionMode, logMode := unique("mode_"), unique("mode_")
+	wiki, search := unique("Wiki_"), unique("Search_")
+	session, _, err := s.GetOrCreateSession("", "chat", user.ID, sessionMode)
+	must(t, err)
+	trace := []models.ThoughtStep{
+		{Iteration: 1, Kind: models.ThoughtStepThought},
+		{Iteration: 1, Kind: models.ThoughtStepToolOutput, ToolName: &wiki},
+		{Iteration: 1, Kind: models.ThoughtStepToolError, ToolName: &search},
+		{Iteration: 2, Kind: models.ThoughtStepToolOutput, ToolName: &wiki},
+	}
+	withTools, err := s.SaveRequestLogWithFiles(&models.RequestLog{SessionID: session.ID, UserQuery: "с инструментами", Mode: &logMode, Timestamp: time.Now().UTC()}, nil, trace)
+	must(t, err)
+	// Лог без режима считается в режиме сессии.
+	plain, err := s.SaveRequestLog(&models.RequestLog{SessionID: session.ID, UserQuery: "без инструментов", Timestamp: time.Now().UTC()})
+	must(t, err)
+	unrated, err := s.SaveRequestLog(&models.RequestLog{SessionID: session.ID, UserQuery: "без оценки", Timestamp: time.Now().UTC()})
+	must(t, err)
+
+	from, to := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	before, err := s.GetFeedbackStats(from, to)
+	must(t, err)
+
+	comment := "слишком длинно"
+	first, err := s.SaveLogFeedback(&models.LogFeedback{RequestLogID: int(withTools), UserID: user.ID, Rating: models.FeedbackPositive, Reasons: []string{"helpful", "accurate"}})
+	must(t, err)
+	if first.RequestLogID != int(withTools) || first.Rating != 1 || first.Comment != nil || !reflect.DeepEqual(first.Reasons, []string{"accurate", "helpful"}) {
+		t.Errorf("feedback = %+v", first)
+	}
+	updated, err := s.SaveLogFeedback(&models.LogFeedback{RequestLogID: int(withTools), UserID: user.ID, Rating: models.FeedbackNegative, Comment: &comment, Reasons: []string{"too_long"}})
+	must(t, err)
+	if updated.ID != first.ID || !updated.CreatedAt.Equal(first.CreatedAt) || updated.UpdatedAt.Before(first.UpdatedAt) || updated.Rating != -1 || *updated.Comment != comment {
+		t.Errorf("повторная оценка должна заменить первую: %+v -> %+v", first, updated)
+	}
+	_, err = s.SaveLogFeedback(&models.LogFeedback{RequestLogID: int(plain), UserID: user.ID, Rating: models.FeedbackPositive})
+	must(t, err)
+	_, err = s.SaveLogFeedback(&models.LogFeedback{RequestLogID: int(withTools), UserID: other.ID, Rating: models.FeedbackNegative, Reasons: []string{"too_long", "incorrect"}})
+	must(t, err)
+	if _, err := s.SaveLogFeedback(&models.LogFeedback{RequestLogID: int(plain), UserID: other.ID, Rating: 1, Reasons: []string{"other", "other"}}); err == nil {
+		t.Error("повторяющиеся причины приняты")
+	}
+
+	feedback, err := s.GetLogFeedback(user.ID, []int{int(withTools), int(plain), int(unrated)})
+	must(t, err)
+	if len(feedback) != 2 {
+		t.Fatalf("feedback = %+v", feedback)
+	}
+	if f := feedback[int(withTools)]; f.Rating != -1 || f.Comment == nil || *f.Comment != comment || !reflect.DeepEqual(f.Reasons, []string{"too_long"}) || f.UserID != user.ID {
+		t.Errorf("feedback[withTools] = %+v", f)
+	}
+	if f := feedback[int(plain)]; f.Rating != 1 || f.Comment != nil || f.Reasons == nil || len(f.Reasons) != 0 {
+		t.Errorf("feedback[plain] = %#v", f)
+	}
+	if empty, err := s.GetLogFeedback(user.ID, nil); err != nil || empty == nil || len(empty) != 0 {
+		t.Errorf("GetLogFeedback(nil) = %#v, %v", empty, err)
+	}
+
+	after, err := s.GetFeedbackStats(from, to)
+	must(t, err)
+	if got := subCounts(after.Total, before.Total); got != (models.FeedbackCounts{Total: 3, Positive: 1, Negative: 2}) {
+		t.Errorf("total = %+v", got)
+	}
+	byMode := make(map[string]models.FeedbackCounts)
+	for _, m := range after.ByMode {
+		byMode[m.Mode] = m.FeedbackCounts
+	}
+	if byMode[logMode] != (models.FeedbackCounts{Total: 2, Negative: 2}) || byMode[sessionMode] != (models.FeedbackCounts{Total: 1, Positive: 1}) {
+		t.Errorf("by mode = %+v", after.ByMode)
+	}
+	byTool := make(map[string]models.FeedbackCounts)
+	for _, tool := range after.ByTool {
+		byTool[tool.Tool] = tool.FeedbackCounts
+	}
+	if byTool[wiki] != (models.FeedbackCounts{Total: 2, Negative: 2}) || byTool[search] != (models.FeedbackCounts{Total: 2, Negative: 2}) {
+		t.Errorf("by tool = %+v", after.ByTool)
+	}
+	if got := subCounts(findTool(after, ""), findTool(before, "")); got != (models.FeedbackCounts{Total: 1, Positive: 1}) {
+		t.Errorf("без инструментов = %+v", got)
+	}
+	if got := subCounts(findReason(after, "too_long"), findReason(before, "too_long")); got != (models.FeedbackCounts{Total: 2, Negative: 2}) {
+		t.Errorf("too_long = %+v", got)
+	}
+	if got := subCounts(findReason(after, "accurate"), findReason(before, "accurate")); got.Total != 0 {
+		t.Errorf("причины замененной оценки остались в статистике: %+v", got)
+	}
+	for i := 1; i < len(after.ByMode); i++ {
+		if after.ByMode[i].Total > after.ByMode[i-1].Total {
+			t.Errorf("by mode не отсортирован по числу оценок: %+v", after.ByMode)
+		}
+	}
+
+	future, err := s.GetFeedbackStats(to, to.Add(time.Hour))
+	must(t, err)
+	if future.Total.Total != 0 || future.ByMode == nil || len(future.ByMode) != 0 || future.ByTool == nil || future.Reasons == nil {
+		t.Errorf("пустое окно = %#v", future)
+	}
+
+	// Регенерация заменяет ответ, и старые оценки к нему больше не относятся.
+	must(t, s.UpdateRequestLogResponse(withTools, sessionMode, "[]", "новый ответ", nil))
+	feedback, err = s.GetLogFeedback(other.ID, []int{int(withTools)})
+	must(t, err)
+	if len(feedback) != 0 {
+		t.Errorf("оценка пережила регенерацию: %+v", feedback)
+	}
+	regenerated, err := s.GetRequestLogByID(withTools, user.ID)
+	must(t, err)
+	if regenerated.Mode == nil || *regenerated.Mode != sessionMode {
+		t.Errorf("mode после регенерации = %v", regenerated.Mode)
+	}
+
+	_, err = s.DeleteSession(session.ID, user.ID)
+	must(t, err)
+	feedback, err = s.GetLogFeedback(user.ID, []int{int(plain)})
+	must(t, err)
+	if len(feedback) != 0 {
+		t.Errorf("оценка пережила удаление сессии: %+v", feedback)
+	}
+}
+
+func subCounts(a, b models.FeedbackCounts) models.FeedbackCounts {
+	return models.FeedbackCounts{Total: a.Total - b.Total, Positive: a.Positive - b.Positive, Negative: a.Negative - b.Negative}
+}
+
+func findTool(stats *models.FeedbackStats, tool string) models.FeedbackCounts {
+	for _, t := range stats.ByTool {
+		if t.Tool == tool {
+			return t.FeedbackCounts
+		}
+	}
+	return models.FeedbackCounts{}
+}
+
+func findReason(stats *models.FeedbackStats, reason string) models.FeedbackCounts {
+	for _, r := range stats.Reasons {
+		if r.Reason == reason {
+			return r.FeedbackCounts
+		}
+	}
+	return models.FeedbackCounts{}
+}
+
+func testUnlinkedAttachments(t *testing.T, s database.Store) {
+	user := NewUser(t, s)
+	session, _, err := s.GetOrCreateSession("", "chat", user.ID, "default")
+	must(t, err)
+	pendingURI, committedURI := unique("p_")+".png", unique("c_")+".png"
+	_, err = s.SaveFileAttachment(session.ID, user.ID, "p.png", pendingURI, "image/png", models.AttachmentStatusPending)
+	must(t, err)
+	committed, err := s.SaveFileAttachment(session.ID, user.ID, "c.png", committedURI, "image/png", models.AttachmentStatusPending)
+	must(t, err)
+	firstLog, err := s.SaveRequestLogWithFiles(&models.RequestLog{SessionID: session.ID, UserQuery: "1", Timestamp: time.Now().UTC()}, []int64{committed}, nil)
+	must(t, err)
+	// Сохраненный файл можно приложить к следующему сообщению, а чужой и
+	// несуществующий пропускаются.
+	other := NewUser(t, s)
+	otherSession, _, err := s.GetOrCreateSession("", "chat", other.ID, "default")
+	must(t, err)
+	foreign, err := s.SaveFileAttachment(otherSession.ID, other.ID, "f.png", unique("f_")+".png", "image/png", models.AttachmentStatusPending)
+	must(t, err)
+	secondLog, err := s.SaveRequestLogWithFiles(&models.RequestLog{SessionID: session.ID, UserQuery: "2", Timestamp: time.Now().UTC()}, []int64{committed, foreign, -1, committed}, nil)
+	must(t, err)
+	for _, logID := range []int64{firstLog, secondLog} {
+		files, err := s.GetRequestLogAttachments(logID)
+		must(t, err)
+		if len(files) != 1 || files[0].ID != committed || files[0].Status != models.AttachmentStatusCommitted {
+			t.Errorf("вложения лога %d = %+v, want [%d]", logID, files, committed)
+		}
+	}
+	byLog, err := s.GetUserLogAttachments(user.ID)
+	must(t, err)
+	if len(byLog) != 2 || len(byLog[int(firstLog)]) != 1 || len(byLog[int(secondLog)]) != 1 {
+		t.Errorf("GetUserLogAttachments = %+v", byLog)
+	}
+	if byLog, err := s.GetUserLogAttachments(other.ID); err != nil || len(byLog) != 0 {
+		t.Errorf("чужой файл привязан: %+v, %v", byLog, err)
+	}
+
+	fresh, err := s.DeleteStaleUnlinkedAttachments(time.Hour, 1000)
+	must(t, err)
+	if contains(fresh, pendingURI) {
+		t.Error("свежее вложение удалено до истечения срока")
+	}
+	stale, err := s.DeleteStaleUnlinkedAttachments(-time.Minute, 1000)
+	must(t, err)
+	if !contains(stale, pendingURI) || contains(stale, committedURI) {
+		t.Errorf("stale = %v, want %s без %s", stale, pendingURI, committedURI)
+	}
+
+	missing := unique("m_") + ".png"
+	orphans, err := s.FindOrphanFileURIs([]string{pendingURI, committedURI, missing})
+	must(t, err)
+	if len(orphans) != 2 || orphans[0] != pendingURI || orphans[1] != missing {
+		t.Errorf("orphans = %v", orphans)
+	}
+	if orphans, err := s.FindOrphanFileURIs(nil); err != nil || len(orphans) != 0 {
+		t.Errorf("FindOrphanFileURIs(nil) = %v, %v", orphans, err)
+	}
+
+	kept, err := s.DeleteExpiredCommittedAttachments(time.Hour, 1000)
+	must(t, err)
+	if contains(kept, committedURI) {
+		t.Error("сохраненное вложение удалено до истечения срока хранения")
+	}
+	expired, err := s.DeleteExpiredCommittedAttachments(-time.Minute, 1000)
+	must(t, err)
+	if !contains(expired, committedURI) {
+		t.Errorf("expired = %v, want %s", expired, committedURI)
+	}
+	if files, err := s.GetRequestLogAttachments(firstLog); err != nil || len(files) != 0 {
+		t.Errorf("после истечения срока у лога остались вложения: %+v, %v", files, err)
+	}
+}
@@ -0,0 +1,58 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+func (db *DB) CreateUserToken(userID int, purpose, tokenHash string, ttl time.Duration) error {
+	now := time.Now().UTC()
+	query := `INSERT INTO user_tokens (user_id, purpose, token_hash, expires_at, created_at)
+              VALUES ($1, $2, $3, $4, $5)`
+	_, err := db.Exec(query, userID, purpose, tokenHash, now.Add(ttl), now)
+	return err
+}
+
+// CheckUserToken возвращает владельца действующего токена, не тратя его.
+// Для недействительного токена — (0, nil), как у ConsumeUserToken.
+func (db *DB) CheckUserToken(purpose, tokenHash string) (int, error) {
+	query := `SELECT user_id FROM user_tokens
+              WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > $3`
+	var userID int
+	err := db.Get(&userID, query, tokenHash, purpose, time.Now().UTC())
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return userID, err
+}
+
+// ConsumeUserToken атомарно помечает токен использованным и возвращает
+// владельца. Просроченный, чужой по назначению или уже использованный
+// токен дает (0, nil).
+func (db *DB) ConsumeUserToken(purpose, tokenHash string) (int, error) {
+	now := time.Now().UTC()
+	query := `UPDATE user_tokens SET used_at = $1
+              WHERE token_hash = $2 AND purpose = $3 AND used_at IS NULL AND expires_at > $1
+              RETURNING user_id`
+	var userID int
+	err := db.Get(&userID, query, now, tokenHash, purpose)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return userID, err
+}
+
+func (db *DB) InvalidateUserTokens(userID int, purpose string) error {
+	query := `UPDATE user_tokens SET used_at = $1 WHERE user_id = $2 AND purpose = $3 AND used_at IS NULL`
+	_, err := db.Exec(query, time.Now().UTC(), userID, purpose)
+	return err
+}
+
+func (db *DB) DeleteExpiredUserTokens() (int64, error) {
+	query := `DELETE FROM user_tokens WHERE expires_at < $1 OR used_at < $1`
+	res, err := db.Exec(query, time.Now().UTC().Add(-24*time.Hour))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -1,14 +1,21 @@
 package database
 
 import (
+	"context"
+	"database/sql"
 	"egobackend/internal/models"
+	"errors"
 )
 
-func (db *DB) CreateUser(username, hashedPassword string) (*models.User, error) {
-	query := `INSERT INTO users (username, hashed_password) VALUES ($1, $2) RETURNING *`
+// ErrEmailTaken возвращает MarkEmailVerified, если адрес уже подтвержден
+// другим пользователем.
+var ErrEmailTaken = errors.New("email уже подтвержден другим пользователем")
+
+func (db *DB) CreateUser(username, hashedPassword, email string) (*models.User, error) {
+	query := `INSERT INTO users (username, hashed_password, email) VALUES ($1, $2, $3) RETURNING *`
 
 	var newUser models.User
-	err := db.Get(&newUser, query, username, hashedPassword)
+	err := db.Get(&newUser, query, username, hashedPassword, sql.NullString{String: email, Valid: email != ""})
 	if err != nil {
 		return nil, err
 	}
@@ -33,3 +40,70 @@ func (db *DB) UpdateUserRole(userID int, newRole string) error {
 	_, err := db.Exec(query, newRole, userID)
 	return err
 }
+
+// GetUserByEmail ищет владельца адреса. Неподтвержденный адрес может быть
+// указан у нескольких пользователей, поэтому подтвержденный идет первым.
+func (db *DB) GetUserByEmail(email string) (*models.User, error) {
+	var user models.User
+	query := `SELECT * FROM users WHERE LOWER(email) = LOWER($1)
+              ORDER BY email_verified DESC, id LIMIT 1`
+
+	err := db.Get(&user, query, email)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// UpdateUserPassword меняет хеш и увеличивает версию токенов, поэтому все
+// выданные раньше JWT пользователя становятся недействительными.
+func (db *DB) UpdateUserPassword(userID int, hashedPassword string) error {
+	query := `UPDATE users SET hashed_password = $1, token_version = token_version + 1 WHERE id = $2`
+	_, err := db.Exec(query, hashedPassword, userID)
+	return err
+}
+
+// UpdateUserLocale сохраняет язык интерфейса. Пустая строка сбрасывает
+// настройку, и язык снова берется из браузера.
+func (db *DB) UpdateUserLocale(userID int, locale string) error {
+	query := `UPDATE users SET locale = NULLIF($1, '') WHERE id = $2`
+	_, err := db.Exec(query, locale, userID)
+	return err
+}
+
+// MarkEmailVerified подтверждает адрес пользователя и снимает его с чужих
+// неподтвержденных аккаунтов, так что занять адрес заранее не получится.
+func (db *DB) MarkEmailVerified(userID int) error {
+	tx, err := db.BeginTxx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var email sql.NullString
+	if err := tx.Get(&email, db.rebind(`SELECT email FROM users WHERE id = $1`), userID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+	if email.Valid {
+		var owners int
+		query := `SELECT COUNT(*) FROM users WHERE LOWER(email) = LOWER($1) AND email_verified AND id <> $2`
+		if err := tx.Get(&owners, db.rebind(query), email.String, userID); err != nil {
+			return err
+		}
+		if owners > 0 {
+			return ErrEmailTaken
+		}
+		query = `UPDATE users SET email = NULL WHERE LOWER(email) = LOWER($1) AND NOT email_verified AND id <> $2`
+		if _, err := tx.Exec(db.rebind(query), email.String, userID); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(db.rebind(`UPDATE users SET email_verified = TRUE WHERE id = $1`), userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
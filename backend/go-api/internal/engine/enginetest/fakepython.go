@@ -0,0 +1,293 @@
+// Package enginetest — поддельный Python-сервис и обвязка для сквозных
+// тестов движка. FakePython отвечает на /generate_thought,
+// /execute_tool/{name} и /synthesize_stream по заранее заданному сценарию,
+// включая ошибки и медленный стрим, и запоминает полученные запросы.
+package enginetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"egobackend/internal/engine"
+	"egobackend/internal/models"
+)
+
+// ThoughtStep — ответ на один вызов /generate_thought. Если Status задан и
+// не равен 200, вместо мысли возвращается эта ошибка.
+type ThoughtStep struct {
+	Thought models.ThoughtResponse
+	Usage   *models.TokenUsage
+	Status  int
+	Delay   time.Duration
+}
+
+// ToolStep — ответ на один вызов /execute_tool/{name}.
+type ToolStep struct {
+	Result string
+	Status int
+	Delay  time.Duration
+}
+
+// StreamStep — ответ на один вызов /synthesize_stream. Куски уходят по
+// одному с паузой ChunkDelay; Error отправляется событием error после
+// кусков, как это делает Python при сбое модели посреди ответа.
+type StreamStep struct {
+	Chunks     []string
+	ChunkDelay time.Duration
+	Error      string
+	Status     int
+}
+
+// Script — сценарий поддельного сервиса. Шаги каждого эндпоинта
+// расходуются по порядку, последний шаг повторяется. Вызов эндпоинта без
+// шагов получает 500, чтобы лишний вызов был виден в тесте.
+type Script struct {
+	Thoughts  []ThoughtStep
+	Tools     map[string][]ToolStep
+	Synthesis []StreamStep
+	Title     string
+	Summary   string
+}
+
+// FakePython — httptest-сервер, который ведет себя как Python-сервис.
+type FakePython struct {
+	Server *httptest.Server
+
+	mu       sync.Mutex
+	script   Script
+	calls    map[string]int
+	requests map[string][]models.PythonRequest
+	queries  map[string][]string
+}
+
+// NewFakePython запускает сервер и останавливает его в конце теста.
+func NewFakePython(t testing.TB, script Script) *FakePython {
+	t.Helper()
+	f := &FakePython{
+		script:   script,
+		calls:    make(map[string]int),
+		requests: make(map[string][]models.PythonRequest),
+		queries:  make(map[string][]string),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("POST /generate_thought", f.handleThought)
+	mux.HandleFunc("POST /execute_tool/{name}", f.handleTool)
+	mux.HandleFunc("POST /synthesize_stream", f.handleStream)
+	mux.HandleFunc("POST /generate_title", f.handleTitle)
+	mux.HandleFunc("POST /summarize_history", f.handleSummary)
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Server.Close)
+	return f
+}
+
+// URL — адрес сервера в формате PYTHON_BACKEND_URL.
+func (f *FakePython) URL() string {
+	return f.Server.URL
+}
+
+// Backends — движок, в котором мышление, синтез и инструменты идут через
+// этот сервер.
+func (f *FakePython) Backends(t testing.TB) engine.Backends {
+	t.Helper()
+	client, err := engine.NewPythonClient(f.URL())
+	if err != nil {
+		t.Fatalf("NewPythonClient: %v", err)
+	}
+	return engine.NewPythonBackends(client)
+}
+
+// Calls — сколько раз вызывали эндпоинт. Для инструментов ключ —
+// "/execute_tool/<name>".
+func (f *FakePython) Calls(endpoint string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[endpoint]
+}
+
+// Requests возвращает request_data всех вызовов /generate_thought или
+// /synthesize_stream по порядку.
+func (f *FakePython) Requests(endpoint string) []models.PythonRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]models.PythonRequest(nil), f.requests[endpoint]...)
+}
+
+// ToolQueries возвращает запросы, с которыми вызывали инструмент.
+func (f *FakePython) ToolQueries(tool string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.queries[tool]...)
+}
+
+// next учитывает вызов и возвращает номер шага для сценария из n шагов
+// или -1, если шагов нет.
+func (f *FakePython) next(endpoint string, n int) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	call := f.calls[endpoint]
+	f.calls[endpoint]++
+	if n == 0 {
+		return -1
+	}
+	if call >= n {
+		return n - 1
+	}
+	return call
+}
+
+func (f *FakePython) recordRequest(endpoint string, r *http.Request) {
+	var data models.PythonRequest
+	if err := json.Unmarshal([]byte(r.FormValue("request_data")), &data); err != nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests[endpoint] = append(f.requests[endpoint], data)
+}
+
+func (f *FakePython) handleThought(w http.ResponseWriter, r *http.Request) {
+	const endpoint = "/generate_thought"
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.recordRequest(endpoint, r)
+	i := f.next(endpoint, len(f.script.Thoughts))
+	if i < 0 {
+		http.Error(w, "сценарий не содержит мыслей", http.StatusInternalServerError)
+		return
+	}
+	step := f.script.Thoughts[i]
+	if !sleep(r, step.Delay) {
+		return
+	}
+	if step.Status != 0 && step.Status != http.StatusOK {
+		http.Error(w, fmt.Sprintf("fake: шаг мышления %d завершился ошибкой", i+1), step.Status)
+		return
+	}
+	writeJSON(w, models.ThoughtResponseWithData{Thought: step.Thought, Usage: step.Usage})
+}
+
+func (f *FakePython) handleTool(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	var body struct {
+		Query string `json:"query"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	f.queries[name] = append(f.queries[name], body.Query)
+	steps := f.script.Tools[name]
+	f.mu.Unlock()
+
+	i := f.next("/execute_tool/"+name, len(steps))
+	if i < 0 {
+		http.Error(w, fmt.Sprintf("сценарий не содержит инструмента %s", name), http.StatusInternalServerError)
+		return
+	}
+	step := steps[i]
+	if !sleep(r, step.Delay) {
+		return
+	}
+	if step.Status != 0 && step.Status != http.StatusOK {
+		http.Error(w, fmt.Sprintf("fake: инструмент %s завершился ошибкой", name), step.Status)
+		return
+	}
+	writeJSON(w, map[string]string{"result": step.Result})
+}
+
+func (f *FakePython) handleStream(w http.ResponseWriter, r *http.Request) {
+	const endpoint = "/synthesize_stream"
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.recordRequest(endpoint, r)
+	i := f.next(endpoint, len(f.script.Synthesis))
+	if i < 0 {
+		http.Error(w, "сценарий не содержит синтеза", http.StatusInternalServerError)
+		return
+	}
+	step := f.script.Synthesis[i]
+	if step.Status != 0 && step.Status != http.StatusOK {
+		http.Error(w, "fake: синтез завершился ошибкой", step.Status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	flusher, _ := w.(http.Flusher)
+	send := func(eventType string, data interface{}) {
+		payload, _ := json.Marshal(map[string]interface{}{"type": eventType, "data": data})
+		fmt.Fprintf(w, "data: %s\n\n", payload)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	for n, chunk := range step.Chunks {
+		if n > 0 && !sleep(r, step.ChunkDelay) {
+			return
+		}
+		send("chunk", map[string]string{"text": chunk})
+	}
+	if step.Error != "" {
+		send("error", map[string]string{"message": step.Error})
+	}
+}
+
+func (f *FakePython) handleTitle(w http.ResponseWriter, r *http.Request) {
+	f.next("/generate_title", 0)
+	if f.script.Title == "" {
+		http.Error(w, "сценарий не содержит названия", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, models.TitleResponse{Title: f.script.Title})
+}
+
+func (f *FakePython) handleSummary(w http.ResponseWriter, r *http.Request) {
+	f.next("/summarize_history", 0)
+	if f.script.Summary == "" {
+		http.Error(w, "сценарий не содержит сводки", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, models.SummaryResponse{Summary: f.script.Summary})
+}
+
+// sleep ждет d и возвращает false, если клиент за это время ушел.
+func sleep(r *http.Request, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	select {
+	case <-time.After(d):
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// Thought — короткая запись шага мышления для сценариев.
+func Thought(header string, next bool, tools ...models.ToolCall) ThoughtStep {
+	return ThoughtStep{Thought: models.ThoughtResponse{
+		Thoughts:          strings.ToLower(header),
+		Confidence:        "0.9",
+		ThoughtHeader:     header,
+		ToolCalls:         tools,
+		NextThoughtNeeded: next,
+	}}
+}
@@ -0,0 +1,88 @@
+package enginetest
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"egobackend/internal/database"
+	"egobackend/internal/database/storetest"
+	"egobackend/internal/engine"
+	"egobackend/internal/i18n"
+	"egobackend/internal/models"
+)
+
+// OpenStore возвращает хранилище для сквозных тестов: тестовую БД
+// PostgreSQL, если задан storetest.TestDatabaseEnv, иначе хранилище в
+// памяти. Обе реализации проходят один набор тестов storetest.
+func OpenStore(t testing.TB) database.Store {
+	t.Helper()
+	if os.Getenv(storetest.TestDatabaseEnv) == "" {
+		return database.NewMemory()
+	}
+	return storetest.OpenPostgres(t)
+}
+
+// Harness — сквозное окружение движка: поддельный Python, хранилище и
+// пользователь. S3 не подключен, поэтому сценарии обходятся без файлов.
+type Harness struct {
+	DB     database.Store
+	Python *FakePython
+	User   *models.User
+	// Published — события, которые процессор публикует после done
+	// (например, session_updated с новым названием).
+	Published *Recorder
+}
+
+func NewHarness(t testing.TB, script Script) *Harness {
+	t.Helper()
+	store := OpenStore(t)
+	return &Harness{
+		DB:        store,
+		Python:    NewFakePython(t, script),
+		User:      storetest.NewUser(t, store),
+		Published: &Recorder{},
+	}
+}
+
+func (h *Harness) Processor(t testing.TB) *engine.Processor {
+	t.Helper()
+	processor := engine.NewProcessor(h.DB, h.Python.Backends(t), nil)
+	processor.Events = h.Published
+	return processor
+}
+
+// Run выполняет запрос так же, как обработчик /ws, и возвращает
+// записанные события. Язык событий — русский.
+func (h *Harness) Run(t testing.TB, ctx context.Context, req models.StreamRequest) *Recorder {
+	t.Helper()
+	ctx = i18n.WithLocale(ctx, i18n.RU)
+	recorder := &Recorder{}
+	h.Processor(t).ProcessRequest(ctx, req, h.User, req.TempID, recorder.Callback)
+	return recorder
+}
+
+// SessionLogs — сохраненные логи сессии в порядке создания.
+func (h *Harness) SessionLogs(t testing.TB, sessionID int) []models.RequestLog {
+	t.Helper()
+	logs, err := h.DB.GetAllSessionLogs(sessionID)
+	if err != nil {
+		t.Fatalf("чтение логов сессии %d: %v", sessionID, err)
+	}
+	return logs
+}
+
+// Eventually ждет, пока cond не станет истинным, например пока фоновая
+// задача процессора не сохранит название сессии.
+func Eventually(t testing.TB, timeout time.Duration, cond func() bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return cond()
+}
@@ -0,0 +1,77 @@
+package enginetest
+
+import (
+	"sync"
+
+	"egobackend/internal/protocol"
+)
+
+// Recorder собирает события запуска. Метод Callback передается в
+// ProcessRequest, а сам Recorder годится как engine.EventPublisher.
+type Recorder struct {
+	mu     sync.Mutex
+	events []protocol.Event
+}
+
+func (r *Recorder) Callback(event protocol.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+}
+
+func (r *Recorder) PublishToUser(userID int, event protocol.Event) {
+	r.Callback(event)
+}
+
+func (r *Recorder) Events() []protocol.Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]protocol.Event(nil), r.events...)
+}
+
+// Types — типы событий по порядку. Подряд идущие куски текста схлопываются
+// в один "chunk": их число зависит от буферизации, а не от логики движка.
+func (r *Recorder) Types() []string {
+	return CompactTypes(EventTypes(r.Events()))
+}
+
+// Text — текст ответа, собранный из всех кусков.
+func (r *Recorder) Text() string {
+	var text string
+	for _, event := range r.Events() {
+		if chunk, ok := event.(protocol.ChunkEvent); ok {
+			text += chunk.Text
+		}
+	}
+	return text
+}
+
+// Find возвращает первое событие типа eventType.
+func (r *Recorder) Find(eventType string) (protocol.Event, bool) {
+	for _, event := range r.Events() {
+		if event.EventType() == eventType {
+			return event, true
+		}
+	}
+	return nil, false
+}
+
+func EventTypes(events []protocol.Event) []string {
+	types := make([]string, 0, len(events))
+	for _, event := range events {
+		types = append(types, event.EventType())
+	}
+	return types
+}
+
+// CompactTypes схлопывает подряд идущие "chunk".
+func CompactTypes(types []string) []string {
+	var compact []string
+	for _, t := range types {
+		if t == "chunk" && len(compact) > 0 && compact[len(compact)-1] == "chunk" {
+			continue
+		}
+		compact = append(compact, t)
+	}
+	return compact
+}
@@ -0,0 +1,182 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"egobackend/internal/i18n"
+	"egobackend/internal/models"
+)
+
+const (
+	// historyScanLimit — сколько последних сообщений вообще рассматриваем
+	// при сборке истории. Все, что старше, давно должно быть в сводке.
+	historyScanLimit      = 200
+	summaryRefreshTimeout = 2 * time.Minute
+	// summaryTurnTokens ограничивает одно сообщение в запросе на сводку,
+	// чтобы вставленный документ не занял весь контекст суммаризатора.
+	summaryTurnTokens = 4000
+)
+
+// summaryRefreshes не дает запустить два обновления сводки одной сессии.
+var summaryRefreshes sync.Map
+
+// estimateTokens грубо оценивает число токенов — около четырех символов на
+// токен. Точный токенайзер есть только у модели, нам важен порядок величины.
+func estimateTokens(s string) int {
+	return (utf8.RuneCountInString(s) + 3) / 4
+}
+
+// clipToTokens обрезает текст до примерно maxTokens токенов.
+func clipToTokens(s string, maxTokens int) string {
+	if estimateTokens(s) <= maxTokens {
+		return s
+	}
+	return truncateString(s, maxTokens*4) + "…"
+}
+
+type historyWindow struct {
+	// logs — сообщения, которые идут в историю, по порядку.
+	logs        []models.RequestLog
+	attachments map[int][]models.FileAttachment
+	summary     string
+	// unsummarized — выпавшие из окна сообщения, которых еще нет в сводке.
+	unsummarized  []models.RequestLog
+	maxTurnTokens int
+}
+
+// selectHistory набирает в бюджет закрепленные сообщения и столько
+// последних, сколько поместится. Одно сообщение занимает не больше
+// половины бюджета, чтобы вставленный документ не вытеснил все остальное.
+// Сообщения, уже вошедшие в сводку, повторно не отправляются — кроме
+// закрепленных: их пользователь просил держать в истории дословно.
+func selectHistory(logs []models.RequestLog, attachments map[int][]models.FileAttachment, summary models.SessionSummary, budget int) historyWindow {
+	window := historyWindow{
+		attachments:   make(map[int][]models.FileAttachment),
+		summary:       summary.Summary,
+		maxTurnTokens: budget / 2,
+	}
+	remaining := budget - estimateTokens(summary.Summary)
+	included := make(map[int]bool)
+	summarized := make(map[int]bool, len(summary.LogIDs))
+	for _, id := range summary.LogIDs {
+		summarized[id] = true
+	}
+	cost := func(l models.RequestLog) int {
+		return estimateTokens(formatTurn(l, attachments[l.ID], window.maxTurnTokens))
+	}
+
+	for _, l := range logs {
+		if l.Pinned {
+			included[l.ID] = true
+			remaining -= cost(l)
+		}
+	}
+	for i := len(logs) - 1; i >= 0; i-- {
+		l := logs[i]
+		if l.Pinned || summarized[l.ID] {
+			continue
+		}
+		c := cost(l)
+		if c > remaining {
+			break
+		}
+		included[l.ID] = true
+		remaining -= c
+	}
+
+	for _, l := range logs {
+		switch {
+		case included[l.ID]:
+			window.logs = append(window.logs, l)
+			if atts, ok := attachments[l.ID]; ok {
+				window.attachments[l.ID] = atts
+			}
+		case !summarized[l.ID]:
+			window.unsummarized = append(window.unsummarized, l)
+		}
+	}
+	return window
+}
+
+func formatTurn(logEntry models.RequestLog, attachments []models.FileAttachment, maxTokens int) string {
+	finalResponseText := ""
+	if logEntry.FinalResponse != nil {
+		finalResponseText = *logEntry.FinalResponse
+	}
+	attachmentsText := ""
+	if len(attachments) > 0 {
+		var names []string
+		for _, a := range attachments {
+			names = append(names, a.FileName)
+		}
+		attachmentsText = fmt.Sprintf(" [Attached: %s]", strings.Join(names, ", "))
+	}
+	turn := fmt.Sprintf("User: %s%s\nEGO: %s\n\n", logEntry.UserQuery, attachmentsText, finalResponseText)
+	if maxTokens > 0 {
+		turn = clipToTokens(turn, maxTokens)
+	}
+	return turn
+}
+
+func (p *Processor) buildChatHistory(window historyWindow) string {
+	var chatHistoryBuilder strings.Builder
+	if window.summary != "" {
+		chatHistoryBuilder.WriteString(fmt.Sprintf("Summary of the earlier conversation:\n%s\n\n", window.summary))
+	}
+	for _, logEntry := range window.logs {
+		chatHistoryBuilder.WriteString(formatTurn(logEntry, window.attachments[logEntry.ID], window.maxTurnTokens))
+	}
+	return chatHistoryBuilder.String()
+}
+
+// refreshSessionSummary дописывает в сводку сессии сообщения, выпавшие из
+// окна истории. Работает в фоне: текущий запрос использует прежнюю сводку.
+func (p *Processor) refreshSessionSummary(locale i18n.Locale, sessionID int, previous models.SessionSummary, turns []models.RequestLog, attachments map[int][]models.FileAttachment) {
+	if _, busy := summaryRefreshes.LoadOrStore(sessionID, struct{}{}); busy {
+		return
+	}
+	defer summaryRefreshes.Delete(sessionID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), summaryRefreshTimeout)
+	defer cancel()
+
+	var history strings.Builder
+	for _, turn := range turns {
+		history.WriteString(formatTurn(turn, attachments[turn.ID], summaryTurnTokens))
+	}
+	body, err := p.callPythonService(ctx, "/summarize_history", models.SummaryRequest{
+		PreviousSummary: previous.Summary,
+		ChatHistory:     history.String(),
+		Locale:          string(locale),
+	})
+	if err != nil {
+		log.Printf("!!! [SUMMARY] Не удалось обновить сводку сессии %d: %v", sessionID, err)
+		return
+	}
+	var result models.SummaryResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		log.Printf("!!! [SUMMARY] Ошибка разбора ответа /summarize_history: %v", err)
+		return
+	}
+	summary := strings.TrimSpace(result.Summary)
+	if summary == "" {
+		return
+	}
+
+	logIDs := make([]int, len(turns))
+	for i, turn := range turns {
+		logIDs[i] = turn.ID
+	}
+	if err := p.DB.UpdateSessionSummary(sessionID, summary, previous.Version, logIDs); err != nil {
+		log.Printf("!!! [SUMMARY] Не удалось сохранить сводку сессии %d: %v", sessionID, err)
+		return
+	}
+	log.Printf("[SUMMARY] Сводка сессии %d обновлена (%d новых сообщений).", sessionID, len(turns))
+}
@@ -0,0 +1,80 @@
+package engine
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"egobackend/internal/models"
+)
+
+func historyLogs(n int) []models.RequestLog {
+	logs := make([]models.RequestLog, n)
+	for i := range logs {
+		response := strings.Repeat("ответ ", 10)
+		logs[i] = models.RequestLog{ID: i + 1, UserQuery: strings.Repeat("вопрос ", 10), FinalResponse: &response}
+	}
+	return logs
+}
+
+func windowIDs(logs []models.RequestLog) []int {
+	var ids []int
+	for _, l := range logs {
+		ids = append(ids, l.ID)
+	}
+	return ids
+}
+
+func TestSelectHistory(t *testing.T) {
+	turnCost := estimateTokens(formatTurn(historyLogs(1)[0], nil, 0))
+
+	tests := []struct {
+		name             string
+		pinned           []int
+		summarized       []int
+		budgetTurns      int
+		wantLogs         []int
+		wantUnsummarized []int
+	}{
+		{
+			// Сообщение 2 было закреплено, пока сводка росла, и открепилось
+			// уже ниже сводки: оно должно попасть в следующую сводку.
+			name:             "открепленное ниже сводки",
+			summarized:       []int{1, 3},
+			budgetTurns:      2,
+			wantLogs:         []int{4, 5},
+			wantUnsummarized: []int{2},
+		},
+		{
+			name:        "окно больше прежнего",
+			summarized:  []int{1, 2},
+			budgetTurns: 10,
+			wantLogs:    []int{3, 4, 5},
+		},
+		{
+			name:        "закрепленное из сводки",
+			pinned:      []int{1},
+			summarized:  []int{1, 2},
+			budgetTurns: 10,
+			wantLogs:    []int{1, 3, 4, 5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := historyLogs(5)
+			for i := range logs {
+				logs[i].Pinned = slices.Contains(tt.pinned, logs[i].ID)
+			}
+			summary := models.SessionSummary{Summary: "сводка", LogIDs: tt.summarized}
+			budget := tt.budgetTurns*turnCost + estimateTokens(summary.Summary)
+
+			window := selectHistory(logs, nil, summary, budget)
+			if got := windowIDs(window.logs); !slices.Equal(got, tt.wantLogs) {
+				t.Errorf("logs = %v, want %v", got, tt.wantLogs)
+			}
+			if got := windowIDs(window.unsummarized); !slices.Equal(got, tt.wantUnsummarized) {
+				t.Errorf("unsummarized = %v, want %v", got, tt.wantUnsummarized)
+			}
+		})
+	}
+}
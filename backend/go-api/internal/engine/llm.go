@@ -0,0 +1,34 @@
+package engine
+
+import (
+	"context"
+
+	"egobackend/internal/models"
+)
+
+// Thinker делает один шаг мышления: по запросу, истории и уже сделанным
+// шагам возвращает следующую мысль с вызовами инструментов.
+type Thinker interface {
+	Think(ctx context.Context, req models.PythonRequest, files []models.FilePayload) (*models.ThoughtResponseWithData, error)
+}
+
+// Synthesizer пишет итоговый ответ: отправляет куски текста через callback
+// по мере генерации и возвращает ответ целиком.
+type Synthesizer interface {
+	Synthesize(ctx context.Context, req models.PythonRequest, files []models.FilePayload, callback EventCallback) (string, error)
+}
+
+// Backends — внешние сервисы движка. Python нужен для инструментов,
+// названий сессий и сводок истории; без него эти функции недоступны, но
+// мышление и синтез могут идти через другой Thinker/Synthesizer.
+type Backends struct {
+	Python      *PythonClient
+	Thinker     Thinker
+	Synthesizer Synthesizer
+}
+
+// NewPythonBackends — конфигурация, в которой все идет через Python.
+func NewPythonBackends(python *PythonClient) Backends {
+	backend := &PythonBackend{Client: python}
+	return Backends{Python: python, Thinker: backend, Synthesizer: backend}
+}
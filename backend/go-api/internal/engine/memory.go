@@ -0,0 +1,119 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"egobackend/internal/apperr"
+	"egobackend/internal/models"
+)
+
+const (
+	// memoryToolName — инструмент долговременной памяти. Его выполняет сам
+	// Go, потому что память хранится в нашей БД, а не в Python.
+	memoryToolName = "EgoMemory"
+	// promptMemoryLimit — сколько записей памяти попадает в промпт.
+	promptMemoryLimit = 20
+	recallMemoryLimit = 10
+)
+
+// loadMemories возвращает записи памяти пользователя, которые больше всего
+// подходят к запросу. Ошибка БД не должна ломать ответ, поэтому она
+// только логируется.
+func (p *Processor) loadMemories(userID int, query string) []string {
+	memories, err := p.DB.GetUserMemories(userID)
+	if err != nil {
+		log.Printf("!!! [MEMORY] Не удалось загрузить память пользователя %d: %v", userID, err)
+		return nil
+	}
+	return selectMemories(memories, query, promptMemoryLimit)
+}
+
+// selectMemories сортирует записи по числу общих с запросом слов, при
+// равенстве — по свежести (GetUserMemories отдает их от новых к старым).
+func selectMemories(memories []models.UserMemory, query string, limit int) []string {
+	queryWords := memoryWords(query)
+	type scored struct {
+		content string
+		score   int
+	}
+	ranked := make([]scored, len(memories))
+	for i, m := range memories {
+		score := 0
+		for word := range memoryWords(m.Content) {
+			if queryWords[word] {
+				score++
+			}
+		}
+		ranked[i] = scored{content: m.Content, score: score}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool { return ranked[i].score > ranked[j].score })
+
+	var result []string
+	for _, r := range ranked {
+		if len(result) >= limit {
+			break
+		}
+		result = append(result, r.content)
+	}
+	return result
+}
+
+// memoryWords разбивает текст на слова в нижнем регистре. Слова короче
+// трех букв — в основном предлоги и союзы — не учитываются.
+func memoryWords(text string) map[string]bool {
+	words := make(map[string]bool)
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if utf8.RuneCountInString(word) >= 3 {
+			words[word] = true
+		}
+	}
+	return words
+}
+
+// runMemoryTool выполняет запрос к EgoMemory: "save: <факт>" сохраняет
+// запись, "recall: <тема>" возвращает подходящие.
+func (p *Processor) runMemoryTool(userID int, toolQuery string) (string, error) {
+	command, argument, found := strings.Cut(toolQuery, ":")
+	argument = strings.TrimSpace(argument)
+	if !found || argument == "" {
+		return "", apperr.New(apperr.ToolFailed).WithDetail("неверный запрос к %s: %q", memoryToolName, toolQuery)
+	}
+
+	switch strings.ToLower(strings.TrimSpace(command)) {
+	case "save":
+		if utf8.RuneCountInString(argument) > models.MaxMemoryRunes {
+			return "", apperr.New(apperr.MemoryTooLong, models.MaxMemoryRunes)
+		}
+		count, err := p.DB.CountUserMemories(userID)
+		if err != nil {
+			return "", apperr.Wrap(apperr.Internal, err).WithDetail("подсчет записей памяти")
+		}
+		if count >= models.MaxUserMemories {
+			return "", apperr.New(apperr.MemoryLimitReached, models.MaxUserMemories)
+		}
+		if _, err := p.DB.CreateUserMemory(userID, argument, models.MemorySourceAssistant); err != nil {
+			return "", apperr.Wrap(apperr.Internal, err).WithDetail("создание записи памяти")
+		}
+		log.Printf("[MEMORY] Модель сохранила запись для пользователя %d.", userID)
+		return fmt.Sprintf("Saved to long-term memory: %s", argument), nil
+	case "recall":
+		memories, err := p.DB.GetUserMemories(userID)
+		if err != nil {
+			return "", apperr.Wrap(apperr.Internal, err).WithDetail("получение памяти")
+		}
+		found := selectMemories(memories, argument, recallMemoryLimit)
+		if len(found) == 0 {
+			return "Long-term memory is empty.", nil
+		}
+		return "- " + strings.Join(found, "\n- "), nil
+	default:
+		return "", apperr.New(apperr.ToolFailed).WithDetail("неизвестная команда %s: %q", memoryToolName, command)
+	}
+}
@@ -0,0 +1,309 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"egobackend/internal/apperr"
+	"egobackend/internal/models"
+	"egobackend/internal/protocol"
+)
+
+const (
+	openAIThinkTimeout      = 3 * time.Minute
+	openAISynthesizeTimeout = 10 * time.Minute
+	// openAIMaxInlineFileKB — текстовые вложения больше этого размера
+	// обрезаются: OpenAI-совместимые API не принимают произвольные файлы.
+	openAIMaxInlineFileKB = 256
+)
+
+// OpenAIBackend думает и пишет ответ через любой OpenAI-совместимый
+// /chat/completions. Подходит для небольших установок без Python-сервиса;
+// инструменты, кроме EgoMemory, без Python недоступны.
+type OpenAIBackend struct {
+	BaseURL    string
+	APIKey     string
+	Model      string
+	httpClient *http.Client
+}
+
+func NewOpenAIBackend(baseURL, apiKey, model string) *OpenAIBackend {
+	return &OpenAIBackend{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		APIKey:     apiKey,
+		Model:      model,
+		httpClient: &http.Client{},
+	}
+}
+
+type openAIMessage struct {
+	Role    string      `json:"role"`
+	Content interface{} `json:"content"`
+}
+
+type openAIContentPart struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	ImageURL *openAIImageURL `json:"image_url,omitempty"`
+}
+
+type openAIImageURL struct {
+	URL string `json:"url"`
+}
+
+type openAIChatRequest struct {
+	Model          string            `json:"model"`
+	Messages       []openAIMessage   `json:"messages"`
+	Temperature    *float64          `json:"temperature,omitempty"`
+	Stream         bool              `json:"stream,omitempty"`
+	StreamOptions  map[string]bool   `json:"stream_options,omitempty"`
+	ResponseFormat map[string]string `json:"response_format,omitempty"`
+}
+
+type openAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+func (u *openAIUsage) tokenUsage() *models.TokenUsage {
+	if u == nil {
+		return nil
+	}
+	return &models.TokenUsage{
+		PromptTokenCount:     u.PromptTokens,
+		CandidatesTokenCount: u.CompletionTokens,
+		TotalTokenCount:      u.TotalTokens,
+	}
+}
+
+type openAIChatResponse struct {
+	Choices []struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+	} `json:"choices"`
+	Usage *openAIUsage `json:"usage"`
+}
+
+type openAIStreamChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+	} `json:"choices"`
+	Usage *openAIUsage `json:"usage"`
+}
+
+func (o *OpenAIBackend) Think(ctx context.Context, req models.PythonRequest, files []models.FilePayload) (*models.ThoughtResponseWithData, error) {
+	intro, ok := openAIModeIntros[req.Mode]
+	if !ok {
+		intro = openAIModeIntros["default"]
+	}
+	system := fmt.Sprintf(openAIThinkingPrompt, intro, formatMemories(req.Memories), orNone(req.ChatHistory), orNone(req.ThoughtsHistory), formatTools(req.AllowedTools))
+
+	ctx, cancel := context.WithTimeout(ctx, openAIThinkTimeout)
+	defer cancel()
+	resp, err := o.post(ctx, openAIChatRequest{
+		Model:          o.Model,
+		Messages:       []openAIMessage{{Role: "system", Content: system}, userMessage(req.Query, files)},
+		Temperature:    req.Temperature,
+		ResponseFormat: map[string]string{"type": "json_object"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var completion openAIChatResponse
+	if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+		return nil, apperr.Wrap(apperr.GenerationFailed, err).WithDetail("разбор ответа /chat/completions")
+	}
+	if len(completion.Choices) == 0 {
+		return nil, apperr.New(apperr.GenerationFailed).WithDetail("/chat/completions вернул ответ без choices")
+	}
+	content := completion.Choices[0].Message.Content
+	var thought models.ThoughtResponse
+	if err := json.Unmarshal([]byte(extractJSONObject(content)), &thought); err != nil {
+		return nil, apperr.Wrap(apperr.GenerationFailed, err).WithDetail("разбор мысли: %s", truncateString(content, 2000))
+	}
+	return &models.ThoughtResponseWithData{Thought: thought, Usage: completion.Usage.tokenUsage()}, nil
+}
+
+func (o *OpenAIBackend) Synthesize(ctx context.Context, req models.PythonRequest, files []models.FilePayload, callback EventCallback) (string, error) {
+	instructions := ""
+	if req.CustomInstructions != nil {
+		instructions = *req.CustomInstructions
+	}
+	system := fmt.Sprintf(openAISynthesisPrompt, orNone(instructions), formatMemories(req.Memories), orNone(req.ChatHistory), orNone(req.ThoughtsHistory))
+
+	ctx, cancel := context.WithTimeout(ctx, openAISynthesizeTimeout)
+	defer cancel()
+	resp, err := o.post(ctx, openAIChatRequest{
+		Model:         o.Model,
+		Messages:      []openAIMessage{{Role: "system", Content: system}, userMessage(req.Query, files)},
+		Temperature:   req.Temperature,
+		Stream:        true,
+		StreamOptions: map[string]bool{"include_usage": true},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var fullResponse strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		payload, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		payload = strings.TrimSpace(payload)
+		if payload == "[DONE]" {
+			break
+		}
+		var chunk openAIStreamChunk
+		if err := json.Unmarshal([]byte(payload), &chunk); err != nil {
+			log.Printf("!!! [OPENAI] Ошибка разбора куска стрима: %v. Payload: %s", err, truncateString(payload, 500))
+			continue
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Delta.Content == "" {
+				continue
+			}
+			callback(protocol.ChunkEvent{Text: choice.Delta.Content})
+			fullResponse.WriteString(choice.Delta.Content)
+		}
+		if usage := chunk.Usage.tokenUsage(); usage != nil {
+			callback(protocol.UsageUpdateEvent{TokenUsage: *usage})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", apperr.Wrap(apperr.PythonUnavailable, err).WithDetail("чтение стрима /chat/completions")
+	}
+	return fullResponse.String(), nil
+}
+
+func (o *OpenAIBackend) post(ctx context.Context, body openAIChatRequest) (*http.Response, error) {
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", o.BaseURL+"/chat/completions", bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if o.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+o.APIKey)
+	}
+	resp, err := o.httpClient.Do(req)
+	if err != nil {
+		return nil, apperr.Wrap(apperr.PythonUnavailable, err).WithDetail("вызов /chat/completions")
+	}
+	if resp.StatusCode != http.StatusOK {
+		responseBody, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		code := apperr.GenerationFailed
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError {
+			code = apperr.PythonUnavailable
+		}
+		return nil, apperr.New(code).WithDetail("/chat/completions вернул статус %d: %s", resp.StatusCode, truncateString(string(responseBody), 2000))
+	}
+	return resp, nil
+}
+
+// userMessage собирает сообщение пользователя с вложениями: картинки
+// уходят как data URL, текстовые файлы — текстом, об остальных модель
+// узнает только имя.
+func userMessage(query string, files []models.FilePayload) openAIMessage {
+	if len(files) == 0 {
+		return openAIMessage{Role: "user", Content: query}
+	}
+	parts := []openAIContentPart{{Type: "text", Text: query}}
+	for _, file := range files {
+		switch {
+		case strings.HasPrefix(file.MimeType, "image/"):
+			parts = append(parts, openAIContentPart{
+				Type:     "image_url",
+				ImageURL: &openAIImageURL{URL: "data:" + file.MimeType + ";base64," + file.Base64Data},
+			})
+		case isTextMime(file.MimeType):
+			text := decodeBase64Text(file.Base64Data, openAIMaxInlineFileKB<<10)
+			parts = append(parts, openAIContentPart{Type: "text", Text: fmt.Sprintf("[File: %s]\n%s", file.FileName, text)})
+		default:
+			parts = append(parts, openAIContentPart{Type: "text", Text: fmt.Sprintf("[File %s (%s) is attached but cannot be read by this backend]", file.FileName, file.MimeType)})
+		}
+	}
+	return openAIMessage{Role: "user", Content: parts}
+}
+
+func isTextMime(mimeType string) bool {
+	if strings.HasPrefix(mimeType, "text/") {
+		return true
+	}
+	switch mimeType {
+	case "application/json", "application/xml", "application/x-yaml", "application/javascript":
+		return true
+	}
+	return false
+}
+
+func formatMemories(memories []string) string {
+	if len(memories) == 0 {
+		return "(nothing yet)"
+	}
+	return "- " + strings.Join(memories, "\n- ")
+}
+
+func formatTools(allowed []string) string {
+	var lines []string
+	for _, name := range allowed {
+		if description, ok := openAIToolDescriptions[name]; ok {
+			lines = append(lines, fmt.Sprintf("- %s: %s", name, description))
+		}
+	}
+	if len(lines) == 0 {
+		return "(no tools)"
+	}
+	return strings.Join(lines, "\n")
+}
+
+func orNone(s string) string {
+	if strings.TrimSpace(s) == "" || s == "null" {
+		return "(none)"
+	}
+	return s
+}
+
+// extractJSONObject вырезает JSON-объект из ответа модели, даже если она
+// обернула его в markdown или добавила текст вокруг.
+func extractJSONObject(text string) string {
+	first := strings.Index(text, "{")
+	last := strings.LastIndex(text, "}")
+	if first == -1 || last < first {
+		return text
+	}
+	return text[first : last+1]
+}
+
+func decodeBase64Text(data string, maxBytes int) string {
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "(file could not be decoded)"
+	}
+	if len(decoded) > maxBytes {
+		return strings.ToValidUTF8(string(decoded[:maxBytes]), "") + "\n…(truncated)"
+	}
+	return strings.ToValidUTF8(string(decoded), "")
+}
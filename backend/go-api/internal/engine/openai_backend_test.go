@@ -0,0 +1,139 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"egobackend/internal/apperr"
+	"egobackend/internal/models"
+	"egobackend/internal/protocol"
+)
+
+func newMockOpenAI(t *testing.T, handler func(w http.ResponseWriter, req openAIChatRequest)) *OpenAIBackend {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer test-key" {
+			t.Errorf("Authorization = %q", got)
+		}
+		var req openAIChatRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatalf("decode request: %v", err)
+		}
+		handler(w, req)
+	}))
+	t.Cleanup(server.Close)
+	return NewOpenAIBackend(server.URL+"/v1/", "test-key", "test-model")
+}
+
+func TestOpenAIThinkParsesThought(t *testing.T) {
+	backend := newMockOpenAI(t, func(w http.ResponseWriter, req openAIChatRequest) {
+		if req.Model != "test-model" || req.Stream {
+			t.Errorf("model = %q, stream = %v", req.Model, req.Stream)
+		}
+		if req.ResponseFormat["type"] != "json_object" {
+			t.Errorf("response_format = %v", req.ResponseFormat)
+		}
+		content := "```json\n" + `{"thoughts": "think", "confidence": 0.7, "tool_calls": [{"tool_name": "EgoWiki", "tool_query": "Go"}], "thoughts_header": "Thinking", "nextThoughtNeeded": false}` + "\n```"
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []map[string]interface{}{{"message": map[string]string{"role": "assistant", "content": content}}},
+			"usage":   map[string]int{"prompt_tokens": 10, "completion_tokens": 5, "total_tokens": 15},
+		})
+	})
+
+	temperature := 0.5
+	data, err := backend.Think(context.Background(), models.PythonRequest{
+		Query: "what is Go?", Mode: "default", AllowedTools: []string{"EgoWiki"}, Temperature: &temperature,
+	}, nil)
+	if err != nil {
+		t.Fatalf("Think: %v", err)
+	}
+	if data.Thought.Thoughts != "think" || data.Thought.NextThoughtNeeded || data.Thought.ThoughtHeader != "Thinking" {
+		t.Errorf("thought = %+v", data.Thought)
+	}
+	if len(data.Thought.ToolCalls) != 1 || data.Thought.ToolCalls[0].ToolName != "EgoWiki" {
+		t.Errorf("tool calls = %+v", data.Thought.ToolCalls)
+	}
+	if data.Usage == nil || data.Usage.TotalTokenCount != 15 {
+		t.Errorf("usage = %+v", data.Usage)
+	}
+}
+
+func TestOpenAISynthesizeStreamsDeltas(t *testing.T) {
+	backend := newMockOpenAI(t, func(w http.ResponseWriter, req openAIChatRequest) {
+		if !req.Stream {
+			t.Error("synthesis request is not streaming")
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, text := range []string{"Hel", "lo"} {
+			fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":%q}}]}\n\n", text)
+		}
+		fmt.Fprint(w, "data: {\"choices\":[],\"usage\":{\"prompt_tokens\":3,\"completion_tokens\":2,\"total_tokens\":5}}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	})
+
+	var chunks []string
+	var usage *models.TokenUsage
+	response, err := backend.Synthesize(context.Background(), models.PythonRequest{Query: "hi"}, nil, func(event protocol.Event) {
+		switch e := event.(type) {
+		case protocol.ChunkEvent:
+			chunks = append(chunks, e.Text)
+		case protocol.UsageUpdateEvent:
+			usage = &e.TokenUsage
+		}
+	})
+	if err != nil {
+		t.Fatalf("Synthesize: %v", err)
+	}
+	if response != "Hello" || len(chunks) != 2 {
+		t.Errorf("response = %q, chunks = %q", response, chunks)
+	}
+	if usage == nil || usage.TotalTokenCount != 5 {
+		t.Errorf("usage = %+v", usage)
+	}
+}
+
+func TestOpenAIErrorStatuses(t *testing.T) {
+	status := http.StatusTooManyRequests
+	backend := newMockOpenAI(t, func(w http.ResponseWriter, req openAIChatRequest) {
+		http.Error(w, `{"error": "slow down"}`, status)
+	})
+
+	_, err := backend.Think(context.Background(), models.PythonRequest{Query: "q"}, nil)
+	if !apperr.Is(err, apperr.PythonUnavailable) {
+		t.Errorf("429: err = %v, want python_unavailable", err)
+	}
+
+	status = http.StatusBadRequest
+	_, err = backend.Think(context.Background(), models.PythonRequest{Query: "q"}, nil)
+	if !apperr.Is(err, apperr.GenerationFailed) {
+		t.Errorf("400: err = %v, want generation_failed", err)
+	}
+}
+
+func TestUserMessageAttachments(t *testing.T) {
+	msg := userMessage("look", []models.FilePayload{
+		{FileName: "a.png", MimeType: "image/png", Base64Data: "iVBORw=="},
+		{FileName: "notes.txt", MimeType: "text/plain", Base64Data: "aGVsbG8="},
+		{FileName: "doc.pdf", MimeType: "application/pdf", Base64Data: "JVBERg=="},
+	})
+	parts, ok := msg.Content.([]openAIContentPart)
+	if !ok || len(parts) != 4 {
+		t.Fatalf("content = %#v", msg.Content)
+	}
+	if parts[1].ImageURL == nil || parts[1].ImageURL.URL != "data:image/png;base64,iVBORw==" {
+		t.Errorf("image part = %+v", parts[1])
+	}
+	if parts[2].Text != "[File: notes.txt]\nhello" {
+		t.Errorf("text part = %q", parts[2].Text)
+	}
+	if parts[3].ImageURL != nil || parts[3].Type != "text" {
+		t.Errorf("pdf part = %+v", parts[3])
+	}
+}
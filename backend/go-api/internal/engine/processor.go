@@ -1,49 +1,66 @@
 package engine
 
 import (
-	"bufio"
-	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
-	"mime/multipart"
 	"net/http"
-	"net/textproto"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 	"unicode/utf8"
 
+	"egobackend/internal/apperr"
 	"egobackend/internal/database"
+	"egobackend/internal/i18n"
 	"egobackend/internal/models"
+	"egobackend/internal/modes"
+	"egobackend/internal/protocol"
 	"egobackend/internal/storage"
 
 	"github.com/google/uuid"
 )
 
+// EventPublisher доставляет события во все соединения пользователя.
+// Через него уходят изменения, которые случаются уже после done.
+type EventPublisher interface {
+	PublishToUser(userID int, event protocol.Event)
+}
+
 type Processor struct {
-	DB               *database.DB
-	PythonBackendURL string
-	S3Service        *storage.S3Service
-	httpClient       *http.Client
+	DB          database.Store
+	Python      *PythonClient
+	Thinker     Thinker
+	Synthesizer Synthesizer
+	S3Service   *storage.S3Service
+	Events      EventPublisher
 }
 
-func NewProcessor(db *database.DB, pyURL string, s3 *storage.S3Service) *Processor {
+func NewProcessor(db database.Store, backends Backends, s3 *storage.S3Service) *Processor {
 	return &Processor{
-		DB:               db,
-		PythonBackendURL: pyURL,
-		S3Service:        s3,
-		httpClient: &http.Client{
-			Timeout: 15 * time.Minute,
-		},
+		DB:          db,
+		Python:      backends.Python,
+		Thinker:     backends.Thinker,
+		Synthesizer: backends.Synthesizer,
+		S3Service:   s3,
 	}
 }
 
-type EventCallback func(eventType string, data interface{})
+type EventCallback func(event protocol.Event)
+
+const (
+	// maxAttachmentSizeMB ограничивает размер одного вложения. Сообщение
+	// WebSocket ограничено 20 МБ, а base64 раздувает файл на треть.
+	maxAttachmentSizeMB = 15
+
+	sessionTitleTimeout   = 30 * time.Second
+	maxSessionTitleLength = 80
+)
 
 func truncateString(s string, maxLen int) string {
 	if utf8.RuneCountInString(s) <= maxLen {
@@ -52,63 +69,72 @@ func truncateString(s string, maxLen int) string {
 	return string(([]rune(s))[:maxLen])
 }
 
-func (p *Processor) ProcessRequest(req models.StreamRequest, user *models.User, tempID int64, callback EventCallback) {
+func (p *Processor) ProcessRequest(ctx context.Context, req models.StreamRequest, user *models.User, tempID int64, callback EventCallback) {
 	var session *models.ChatSession
 	var userQuery string
 	var filesForRequest []models.FilePayload
 	var historyLogs []models.RequestLog
 	var historyAttachments map[int][]models.FileAttachment
-	var err error
 	var newAttachedFileIDs []int64
+	var err error
+
+	ctx = WithRunAffinity(ctx)
+	// Явный режим проверяется сразу, а без него действует режим сессии.
+	if req.Mode != "" {
+		if _, err := modes.Resolve(req.Mode); err != nil {
+			reportError(ctx, callback, err)
+			return
+		}
+	}
 
 	if req.IsRegeneration {
 		log.Printf("[PROCESSOR] Запуск регенерации для лога ID %d", req.RequestLogIDToRegen)
 		logToRegen, errGetLog := p.DB.GetRequestLogByID(req.RequestLogIDToRegen, user.ID)
 		if errGetLog != nil || logToRegen == nil {
-			callback("error", map[string]string{"message": "Ошибка: лог для регенерации не найден или нет доступа."})
+			reportError(ctx, callback, apperr.Wrap(apperr.LogNotFound, errGetLog).WithDetail("регенерация лога %d", req.RequestLogIDToRegen))
 			return
 		}
 		session, err = p.DB.GetSessionByID(logToRegen.SessionID, user.ID)
 		if err != nil || session == nil {
-			callback("error", map[string]string{"message": "Ошибка получения сессии для регенерации"})
+			reportError(ctx, callback, apperr.Wrap(apperr.SessionNotFound, err).WithDetail("регенерация лога %d", req.RequestLogIDToRegen))
 			return
 		}
 		userQuery = logToRegen.UserQuery
-		historyLogs, historyAttachments, err = p.DB.GetSessionHistoryBefore(session.ID, logToRegen.Timestamp, 10)
+		historyLogs, historyAttachments, err = p.DB.GetContextHistory(session.ID, logToRegen.Timestamp, historyScanLimit)
 		if err != nil {
-			callback("error", map[string]string{"message": "Ошибка загрузки чистой истории: " + err.Error()})
+			reportError(ctx, callback, apperr.Wrap(apperr.Internal, err).WithDetail("загрузка истории до лога %d", req.RequestLogIDToRegen))
 			return
 		}
-		var originalFileIDs []int
-		if err := json.Unmarshal([]byte(logToRegen.AttachedFileIDs), &originalFileIDs); err == nil && len(originalFileIDs) > 0 {
-			attachments, err := p.DB.GetAttachmentsByIDs(originalFileIDs)
+		attachments, err := p.DB.GetRequestLogAttachments(req.RequestLogIDToRegen)
+		if err != nil {
+			log.Printf("!!! Ошибка получения файлов для регенерации: %v", err)
+		}
+		for _, att := range attachments {
+			fileBytes, err := p.S3Service.DownloadFile(ctx, att.FileURI)
 			if err != nil {
-				log.Printf("!!! Ошибка получения файлов для регенерации: %v", err)
-			} else {
-				for _, att := range attachments {
-					fileBytes, err := p.S3Service.DownloadFile(context.Background(), att.FileURI)
-					if err != nil {
-						continue
-					}
-					encodedData := base64.StdEncoding.EncodeToString(fileBytes)
-					filesForRequest = append(filesForRequest, models.FilePayload{
-						Base64Data: encodedData, MimeType: att.MimeType, FileName: att.FileName,
-					})
-				}
+				continue
 			}
+			encodedData := base64.StdEncoding.EncodeToString(fileBytes)
+			filesForRequest = append(filesForRequest, models.FilePayload{
+				Base64Data: encodedData, MimeType: att.MimeType, FileName: att.FileName,
+			})
 		}
 	} else {
-		log.Printf("[PROCESSOR] Запрос от %s (ID %d) принят. Режим: %s.", user.Username, user.ID, req.Mode)
+		log.Printf("[PROCESSOR] Запрос от %s (ID %d) принят.", user.Username, user.ID)
+		if err := checkAttachmentSizes(req.Files); err != nil {
+			reportError(ctx, callback, err)
+			return
+		}
 
 		var wasCreated bool
-		session, wasCreated, err = p.getOrCreateSessionFromRequest(req, user)
+		session, wasCreated, err = p.getOrCreateSessionFromRequest(ctx, req, user)
 		if err != nil {
-			callback("error", map[string]string{"message": err.Error()})
+			reportError(ctx, callback, err)
 			return
 		}
 
 		if wasCreated {
-			callback("session_created", session)
+			callback(protocol.SessionCreatedEvent{ChatSession: *session})
 		}
 
 		newAttachedFileIDs, err = p.saveAttachmentsFromRequest(req, user, session.ID)
@@ -118,25 +144,42 @@ func (p *Processor) ProcessRequest(req models.StreamRequest, user *models.User,
 
 		userQuery = req.Query
 		filesForRequest = req.Files
-		historyLogs, historyAttachments, err = p.DB.GetSessionHistory(session.ID, 10)
+		historyLogs, historyAttachments, err = p.DB.GetContextHistory(session.ID, time.Time{}, historyScanLimit)
 		if err != nil {
-			callback("error", map[string]string{"message": "Ошибка загрузки истории: " + err.Error()})
+			reportError(ctx, callback, apperr.Wrap(apperr.Internal, err).WithDetail("загрузка истории сессии %d", session.ID))
 			return
 		}
 	}
 
-	chatHistory := p.buildChatHistory(historyLogs, historyAttachments)
+	mode := p.sessionMode(req, user, session)
+	log.Printf("[PROCESSOR] Сессия %d, режим: %s.", session.ID, mode.ID)
+
+	summary, err := p.DB.GetSessionSummary(session.ID)
+	if err != nil {
+		log.Printf("!!! [PROCESSOR] Не удалось получить сводку сессии %d: %v", session.ID, err)
+	}
+	if req.IsRegeneration && slices.ContainsFunc(summary.LogIDs, func(id int) bool { return id >= int(req.RequestLogIDToRegen) }) {
+		// Сводка уже включает сообщения после регенерируемого.
+		summary = models.SessionSummary{}
+	}
+	window := selectHistory(historyLogs, historyAttachments, summary, mode.HistoryBudget)
+	if !req.IsRegeneration && len(window.unsummarized) > 0 {
+		go p.refreshSessionSummary(i18n.FromContext(ctx), session.ID, summary, window.unsummarized, historyAttachments)
+	}
+	log.Printf("[PROCESSOR] В историю вошло %d из %d сообщений, сводка: %t.", len(window.logs), len(historyLogs), window.summary != "")
+
+	chatHistory := p.buildChatHistory(window)
 	allFilesPayload := filesForRequest
 	processedFileNames := make(map[string]bool)
 	for _, f := range allFilesPayload {
 		processedFileNames[f.FileName] = true
 	}
-	for _, attachmentsInLog := range historyAttachments {
+	for _, attachmentsInLog := range window.attachments {
 		for _, att := range attachmentsInLog {
 			if _, exists := processedFileNames[att.FileName]; exists {
 				continue
 			}
-			fileBytes, err := p.S3Service.DownloadFile(context.Background(), att.FileURI)
+			fileBytes, err := p.S3Service.DownloadFile(ctx, att.FileURI)
 			if err != nil {
 				log.Printf("!!! ОШИБКА: Не удалось загрузить исторический файл %s из S3: %v", att.FileURI, err)
 				continue
@@ -150,48 +193,121 @@ func (p *Processor) ProcessRequest(req models.StreamRequest, user *models.User,
 	}
 	log.Printf("[PROCESSOR] Всего будет отправлено в Python %d файлов.", len(allFilesPayload))
 
-	thoughtsHistory, err := p.runThinkerLoop(userQuery, req.Mode, session.CustomInstructions, chatHistory, allFilesPayload, callback)
+	memories := p.loadMemories(user.ID, userQuery)
+	trace, err := p.runThinkerLoop(ctx, user, userQuery, mode, session.CustomInstructions, chatHistory, memories, allFilesPayload, callback)
+	if ctx.Err() != nil {
+		p.reportCancelled(ctx, callback)
+		return
+	}
 	if err != nil {
-		callback("error", map[string]string{"message": "Ошибка в цикле мышления: " + err.Error()})
+		reportError(ctx, callback, err)
 		return
 	}
 
-	thoughtsHistoryJSON, _ := json.Marshal(thoughtsHistory)
+	thoughtsHistoryJSON, _ := json.Marshal(trace.history)
 	synthesisRequest := models.PythonRequest{
-		Query: userQuery, ChatHistory: chatHistory, ThoughtsHistory: string(thoughtsHistoryJSON), Mode: req.Mode, CustomInstructions: session.CustomInstructions,
+		Query: userQuery, ChatHistory: chatHistory, ThoughtsHistory: string(thoughtsHistoryJSON), Mode: mode.ID, CustomInstructions: session.CustomInstructions, Memories: memories,
+		Temperature: &mode.Synthesis.SynthesisTemperature,
+	}
+	finalResponse, err := p.Synthesizer.Synthesize(ctx, synthesisRequest, allFilesPayload, callback)
+	if ctx.Err() != nil {
+		p.reportCancelled(ctx, callback)
+		return
 	}
-	finalResponse, err := p.processPythonMultipartStream("/synthesize_stream", synthesisRequest, allFilesPayload, callback)
 	if err != nil {
-		callback("error", map[string]string{"message": "Ошибка синтеза: " + err.Error()})
+		reportError(ctx, callback, err)
 		return
 	}
 
 	if req.IsRegeneration {
-		err = p.DB.UpdateRequestLogResponse(req.RequestLogIDToRegen, string(thoughtsHistoryJSON), finalResponse)
+		err = p.DB.UpdateRequestLogResponse(req.RequestLogIDToRegen, mode.ID, string(thoughtsHistoryJSON), finalResponse, trace.steps)
 		if err != nil {
 			log.Printf("!!! ОШИБКА: Не удалось обновить лог %d: %v", req.RequestLogIDToRegen, err)
 		} else {
 			log.Printf("[PROCESSOR] Лог %d успешно обновлен после регенерации.", req.RequestLogIDToRegen)
+			callback(protocol.LogUpdatedEvent{TempID: tempID, DBID: req.RequestLogIDToRegen, SessionID: int64(session.ID)})
 		}
 	} else {
-		attachedFileIDsJSON, _ := json.Marshal(newAttachedFileIDs)
+		firstTurn := len(historyLogs) == 0
 		logEntry := &models.RequestLog{
-			SessionID: session.ID, UserQuery: userQuery, EgoThoughtsJSON: string(thoughtsHistoryJSON), FinalResponse: &finalResponse, Timestamp: time.Now().UTC(), AttachedFileIDs: string(attachedFileIDsJSON),
+			SessionID: session.ID, UserQuery: userQuery, EgoThoughtsJSON: string(thoughtsHistoryJSON), FinalResponse: &finalResponse, Timestamp: time.Now().UTC(),
+			Mode: &mode.ID,
 		}
-		logID, err := p.DB.SaveRequestLog(logEntry)
+		logID, err := p.DB.SaveRequestLogWithFiles(logEntry, newAttachedFileIDs, trace.steps)
 		if err != nil {
 			log.Printf("!!! [PROCESSOR] КРИТИЧЕСКАЯ ОШИБКА: Не удалось сохранить лог в БД: %v", err)
 		} else {
-			if err := p.DB.AssociateFilesWithRequestLog(logID, newAttachedFileIDs); err != nil {
-				log.Printf("!!! [PROCESSOR] ОШИБКА: Не удалось связать файлы с логом %d: %v", logID, err)
+			callback(protocol.LogSavedEvent{TempID: tempID, DBID: logID, SessionID: int64(session.ID)})
+			if firstTurn {
+				go p.generateSessionTitle(i18n.FromContext(ctx), user.ID, session.ID, userQuery, finalResponse)
 			}
-			callback("log_saved", map[string]int64{"temp_id": tempID, "db_id": logID})
 		}
 	}
-	callback("done", "Процесс завершен")
+	callback(protocol.DoneEvent{Message: i18n.T(i18n.FromContext(ctx), i18n.RunDone)})
+}
+
+// reportError отправляет клиенту код и локализованное сообщение, а
+// внутренние подробности оставляет в логе.
+func reportError(ctx context.Context, callback EventCallback, err error) {
+	appErr := apperr.From(err)
+	log.Printf("!!! [PROCESSOR] Ошибка обработки запроса: %v", appErr)
+	callback(protocol.ErrorEvent{Code: string(appErr.Code), Message: appErr.Message(i18n.FromContext(ctx))})
+}
+
+func checkAttachmentSizes(files []models.FilePayload) error {
+	for _, f := range files {
+		if base64.StdEncoding.DecodedLen(len(f.Base64Data)) > maxAttachmentSizeMB<<20 {
+			return apperr.New(apperr.FileTooLarge, f.FileName, maxAttachmentSizeMB)
+		}
+	}
+	return nil
+}
+
+// pythonStatusError превращает неуспешный ответ Python в ошибку с кодом.
+// Тело ответа может содержать трейсбеки, поэтому оно идет только в детали.
+func pythonStatusError(endpoint string, status int, body []byte) error {
+	code := apperr.GenerationFailed
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		code = apperr.PythonUnavailable
+	}
+	return apperr.New(code).WithDetail("%s вернул статус %d: %s", endpoint, status, truncateString(string(body), 2000))
 }
 
-func (p *Processor) getOrCreateSessionFromRequest(req models.StreamRequest, user *models.User) (*models.ChatSession, bool, error) {
+func pythonTransportError(endpoint string, err error) error {
+	return apperr.Wrap(apperr.PythonUnavailable, err).WithDetail("вызов %s", endpoint)
+}
+
+func (p *Processor) reportCancelled(ctx context.Context, callback EventCallback) {
+	log.Printf("[PROCESSOR] Генерация отменена клиентом.")
+	callback(protocol.CancelledEvent{Message: i18n.T(i18n.FromContext(ctx), i18n.RunCancelled)})
+}
+
+// sessionMode выбирает режим запуска. Явный режим запроса сохраняется в
+// сессию, чтобы следующие запросы без режима продолжили в нем же. Без
+// него действует режим сессии, в том числе выбранный через PATCH.
+func (p *Processor) sessionMode(req models.StreamRequest, user *models.User, session *models.ChatSession) modes.Mode {
+	if req.Mode != "" {
+		mode, _ := modes.Resolve(req.Mode)
+		if session.Mode != mode.ID {
+			if err := p.DB.UpdateSessionMode(session.ID, user.ID, mode.ID); err != nil {
+				log.Printf("!!! [PROCESSOR] Не удалось сохранить режим %s для сессии %d: %v", mode.ID, session.ID, err)
+			} else {
+				session.Mode = mode.ID
+			}
+		}
+		return mode
+	}
+	mode, err := modes.Resolve(session.Mode)
+	if err != nil {
+		// Режим сессии мог быть удален из реестра после ее создания.
+		log.Printf("!!! [PROCESSOR] У сессии %d неизвестный режим %q, используется %s", session.ID, session.Mode, modes.DefaultID)
+		mode, _ = modes.Resolve(modes.DefaultID)
+	}
+	return mode
+}
+
+func (p *Processor) getOrCreateSessionFromRequest(ctx context.Context, req models.StreamRequest, user *models.User) (*models.ChatSession, bool, error) {
 	var sessionIDStr string
 	if req.SessionID != nil {
 		sessionIDStr = fmt.Sprintf("%d", *req.SessionID)
@@ -211,23 +327,111 @@ func (p *Processor) getOrCreateSessionFromRequest(req models.StreamRequest, user
 		}
 	}
 	if sessionTitle == "" {
-		sessionTitle = "Новый чат"
+		sessionTitle = i18n.T(i18n.FromContext(ctx), i18n.NewChatTitle)
+	}
+
+	// Явно выбранный пресет проверяем до создания сессии, чтобы не
+	// оставить пустой чат при неверном preset_id.
+	var preset *models.InstructionPreset
+	if req.PresetID != nil {
+		var err error
+		preset, err = p.DB.GetVisiblePreset(*req.PresetID, user.ID)
+		if err != nil {
+			return nil, false, apperr.Wrap(apperr.Internal, err).WithDetail("получение пресета %d", *req.PresetID)
+		}
+		if preset == nil {
+			return nil, false, apperr.New(apperr.PresetNotFound)
+		}
 	}
 
-	session, wasCreated, err := p.DB.GetOrCreateSession(sessionIDStr, sessionTitle, user.ID, req.Mode)
+	newSessionMode := req.Mode
+	if newSessionMode == "" {
+		newSessionMode = modes.DefaultID
+	}
+	session, wasCreated, err := p.DB.GetOrCreateSession(sessionIDStr, sessionTitle, user.ID, newSessionMode)
 	if err != nil {
-		return nil, false, fmt.Errorf("ошибка работы с сессией: %w", err)
+		return nil, false, apperr.Wrap(apperr.Internal, err).WithDetail("получение или создание сессии")
+	}
+	if !wasCreated {
+		return session, false, nil
 	}
 
-	if wasCreated && req.CustomInstructions != nil && *req.CustomInstructions != "" {
-		if err := p.DB.UpdateSessionInstructions(session.ID, user.ID, *req.CustomInstructions); err != nil {
+	// Инструкции новой сессии: явно переданные, затем выбранный пресет,
+	// затем пресет пользователя по умолчанию.
+	instructions := req.CustomInstructions
+	if instructions == nil || *instructions == "" {
+		if preset == nil {
+			preset, err = p.DB.GetUserDefaultPreset(user.ID)
+			if err != nil {
+				log.Printf("!!! ОШИБКА: Не удалось получить пресет по умолчанию пользователя %d: %v", user.ID, err)
+			}
+		}
+		if preset != nil {
+			instructions = &preset.Instructions
+		}
+	}
+	if instructions != nil && *instructions != "" {
+		if err := p.DB.UpdateSessionInstructions(session.ID, user.ID, *instructions); err != nil {
 			log.Printf("!!! ОШИБКА: Не удалось сохранить инструкции для новой сессии %d: %v", session.ID, err)
 		} else {
-			session.CustomInstructions = req.CustomInstructions
+			session.CustomInstructions = instructions
 		}
 	}
 
-	return session, wasCreated, nil
+	return session, true, nil
+}
+
+// generateSessionTitle просит Python придумать короткое название по первому
+// обмену репликами. Работает в фоне уже после done, поэтому ошибки только
+// логируются, а новое название приходит клиенту событием session_updated.
+func (p *Processor) generateSessionTitle(locale i18n.Locale, userID, sessionID int, query, response string) {
+	ctx, cancel := context.WithTimeout(context.Background(), sessionTitleTimeout)
+	defer cancel()
+
+	body, err := p.callPythonService(ctx, "/generate_title", models.TitleRequest{
+		Query:    truncateString(query, 2000),
+		Response: truncateString(response, 4000),
+		Locale:   string(locale),
+	})
+	if err != nil {
+		log.Printf("!!! [TITLE] Не удалось сгенерировать название для сессии %d: %v", sessionID, err)
+		return
+	}
+	var result models.TitleResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		log.Printf("!!! [TITLE] Ошибка разбора ответа /generate_title: %v", err)
+		return
+	}
+	title := cleanSessionTitle(result.Title)
+	if title == "" {
+		return
+	}
+
+	session, err := p.DB.SetGeneratedSessionTitle(sessionID, title)
+	if err != nil {
+		log.Printf("!!! [TITLE] Не удалось сохранить название сессии %d: %v", sessionID, err)
+		return
+	}
+	if session == nil {
+		log.Printf("[TITLE] Сессия %d переименована пользователем, название не меняю.", sessionID)
+		return
+	}
+	log.Printf("[TITLE] Сессия %d получила название '%s'.", sessionID, title)
+	if p.Events != nil {
+		p.Events.PublishToUser(userID, protocol.SessionUpdatedEvent{ChatSession: *session})
+	}
+}
+
+// cleanSessionTitle убирает кавычки, переносы и точку в конце, которые
+// модель иногда добавляет вокруг названия.
+func cleanSessionTitle(title string) string {
+	title = strings.Join(strings.Fields(title), " ")
+	title = strings.Trim(title, "\"'«»`*")
+	title = strings.TrimSuffix(strings.TrimSpace(title), ".")
+	if utf8.RuneCountInString(title) > maxSessionTitleLength {
+		title = truncateString(title, maxSessionTitleLength-3) + "..."
+	}
+	return title
 }
 
 func (p *Processor) saveAttachmentsFromRequest(req models.StreamRequest, user *models.User, sessionID int) ([]int64, error) {
@@ -241,15 +445,19 @@ func (p *Processor) saveAttachmentsFromRequest(req models.StreamRequest, user *m
 				continue
 			}
 			s3Key := fmt.Sprintf("%s%s", uuid.New().String(), filepath.Ext(fileData.FileName))
-			err = p.S3Service.UploadFile(context.Background(), s3Key, fileData.MimeType, data)
+			// Строка pending появляется раньше объекта: если процесс упадет
+			// после загрузки, сверка найдет объект по этой строке.
+			fileID, err := p.DB.SaveFileAttachment(sessionID, user.ID, fileData.FileName, s3Key, fileData.MimeType, models.AttachmentStatusPending)
 			if err != nil {
-				log.Printf("!!! ОШИБКА: Не удалось загрузить файл %s в S3: %v", fileData.FileName, err)
+				log.Printf("!!! Ошибка сохранения метаданных файла %s в БД: %v", fileData.FileName, err)
 				continue
 			}
-			fileID, err := p.DB.SaveFileAttachment(sessionID, user.ID, fileData.FileName, s3Key, fileData.MimeType, "uploaded")
+			err = p.S3Service.UploadFile(context.Background(), s3Key, fileData.MimeType, data)
 			if err != nil {
-				log.Printf("!!! Ошибка сохранения метаданных файла в БД: %v. Удаляю объект из S3...", err)
-				_ = p.S3Service.DeleteFiles(context.Background(), []string{s3Key})
+				log.Printf("!!! ОШИБКА: Не удалось загрузить файл %s в S3: %v", fileData.FileName, err)
+				if err := p.DB.DeleteFileAttachmentsByURI([]string{s3Key}); err != nil {
+					log.Printf("!!! Не удалось удалить метаданные файла %s, их уберет сверка: %v", s3Key, err)
+				}
 				continue
 			}
 			attachedFileIDs = append(attachedFileIDs, fileID)
@@ -258,248 +466,182 @@ func (p *Processor) saveAttachmentsFromRequest(req models.StreamRequest, user *m
 	return attachedFileIDs, nil
 }
 
-func (p *Processor) runThinkerLoop(query, mode string, customInstructions *string, chatHistory string, allFilesPayload []models.FilePayload, callback EventCallback) ([]map[string]interface{}, error) {
-	var thoughtsHistory []map[string]interface{}
-	maxThoughts := 15
-	for i := 0; i < maxThoughts; i++ {
+// thinkingTrace — результат цикла мышления. history уходит в Python и
+// сохраняется в ego_thoughts_json как есть, steps — те же шаги для
+// thought_steps с итерацией, уверенностью и длительностью.
+type thinkingTrace struct {
+	history []map[string]interface{}
+	steps   []models.ThoughtStep
+}
+
+func (t *thinkingTrace) add(entry map[string]interface{}, step models.ThoughtStep) {
+	t.history = append(t.history, entry)
+	step.Position = len(t.steps)
+	t.steps = append(t.steps, step)
+}
+
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func (p *Processor) runThinkerLoop(ctx context.Context, user *models.User, query string, mode modes.Mode, customInstructions *string, chatHistory string, memories []string, allFilesPayload []models.FilePayload, callback EventCallback) (*thinkingTrace, error) {
+	trace := &thinkingTrace{}
+	for i := 0; i < mode.MaxThoughts; i++ {
+		if err := ctx.Err(); err != nil {
+			return trace, err
+		}
 		pythonRequestData := models.PythonRequest{
-			Query: query, Mode: mode, ChatHistory: chatHistory, ThoughtsHistory: mustMarshal(thoughtsHistory), CustomInstructions: customInstructions,
+			Query: query, Mode: mode.ID, ChatHistory: chatHistory, ThoughtsHistory: mustMarshal(trace.history), CustomInstructions: customInstructions, Memories: memories,
+			AllowedTools: p.availableTools(mode), Temperature: &mode.Synthesis.ThinkingTemperature,
+		}
+		started := time.Now()
+		thoughtData, err := p.Thinker.Think(ctx, pythonRequestData, allFilesPayload)
+		elapsed := time.Since(started)
+		if ctx.Err() != nil {
+			return trace, ctx.Err()
+		}
+		if apperr.Is(err, apperr.PythonUnavailable) {
+			return trace, err
 		}
-		thoughtData, err := p.callGenerateThoughtMultipart(pythonRequestData, allFilesPayload)
 		if err != nil {
 			log.Printf("!!! Ошибка генерации мысли на итерации %d: %v", i+1, err)
-			thoughtsHistory = append(thoughtsHistory, map[string]interface{}{"type": "system_error", "error": err.Error()})
+			trace.add(map[string]interface{}{"type": models.ThoughtStepSystemError, "error": err.Error()}, models.ThoughtStep{
+				Iteration: i + 1, Kind: models.ThoughtStepSystemError, DurationMS: elapsed.Milliseconds(), Error: optionalString(err.Error()),
+			})
 			continue
 		}
-		p.processThoughtData(thoughtData, &thoughtsHistory, callback)
+		p.processThoughtData(ctx, user, mode, i+1, elapsed, thoughtData, trace, callback)
 		if !thoughtData.Thought.NextThoughtNeeded {
 			log.Printf("[PROCESSOR] Мышление завершено по флагу NextThoughtNeeded=false.")
 			break
 		}
 	}
-	return thoughtsHistory, nil
+	return trace, nil
 }
 
-func (p *Processor) processThoughtData(thoughtData *models.ThoughtResponseWithData, thoughtsHistory *[]map[string]interface{}, callback EventCallback) {
-	thought := thoughtData.Thought
-	if thoughtData.Usage != nil {
-		callback("usage_update", thoughtData.Usage)
+// availableTools — инструменты режима, которые можно выполнить. Без
+// Python-сервиса остается только EgoMemory, его выполняет Go.
+func (p *Processor) availableTools(mode modes.Mode) []string {
+	if p.Python != nil {
+		return mode.AllowedTools
 	}
-	*thoughtsHistory = append(*thoughtsHistory, map[string]interface{}{"type": "thought", "content": thought})
-	if thought.ThoughtHeader != "" {
-		callback("thought_header", thought.ThoughtHeader)
-	}
-	if len(thought.ToolCalls) > 0 {
-		toolResults := p.executeTools(thought.ToolCalls, callback)
-		*thoughtsHistory = append(*thoughtsHistory, toolResults...)
+	var tools []string
+	for _, tool := range mode.AllowedTools {
+		if tool == memoryToolName {
+			tools = append(tools, tool)
+		}
 	}
+	return tools
 }
 
-func (p *Processor) callGenerateThoughtMultipart(requestData models.PythonRequest, files []models.FilePayload) (*models.ThoughtResponseWithData, error) {
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-	jsonPart, err := json.Marshal(requestData)
-	if err != nil {
-		return nil, fmt.Errorf("ошибка маршалинга request_data: %w", err)
-	}
-	if err := writer.WriteField("request_data", string(jsonPart)); err != nil {
-		return nil, fmt.Errorf("ошибка записи поля request_data: %w", err)
-	}
-	for _, file := range files {
-		fileBytes, err := base64.StdEncoding.DecodeString(file.Base64Data)
-		if err != nil {
-			log.Printf("!!! Ошибка декодирования base64 для файла %s: %v", file.FileName, err)
-			continue
-		}
-		h := make(textproto.MIMEHeader)
-		h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="files"; filename="%s"`, file.FileName))
-		h.Set("Content-Type", file.MimeType)
-		part, err := writer.CreatePart(h)
-		if err != nil {
-			return nil, fmt.Errorf("ошибка создания form-file для %s: %w", file.FileName, err)
-		}
-		if _, err := part.Write(fileBytes); err != nil {
-			return nil, fmt.Errorf("ошибка записи байтов файла %s: %w", file.FileName, err)
-		}
-	}
-	if err := writer.Close(); err != nil {
-		return nil, fmt.Errorf("ошибка закрытия multipart writer: %w", err)
-	}
-	url := p.PythonBackendURL + "/generate_thought"
-	req, err := http.NewRequest("POST", url, body)
-	if err != nil {
-		return nil, fmt.Errorf("ошибка создания multipart запроса: %w", err)
+func (p *Processor) processThoughtData(ctx context.Context, user *models.User, mode modes.Mode, iteration int, elapsed time.Duration, thoughtData *models.ThoughtResponseWithData, trace *thinkingTrace, callback EventCallback) {
+	thought := thoughtData.Thought
+	if thoughtData.Usage != nil {
+		callback(protocol.UsageUpdateEvent{TokenUsage: *thoughtData.Usage})
 	}
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-	log.Printf("--> [HTTP MULTIPART] Вызов Python. Эндпоинт: /generate_thought. Количество файлов: %d", len(files))
-	resp, err := p.httpClient.Do(req)
-	if err != nil {
-		log.Printf("!!! [HTTP MULTIPART] КРИТИЧЕСКАЯ ОШИБКА вызова Python: %v", err)
-		return nil, err
+	step := models.ThoughtStep{
+		Iteration: iteration, Kind: models.ThoughtStepThought, Header: optionalString(thought.ThoughtHeader),
+		Content: optionalString(thought.Thoughts), DurationMS: elapsed.Milliseconds(),
 	}
-	defer resp.Body.Close()
-	log.Printf("<-- [HTTP MULTIPART] Ответ от Python получен. Статус: %d", resp.StatusCode)
-	responseBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	if confidence, err := thought.Confidence.Float64(); err == nil {
+		step.Confidence = &confidence
 	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("python-сервис вернул ошибку (статус %d): %s", resp.StatusCode, string(responseBody))
+	trace.add(map[string]interface{}{"type": models.ThoughtStepThought, "content": thought}, step)
+	if thought.ThoughtHeader != "" {
+		callback(protocol.ThoughtHeaderEvent(thought.ThoughtHeader))
 	}
-	var response models.ThoughtResponseWithData
-	if err := json.Unmarshal(responseBody, &response); err != nil {
-		return nil, fmt.Errorf("ошибка парсинга multipart ответа: %w. Ответ: %s", err, string(responseBody))
+	for _, result := range p.executeTools(ctx, user, mode, thought.ToolCalls, callback) {
+		step := models.ThoughtStep{
+			Iteration: iteration, ToolName: optionalString(result.call.ToolName), Query: optionalString(result.call.ToolQuery),
+			DurationMS: result.duration.Milliseconds(),
+		}
+		if result.err != nil {
+			step.Kind, step.Error = models.ThoughtStepToolError, optionalString(result.err.Error())
+			trace.add(map[string]interface{}{"type": step.Kind, "tool_name": result.call.ToolName, "error": result.err.Error()}, step)
+		} else {
+			step.Kind, step.Output = models.ThoughtStepToolOutput, &result.output
+			trace.add(map[string]interface{}{"type": step.Kind, "tool_name": result.call.ToolName, "output": result.output}, step)
+		}
 	}
-	return &response, nil
 }
 
-func (p *Processor) executeTools(toolCalls []models.ToolCall, callback EventCallback) []map[string]interface{} {
+// toolResult — итог одного вызова инструмента.
+type toolResult struct {
+	call     models.ToolCall
+	output   string
+	err      error
+	duration time.Duration
+}
+
+func (p *Processor) executeTools(ctx context.Context, user *models.User, mode modes.Mode, toolCalls []models.ToolCall, callback EventCallback) []toolResult {
 	var wg sync.WaitGroup
-	resultsChan := make(chan map[string]interface{}, len(toolCalls))
+	resultsChan := make(chan toolResult, len(toolCalls))
 	for _, toolCall := range toolCalls {
 		wg.Add(1)
 		go func(tc models.ToolCall) {
 			defer wg.Done()
-			callback("tool_call", tc)
-			toolResult, err := p.callPythonTool(tc.ToolName, tc.ToolQuery)
-			if err != nil {
-				log.Printf("!!! Ошибка вызова инструмента '%s': %v", tc.ToolName, err)
-				resultsChan <- map[string]interface{}{"type": "tool_error", "tool_name": tc.ToolName, "error": err.Error()}
-			} else {
-				resultsChan <- map[string]interface{}{"type": "tool_output", "tool_name": tc.ToolName, "output": toolResult}
+			callback(protocol.ToolCallEvent{ToolName: tc.ToolName, ToolQuery: tc.ToolQuery})
+			result := toolResult{call: tc}
+			started := time.Now()
+			switch {
+			case !mode.AllowsTool(tc.ToolName):
+				result.err = apperr.New(apperr.ToolFailed).WithDetail("инструмент %s недоступен в режиме %s", tc.ToolName, mode.ID)
+			case tc.ToolName == memoryToolName:
+				result.output, result.err = p.runMemoryTool(user.ID, tc.ToolQuery)
+			default:
+				result.output, result.err = p.callPythonTool(ctx, tc.ToolName, tc.ToolQuery)
+			}
+			result.duration = time.Since(started)
+			if result.err != nil {
+				log.Printf("!!! Ошибка вызова инструмента '%s': %v", tc.ToolName, result.err)
 			}
+			resultsChan <- result
 		}(toolCall)
 	}
 	wg.Wait()
 	close(resultsChan)
-	var results []map[string]interface{}
+	var results []toolResult
 	for result := range resultsChan {
 		results = append(results, result)
-		callback(result["type"].(string), result)
-	}
-	return results
-}
-
-func (p *Processor) processPythonMultipartStream(endpoint string, requestData models.PythonRequest, files []models.FilePayload, callback EventCallback) (string, error) {
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-	jsonPart, err := json.Marshal(requestData)
-	if err != nil {
-		return "", fmt.Errorf("ошибка маршалинга request_data: %w", err)
-	}
-	if err := writer.WriteField("request_data", string(jsonPart)); err != nil {
-		return "", fmt.Errorf("ошибка записи поля request_data: %w", err)
-	}
-	for _, file := range files {
-		fileBytes, err := base64.StdEncoding.DecodeString(file.Base64Data)
-		if err != nil {
-			log.Printf("!!! Ошибка декодирования base64 для файла %s: %v", file.FileName, err)
-			continue
-		}
-		h := make(textproto.MIMEHeader)
-		h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="files"; filename="%s"`, file.FileName))
-		h.Set("Content-Type", file.MimeType)
-		part, err := writer.CreatePart(h)
-		if err != nil {
-			return "", fmt.Errorf("ошибка создания form-file для %s: %w", file.FileName, err)
-		}
-		if _, err := part.Write(fileBytes); err != nil {
-			return "", fmt.Errorf("ошибка записи байтов файла %s: %w", file.FileName, err)
-		}
-	}
-	if err := writer.Close(); err != nil {
-		return "", fmt.Errorf("ошибка закрытия multipart writer: %w", err)
-	}
-	url := p.PythonBackendURL + endpoint
-	req, err := http.NewRequest("POST", url, body)
-	if err != nil {
-		return "", fmt.Errorf("ошибка создания multipart запроса для стрима: %w", err)
-	}
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-	log.Printf("--> [HTTP MULTIPART STREAM] Вызов Python. Эндпоинт: %s. Количество файлов: %d", endpoint, len(files))
-	resp, err := p.httpClient.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("ошибка HTTP POST запроса к Python (стрим): %w", err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("ошибка стрима от Python (статус %d): %s", resp.StatusCode, string(body))
-	}
-	scanner := bufio.NewScanner(resp.Body)
-	buf := make([]byte, 0, 64*1024)
-	scanner.Buffer(buf, 1024*1024)
-	scanner.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
-		if atEOF && len(data) == 0 {
-			return 0, nil, nil
-		}
-		if i := bytes.Index(data, []byte("\n\n")); i >= 0 {
-			return i + 2, data[0:i], nil
-		}
-		if atEOF {
-			return len(data), data, nil
-		}
-		return 0, nil, nil
-	})
-	var fullResponseBuilder strings.Builder
-	for scanner.Scan() {
-		eventBlock := scanner.Bytes()
-		if !bytes.HasPrefix(eventBlock, []byte("data: ")) {
-			continue
-		}
-		jsonPayload := bytes.TrimPrefix(eventBlock, []byte("data: "))
-		if len(jsonPayload) == 0 {
-			continue
-		}
-		var rawEvent map[string]interface{}
-		if err := json.Unmarshal(jsonPayload, &rawEvent); err == nil {
-			if eventType, ok := rawEvent["type"].(string); ok {
-				if data, ok := rawEvent["data"]; ok {
-					callback(eventType, data)
-					if eventType == "chunk" {
-						if dataMap, ok := data.(map[string]interface{}); ok {
-							if text, ok := dataMap["text"].(string); ok {
-								fullResponseBuilder.WriteString(text)
-							}
-						}
-					}
-				}
-			}
+		if result.err != nil {
+			toolErr := apperr.New(apperr.ToolFailed)
+			callback(protocol.ToolErrorEvent{Type: "tool_error", ToolName: result.call.ToolName, Code: string(toolErr.Code), Error: toolErr.Message(i18n.FromContext(ctx))})
 		} else {
-			log.Printf("!!! ОШИБКА ПАРСИНГА JSON из стрима: %v. Payload: %s", err, string(jsonPayload))
+			callback(protocol.ToolOutputEvent{Type: "tool_output", ToolName: result.call.ToolName, Output: result.output})
 		}
 	}
-	if err := scanner.Err(); err != nil {
-		return "", fmt.Errorf("ошибка чтения потока от Python: %w", err)
-	}
-	log.Println("[STREAM] Конец потока от Python.")
-	return fullResponseBuilder.String(), nil
+	return results
 }
 
-func (p *Processor) callPythonTool(toolName, toolQuery string) (string, error) {
+func (p *Processor) callPythonTool(ctx context.Context, toolName, toolQuery string) (string, error) {
 	toolRequestBody := map[string]string{"query": toolQuery}
-	toolResultBody, err := p.callPythonService(fmt.Sprintf("/execute_tool/%s", toolName), toolRequestBody)
+	toolResultBody, err := p.callPythonService(ctx, fmt.Sprintf("/execute_tool/%s", toolName), toolRequestBody)
 	if err != nil {
 		return "", err
 	}
 	var toolResult map[string]string
 	if err := json.Unmarshal(toolResultBody, &toolResult); err != nil {
-		return "", fmt.Errorf("ошибка парсинга результата инструмента: %w", err)
+		return "", apperr.Wrap(apperr.ToolFailed, err).WithDetail("разбор результата %s", toolName)
 	}
 	if result, ok := toolResult["result"]; ok {
 		return result, nil
 	}
-	return "", fmt.Errorf("ключ 'result' не найден в ответе инструмента")
+	return "", apperr.New(apperr.ToolFailed).WithDetail("ключ 'result' не найден в ответе %s", toolName)
 }
 
-func (p *Processor) callPythonService(endpoint string, requestBody interface{}) ([]byte, error) {
+func (p *Processor) callPythonService(ctx context.Context, endpoint string, requestBody interface{}) ([]byte, error) {
 	jsonData, err := json.Marshal(requestBody)
 	if err != nil {
 		return nil, err
 	}
-	url := p.PythonBackendURL + endpoint
+	if p.Python == nil {
+		return nil, apperr.New(apperr.PythonUnavailable).WithDetail("Python-сервис не настроен, %s недоступен", endpoint)
+	}
 	log.Printf("--> [HTTP JSON] Вызов Python. Эндпоинт: %s. Размер тела запроса: %.2f KB", endpoint, float64(len(jsonData))/1024.0)
-	resp, err := p.httpClient.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	resp, err := p.Python.Post(ctx, endpoint, "application/json", jsonData)
 	if err != nil {
 		log.Printf("!!! [HTTP JSON] КРИТИЧЕСКАЯ ОШИБКА вызова Python: %v", err)
 		return nil, err
@@ -508,10 +650,7 @@ func (p *Processor) callPythonService(endpoint string, requestBody interface{})
 	log.Printf("<-- [HTTP JSON] Ответ от Python получен. Статус: %d", resp.StatusCode)
 	responseBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
-	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("python-сервис вернул ошибку (статус %d): %s", resp.StatusCode, string(responseBody))
+		return nil, pythonTransportError(endpoint, err)
 	}
 	return responseBody, nil
 }
@@ -524,23 +663,3 @@ func mustMarshal(v interface{}) string {
 	}
 	return string(bytes)
 }
-
-func (p *Processor) buildChatHistory(logs []models.RequestLog, attachments map[int][]models.FileAttachment) string {
-	var chatHistoryBuilder strings.Builder
-	for _, logEntry := range logs {
-		finalResponseText := ""
-		if logEntry.FinalResponse != nil {
-			finalResponseText = *logEntry.FinalResponse
-		}
-		attachmentsText := ""
-		if attachments, ok := attachments[logEntry.ID]; ok && len(attachments) > 0 {
-			var names []string
-			for _, a := range attachments {
-				names = append(names, a.FileName)
-			}
-			attachmentsText = fmt.Sprintf(" [Attached: %s]", strings.Join(names, ", "))
-		}
-		chatHistoryBuilder.WriteString(fmt.Sprintf("User: %s%s\nEGO: %s\n\n", logEntry.UserQuery, attachmentsText, finalResponseText))
-	}
-	return chatHistoryBuilder.String()
-}
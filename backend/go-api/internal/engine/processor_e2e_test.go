@@ -0,0 +1,243 @@
+package engine_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"egobackend/internal/apperr"
+	"egobackend/internal/engine/enginetest"
+	"egobackend/internal/models"
+	"egobackend/internal/protocol"
+)
+
+func assertTypes(t *testing.T, recorder *enginetest.Recorder, want ...string) {
+	t.Helper()
+	if got := recorder.Types(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("events:\n got  %v\n want %v", got, want)
+	}
+}
+
+func savedSessionID(t *testing.T, recorder *enginetest.Recorder) int {
+	t.Helper()
+	event, ok := recorder.Find("session_created")
+	if !ok {
+		t.Fatalf("no session_created in %v", recorder.Types())
+	}
+	return event.(protocol.SessionCreatedEvent).ID
+}
+
+func TestProcessRequestWithTool(t *testing.T) {
+	h := enginetest.NewHarness(t, enginetest.Script{
+		Thoughts: []enginetest.ThoughtStep{
+			enginetest.Thought("Ищу в Википедии", true, models.ToolCall{ToolName: "EgoWiki", ToolQuery: "Go язык"}),
+			enginetest.Thought("Отвечаю", false),
+		},
+		Tools:     map[string][]enginetest.ToolStep{"EgoWiki": {{Result: "Go — язык программирования."}}},
+		Synthesis: []enginetest.StreamStep{{Chunks: []string{"Go — ", "язык ", "от Google."}}},
+		Title:     "Язык Go",
+	})
+
+	recorder := h.Run(t, context.Background(), models.StreamRequest{Query: "Что такое Go?", TempID: 7})
+
+	assertTypes(t, recorder,
+		"session_created",
+		"thought_header", "tool_call", "tool_output",
+		"thought_header",
+		"chunk", "log_saved", "done")
+	if queries := h.Python.ToolQueries("EgoWiki"); len(queries) != 1 || queries[0] != "Go язык" {
+		t.Errorf("tool queries = %v", queries)
+	}
+	thoughtRequests := h.Python.Requests("/generate_thought")
+	if len(thoughtRequests) != 2 || !strings.Contains(thoughtRequests[1].ThoughtsHistory, "Go — язык программирования.") {
+		t.Errorf("второй шаг мышления не получил результат инструмента: %+v", thoughtRequests)
+	}
+
+	event, _ := recorder.Find("log_saved")
+	saved := event.(protocol.LogSavedEvent)
+	if saved.TempID != 7 {
+		t.Errorf("log_saved temp_id = %d", saved.TempID)
+	}
+	logs := h.SessionLogs(t, savedSessionID(t, recorder))
+	if len(logs) != 1 {
+		t.Fatalf("logs = %d, want 1", len(logs))
+	}
+	entry := logs[0]
+	if int64(entry.ID) != saved.DBID || entry.UserQuery != "Что такое Go?" {
+		t.Errorf("log = %+v", entry)
+	}
+	if entry.FinalResponse == nil || *entry.FinalResponse != "Go — язык от Google." {
+		t.Errorf("final response = %v", entry.FinalResponse)
+	}
+	var thoughts []map[string]interface{}
+	if err := json.Unmarshal([]byte(entry.EgoThoughtsJSON), &thoughts); err != nil {
+		t.Fatalf("ego_thoughts_json: %v", err)
+	}
+	var kinds []string
+	for _, thought := range thoughts {
+		kinds = append(kinds, thought["type"].(string))
+	}
+	if want := []string{"thought", "tool_output", "thought"}; !reflect.DeepEqual(kinds, want) {
+		t.Errorf("thought kinds = %v, want %v", kinds, want)
+	}
+
+	steps, err := h.DB.GetThoughtTrace(saved.DBID)
+	if err != nil {
+		t.Fatalf("GetThoughtTrace: %v", err)
+	}
+	var stepKinds []string
+	var iterations []int
+	for _, step := range steps {
+		stepKinds = append(stepKinds, step.Kind)
+		iterations = append(iterations, step.Iteration)
+	}
+	if want := []string{"thought", "tool_output", "thought"}; !reflect.DeepEqual(stepKinds, want) || !reflect.DeepEqual(iterations, []int{1, 1, 2}) {
+		t.Errorf("trace = %v %v, want %v [1 1 2]", stepKinds, iterations, want)
+	} else {
+		if steps[0].Header == nil || *steps[0].Header != "Ищу в Википедии" || steps[0].Confidence == nil || *steps[0].Confidence != 0.9 {
+			t.Errorf("thought step = %+v", steps[0])
+		}
+		if tool := steps[1]; tool.ToolName == nil || *tool.ToolName != "EgoWiki" || tool.Query == nil || *tool.Query != "Go язык" || tool.Output == nil || *tool.Output != "Go — язык программирования." {
+			t.Errorf("tool step = %+v", tool)
+		}
+	}
+
+	if !enginetest.Eventually(t, 5*time.Second, func() bool { _, ok := h.Published.Find("session_updated"); return ok }) {
+		t.Error("название сессии не опубликовано")
+	}
+}
+
+func TestProcessRequestToolErrorDoesNotStopRun(t *testing.T) {
+	h := enginetest.NewHarness(t, enginetest.Script{
+		Thoughts: []enginetest.ThoughtStep{
+			enginetest.Thought("Считаю", true, models.ToolCall{ToolName: "EgoCalc", ToolQuery: "2+2"}),
+			enginetest.Thought("Отвечаю", false),
+		},
+		Tools:     map[string][]enginetest.ToolStep{"EgoCalc": {{Status: http.StatusInternalServerError}}},
+		Synthesis: []enginetest.StreamStep{{Chunks: []string{"Не получилось посчитать."}}},
+	})
+
+	recorder := h.Run(t, context.Background(), models.StreamRequest{Query: "2+2"})
+
+	assertTypes(t, recorder,
+		"session_created",
+		"thought_header", "tool_call", "tool_error",
+		"thought_header",
+		"chunk", "log_saved", "done")
+	logs := h.SessionLogs(t, savedSessionID(t, recorder))
+	if len(logs) != 1 || !strings.Contains(logs[0].EgoThoughtsJSON, "tool_error") {
+		t.Errorf("logs = %+v", logs)
+	}
+}
+
+func TestProcessRequestPythonUnavailable(t *testing.T) {
+	h := enginetest.NewHarness(t, enginetest.Script{
+		Thoughts: []enginetest.ThoughtStep{{Status: http.StatusServiceUnavailable}},
+	})
+
+	recorder := h.Run(t, context.Background(), models.StreamRequest{Query: "привет"})
+
+	assertTypes(t, recorder, "session_created", "error")
+	event, _ := recorder.Find("error")
+	if code := event.(protocol.ErrorEvent).Code; code != string(apperr.PythonUnavailable) {
+		t.Errorf("error code = %q", code)
+	}
+	if calls := h.Python.Calls("/generate_thought"); calls != 3 {
+		t.Errorf("generate_thought calls = %d, want 3", calls)
+	}
+	if logs := h.SessionLogs(t, savedSessionID(t, recorder)); len(logs) != 0 {
+		t.Errorf("после ошибки сохранено %d логов", len(logs))
+	}
+}
+
+func TestProcessRequestSlowStreamCancelled(t *testing.T) {
+	h := enginetest.NewHarness(t, enginetest.Script{
+		Thoughts:  []enginetest.ThoughtStep{enginetest.Thought("Отвечаю", false)},
+		Synthesis: []enginetest.StreamStep{{Chunks: []string{"Медленно", "...", "..."}, ChunkDelay: 10 * time.Second}},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		// Отменяем, как только пришел первый кусок ответа.
+		for ctx.Err() == nil {
+			if calls := h.Python.Calls("/synthesize_stream"); calls > 0 {
+				time.Sleep(200 * time.Millisecond)
+				cancel()
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+
+	recorder := h.Run(t, ctx, models.StreamRequest{Query: "расскажи длинно"})
+
+	assertTypes(t, recorder, "session_created", "thought_header", "chunk", "cancelled")
+	if logs := h.SessionLogs(t, savedSessionID(t, recorder)); len(logs) != 0 {
+		t.Errorf("после отмены сохранено %d логов", len(logs))
+	}
+}
+
+func TestProcessRequestRegeneration(t *testing.T) {
+	h := enginetest.NewHarness(t, enginetest.Script{
+		Thoughts: []enginetest.ThoughtStep{enginetest.Thought("Отвечаю", false)},
+		Synthesis: []enginetest.StreamStep{
+			{Chunks: []string{"Первый ответ"}},
+			{Chunks: []string{"Второй ответ"}},
+		},
+	})
+
+	first := h.Run(t, context.Background(), models.StreamRequest{Query: "вопрос"})
+	event, ok := first.Find("log_saved")
+	if !ok {
+		t.Fatalf("первый запуск: %v", first.Types())
+	}
+	logID := event.(protocol.LogSavedEvent).DBID
+
+	second := h.Run(t, context.Background(), models.StreamRequest{IsRegeneration: true, RequestLogIDToRegen: logID, TempID: 9})
+
+	assertTypes(t, second, "thought_header", "chunk", "log_updated", "done")
+	logs := h.SessionLogs(t, savedSessionID(t, first))
+	if len(logs) != 1 || logs[0].FinalResponse == nil || *logs[0].FinalResponse != "Второй ответ" {
+		t.Errorf("logs = %+v", logs)
+	}
+	if requests := h.Python.Requests("/synthesize_stream"); len(requests) != 2 || requests[1].Query != "вопрос" {
+		t.Errorf("synthesis requests = %+v", requests)
+	}
+}
+
+func TestProcessRequestSessionMode(t *testing.T) {
+	h := enginetest.NewHarness(t, enginetest.Script{
+		Thoughts:  []enginetest.ThoughtStep{enginetest.Thought("Отвечаю", false)},
+		Synthesis: []enginetest.StreamStep{{Chunks: []string{"Ответ"}}},
+	})
+
+	first := h.Run(t, context.Background(), models.StreamRequest{Query: "первый"})
+	sessionID := savedSessionID(t, first)
+	if err := h.DB.UpdateSessionMode(sessionID, h.User.ID, "research"); err != nil {
+		t.Fatalf("UpdateSessionMode: %v", err)
+	}
+
+	// Запрос без режима идет в режиме сессии.
+	h.Run(t, context.Background(), models.StreamRequest{Query: "второй", SessionID: &sessionID})
+	// Явный режим запроса сохраняется в сессии.
+	h.Run(t, context.Background(), models.StreamRequest{Query: "третий", SessionID: &sessionID, Mode: "deeper"})
+
+	var sent []string
+	for _, request := range h.Python.Requests("/generate_thought") {
+		sent = append(sent, request.Mode)
+	}
+	if want := []string{"default", "research", "deeper"}; !reflect.DeepEqual(sent, want) {
+		t.Errorf("modes = %v, want %v", sent, want)
+	}
+	session, err := h.DB.GetSessionByID(sessionID, h.User.ID)
+	if err != nil {
+		t.Fatalf("GetSessionByID: %v", err)
+	}
+	if session.Mode != "deeper" {
+		t.Errorf("session mode = %q, want deeper", session.Mode)
+	}
+}
@@ -0,0 +1,247 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"egobackend/internal/apperr"
+)
+
+const (
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 8 * time.Second
+
+	// После breakerThreshold подряд неудачных вызовов воркер считается
+	// недоступным на breakerCooldown: запросы сразу получают
+	// python_unavailable, потом один пробный вызов решает, закрыть ли цепь.
+	breakerThreshold = 5
+	breakerCooldown  = 30 * time.Second
+)
+
+// callPolicy — таймаут одной попытки и число попыток для эндпоинта.
+// Повторяются только вызовы без побочных эффектов; стрим синтеза
+// повторяется, лишь пока Python не начал отвечать.
+type callPolicy struct {
+	timeout  time.Duration
+	attempts int
+}
+
+var callPolicies = map[string]callPolicy{
+	"/generate_thought":  {timeout: 3 * time.Minute, attempts: 3},
+	"/execute_tool/":     {timeout: 2 * time.Minute, attempts: 3},
+	"/synthesize_stream": {timeout: 10 * time.Minute, attempts: 2},
+	"/generate_title":    {timeout: 30 * time.Second, attempts: 2},
+	"/summarize_history": {timeout: 2 * time.Minute, attempts: 2},
+}
+
+var defaultCallPolicy = callPolicy{timeout: 2 * time.Minute, attempts: 1}
+
+func policyFor(endpoint string) callPolicy {
+	if policy, ok := callPolicies[endpoint]; ok {
+		return policy
+	}
+	for prefix, policy := range callPolicies {
+		if strings.HasSuffix(prefix, "/") && strings.HasPrefix(endpoint, prefix) {
+			return policy
+		}
+	}
+	return defaultCallPolicy
+}
+
+// PythonClient — общий для всех запусков клиент Python-сервиса: пул
+// воркеров, повторы с backoff, таймауты по эндпоинтам и circuit breaker на
+// каждом воркере. Создается один раз, чтобы состояние пула не терялось
+// между запросами.
+type PythonClient struct {
+	workers    []*pythonWorker
+	httpClient *http.Client
+}
+
+// NewPythonClient принимает список адресов воркеров через запятую. У адреса
+// можно указать вес через "|": "http://py1:8000|2,http://py2:8000".
+func NewPythonClient(urls string) (*PythonClient, error) {
+	workers, err := parseWorkers(urls)
+	if err != nil {
+		return nil, err
+	}
+	return &PythonClient{
+		workers: workers,
+		// Общего таймаута нет: его задает callPolicy каждой попытки.
+		httpClient: &http.Client{},
+	}, nil
+}
+
+// Post отправляет тело в эндпоинт Python и возвращает ответ со статусом
+// 200. Воркер выбирается с учетом привязки запуска (см. WithRunAffinity),
+// при сбое повтор уходит на другой воркер, если он есть. Таймаут попытки
+// действует, пока не закрыт resp.Body, поэтому закрывать его обязательно.
+func (c *PythonClient) Post(ctx context.Context, endpoint, contentType string, body []byte) (*http.Response, error) {
+	policy := policyFor(endpoint)
+	affinity := affinityFrom(ctx)
+	var lastErr error
+	var failed *pythonWorker
+	for attempt := 1; attempt <= policy.attempts; attempt++ {
+		worker := c.pick(affinity, failed)
+		if worker == nil {
+			if lastErr != nil {
+				return nil, lastErr
+			}
+			return nil, apperr.New(apperr.PythonUnavailable).WithDetail("нет доступных Python-воркеров для %s", endpoint)
+		}
+
+		resp, err, retryable := c.attempt(ctx, worker, endpoint, contentType, body, policy.timeout)
+		if err == nil {
+			worker.breaker.success(worker.url)
+			return resp, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			worker.breaker.release()
+			return nil, ctx.Err()
+		}
+		if !retryable {
+			// Python ответил, значит воркер жив, даже если запрос не удался.
+			worker.breaker.success(worker.url)
+			return nil, err
+		}
+		failed = worker
+		opened := worker.breaker.failure(worker.url, endpoint)
+		if attempt == policy.attempts || (opened && !c.hasUsableWorker()) {
+			break
+		}
+		delay := backoffDelay(attempt)
+		log.Printf("!!! [PYTHON] %s на %s: попытка %d/%d не удалась: %v. Повтор через %s", endpoint, worker.url, attempt, policy.attempts, err, delay.Round(time.Millisecond))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return nil, lastErr
+}
+
+// attempt делает одну попытку на воркере. retryable сообщает, стоит ли
+// повторять: сетевые ошибки, таймаут попытки и 502/503/504.
+func (c *PythonClient) attempt(ctx context.Context, worker *pythonWorker, endpoint, contentType string, body []byte, timeout time.Duration) (*http.Response, error, bool) {
+	attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+	worker.inFlight.Add(1)
+	done := func() {
+		cancel()
+		worker.inFlight.Add(-1)
+	}
+
+	req, err := http.NewRequestWithContext(attemptCtx, "POST", worker.url+endpoint, bytes.NewReader(body))
+	if err != nil {
+		done()
+		return nil, err, false
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		done()
+		return nil, pythonTransportError(endpoint, err), true
+	}
+	if resp.StatusCode != http.StatusOK {
+		responseBody, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		done()
+		err := pythonStatusError(endpoint, resp.StatusCode, responseBody)
+		return nil, err, apperr.Is(err, apperr.PythonUnavailable)
+	}
+	// Стрим синтеза занимает воркер, пока его читают, поэтому счетчик
+	// уменьшается при закрытии тела, а не при получении заголовков.
+	resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: done}
+	return resp, nil, false
+}
+
+// backoffDelay — экспоненциальная задержка с полным джиттером, чтобы
+// запуски, упавшие одновременно, не повторяли запросы синхронно.
+func backoffDelay(attempt int) time.Duration {
+	ceiling := retryBaseDelay << (attempt - 1)
+	if ceiling > retryMaxDelay || ceiling <= 0 {
+		ceiling = retryMaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(ceiling))) + retryBaseDelay/2
+}
+
+type releaseOnClose struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (r *releaseOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
+
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// usable сообщает, примет ли breaker вызов, ничего не меняя. Нужен при
+// выборе воркера, чтобы не занять пробный вызов у кандидатов.
+func (b *circuitBreaker) usable() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures < breakerThreshold || (!time.Now().Before(b.openUntil) && !b.probing)
+}
+
+// allow решает, можно ли вызывать воркер. Когда цепь разомкнута и
+// cooldown прошел, пропускается ровно один пробный вызов.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < breakerThreshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *circuitBreaker) success(workerURL string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures >= breakerThreshold {
+		log.Printf("[PYTHON] Воркер %s снова отвечает, circuit breaker закрыт.", workerURL)
+	}
+	b.failures = 0
+	b.probing = false
+}
+
+// failure учитывает неудачный вызов и сообщает, разомкнута ли теперь цепь.
+func (b *circuitBreaker) failure(workerURL, endpoint string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = false
+	if b.failures >= breakerThreshold {
+		b.openUntil = time.Now().Add(breakerCooldown)
+		log.Printf("!!! [PYTHON] Воркер %s: %d неудачных вызовов подряд (последний — %s), circuit breaker открыт на %s.", workerURL, b.failures, endpoint, breakerCooldown)
+		return true
+	}
+	return false
+}
+
+// release снимает пробный вызов, результат которого неизвестен: например,
+// запуск отменил пользователь.
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
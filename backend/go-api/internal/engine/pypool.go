@@ -0,0 +1,219 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	healthCheckInterval = 10 * time.Second
+	healthCheckTimeout  = 5 * time.Second
+	// После ejectAfterFailures подряд неудачных проверок /health воркер
+	// исключается из ротации до первой успешной проверки.
+	ejectAfterFailures = 2
+)
+
+type pythonWorker struct {
+	url      string
+	weight   int
+	inFlight atomic.Int64
+	breaker  circuitBreaker
+
+	mu             sync.Mutex
+	healthy        bool
+	healthFailures int
+}
+
+func (w *pythonWorker) isHealthy() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.healthy
+}
+
+func (w *pythonWorker) usable() bool {
+	return w.isHealthy() && w.breaker.usable()
+}
+
+func parseWorkers(urls string) ([]*pythonWorker, error) {
+	var workers []*pythonWorker
+	for _, entry := range strings.Split(urls, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		rawURL, rawWeight, hasWeight := strings.Cut(entry, "|")
+		rawURL = strings.TrimRight(strings.TrimSpace(rawURL), "/")
+		weight := 1
+		if hasWeight {
+			parsed, err := strconv.Atoi(strings.TrimSpace(rawWeight))
+			if err != nil || parsed < 1 {
+				return nil, fmt.Errorf("неверный вес воркера %q", entry)
+			}
+			weight = parsed
+		}
+		if _, err := url.ParseRequestURI(rawURL); err != nil {
+			return nil, fmt.Errorf("неверный адрес воркера %q: %w", rawURL, err)
+		}
+		workers = append(workers, &pythonWorker{
+			url:     rawURL,
+			weight:  weight,
+			healthy: true,
+		})
+	}
+	if len(workers) == 0 {
+		return nil, fmt.Errorf("не задан ни один адрес Python-воркера")
+	}
+	return workers, nil
+}
+
+// pick выбирает воркер для вызова. Если у запуска уже есть воркер и он
+// доступен, используется он; иначе берется доступный воркер с наименьшей
+// нагрузкой на единицу веса, и запуск привязывается к нему. Воркер avoid
+// (только что не ответивший) выбирается, лишь если других нет.
+func (c *PythonClient) pick(affinity *runAffinity, avoid *pythonWorker) *pythonWorker {
+	if affinity != nil {
+		if worker := affinity.get(); worker != nil && worker != avoid && worker.usable() && worker.breaker.allow() {
+			return worker
+		}
+	}
+
+	excluded := make(map[*pythonWorker]bool)
+	if avoid != nil && len(c.workers) > 1 {
+		excluded[avoid] = true
+	}
+	for {
+		var best *pythonWorker
+		for _, worker := range c.workers {
+			if excluded[worker] || !worker.usable() {
+				continue
+			}
+			// Сравниваем inFlight/weight без деления.
+			if best == nil || worker.inFlight.Load()*int64(best.weight) < best.inFlight.Load()*int64(worker.weight) {
+				best = worker
+			}
+		}
+		if best == nil {
+			if avoid != nil && excluded[avoid] && avoid.usable() && avoid.breaker.allow() {
+				return avoid
+			}
+			return nil
+		}
+		// Между usable и allow пробный вызов мог занять другой запуск.
+		if !best.breaker.allow() {
+			excluded[best] = true
+			continue
+		}
+		if affinity != nil {
+			if previous := affinity.set(best); previous != nil && previous != best {
+				log.Printf("[PYTHON] Запуск переведен с воркера %s на %s.", previous.url, best.url)
+			}
+		}
+		return best
+	}
+}
+
+// RunHealthChecks периодически опрашивает /health каждого воркера и
+// исключает из ротации тех, кто не отвечает. Блокирует, запускать в
+// отдельной горутине.
+func (c *PythonClient) RunHealthChecks() {
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		var wg sync.WaitGroup
+		for _, worker := range c.workers {
+			wg.Add(1)
+			go func(w *pythonWorker) {
+				defer wg.Done()
+				c.checkHealth(w)
+			}(worker)
+		}
+		wg.Wait()
+	}
+}
+
+func (c *PythonClient) checkHealth(worker *pythonWorker) {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	var probeErr error
+	req, err := http.NewRequestWithContext(ctx, "GET", worker.url+"/health", nil)
+	if err == nil {
+		var resp *http.Response
+		resp, probeErr = c.httpClient.Do(req)
+		if probeErr == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				probeErr = fmt.Errorf("статус %d", resp.StatusCode)
+			}
+		}
+	} else {
+		probeErr = err
+	}
+
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+	if probeErr == nil {
+		if !worker.healthy {
+			log.Printf("[PYTHON] Воркер %s прошел проверку /health и возвращен в ротацию.", worker.url)
+		}
+		worker.healthy = true
+		worker.healthFailures = 0
+		return
+	}
+	worker.healthFailures++
+	if worker.healthy && worker.healthFailures >= ejectAfterFailures {
+		worker.healthy = false
+		log.Printf("!!! [PYTHON] Воркер %s исключен из ротации: %d неудачных проверок /health подряд (%v).", worker.url, worker.healthFailures, probeErr)
+	}
+}
+
+// runAffinity привязывает все вызовы одного запуска к одному воркеру:
+// итерации мышления и синтез одного ответа обслуживает один процесс Python.
+type runAffinity struct {
+	mu     sync.Mutex
+	worker *pythonWorker
+}
+
+func (a *runAffinity) get() *pythonWorker {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.worker
+}
+
+func (a *runAffinity) set(worker *pythonWorker) *pythonWorker {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	previous := a.worker
+	a.worker = worker
+	return previous
+}
+
+type affinityKey struct{}
+
+// WithRunAffinity помечает контекст запуска: все вызовы Python с этим
+// контекстом пойдут на один воркер, пока он доступен.
+func WithRunAffinity(ctx context.Context) context.Context {
+	return context.WithValue(ctx, affinityKey{}, &runAffinity{})
+}
+
+func affinityFrom(ctx context.Context) *runAffinity {
+	affinity, _ := ctx.Value(affinityKey{}).(*runAffinity)
+	return affinity
+}
+
+func (c *PythonClient) hasUsableWorker() bool {
+	for _, worker := range c.workers {
+		if worker.usable() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,158 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+
+	"egobackend/internal/apperr"
+	"egobackend/internal/models"
+	"egobackend/internal/protocol"
+)
+
+// PythonBackend думает и пишет ответ через Python-сервис: /generate_thought
+// и /synthesize_stream. Промпты режимов живут на стороне Python.
+type PythonBackend struct {
+	Client *PythonClient
+}
+
+func (b *PythonBackend) Think(ctx context.Context, requestData models.PythonRequest, files []models.FilePayload) (*models.ThoughtResponseWithData, error) {
+	body, contentType, err := buildMultipartBody(requestData, files)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("--> [HTTP MULTIPART] Вызов Python. Эндпоинт: /generate_thought. Количество файлов: %d", len(files))
+	resp, err := b.Client.Post(ctx, "/generate_thought", contentType, body)
+	if err != nil {
+		log.Printf("!!! [HTTP MULTIPART] КРИТИЧЕСКАЯ ОШИБКА вызова Python: %v", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	log.Printf("<-- [HTTP MULTIPART] Ответ от Python получен. Статус: %d", resp.StatusCode)
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, pythonTransportError("/generate_thought", err)
+	}
+	var response models.ThoughtResponseWithData
+	if err := json.Unmarshal(responseBody, &response); err != nil {
+		return nil, apperr.Wrap(apperr.GenerationFailed, err).WithDetail("разбор ответа /generate_thought: %s", truncateString(string(responseBody), 2000))
+	}
+	return &response, nil
+}
+
+func (b *PythonBackend) Synthesize(ctx context.Context, requestData models.PythonRequest, files []models.FilePayload, callback EventCallback) (string, error) {
+	const endpoint = "/synthesize_stream"
+	body, contentType, err := buildMultipartBody(requestData, files)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("--> [HTTP MULTIPART STREAM] Вызов Python. Эндпоинт: %s. Количество файлов: %d", endpoint, len(files))
+	resp, err := b.Client.Post(ctx, endpoint, contentType, body)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	buf := make([]byte, 0, 64*1024)
+	scanner.Buffer(buf, 1024*1024)
+	scanner.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		if atEOF && len(data) == 0 {
+			return 0, nil, nil
+		}
+		if i := bytes.Index(data, []byte("\n\n")); i >= 0 {
+			return i + 2, data[0:i], nil
+		}
+		if atEOF {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+	var fullResponseBuilder strings.Builder
+	for scanner.Scan() {
+		eventBlock := scanner.Bytes()
+		if !bytes.HasPrefix(eventBlock, []byte("data: ")) {
+			continue
+		}
+		jsonPayload := bytes.TrimPrefix(eventBlock, []byte("data: "))
+		if len(jsonPayload) == 0 {
+			continue
+		}
+		var rawEvent struct {
+			Type string          `json:"type"`
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(jsonPayload, &rawEvent); err == nil {
+			if rawEvent.Type == "" || len(rawEvent.Data) == 0 {
+				continue
+			}
+			switch rawEvent.Type {
+			case "chunk":
+				var chunk protocol.ChunkEvent
+				if err := json.Unmarshal(rawEvent.Data, &chunk); err == nil {
+					callback(chunk)
+					fullResponseBuilder.WriteString(chunk.Text)
+				}
+			case "error":
+				var streamErr protocol.ErrorEvent
+				if err := json.Unmarshal(rawEvent.Data, &streamErr); err == nil {
+					reportError(ctx, callback, apperr.New(apperr.GenerationFailed).WithDetail("%s прислал ошибку: %s", endpoint, streamErr.Message))
+				}
+			default:
+				var data interface{}
+				if err := json.Unmarshal(rawEvent.Data, &data); err == nil {
+					callback(protocol.RawEvent{Type: rawEvent.Type, Data: data})
+				}
+			}
+		} else {
+			log.Printf("!!! ОШИБКА ПАРСИНГА JSON из стрима: %v. Payload: %s", err, string(jsonPayload))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", apperr.Wrap(apperr.PythonUnavailable, err).WithDetail("чтение потока %s", endpoint)
+	}
+	log.Println("[STREAM] Конец потока от Python.")
+	return fullResponseBuilder.String(), nil
+}
+
+// buildMultipartBody собирает тело запроса с request_data и файлами.
+// Тело целиком в памяти, чтобы его можно было отправить повторно.
+func buildMultipartBody(requestData models.PythonRequest, files []models.FilePayload) ([]byte, string, error) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	jsonPart, err := json.Marshal(requestData)
+	if err != nil {
+		return nil, "", fmt.Errorf("ошибка маршалинга request_data: %w", err)
+	}
+	if err := writer.WriteField("request_data", string(jsonPart)); err != nil {
+		return nil, "", fmt.Errorf("ошибка записи поля request_data: %w", err)
+	}
+	for _, file := range files {
+		fileBytes, err := base64.StdEncoding.DecodeString(file.Base64Data)
+		if err != nil {
+			log.Printf("!!! Ошибка декодирования base64 для файла %s: %v", file.FileName, err)
+			continue
+		}
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="files"; filename="%s"`, file.FileName))
+		h.Set("Content-Type", file.MimeType)
+		part, err := writer.CreatePart(h)
+		if err != nil {
+			return nil, "", fmt.Errorf("ошибка создания form-file для %s: %w", file.FileName, err)
+		}
+		if _, err := part.Write(fileBytes); err != nil {
+			return nil, "", fmt.Errorf("ошибка записи байтов файла %s: %w", file.FileName, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, "", fmt.Errorf("ошибка закрытия multipart writer: %w", err)
+	}
+	return body.Bytes(), writer.FormDataContentType(), nil
+}
@@ -0,0 +1,133 @@
+package engine_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"egobackend/internal/apperr"
+	"egobackend/internal/engine/enginetest"
+	"egobackend/internal/models"
+	"egobackend/internal/protocol"
+)
+
+func TestPythonThinkSendsRequestData(t *testing.T) {
+	fake := enginetest.NewFakePython(t, enginetest.Script{
+		Thoughts: []enginetest.ThoughtStep{enginetest.Thought("Ищу", false, models.ToolCall{ToolName: "EgoWiki", ToolQuery: "Go"})},
+	})
+	backends := fake.Backends(t)
+
+	data, err := backends.Thinker.Think(context.Background(), models.PythonRequest{
+		Query: "что такое Go?", Mode: "default", AllowedTools: []string{"EgoWiki"},
+	}, nil)
+	if err != nil {
+		t.Fatalf("Think: %v", err)
+	}
+	if data.Thought.ThoughtHeader != "Ищу" || len(data.Thought.ToolCalls) != 1 {
+		t.Errorf("thought = %+v", data.Thought)
+	}
+	requests := fake.Requests("/generate_thought")
+	if len(requests) != 1 || requests[0].Query != "что такое Go?" || len(requests[0].AllowedTools) != 1 {
+		t.Errorf("requests = %+v", requests)
+	}
+}
+
+func TestPythonThinkRetriesUnavailable(t *testing.T) {
+	fake := enginetest.NewFakePython(t, enginetest.Script{
+		Thoughts: []enginetest.ThoughtStep{
+			{Status: http.StatusServiceUnavailable},
+			enginetest.Thought("Готово", false),
+		},
+	})
+
+	data, err := fake.Backends(t).Thinker.Think(context.Background(), models.PythonRequest{Query: "q"}, nil)
+	if err != nil {
+		t.Fatalf("Think: %v", err)
+	}
+	if data.Thought.ThoughtHeader != "Готово" {
+		t.Errorf("thought = %+v", data.Thought)
+	}
+	if calls := fake.Calls("/generate_thought"); calls != 2 {
+		t.Errorf("calls = %d, want 2", calls)
+	}
+}
+
+func TestPythonThinkDoesNotRetryGenerationError(t *testing.T) {
+	fake := enginetest.NewFakePython(t, enginetest.Script{
+		Thoughts: []enginetest.ThoughtStep{{Status: http.StatusInternalServerError}},
+	})
+
+	_, err := fake.Backends(t).Thinker.Think(context.Background(), models.PythonRequest{Query: "q"}, nil)
+	if !apperr.Is(err, apperr.GenerationFailed) {
+		t.Fatalf("err = %v, want generation_failed", err)
+	}
+	if calls := fake.Calls("/generate_thought"); calls != 1 {
+		t.Errorf("calls = %d, want 1", calls)
+	}
+}
+
+func TestPythonSynthesizeStreamsChunks(t *testing.T) {
+	fake := enginetest.NewFakePython(t, enginetest.Script{
+		Synthesis: []enginetest.StreamStep{{Chunks: []string{"При", "вет"}}},
+	})
+	recorder := &enginetest.Recorder{}
+
+	text, err := fake.Backends(t).Synthesizer.Synthesize(context.Background(), models.PythonRequest{Query: "q"}, nil, recorder.Callback)
+	if err != nil {
+		t.Fatalf("Synthesize: %v", err)
+	}
+	if text != "Привет" || recorder.Text() != "Привет" {
+		t.Errorf("text = %q, streamed = %q", text, recorder.Text())
+	}
+	if got := len(recorder.Events()); got != 2 {
+		t.Errorf("events = %d, want 2", got)
+	}
+}
+
+func TestPythonSynthesizeReportsStreamError(t *testing.T) {
+	fake := enginetest.NewFakePython(t, enginetest.Script{
+		Synthesis: []enginetest.StreamStep{{Chunks: []string{"Нача"}, Error: "model overloaded"}},
+	})
+	recorder := &enginetest.Recorder{}
+
+	text, err := fake.Backends(t).Synthesizer.Synthesize(context.Background(), models.PythonRequest{Query: "q"}, nil, recorder.Callback)
+	if err != nil {
+		t.Fatalf("Synthesize: %v", err)
+	}
+	if text != "Нача" {
+		t.Errorf("text = %q", text)
+	}
+	event, ok := recorder.Find("error")
+	if !ok {
+		t.Fatalf("no error event in %v", recorder.Types())
+	}
+	if code := event.(protocol.ErrorEvent).Code; code != string(apperr.GenerationFailed) {
+		t.Errorf("error code = %q", code)
+	}
+}
+
+func TestPythonSynthesizeStopsOnCancel(t *testing.T) {
+	fake := enginetest.NewFakePython(t, enginetest.Script{
+		Synthesis: []enginetest.StreamStep{{Chunks: []string{"один ", "два ", "три"}, ChunkDelay: 5 * time.Second}},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var events []protocol.Event
+	callback := func(event protocol.Event) {
+		events = append(events, event)
+		cancel()
+	}
+
+	start := time.Now()
+	_, err := fake.Backends(t).Synthesizer.Synthesize(ctx, models.PythonRequest{Query: "q"}, nil, callback)
+	if err == nil {
+		t.Fatal("Synthesize finished without error after cancel")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("cancel took %s", elapsed)
+	}
+	if len(events) != 1 {
+		t.Errorf("events = %d, want 1", len(events))
+	}
+}
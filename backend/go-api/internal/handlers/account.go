@@ -0,0 +1,255 @@
+package handlers
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"egobackend/internal/apperr"
+	"egobackend/internal/database"
+	"egobackend/internal/i18n"
+	"egobackend/internal/models"
+	"egobackend/internal/storage"
+)
+
+type AccountHandler struct {
+	DB               database.Store
+	S3Service        *storage.S3Service
+	PurgeGracePeriod time.Duration
+	// Auth повторно проверяет пароль перед удалением аккаунта.
+	Auth *AuthHandler
+}
+
+// ExportData отдает zip со всеми данными пользователя. Архив пишется
+// прямо в ответ, поэтому после первого байта статус уже не поменять —
+// ошибки по ходу только логируются.
+func (h *AccountHandler) ExportData(w http.ResponseWriter, r *http.Request) {
+	user, ok := r.Context().Value(UserContextKey).(*models.User)
+	if !ok {
+		RespondWithError(w, r, apperr.New(apperr.Unauthorized))
+		return
+	}
+
+	sessions, err := h.DB.GetUserSessions(user.ID)
+	if err != nil {
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("получение сессий"))
+		return
+	}
+	attachments, err := h.DB.GetUserFileAttachments(user.ID)
+	if err != nil {
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("получение вложений"))
+		return
+	}
+	logAttachments, err := h.DB.GetUserLogAttachments(user.ID)
+	if err != nil {
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("получение вложений логов"))
+		return
+	}
+
+	memories, err := h.DB.GetUserMemories(user.ID)
+	if err != nil {
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("получение памяти"))
+		return
+	}
+	presets, err := h.DB.GetUserPresets(user.ID)
+	if err != nil {
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("получение пресетов"))
+		return
+	}
+
+	// Файл может быть приложен к нескольким сообщениям; в архив он
+	// попадает один раз, а сообщения ссылаются на него по пути.
+	attachmentsByLog := make(map[int][]models.ExportAttachmentRecord)
+	linked := make(map[int64]bool)
+	for logID, files := range logAttachments {
+		for _, att := range files {
+			attachmentsByLog[logID] = append(attachmentsByLog[logID], exportAttachmentRecord(att))
+			linked[att.ID] = true
+		}
+	}
+	var unlinked []models.ExportAttachmentRecord
+	for _, att := range attachments {
+		if !linked[att.ID] {
+			unlinked = append(unlinked, exportAttachmentRecord(att))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="ego-export-%d-%s.zip"`, user.ID, time.Now().UTC().Format("20060102")))
+	w.WriteHeader(http.StatusOK)
+
+	zw := zip.NewWriter(w)
+	defer func() {
+		if err := zw.Close(); err != nil {
+			log.Printf("!!! [EXPORT] Ошибка завершения архива для пользователя %d: %v", user.ID, err)
+		}
+	}()
+
+	readme := i18n.T(RequestLocale(r), i18n.ExportReadme, user.Username, time.Now().UTC().Format(time.RFC3339))
+	if err := writeZipFile(zw, "README.txt", []byte(readme)); err != nil {
+		log.Printf("!!! [EXPORT] Ошибка записи README.txt: %v", err)
+		return
+	}
+	if err := writeZipJSON(zw, "account.json", userResponse(user)); err != nil {
+		log.Printf("!!! [EXPORT] Ошибка записи account.json: %v", err)
+		return
+	}
+	if err := writeZipJSON(zw, "memories.json", memories); err != nil {
+		log.Printf("!!! [EXPORT] Ошибка записи memories.json: %v", err)
+		return
+	}
+	if err := writeZipJSON(zw, "presets.json", presets); err != nil {
+		log.Printf("!!! [EXPORT] Ошибка записи presets.json: %v", err)
+		return
+	}
+
+	for _, session := range sessions {
+		logs, err := h.DB.GetAllSessionLogs(session.ID)
+		if err != nil {
+			log.Printf("!!! [EXPORT] Ошибка получения логов сессии %d: %v", session.ID, err)
+			return
+		}
+		logIDs := make([]int, len(logs))
+		for i, l := range logs {
+			logIDs[i] = l.ID
+		}
+		feedbackMap, err := h.DB.GetLogFeedback(user.ID, logIDs)
+		if err != nil {
+			log.Printf("!!! [EXPORT] Ошибка получения оценок сессии %d: %v", session.ID, err)
+			return
+		}
+		exportLogs := make([]models.ExportLog, len(logs))
+		for i, l := range logs {
+			exportLogs[i] = models.ExportLog{
+				ID:               l.ID,
+				UserQuery:        l.UserQuery,
+				FinalResponse:    l.FinalResponse,
+				PromptTokens:     l.PromptTokens,
+				CompletionTokens: l.CompletionTokens,
+				TotalTokens:      l.TotalTokens,
+				Timestamp:        l.Timestamp,
+				Attachments:      attachmentsByLog[l.ID],
+			}
+			if feedback, ok := feedbackMap[l.ID]; ok {
+				exportLogs[i].Feedback = &feedback
+			}
+			if json.Valid([]byte(l.EgoThoughtsJSON)) {
+				exportLogs[i].Thoughts = json.RawMessage(l.EgoThoughtsJSON)
+			}
+		}
+
+		dir := fmt.Sprintf("sessions/%d", session.ID)
+		if err := writeZipJSON(zw, dir+"/session.json", session); err != nil {
+			log.Printf("!!! [EXPORT] Ошибка записи сессии %d: %v", session.ID, err)
+			return
+		}
+		if err := writeZipJSON(zw, dir+"/logs.json", exportLogs); err != nil {
+			log.Printf("!!! [EXPORT] Ошибка записи логов сессии %d: %v", session.ID, err)
+			return
+		}
+	}
+
+	if len(unlinked) > 0 {
+		if err := writeZipJSON(zw, "attachments/unlinked.json", unlinked); err != nil {
+			log.Printf("!!! [EXPORT] Ошибка записи списка вложений: %v", err)
+			return
+		}
+	}
+
+	for _, att := range attachments {
+		if err := h.copyAttachment(r, zw, att); err != nil {
+			log.Printf("!!! [EXPORT] Пропускаю вложение %d (%s): %v", att.ID, att.FileURI, err)
+		}
+	}
+
+	log.Printf("[EXPORT] Пользователь '%s' выгрузил данные: %d сессий, %d вложений.", user.Username, len(sessions), len(attachments))
+}
+
+func (h *AccountHandler) copyAttachment(r *http.Request, zw *zip.Writer, att models.FileAttachment) error {
+	body, err := h.S3Service.OpenFile(r.Context(), att.FileURI)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	entry, err := zw.Create(exportAttachmentPath(att))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, body)
+	return err
+}
+
+// DeleteAccount помечает аккаунт удаленным. Одного токена мало: угнанная
+// сессия не должна стирать данные, поэтому нужен пароль или вход Google.
+func (h *AccountHandler) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	user, ok := r.Context().Value(UserContextKey).(*models.User)
+	if !ok {
+		RespondWithError(w, r, apperr.New(apperr.Unauthorized))
+		return
+	}
+
+	var req models.DeleteAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		RespondWithError(w, r, apperr.New(apperr.BadRequest))
+		return
+	}
+	if !h.Auth.confirmIdentity(w, r, user, req.CurrentPassword, req.GoogleToken) {
+		return
+	}
+
+	deleted, err := h.DB.SoftDeleteUser(user.ID, h.PurgeGracePeriod)
+	if err != nil {
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("мягкое удаление аккаунта %d", user.ID))
+		return
+	}
+
+	log.Printf("[ACCOUNT] Пользователь '%s' (ID %d) удалил аккаунт. Очистка данных после %s.", user.Username, user.ID, deleted.PurgeAfter.Time.Format(time.RFC3339))
+	RespondWithJSON(w, http.StatusAccepted, models.AccountDeletionResponse{
+		DeletedAt:  deleted.DeletedAt.Time,
+		PurgeAfter: deleted.PurgeAfter.Time,
+	})
+}
+
+func exportAttachmentRecord(att models.FileAttachment) models.ExportAttachmentRecord {
+	return models.ExportAttachmentRecord{
+		ID:          att.ID,
+		FileName:    att.FileName,
+		MimeType:    att.MimeType,
+		ArchivePath: exportAttachmentPath(att),
+		CreatedAt:   att.CreatedAt,
+	}
+}
+
+func exportAttachmentPath(att models.FileAttachment) string {
+	name := path.Base(strings.ReplaceAll(att.FileName, "\\", "/"))
+	if name == "." || name == "/" || name == "" {
+		name = "file"
+	}
+	return fmt.Sprintf("attachments/%d_%s", att.ID, name)
+}
+
+func writeZipFile(zw *zip.Writer, name string, data []byte) error {
+	entry, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = entry.Write(data)
+	return err
+}
+
+func writeZipJSON(zw *zip.Writer, name string, v interface{}) error {
+	entry, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(entry)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"egobackend/internal/apperr"
+	"egobackend/internal/auth"
+	"egobackend/internal/database"
+	"egobackend/internal/models"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type AdminHandler struct {
+	DB      database.Store
+	Limiter *auth.LoginLimiter
+}
+
+func AdminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value(UserContextKey).(*models.User)
+		if !ok {
+			RespondWithError(w, r, apperr.New(apperr.Unauthorized))
+			return
+		}
+		if user.Role != "admin" {
+			RespondWithError(w, r, apperr.New(apperr.AdminOnly))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (h *AdminHandler) GetLockouts(w http.ResponseWriter, r *http.Request) {
+	activeOnly := r.URL.Query().Get("all") != "true"
+	lockouts, err := h.DB.GetLoginLockouts(activeOnly, 200)
+	if err != nil {
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err))
+		return
+	}
+	if lockouts == nil {
+		lockouts = []models.LoginLockout{}
+	}
+	RespondWithJSON(w, http.StatusOK, lockouts)
+}
+
+func (h *AdminHandler) ClearLockout(w http.ResponseWriter, r *http.Request) {
+	admin := r.Context().Value(UserContextKey).(*models.User)
+
+	lockoutID, err := strconv.Atoi(chi.URLParam(r, "lockoutID"))
+	if err != nil {
+		RespondWithError(w, r, apperr.New(apperr.InvalidID))
+		return
+	}
+
+	lockout, err := h.DB.ClearLoginLockout(lockoutID, admin.ID)
+	if err != nil {
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("снятие блокировки %d", lockoutID))
+		return
+	}
+	if lockout == nil {
+		RespondWithError(w, r, apperr.New(apperr.LockoutNotFound))
+		return
+	}
+
+	h.Limiter.Reset(lockout.Scope, lockout.Subject)
+	log.Printf("[ADMIN] %s снял блокировку %s '%s'", admin.Username, lockout.Scope, lockout.Subject)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// defaultFeedbackWindow — период статистики оценок, если from не указан.
+const defaultFeedbackWindow = 30 * 24 * time.Hour
+
+// GetFeedbackStats сводит оценки ответов по режимам, инструментам и
+// причинам за период [from, to). По умолчанию — последние 30 дней.
+func (h *AdminHandler) GetFeedbackStats(w http.ResponseWriter, r *http.Request) {
+	to := time.Now().UTC()
+	if value := r.URL.Query().Get("to"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			RespondWithError(w, r, apperr.New(apperr.InvalidTimeWindow))
+			return
+		}
+		to = parsed
+	}
+	from := to.Add(-defaultFeedbackWindow)
+	if value := r.URL.Query().Get("from"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			RespondWithError(w, r, apperr.New(apperr.InvalidTimeWindow))
+			return
+		}
+		from = parsed
+	}
+	if !from.Before(to) {
+		RespondWithError(w, r, apperr.New(apperr.InvalidTimeWindow))
+		return
+	}
+
+	stats, err := h.DB.GetFeedbackStats(from, to)
+	if err != nil {
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("статистика оценок"))
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, stats)
+}
@@ -4,13 +4,21 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"log"
+	"math"
 	"net/http"
+	"net/mail"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
+	"egobackend/internal/apperr"
 	"egobackend/internal/auth"
 	"egobackend/internal/database"
+	"egobackend/internal/i18n"
+	"egobackend/internal/mailer"
 	"egobackend/internal/models"
 )
 
@@ -19,8 +27,81 @@ type ContextKey string
 const UserContextKey = ContextKey("user")
 
 type AuthHandler struct {
-	DB          *database.DB
-	AuthService *auth.AuthService
+	DB                       database.UserStore
+	AuthService              *auth.AuthService
+	Limiter                  *auth.LoginLimiter
+	Mailer                   mailer.Mailer
+	AppBaseURL               string
+	RequireEmailVerification bool
+}
+
+func userResponse(user *models.User) models.UserResponse {
+	return models.UserResponse{
+		ID:            user.ID,
+		Username:      user.Username,
+		Role:          user.Role,
+		CreatedAt:     user.CreatedAt,
+		Email:         user.Email.String,
+		EmailVerified: user.EmailVerified,
+		Locale:        user.Locale.String,
+		DefaultPreset: defaultPresetID(user),
+	}
+}
+
+func defaultPresetID(user *models.User) *int {
+	if !user.DefaultPreset.Valid {
+		return nil
+	}
+	id := int(user.DefaultPreset.Int64)
+	return &id
+}
+
+// validEmail принимает только голый адрес: без отображаемого имени,
+// угловых скобок и переводов строк, которые попали бы в заголовки письма.
+func validEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Name == "" && addr.Address == email
+}
+
+func (h *AuthHandler) registerLoginFailure(ip, username string) {
+	for _, lockout := range h.Limiter.RegisterFailure(ip, username) {
+		log.Printf("[AUTH] Блокировка %s '%s' до %s после %d неудачных попыток", lockout.Scope, lockout.Subject, lockout.LockedUntil.Format(time.RFC3339), lockout.FailedAttempts)
+		if err := h.DB.SaveLoginLockout(lockout.Scope, lockout.Subject, lockout.FailedAttempts, lockout.LockedUntil); err != nil {
+			log.Printf("!!! [AUTH] Не удалось сохранить блокировку в БД: %v", err)
+		}
+	}
+}
+
+func respondTooManyAttempts(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	RespondWithError(w, r, apperr.New(apperr.TooManyAttempts))
+}
+
+func respondHashingBusy(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "5")
+	RespondWithError(w, r, apperr.New(apperr.ServerBusy))
+}
+
+// respondWithTokens выдает пару токенов текущей версии пользователя.
+func (h *AuthHandler) respondWithTokens(w http.ResponseWriter, r *http.Request, user *models.User) bool {
+	accessToken, err := h.AuthService.CreateAccessToken(user.Username, user.Role, user.TokenVersion)
+	if err != nil {
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("создание access-токена"))
+		return false
+	}
+	refreshToken, err := h.AuthService.CreateRefreshToken(user.Username, user.TokenVersion)
+	if err != nil {
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("создание refresh-токена"))
+		return false
+	}
+
+	response := map[string]interface{}{
+		"access_token":  accessToken,
+		"refresh_token": refreshToken,
+		"user":          userResponse(user),
+	}
+	RespondWithJSON(w, http.StatusOK, response)
+	return true
 }
 
 func (h *AuthHandler) AuthMiddleware(next http.Handler) http.Handler {
@@ -30,33 +111,41 @@ func (h *AuthHandler) AuthMiddleware(next http.Handler) http.Handler {
 		if strings.Contains(r.URL.Path, "/ws") {
 			tokenString = r.URL.Query().Get("token")
 			if tokenString == "" {
-				RespondWithError(w, http.StatusUnauthorized, "Требуется токен в параметрах URL для WebSocket")
+				RespondWithError(w, r, apperr.New(apperr.TokenMissing))
 				return
 			}
 		} else {
 			authHeader := r.Header.Get("Authorization")
 			if authHeader == "" {
-				RespondWithError(w, http.StatusUnauthorized, "Требуется заголовок Authorization")
+				RespondWithError(w, r, apperr.New(apperr.TokenMissing))
 				return
 			}
 			tokenString = strings.TrimPrefix(authHeader, "Bearer ")
 		}
 
 		if tokenString == "" {
-			RespondWithError(w, http.StatusUnauthorized, "Токен авторизации отсутствует")
+			RespondWithError(w, r, apperr.New(apperr.TokenMissing))
 			return
 		}
 
-		username, err := h.AuthService.ValidateJWT(tokenString)
+		claims, err := h.AuthService.ValidateJWT(tokenString)
 		if err != nil {
-			log.Printf("Ошибка валидации токена для %s: %v", r.URL.Path, err)
-			RespondWithError(w, http.StatusUnauthorized, "Невалидный или просроченный токен")
+			RespondWithError(w, r, apperr.Wrap(apperr.InvalidToken, err))
 			return
 		}
 
-		user, err := h.DB.GetUserByUsername(username)
+		user, err := h.DB.GetUserByUsername(claims.Username)
 		if err != nil {
-			RespondWithError(w, http.StatusUnauthorized, "Пользователь из токена не найден")
+			RespondWithError(w, r, apperr.New(apperr.UserNotFound))
+			return
+		}
+		// Токен выдан до смены пароля.
+		if claims.Version != user.TokenVersion {
+			RespondWithError(w, r, apperr.New(apperr.InvalidToken))
+			return
+		}
+		if user.DeletedAt.Valid {
+			RespondWithError(w, r, apperr.New(apperr.AccountDeleted))
 			return
 		}
 
@@ -68,104 +157,142 @@ func (h *AuthHandler) AuthMiddleware(next http.Handler) http.Handler {
 func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 	var req models.AuthRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		RespondWithError(w, http.StatusBadRequest, "Неверный формат запроса")
+		RespondWithError(w, r, apperr.New(apperr.BadRequest))
 		return
 	}
 	if req.Username == "" || req.Password == "" {
-		RespondWithError(w, http.StatusBadRequest, "Имя пользователя и пароль не могут быть пустыми")
+		RespondWithError(w, r, apperr.New(apperr.CredentialsRequired))
+		return
+	}
+	ip := ClientIP(r)
+	if wait := h.Limiter.Check(ip, req.Username); wait > 0 {
+		respondTooManyAttempts(w, r, wait)
 		return
 	}
 	user, err := h.DB.GetUserByUsername(req.Username)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			RespondWithError(w, http.StatusUnauthorized, "Неверный логин или пароль")
+			h.registerLoginFailure(ip, req.Username)
+			RespondWithError(w, r, apperr.New(apperr.InvalidCredentials))
 			return
 		}
-		RespondWithError(w, http.StatusInternalServerError, "Ошибка сервера")
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err))
 		return
 	}
-	if !auth.CheckPasswordHash(req.Password, user.HashedPassword) {
-		RespondWithError(w, http.StatusUnauthorized, "Неверный логин или пароль")
+	passwordOK, err := auth.CheckPasswordHash(req.Password, user.HashedPassword)
+	if errors.Is(err, auth.ErrHashingBusy) {
+		respondHashingBusy(w, r)
 		return
 	}
-	accessToken, err := h.AuthService.CreateAccessToken(user.Username, user.Role)
-	if err != nil {
-		RespondWithError(w, http.StatusInternalServerError, "Не удалось создать токен доступа")
+	if !passwordOK {
+		h.registerLoginFailure(ip, req.Username)
+		RespondWithError(w, r, apperr.New(apperr.InvalidCredentials))
 		return
 	}
-	refreshToken, err := h.AuthService.CreateRefreshToken(user.Username)
-	if err != nil {
-		RespondWithError(w, http.StatusInternalServerError, "Не удалось создать токен обновления")
+	h.Limiter.RegisterSuccess(req.Username)
+	if user.DeletedAt.Valid {
+		RespondWithError(w, r, apperr.New(apperr.AccountDeleted))
 		return
 	}
-
-	response := map[string]interface{}{
-		"access_token":  accessToken,
-		"refresh_token": refreshToken,
-		"user":          models.UserResponse{ID: user.ID, Username: user.Username, Role: user.Role, CreatedAt: user.CreatedAt},
+	if h.RequireEmailVerification && user.Email.Valid && !user.EmailVerified {
+		RespondWithError(w, r, apperr.New(apperr.EmailNotVerified))
+		return
+	}
+	if !h.respondWithTokens(w, r, user) {
+		return
 	}
-
-	RespondWithJSON(w, http.StatusOK, response)
 	log.Printf("Пользователь '%s' успешно вошел в систему.", user.Username)
 }
 
 func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 	var req models.AuthRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		RespondWithError(w, http.StatusBadRequest, "Неверный формат запроса")
+		RespondWithError(w, r, apperr.New(apperr.BadRequest))
 		return
 	}
 	if req.Username == "" || req.Password == "" {
-		RespondWithError(w, http.StatusBadRequest, "Имя пользователя и пароль не могут быть пустыми")
+		RespondWithError(w, r, apperr.New(apperr.CredentialsRequired))
+		return
+	}
+	ip := ClientIP(r)
+	if wait := h.Limiter.Check(ip, ""); wait > 0 {
+		respondTooManyAttempts(w, r, wait)
 		return
 	}
 	_, err := h.DB.GetUserByUsername(req.Username)
 	if err == nil {
-		RespondWithError(w, http.StatusConflict, "Пользователь с таким именем уже существует")
+		// Перебор занятых имен тоже считаем неудачной попыткой с этого IP.
+		h.registerLoginFailure(ip, "")
+		RespondWithError(w, r, apperr.New(apperr.UsernameTaken))
 		return
 	}
 	if err != sql.ErrNoRows {
-		RespondWithError(w, http.StatusInternalServerError, "Ошибка сервера при проверке пользователя")
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("проверка имени пользователя"))
 		return
 	}
+	req.Email = strings.TrimSpace(req.Email)
+	if h.RequireEmailVerification && req.Email == "" {
+		RespondWithError(w, r, apperr.New(apperr.EmailRequired))
+		return
+	}
+	if req.Email != "" {
+		if !validEmail(req.Email) {
+			RespondWithError(w, r, apperr.New(apperr.EmailInvalid))
+			return
+		}
+		// Занятым считается только подтвержденный адрес.
+		if owner, err := h.DB.GetUserByEmail(req.Email); err == nil && owner.EmailVerified {
+			RespondWithError(w, r, apperr.New(apperr.EmailTaken))
+			return
+		}
+	}
 	hashedPassword, err := auth.HashPassword(req.Password)
+	if errors.Is(err, auth.ErrHashingBusy) {
+		respondHashingBusy(w, r)
+		return
+	}
 	if err != nil {
-		RespondWithError(w, http.StatusInternalServerError, "Ошибка сервера при хешировании пароля")
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("хеширование пароля"))
 		return
 	}
-	newUser, err := h.DB.CreateUser(req.Username, hashedPassword)
+	newUser, err := h.DB.CreateUser(req.Username, hashedPassword, req.Email)
 	if err != nil {
-		RespondWithError(w, http.StatusInternalServerError, "Не удалось создать пользователя")
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("создание пользователя"))
 		return
 	}
 	log.Printf("Зарегистрирован новый пользователь: %s (ID: %d)", newUser.Username, newUser.ID)
-	response := models.UserResponse{ID: newUser.ID, Username: newUser.Username, Role: newUser.Role, CreatedAt: newUser.CreatedAt}
-	RespondWithJSON(w, http.StatusCreated, response)
+	if newUser.Email.Valid {
+		h.sendVerificationEmail(newUser, RequestLocale(r))
+	}
+	RespondWithJSON(w, http.StatusCreated, userResponse(newUser))
 }
 
 func (h *AuthHandler) Refresh(w http.ResponseWriter, r *http.Request) {
 	var req models.RefreshTokenRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		RespondWithError(w, http.StatusBadRequest, "Неверный формат запроса")
+		RespondWithError(w, r, apperr.New(apperr.BadRequest))
 		return
 	}
 
-	username, err := h.AuthService.ValidateJWT(req.RefreshToken)
+	claims, err := h.AuthService.ValidateJWT(req.RefreshToken)
 	if err != nil {
-		log.Printf("Попытка обновления с невалидным refresh-токеном: %v", err)
-		RespondWithError(w, http.StatusUnauthorized, "Невалидный refresh-токен")
+		RespondWithError(w, r, apperr.Wrap(apperr.InvalidToken, err))
 		return
 	}
 
-	user, err := h.DB.GetUserByUsername(username)
-	if err != nil {
-		RespondWithError(w, http.StatusUnauthorized, "Пользователь из токена не найден")
+	user, err := h.DB.GetUserByUsername(claims.Username)
+	if err != nil || user.DeletedAt.Valid {
+		RespondWithError(w, r, apperr.New(apperr.UserNotFound))
+		return
+	}
+	if claims.Version != user.TokenVersion {
+		RespondWithError(w, r, apperr.New(apperr.InvalidToken))
 		return
 	}
 
-	newAccessToken, err := h.AuthService.CreateAccessToken(user.Username, user.Role)
+	newAccessToken, err := h.AuthService.CreateAccessToken(user.Username, user.Role, user.TokenVersion)
 	if err != nil {
-		RespondWithError(w, http.StatusInternalServerError, "Не удалось создать новый access-токен")
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("создание access-токена"))
 		return
 	}
 
@@ -180,24 +307,82 @@ func (h *AuthHandler) Refresh(w http.ResponseWriter, r *http.Request) {
 func (h *AuthHandler) Me(w http.ResponseWriter, r *http.Request) {
 	user, ok := r.Context().Value(UserContextKey).(*models.User)
 	if !ok {
-		RespondWithError(w, http.StatusInternalServerError, "Не удалось получить пользователя из контекста")
+		RespondWithError(w, r, apperr.New(apperr.Unauthorized))
 		return
 	}
-	response := models.UserResponse{ID: user.ID, Username: user.Username, Role: user.Role, CreatedAt: user.CreatedAt}
-	RespondWithJSON(w, http.StatusOK, response)
+	RespondWithJSON(w, http.StatusOK, userResponse(user))
+}
+
+func (h *AuthHandler) UpdateProfile(w http.ResponseWriter, r *http.Request) {
+	user, ok := r.Context().Value(UserContextKey).(*models.User)
+	if !ok {
+		RespondWithError(w, r, apperr.New(apperr.Unauthorized))
+		return
+	}
+
+	var req models.UpdateProfileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondWithError(w, r, apperr.New(apperr.BadRequest))
+		return
+	}
+	if req.Locale == nil && req.DefaultPresetID == nil {
+		RespondWithError(w, r, apperr.New(apperr.NothingToUpdate))
+		return
+	}
+
+	if req.Locale != nil {
+		locale := ""
+		if *req.Locale != "" {
+			supported, ok := i18n.Lookup(*req.Locale)
+			if !ok {
+				RespondWithError(w, r, apperr.New(apperr.UnsupportedLocale, *req.Locale))
+				return
+			}
+			locale = string(supported)
+		}
+		if err := h.DB.UpdateUserLocale(user.ID, locale); err != nil {
+			RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("обновление языка пользователя %d", user.ID))
+			return
+		}
+		user.Locale = sql.NullString{String: locale, Valid: locale != ""}
+	}
+
+	if req.DefaultPresetID != nil {
+		var presetID *int
+		if *req.DefaultPresetID != 0 {
+			preset, err := h.DB.GetVisiblePreset(*req.DefaultPresetID, user.ID)
+			if err != nil {
+				RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("получение пресета %d", *req.DefaultPresetID))
+				return
+			}
+			if preset == nil {
+				RespondWithError(w, r, apperr.New(apperr.PresetNotFound))
+				return
+			}
+			presetID = &preset.ID
+		}
+		if err := h.DB.UpdateUserDefaultPreset(user.ID, presetID); err != nil {
+			RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("обновление пресета по умолчанию пользователя %d", user.ID))
+			return
+		}
+		user.DefaultPreset = sql.NullInt64{}
+		if presetID != nil {
+			user.DefaultPreset = sql.NullInt64{Int64: int64(*presetID), Valid: true}
+		}
+	}
+	RespondWithJSON(w, http.StatusOK, userResponse(user))
 }
 
 func (h *AuthHandler) GoogleLogin(w http.ResponseWriter, r *http.Request) {
 	var req models.GoogleAuthRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		RespondWithError(w, http.StatusBadRequest, "Неверный формат запроса")
+		RespondWithError(w, r, apperr.New(apperr.BadRequest))
 		return
 	}
 	googleClientID := os.Getenv("GOOGLE_CLIENT_ID")
 	email, err := h.AuthService.ValidateGoogleJWT(req.Token, googleClientID)
 	if err != nil {
-		log.Printf("Ошибка верификации Google токена %v", err)
-		RespondWithError(w, http.StatusUnauthorized, "Невалидный токен Google")
+		RespondWithError(w, r, apperr.Wrap(apperr.InvalidGoogleToken, err))
 		return
 	}
 	user, err := h.DB.GetUserByUsername(email)
@@ -205,33 +390,34 @@ func (h *AuthHandler) GoogleLogin(w http.ResponseWriter, r *http.Request) {
 		if err == sql.ErrNoRows {
 			log.Printf("Создание нового пользователя через Google Auth: %s", email)
 			randPass := "-veryhard__PASSFORemAil" + email
-			hashPass, _ := auth.HashPassword(randPass)
-			newUser, createErr := h.DB.CreateUser(email, hashPass)
+			hashPass, err := auth.HashPassword(randPass)
+			if err != nil {
+				respondHashingBusy(w, r)
+				return
+			}
+			newUser, createErr := h.DB.CreateUser(email, hashPass, email)
 			if createErr != nil {
-				RespondWithError(w, http.StatusInternalServerError, "Не удалось создать пользователя")
+				RespondWithError(w, r, apperr.Wrap(apperr.Internal, createErr).WithDetail("создание пользователя"))
 				return
 			}
+			// Google уже подтвердил владение адресом.
+			if err := h.DB.MarkEmailVerified(newUser.ID); err != nil {
+				log.Printf("!!! Не удалось отметить email %s подтвержденным: %v", email, err)
+			} else {
+				newUser.EmailVerified = true
+			}
 			user = newUser
 		} else {
-			RespondWithError(w, http.StatusInternalServerError, "Ошибка сервера про поиске пользователя")
+			RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("поиск пользователя"))
 			return
 		}
 	}
-	accessToken, err := h.AuthService.CreateAccessToken(user.Username, user.Role)
-	if err != nil {
-		RespondWithError(w, http.StatusInternalServerError, "Не удалось создать accessJWT токен")
+	if user.DeletedAt.Valid {
+		RespondWithError(w, r, apperr.New(apperr.AccountDeleted))
 		return
 	}
-	refreshToken, err := h.AuthService.CreateRefreshToken(user.Username)
-	if err != nil {
-		RespondWithError(w, http.StatusInternalServerError, "Не удалось создать refreshJWT токен")
+	if !h.respondWithTokens(w, r, user) {
 		return
 	}
-	response := map[string]interface{}{
-		"access_token":  accessToken,
-		"refresh_token": refreshToken,
-		"user":          models.UserResponse{ID: user.ID, Username: user.Username, Role: user.Role, CreatedAt: user.CreatedAt},
-	}
-	RespondWithJSON(w, http.StatusOK, response)
 	log.Printf("Пользователь '%s' успешно вошел через Google.", user.Username)
 }
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"egobackend/internal/auth"
+	"egobackend/internal/database"
+	"egobackend/internal/models"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestValidEmail(t *testing.T) {
+	tests := map[string]bool{
+		"user@example.com":                       true,
+		"first.last+tag@sub.example.org":         true,
+		"user":                                   false,
+		"@example.com":                           false,
+		"User <user@example.com>":                false,
+		"user@example.com\r\nBcc: x@example.com": false,
+		"user@example.com, other@example.com":    false,
+	}
+	for email, want := range tests {
+		if got := validEmail(email); got != want {
+			t.Errorf("validEmail(%q) = %v, want %v", email, got, want)
+		}
+	}
+}
+
+func TestConfirmIdentity(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct-password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &AuthHandler{DB: database.NewMemory(), Limiter: auth.NewLoginLimiter(auth.DefaultLimiterConfig())}
+	user := &models.User{ID: 1, Username: "alice", HashedPassword: string(hash)}
+
+	tests := []struct {
+		name     string
+		password string
+		want     int
+	}{
+		{"без подтверждения", "", http.StatusBadRequest},
+		{"неверный пароль", "wrong-password", http.StatusForbidden},
+		{"верный пароль", "correct-password", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodDelete, "/me", nil)
+			ok := h.confirmIdentity(w, r, user, tt.password, "")
+			if ok != (tt.want == http.StatusOK) || w.Code != tt.want {
+				t.Errorf("confirmIdentity() = %v, status %d; want status %d", ok, w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -1,36 +1,39 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 
+	"egobackend/internal/apperr"
 	"egobackend/internal/database"
 	"egobackend/internal/engine"
+	"egobackend/internal/i18n"
 	"egobackend/internal/models"
+	"egobackend/internal/protocol"
 	"egobackend/internal/storage"
 
 	"github.com/go-chi/chi/v5"
 )
 
 type EgoHandler struct {
-	DB               *database.DB
-	PythonBackendURL string
-	S3Service        *storage.S3Service
+	DB        database.Store
+	Backends  engine.Backends
+	S3Service *storage.S3Service
 }
 
 func (h *EgoHandler) ProccessStream(w http.ResponseWriter, r *http.Request) {
 	user, ok := r.Context().Value(UserContextKey).(*models.User)
 	if !ok {
-		h.writeError(w, "Не удалось получить пользователя из контекста", http.StatusInternalServerError)
+		RespondWithError(w, r, apperr.New(apperr.Unauthorized))
 		return
 	}
 
 	mode := chi.URLParam(r, "mode")
 	var req models.StreamRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.writeError(w, "Ошибка парсинга JSON-тела запроса", http.StatusBadRequest)
+		RespondWithError(w, r, apperr.Wrap(apperr.BadRequest, err))
 		return
 	}
 	req.Mode = mode
@@ -40,15 +43,14 @@ func (h *EgoHandler) ProccessStream(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Connection", "keep-alive")
 	flusher, ok := w.(http.Flusher)
 	if !ok {
-		h.writeError(w, "Клиент не поддерживает стриминг", http.StatusInternalServerError)
+		RespondWithError(w, r, apperr.New(apperr.StreamingUnsupported))
 		return
 	}
 
-	processor := engine.NewProcessor(h.DB, h.PythonBackendURL, h.S3Service)
+	processor := engine.NewProcessor(h.DB, h.Backends, h.S3Service)
 
-	callback := func(eventType string, data interface{}) {
-		eventData := map[string]interface{}{"type": eventType, "data": data}
-		jsonData, _ := json.Marshal(eventData)
+	callback := func(event protocol.Event) {
+		jsonData, _ := json.Marshal(protocol.NewEnvelope(event, 0, ""))
 		fmt.Fprintf(w, "data: %s\n\n", jsonData)
 		flusher.Flush()
 	}
@@ -58,10 +60,6 @@ func (h *EgoHandler) ProccessStream(w http.ResponseWriter, r *http.Request) {
 		sessionID = int64(*req.SessionID)
 	}
 
-	go processor.ProcessRequest(req, user, sessionID, callback)
-}
-
-func (h *EgoHandler) writeError(w http.ResponseWriter, msg string, code int) {
-	log.Printf("!!! HTTP ОШИБКА (%d): %s", code, msg)
-	http.Error(w, msg, code)
+	ctx := i18n.WithLocale(context.Background(), RequestLocale(r))
+	go processor.ProcessRequest(ctx, req, user, sessionID, callback)
 }
@@ -1,10 +1,15 @@
 package handlers
 
 import (
+	"egobackend/internal/apperr"
 	"egobackend/internal/models"
+	"egobackend/internal/protocol"
 	"encoding/json"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/go-chi/chi/v5"
 )
@@ -12,38 +17,194 @@ import (
 func (h *SessionHandler) EditLog(w http.ResponseWriter, r *http.Request) {
 	user, ok := r.Context().Value(UserContextKey).(*models.User)
 	if !ok {
-		RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		RespondWithError(w, r, apperr.New(apperr.Unauthorized))
 		return
 	}
 
 	logIDStr := chi.URLParam(r, "logID")
 	logID, err := strconv.ParseInt(logIDStr, 10, 64)
 	if err != nil {
-		RespondWithError(w, http.StatusBadRequest, "Invalid log ID")
+		RespondWithError(w, r, apperr.New(apperr.InvalidID))
 		return
 	}
 
 	var req models.UpdateLogRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		RespondWithError(w, http.StatusBadRequest, "Invalid request body")
+		RespondWithError(w, r, apperr.New(apperr.BadRequest))
 		return
 	}
-	if req.Query == "" {
-		RespondWithError(w, http.StatusBadRequest, "Query cannot be empty")
+	if req.Query == nil && req.Pinned == nil {
+		RespondWithError(w, r, apperr.New(apperr.NothingToUpdate))
+		return
+	}
+	if req.Query != nil && *req.Query == "" {
+		RespondWithError(w, r, apperr.New(apperr.EmptyQuery))
 		return
 	}
 
 	logToEdit, err := h.DB.GetRequestLogByID(logID, user.ID)
 	if err != nil || logToEdit == nil {
-		RespondWithError(w, http.StatusNotFound, "Log not found or access denied")
+		RespondWithError(w, r, apperr.New(apperr.LogNotFound))
+		return
+	}
+
+	if req.Query != nil {
+		if err := h.DB.UpdateRequestLogQuery(logID, user.ID, *req.Query); err != nil {
+			RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("обновление лога %d", logID))
+			return
+		}
+	}
+	if req.Pinned != nil {
+		if err := h.DB.SetRequestLogPinned(logID, user.ID, *req.Pinned); err != nil {
+			RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("закрепление лога %d", logID))
+			return
+		}
+	}
+	h.Events.PublishToUser(user.ID, protocol.LogUpdatedEvent{DBID: logID, SessionID: int64(logToEdit.SessionID)})
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// GetLogTrace возвращает трассу рассуждения лога для воспроизведения:
+// мысли, вызовы инструментов и ошибки по порядку.
+func (h *SessionHandler) GetLogTrace(w http.ResponseWriter, r *http.Request) {
+	user, ok := r.Context().Value(UserContextKey).(*models.User)
+	if !ok {
+		RespondWithError(w, r, apperr.New(apperr.Unauthorized))
 		return
 	}
 
-	err = h.DB.UpdateRequestLogQuery(logID, user.ID, req.Query)
+	logIDStr := chi.URLParam(r, "logID")
+	logID, err := strconv.ParseInt(logIDStr, 10, 64)
 	if err != nil {
-		RespondWithError(w, http.StatusInternalServerError, "Failed to update log")
+		RespondWithError(w, r, apperr.New(apperr.InvalidID))
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	logEntry, err := h.DB.GetRequestLogByID(logID, user.ID)
+	if err != nil || logEntry == nil {
+		RespondWithError(w, r, apperr.New(apperr.LogNotFound))
+		return
+	}
+
+	steps, err := h.DB.GetThoughtTrace(logID)
+	if err != nil {
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("трасса лога %d", logID))
+		return
+	}
+	if len(steps) == 0 {
+		steps = legacyThoughtTrace(logEntry.EgoThoughtsJSON)
+	}
+
+	RespondWithJSON(w, http.StatusOK, models.TraceResponse{LogID: logID, Steps: steps})
+}
+
+// legacyThoughtTrace восстанавливает трассу из ego_thoughts_json логов,
+// сохраненных до появления thought_steps. Длительностей в них нет, а
+// итерация начинается с каждой мысли или системной ошибки.
+func legacyThoughtTrace(thoughtsJSON string) []models.ThoughtStep {
+	var entries []struct {
+		Type     string                  `json:"type"`
+		Content  *models.ThoughtResponse `json:"content"`
+		ToolName *string                 `json:"tool_name"`
+		Output   *string                 `json:"output"`
+		Error    *string                 `json:"error"`
+	}
+	steps := []models.ThoughtStep{}
+	if err := json.Unmarshal([]byte(thoughtsJSON), &entries); err != nil {
+		return steps
+	}
+	iteration := 0
+	for _, entry := range entries {
+		step := models.ThoughtStep{Kind: entry.Type, ToolName: entry.ToolName, Output: entry.Output, Error: entry.Error}
+		switch entry.Type {
+		case models.ThoughtStepThought, models.ThoughtStepSystemError:
+			iteration++
+		}
+		if entry.Content != nil {
+			if entry.Content.ThoughtHeader != "" {
+				step.Header = &entry.Content.ThoughtHeader
+			}
+			if entry.Content.Thoughts != "" {
+				step.Content = &entry.Content.Thoughts
+			}
+			if confidence, err := entry.Content.Confidence.Float64(); err == nil {
+				step.Confidence = &confidence
+			}
+		}
+		step.Position, step.Iteration = len(steps), max(iteration, 1)
+		steps = append(steps, step)
+	}
+	return steps
+}
+
+// SubmitLogFeedback сохраняет оценку ответа. Повторная оценка того же
+// сообщения заменяет предыдущую.
+func (h *SessionHandler) SubmitLogFeedback(w http.ResponseWriter, r *http.Request) {
+	user, ok := r.Context().Value(UserContextKey).(*models.User)
+	if !ok {
+		RespondWithError(w, r, apperr.New(apperr.Unauthorized))
+		return
+	}
+
+	logIDStr := chi.URLParam(r, "logID")
+	logID, err := strconv.ParseInt(logIDStr, 10, 64)
+	if err != nil {
+		RespondWithError(w, r, apperr.New(apperr.InvalidID))
+		return
+	}
+
+	var req models.FeedbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondWithError(w, r, apperr.New(apperr.BadRequest))
+		return
+	}
+	feedback, err := newLogFeedback(req)
+	if err != nil {
+		RespondWithError(w, r, err)
+		return
+	}
+
+	logEntry, err := h.DB.GetRequestLogByID(logID, user.ID)
+	if err != nil || logEntry == nil {
+		RespondWithError(w, r, apperr.New(apperr.LogNotFound))
+		return
+	}
+
+	feedback.RequestLogID, feedback.UserID = logEntry.ID, user.ID
+	saved, err := h.DB.SaveLogFeedback(feedback)
+	if err != nil {
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("оценка лога %d", logID))
+		return
+	}
+	h.Events.PublishToUser(user.ID, protocol.LogUpdatedEvent{DBID: logID, SessionID: int64(logEntry.SessionID)})
+
+	RespondWithJSON(w, http.StatusOK, saved)
+}
+
+// newLogFeedback проверяет запрос: оценка 1 или -1, причины из
+// models.FeedbackReasons без повторов, комментарий не длиннее лимита.
+func newLogFeedback(req models.FeedbackRequest) (*models.LogFeedback, error) {
+	if req.Rating != models.FeedbackPositive && req.Rating != models.FeedbackNegative {
+		return nil, apperr.New(apperr.InvalidRating)
+	}
+	feedback := &models.LogFeedback{Rating: req.Rating, Reasons: []string{}}
+	for _, reason := range req.Reasons {
+		if !slices.Contains(models.FeedbackReasons, reason) {
+			return nil, apperr.New(apperr.UnknownReason, reason)
+		}
+		if !slices.Contains(feedback.Reasons, reason) {
+			feedback.Reasons = append(feedback.Reasons, reason)
+		}
+	}
+	if req.Comment != nil {
+		comment := strings.TrimSpace(*req.Comment)
+		if utf8.RuneCountInString(comment) > models.MaxFeedbackCommentRunes {
+			return nil, apperr.New(apperr.FeedbackTooLong, models.MaxFeedbackCommentRunes)
+		}
+		if comment != "" {
+			feedback.Comment = &comment
+		}
+	}
+	return feedback, nil
 }
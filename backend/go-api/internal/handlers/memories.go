@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"egobackend/internal/apperr"
+	"egobackend/internal/database"
+	"egobackend/internal/models"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// MemoryHandler отдает пользователю все, что модель о нем помнит, и
+// позволяет это править и удалять.
+type MemoryHandler struct {
+	DB database.UserStore
+}
+
+func (h *MemoryHandler) ListMemories(w http.ResponseWriter, r *http.Request) {
+	user, ok := r.Context().Value(UserContextKey).(*models.User)
+	if !ok {
+		RespondWithError(w, r, apperr.New(apperr.Unauthorized))
+		return
+	}
+
+	memories, err := h.DB.GetUserMemories(user.ID)
+	if err != nil {
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("получение памяти"))
+		return
+	}
+	if memories == nil {
+		memories = []models.UserMemory{}
+	}
+	RespondWithJSON(w, http.StatusOK, memories)
+}
+
+func (h *MemoryHandler) CreateMemory(w http.ResponseWriter, r *http.Request) {
+	user, ok := r.Context().Value(UserContextKey).(*models.User)
+	if !ok {
+		RespondWithError(w, r, apperr.New(apperr.Unauthorized))
+		return
+	}
+
+	content, err := decodeMemoryContent(r)
+	if err != nil {
+		RespondWithError(w, r, err)
+		return
+	}
+
+	count, err := h.DB.CountUserMemories(user.ID)
+	if err != nil {
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("подсчет записей памяти"))
+		return
+	}
+	if count >= models.MaxUserMemories {
+		RespondWithError(w, r, apperr.New(apperr.MemoryLimitReached, models.MaxUserMemories))
+		return
+	}
+
+	memory, err := h.DB.CreateUserMemory(user.ID, content, models.MemorySourceUser)
+	if err != nil {
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("создание записи памяти"))
+		return
+	}
+	RespondWithJSON(w, http.StatusCreated, memory)
+}
+
+func (h *MemoryHandler) UpdateMemory(w http.ResponseWriter, r *http.Request) {
+	user, ok := r.Context().Value(UserContextKey).(*models.User)
+	if !ok {
+		RespondWithError(w, r, apperr.New(apperr.Unauthorized))
+		return
+	}
+
+	memoryID, err := strconv.Atoi(chi.URLParam(r, "memoryID"))
+	if err != nil {
+		RespondWithError(w, r, apperr.New(apperr.InvalidID))
+		return
+	}
+
+	content, err := decodeMemoryContent(r)
+	if err != nil {
+		RespondWithError(w, r, err)
+		return
+	}
+
+	memory, err := h.DB.UpdateUserMemory(memoryID, user.ID, content)
+	if err != nil {
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("обновление записи памяти %d", memoryID))
+		return
+	}
+	if memory == nil {
+		RespondWithError(w, r, apperr.New(apperr.MemoryNotFound))
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, memory)
+}
+
+func (h *MemoryHandler) DeleteMemory(w http.ResponseWriter, r *http.Request) {
+	user, ok := r.Context().Value(UserContextKey).(*models.User)
+	if !ok {
+		RespondWithError(w, r, apperr.New(apperr.Unauthorized))
+		return
+	}
+
+	memoryID, err := strconv.Atoi(chi.URLParam(r, "memoryID"))
+	if err != nil {
+		RespondWithError(w, r, apperr.New(apperr.InvalidID))
+		return
+	}
+
+	deleted, err := h.DB.DeleteUserMemory(memoryID, user.ID)
+	if err != nil {
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("удаление записи памяти %d", memoryID))
+		return
+	}
+	if !deleted {
+		RespondWithError(w, r, apperr.New(apperr.MemoryNotFound))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func decodeMemoryContent(r *http.Request) (string, error) {
+	var req models.MemoryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return "", apperr.New(apperr.BadRequest)
+	}
+	content := strings.TrimSpace(req.Content)
+	if content == "" {
+		return "", apperr.New(apperr.EmptyQuery)
+	}
+	if utf8.RuneCountInString(content) > models.MaxMemoryRunes {
+		return "", apperr.New(apperr.MemoryTooLong, models.MaxMemoryRunes)
+	}
+	return content, nil
+}
@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"net/http"
+
+	"egobackend/internal/models"
+	"egobackend/internal/modes"
+)
+
+// ListModes отдает реестр режимов, чтобы клиент строил переключатель по
+// нему, а не по зашитому списку.
+func ListModes(w http.ResponseWriter, r *http.Request) {
+	locale := RequestLocale(r)
+	all := modes.All()
+	response := make([]models.ModeResponse, len(all))
+	for i, mode := range all {
+		response[i] = models.ModeResponse{
+			ID:                   mode.ID,
+			Name:                 mode.Name(locale),
+			Description:          mode.Description(locale),
+			AllowedTools:         mode.AllowedTools,
+			MaxThoughts:          mode.MaxThoughts,
+			HistoryBudget:        mode.HistoryBudget,
+			ThinkingTemperature:  mode.Synthesis.ThinkingTemperature,
+			SynthesisTemperature: mode.Synthesis.SynthesisTemperature,
+		}
+	}
+	RespondWithJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,318 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"egobackend/internal/apperr"
+	"egobackend/internal/auth"
+	"egobackend/internal/database"
+	"egobackend/internal/i18n"
+	"egobackend/internal/mailer"
+	"egobackend/internal/models"
+)
+
+const (
+	minPasswordLength     = 8
+	passwordResetTTL      = time.Hour
+	emailVerificationTTL  = 48 * time.Hour
+	mailSendTimeout       = 30 * time.Second
+	passwordResetPath     = "/reset-password"
+	emailVerificationPath = "/verify-email"
+)
+
+func validateNewPassword(password string) error {
+	if utf8.RuneCountInString(password) < minPasswordLength {
+		return apperr.New(apperr.PasswordTooShort, minPasswordLength)
+	}
+	return nil
+}
+
+// ChangePassword отзывает все выданные токены пользователя, а текущему
+// клиенту возвращает новую пару.
+func (h *AuthHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	user, ok := r.Context().Value(UserContextKey).(*models.User)
+	if !ok {
+		RespondWithError(w, r, apperr.New(apperr.Unauthorized))
+		return
+	}
+
+	var req models.ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondWithError(w, r, apperr.New(apperr.BadRequest))
+		return
+	}
+	if err := validateNewPassword(req.NewPassword); err != nil {
+		RespondWithError(w, r, err)
+		return
+	}
+
+	if !h.checkCurrentPassword(w, r, user, req.CurrentPassword) {
+		return
+	}
+
+	if !h.setPassword(w, r, user.ID, req.NewPassword) {
+		return
+	}
+	log.Printf("[AUTH] Пользователь '%s' сменил пароль.", user.Username)
+	updated, err := h.DB.GetUserByUsername(user.Username)
+	if err != nil {
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("получение пользователя %d", user.ID))
+		return
+	}
+	h.respondWithTokens(w, r, updated)
+}
+
+// checkCurrentPassword проверяет пароль залогиненного пользователя с теми же
+// ограничениями на перебор, что и вход.
+func (h *AuthHandler) checkCurrentPassword(w http.ResponseWriter, r *http.Request, user *models.User, password string) bool {
+	ip := ClientIP(r)
+	if wait := h.Limiter.Check(ip, user.Username); wait > 0 {
+		respondTooManyAttempts(w, r, wait)
+		return false
+	}
+	passwordOK, err := auth.CheckPasswordHash(password, user.HashedPassword)
+	if errors.Is(err, auth.ErrHashingBusy) {
+		respondHashingBusy(w, r)
+		return false
+	}
+	if !passwordOK {
+		h.registerLoginFailure(ip, user.Username)
+		RespondWithError(w, r, apperr.New(apperr.WrongPassword))
+		return false
+	}
+	return true
+}
+
+// confirmIdentity повторно проверяет пользователя перед необратимым
+// действием: текущим паролем или, у аккаунтов Google, свежим токеном
+// Google на тот же адрес.
+func (h *AuthHandler) confirmIdentity(w http.ResponseWriter, r *http.Request, user *models.User, password, googleToken string) bool {
+	switch {
+	case password != "":
+		return h.checkCurrentPassword(w, r, user, password)
+	case googleToken != "":
+		email, err := h.AuthService.ValidateGoogleJWT(googleToken, os.Getenv("GOOGLE_CLIENT_ID"))
+		if err != nil {
+			RespondWithError(w, r, apperr.Wrap(apperr.InvalidGoogleToken, err))
+			return false
+		}
+		if !strings.EqualFold(email, user.Username) && !(user.EmailVerified && strings.EqualFold(email, user.Email.String)) {
+			RespondWithError(w, r, apperr.New(apperr.InvalidGoogleToken).WithDetail("токен Google выдан на %s, а не на пользователя %d", email, user.ID))
+			return false
+		}
+		return true
+	default:
+		RespondWithError(w, r, apperr.New(apperr.ReauthRequired))
+		return false
+	}
+}
+
+// RequestPasswordReset всегда отвечает 202, чтобы по ответу нельзя было
+// узнать, зарегистрирован ли адрес.
+func (h *AuthHandler) RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req models.PasswordResetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondWithError(w, r, apperr.New(apperr.BadRequest))
+		return
+	}
+	login := strings.TrimSpace(req.Login)
+	if login == "" {
+		RespondWithError(w, r, apperr.New(apperr.CredentialsRequired))
+		return
+	}
+
+	ip := ClientIP(r)
+	if wait := h.Limiter.Check(ip, ""); wait > 0 {
+		respondTooManyAttempts(w, r, wait)
+		return
+	}
+
+	user, err := h.DB.GetUserByEmail(login)
+	if err == sql.ErrNoRows {
+		user, err = h.DB.GetUserByUsername(login)
+	}
+	switch {
+	case err == sql.ErrNoRows:
+		// Запросы на несуществующие адреса тоже учитываем, чтобы сброс
+		// нельзя было использовать для перебора.
+		h.registerLoginFailure(ip, "")
+	case err != nil:
+		log.Printf("!!! [AUTH] Ошибка поиска пользователя для сброса пароля: %v", err)
+	case !user.Email.Valid:
+		log.Printf("[AUTH] Сброс пароля для '%s' невозможен: email не указан.", user.Username)
+	default:
+		h.sendUserTokenEmail(user, UserLocale(user, r.Header.Get("Accept-Language")), models.TokenPurposePasswordReset, passwordResetTTL, passwordResetPath,
+			i18n.PasswordResetSubject, i18n.PasswordResetBody)
+	}
+
+	RespondWithJSON(w, http.StatusAccepted, map[string]string{"message": i18n.T(RequestLocale(r), i18n.PasswordResetSent)})
+}
+
+func (h *AuthHandler) ConfirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req models.PasswordResetConfirmRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondWithError(w, r, apperr.New(apperr.BadRequest))
+		return
+	}
+	if err := validateNewPassword(req.NewPassword); err != nil {
+		RespondWithError(w, r, err)
+		return
+	}
+
+	// Ссылку проверяем до bcrypt: иначе перебор случайных токенов занимает
+	// слоты хеширования, и вход остальных отвечает 503.
+	tokenHash := auth.HashOpaqueToken(req.Token)
+	userID, err := h.DB.CheckUserToken(models.TokenPurposePasswordReset, tokenHash)
+	if err != nil {
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err))
+		return
+	}
+	if userID == 0 {
+		RespondWithError(w, r, apperr.New(apperr.InvalidLink))
+		return
+	}
+	// Тратим токен после хеширования: при перегрузке bcrypt ссылка из
+	// письма должна остаться рабочей.
+	hashedPassword, ok := hashNewPassword(w, r, req.NewPassword)
+	if !ok {
+		return
+	}
+	userID, err = h.DB.ConsumeUserToken(models.TokenPurposePasswordReset, tokenHash)
+	if err != nil {
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err))
+		return
+	}
+	if userID == 0 {
+		RespondWithError(w, r, apperr.New(apperr.InvalidLink))
+		return
+	}
+
+	if err := h.DB.UpdateUserPassword(userID, hashedPassword); err != nil {
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("обновление пароля пользователя %d", userID))
+		return
+	}
+	if err := h.DB.InvalidateUserTokens(userID, models.TokenPurposePasswordReset); err != nil {
+		log.Printf("!!! [AUTH] Не удалось отозвать остальные токены сброса для %d: %v", userID, err)
+	}
+	log.Printf("[AUTH] Пароль пользователя %d сброшен по ссылке из письма.", userID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *AuthHandler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req models.VerifyEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondWithError(w, r, apperr.New(apperr.BadRequest))
+		return
+	}
+
+	userID, err := h.DB.ConsumeUserToken(models.TokenPurposeEmailVerification, auth.HashOpaqueToken(req.Token))
+	if err != nil {
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err))
+		return
+	}
+	if userID == 0 {
+		RespondWithError(w, r, apperr.New(apperr.InvalidLink))
+		return
+	}
+	if err := h.DB.MarkEmailVerified(userID); err != nil {
+		if errors.Is(err, database.ErrEmailTaken) {
+			RespondWithError(w, r, apperr.New(apperr.EmailTaken))
+			return
+		}
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *AuthHandler) ResendVerificationEmail(w http.ResponseWriter, r *http.Request) {
+	user, ok := r.Context().Value(UserContextKey).(*models.User)
+	if !ok {
+		RespondWithError(w, r, apperr.New(apperr.Unauthorized))
+		return
+	}
+	if !user.Email.Valid {
+		RespondWithError(w, r, apperr.New(apperr.EmailMissing))
+		return
+	}
+	if user.EmailVerified {
+		RespondWithError(w, r, apperr.New(apperr.EmailAlreadyVerified))
+		return
+	}
+	if err := h.DB.InvalidateUserTokens(user.ID, models.TokenPurposeEmailVerification); err != nil {
+		log.Printf("!!! [AUTH] Не удалось отозвать старые токены подтверждения для %d: %v", user.ID, err)
+	}
+	h.sendVerificationEmail(user, RequestLocale(r))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// hashPassword подменяется в тестах, чтобы видеть, дошел ли запрос до bcrypt.
+var hashPassword = auth.HashPassword
+
+func hashNewPassword(w http.ResponseWriter, r *http.Request, password string) (string, bool) {
+	hashedPassword, err := hashPassword(password)
+	if errors.Is(err, auth.ErrHashingBusy) {
+		respondHashingBusy(w, r)
+		return "", false
+	}
+	if err != nil {
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("хеширование пароля"))
+		return "", false
+	}
+	return hashedPassword, true
+}
+
+func (h *AuthHandler) setPassword(w http.ResponseWriter, r *http.Request, userID int, password string) bool {
+	hashedPassword, ok := hashNewPassword(w, r, password)
+	if !ok {
+		return false
+	}
+	if err := h.DB.UpdateUserPassword(userID, hashedPassword); err != nil {
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("обновление пароля пользователя %d", userID))
+		return false
+	}
+	return true
+}
+
+func (h *AuthHandler) sendVerificationEmail(user *models.User, locale i18n.Locale) {
+	h.sendUserTokenEmail(user, locale, models.TokenPurposeEmailVerification, emailVerificationTTL, emailVerificationPath,
+		i18n.VerifyEmailSubject, i18n.VerifyEmailBody)
+}
+
+// sendUserTokenEmail выпускает одноразовый токен и отправляет письмо в фоне,
+// чтобы время ответа не зависело от SMTP.
+func (h *AuthHandler) sendUserTokenEmail(user *models.User, locale i18n.Locale, purpose string, ttl time.Duration, path, subjectKey, bodyKey string) {
+	token, tokenHash, err := auth.GenerateOpaqueToken()
+	if err != nil {
+		log.Printf("!!! [AUTH] Не удалось сгенерировать токен (%s): %v", purpose, err)
+		return
+	}
+	if err := h.DB.CreateUserToken(user.ID, purpose, tokenHash, ttl); err != nil {
+		log.Printf("!!! [AUTH] Не удалось сохранить токен (%s) для %d: %v", purpose, user.ID, err)
+		return
+	}
+
+	link := strings.TrimRight(h.AppBaseURL, "/") + path + "?token=" + url.QueryEscape(token)
+	msg := mailer.Message{
+		To:      user.Email.String,
+		Subject: i18n.T(locale, subjectKey),
+		Body:    i18n.T(locale, bodyKey, link),
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), mailSendTimeout)
+		defer cancel()
+		if err := h.Mailer.Send(ctx, msg); err != nil {
+			log.Printf("!!! [MAIL] Не удалось отправить письмо (%s) пользователю %d: %v", purpose, user.ID, err)
+		}
+	}()
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"egobackend/internal/auth"
+	"egobackend/internal/database"
+	"egobackend/internal/database/storetest"
+	"egobackend/internal/models"
+)
+
+func TestConfirmPasswordResetChecksTokenBeforeHashing(t *testing.T) {
+	var hashed int
+	prev := hashPassword
+	hashPassword = func(password string) (string, error) {
+		hashed++
+		return "hashed:" + password, nil
+	}
+	t.Cleanup(func() { hashPassword = prev })
+
+	db := database.NewMemory()
+	user := storetest.NewUser(t, db)
+	token, tokenHash, err := auth.GenerateOpaqueToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateUserToken(user.ID, models.TokenPurposePasswordReset, tokenHash, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	h := &AuthHandler{DB: db}
+
+	tests := []struct {
+		name       string
+		token      string
+		wantStatus int
+		wantHashed int
+	}{
+		{"случайный токен", "junk", http.StatusBadRequest, 0},
+		{"действующий токен", token, http.StatusNoContent, 1},
+		{"использованный токен", token, http.StatusBadRequest, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"token":"` + tt.token + `","new_password":"new-long-password"}`
+			w := httptest.NewRecorder()
+			h.ConfirmPasswordReset(w, httptest.NewRequest(http.MethodPost, "/auth/password-reset/confirm", strings.NewReader(body)))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if hashed != tt.wantHashed {
+				t.Errorf("bcrypt вызван %d раз, want %d", hashed, tt.wantHashed)
+			}
+		})
+	}
+}
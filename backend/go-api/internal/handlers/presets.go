@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"egobackend/internal/apperr"
+	"egobackend/internal/database"
+	"egobackend/internal/models"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// PresetHandler управляет именованными наборами инструкций. Общие
+// пресеты может создавать только администратор.
+type PresetHandler struct {
+	DB database.UserStore
+}
+
+func presetResponse(preset models.InstructionPreset, user *models.User) models.PresetResponse {
+	return models.PresetResponse{
+		InstructionPreset: preset,
+		Editable:          preset.UserID == user.ID,
+		IsDefault:         user.DefaultPreset.Valid && int(user.DefaultPreset.Int64) == preset.ID,
+	}
+}
+
+func (h *PresetHandler) ListPresets(w http.ResponseWriter, r *http.Request) {
+	user, ok := r.Context().Value(UserContextKey).(*models.User)
+	if !ok {
+		RespondWithError(w, r, apperr.New(apperr.Unauthorized))
+		return
+	}
+
+	presets, err := h.DB.GetVisiblePresets(user.ID)
+	if err != nil {
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("получение пресетов"))
+		return
+	}
+	response := make([]models.PresetResponse, len(presets))
+	for i, preset := range presets {
+		response[i] = presetResponse(preset, user)
+	}
+	RespondWithJSON(w, http.StatusOK, response)
+}
+
+func (h *PresetHandler) CreatePreset(w http.ResponseWriter, r *http.Request) {
+	user, ok := r.Context().Value(UserContextKey).(*models.User)
+	if !ok {
+		RespondWithError(w, r, apperr.New(apperr.Unauthorized))
+		return
+	}
+
+	var req models.PresetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondWithError(w, r, apperr.New(apperr.BadRequest))
+		return
+	}
+	preset := models.InstructionPreset{UserID: user.ID}
+	if err := applyPresetRequest(&preset, req, user); err != nil {
+		RespondWithError(w, r, err)
+		return
+	}
+
+	created, err := h.DB.CreatePreset(user.ID, preset.Name, preset.Instructions, preset.Shared)
+	if err != nil {
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("создание пресета"))
+		return
+	}
+	RespondWithJSON(w, http.StatusCreated, presetResponse(*created, user))
+}
+
+func (h *PresetHandler) UpdatePreset(w http.ResponseWriter, r *http.Request) {
+	user, ok := r.Context().Value(UserContextKey).(*models.User)
+	if !ok {
+		RespondWithError(w, r, apperr.New(apperr.Unauthorized))
+		return
+	}
+
+	presetID, err := strconv.Atoi(chi.URLParam(r, "presetID"))
+	if err != nil {
+		RespondWithError(w, r, apperr.New(apperr.InvalidID))
+		return
+	}
+
+	var req models.PresetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondWithError(w, r, apperr.New(apperr.BadRequest))
+		return
+	}
+	if req.Name == nil && req.Instructions == nil && req.Shared == nil {
+		RespondWithError(w, r, apperr.New(apperr.NothingToUpdate))
+		return
+	}
+
+	preset, err := h.DB.GetVisiblePreset(presetID, user.ID)
+	if err != nil {
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("получение пресета %d", presetID))
+		return
+	}
+	if preset == nil {
+		RespondWithError(w, r, apperr.New(apperr.PresetNotFound))
+		return
+	}
+	if preset.UserID != user.ID {
+		RespondWithError(w, r, apperr.New(apperr.Forbidden))
+		return
+	}
+	if err := applyPresetRequest(preset, req, user); err != nil {
+		RespondWithError(w, r, err)
+		return
+	}
+
+	updated, err := h.DB.UpdatePreset(preset)
+	if err != nil {
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("обновление пресета %d", presetID))
+		return
+	}
+	if updated == nil {
+		RespondWithError(w, r, apperr.New(apperr.PresetNotFound))
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, presetResponse(*updated, user))
+}
+
+func (h *PresetHandler) DeletePreset(w http.ResponseWriter, r *http.Request) {
+	user, ok := r.Context().Value(UserContextKey).(*models.User)
+	if !ok {
+		RespondWithError(w, r, apperr.New(apperr.Unauthorized))
+		return
+	}
+
+	presetID, err := strconv.Atoi(chi.URLParam(r, "presetID"))
+	if err != nil {
+		RespondWithError(w, r, apperr.New(apperr.InvalidID))
+		return
+	}
+
+	deleted, err := h.DB.DeletePreset(presetID, user.ID)
+	if err != nil {
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("удаление пресета %d", presetID))
+		return
+	}
+	if !deleted {
+		RespondWithError(w, r, apperr.New(apperr.PresetNotFound))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// applyPresetRequest переносит заданные поля запроса в пресет и проверяет
+// результат. Сделать пресет общим может только администратор.
+func applyPresetRequest(preset *models.InstructionPreset, req models.PresetRequest, user *models.User) error {
+	if req.Name != nil {
+		preset.Name = strings.TrimSpace(*req.Name)
+	}
+	if req.Instructions != nil {
+		preset.Instructions = *req.Instructions
+	}
+	if req.Shared != nil {
+		if *req.Shared && user.Role != "admin" {
+			return apperr.New(apperr.AdminOnly)
+		}
+		preset.Shared = *req.Shared
+	}
+
+	if preset.Name == "" {
+		return apperr.New(apperr.PresetNameRequired)
+	}
+	if utf8.RuneCountInString(preset.Name) > models.MaxPresetNameRunes {
+		return apperr.New(apperr.PresetTooLong, "name", models.MaxPresetNameRunes)
+	}
+	if utf8.RuneCountInString(preset.Instructions) > models.MaxPresetInstructionsRunes {
+		return apperr.New(apperr.PresetTooLong, "instructions", models.MaxPresetInstructionsRunes)
+	}
+	return nil
+}
@@ -3,65 +3,80 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
-	"log"
 	"net/http"
 	"strconv"
 
+	"egobackend/internal/apperr"
 	"egobackend/internal/database"
 	"egobackend/internal/models"
+	"egobackend/internal/modes"
+	"egobackend/internal/protocol"
 
 	"github.com/go-chi/chi/v5"
 )
 
+// EventPublisher доставляет события во все открытые соединения
+// пользователя, чтобы изменения через REST сразу видели другие устройства.
+type EventPublisher interface {
+	PublishToUser(userID int, event protocol.Event)
+}
+
 type SessionHandler struct {
-	DB *database.DB
+	DB     database.Store
+	Events EventPublisher
 }
 
 type UpdateSessionRequest struct {
 	Title              *string `json:"title"`
 	CustomInstructions *string `json:"custom_instructions"`
+	Mode               *string `json:"mode"`
 }
 
 func (h *SessionHandler) UpdateSession(w http.ResponseWriter, r *http.Request) {
 	user, ok := r.Context().Value(UserContextKey).(*models.User)
 	if !ok {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		RespondWithError(w, r, apperr.New(apperr.Unauthorized))
 		return
 	}
 
 	sessionIDStr := chi.URLParam(r, "sessionID")
 	sessionID, err := strconv.Atoi(sessionIDStr)
 	if err != nil {
-		http.Error(w, "Invalid session ID", http.StatusBadRequest)
+		RespondWithError(w, r, apperr.New(apperr.InvalidID))
 		return
 	}
 
 	var req UpdateSessionRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		RespondWithError(w, r, apperr.New(apperr.BadRequest))
 		return
 	}
 
-	if req.CustomInstructions == nil && req.Title == nil {
-		http.Error(w, "No fields to update", http.StatusBadRequest)
+	if req.CustomInstructions == nil && req.Title == nil && req.Mode == nil {
+		RespondWithError(w, r, apperr.New(apperr.NothingToUpdate))
 		return
 	}
+	if req.Mode != nil {
+		if _, ok := modes.Get(*req.Mode); !ok {
+			RespondWithError(w, r, apperr.New(apperr.UnknownMode, *req.Mode))
+			return
+		}
+	}
 
 	isOwner, err := h.DB.CheckSessionOwnership(sessionID, user.ID)
 	if err != nil {
-		http.Error(w, "Server error checking ownership", http.StatusInternalServerError)
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("проверка владельца сессии %d", sessionID))
 		return
 	}
 	if !isOwner {
-		http.Error(w, "Session not found or access denied", http.StatusNotFound)
+		RespondWithError(w, r, apperr.New(apperr.SessionNotFound))
 		return
 	}
 
 	if req.CustomInstructions != nil {
 		err = h.DB.UpdateSessionInstructions(sessionID, user.ID, *req.CustomInstructions)
 		if err != nil {
-			log.Printf("Failed to update instructions for session %d: %v", sessionID, err)
-			http.Error(w, "Failed to update session instructions", http.StatusInternalServerError)
+			RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("обновление инструкций сессии %d", sessionID))
 			return
 		}
 	}
@@ -69,17 +84,25 @@ func (h *SessionHandler) UpdateSession(w http.ResponseWriter, r *http.Request) {
 	if req.Title != nil {
 		err = h.DB.UpdateSessionTitle(sessionID, user.ID, *req.Title)
 		if err != nil {
-			log.Printf("Failed to update title for session %d: %v", sessionID, err)
-			http.Error(w, "Failed to update session title", http.StatusInternalServerError)
+			RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("обновление названия сессии %d", sessionID))
+			return
+		}
+	}
+
+	if req.Mode != nil {
+		err = h.DB.UpdateSessionMode(sessionID, user.ID, *req.Mode)
+		if err != nil {
+			RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("обновление режима сессии %d", sessionID))
 			return
 		}
 	}
 
 	session, err := h.DB.GetSessionByID(sessionID, user.ID)
 	if err != nil {
-		http.Error(w, "Server error fetching updated session", http.StatusInternalServerError)
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("получение сессии %d", sessionID))
 		return
 	}
+	h.Events.PublishToUser(user.ID, protocol.SessionUpdatedEvent{ChatSession: *session})
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(session)
@@ -88,13 +111,13 @@ func (h *SessionHandler) UpdateSession(w http.ResponseWriter, r *http.Request) {
 func (h *SessionHandler) GetSessions(w http.ResponseWriter, r *http.Request) {
 	user, ok := r.Context().Value(UserContextKey).(*models.User)
 	if !ok {
-		http.Error(w, "Пользователь не найден в контексте", http.StatusInternalServerError)
+		RespondWithError(w, r, apperr.New(apperr.Unauthorized))
 		return
 	}
 
 	sessions, err := h.DB.GetUserSessions(user.ID)
 	if err != nil {
-		http.Error(w, "Ошибка получения сессий", http.StatusInternalServerError)
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("получение сессий"))
 		return
 	}
 
@@ -116,31 +139,41 @@ func (h *SessionHandler) GetSessions(w http.ResponseWriter, r *http.Request) {
 func (h *SessionHandler) GetHistory(w http.ResponseWriter, r *http.Request) {
 	user, ok := r.Context().Value(UserContextKey).(*models.User)
 	if !ok {
-		http.Error(w, "Пользователь не найден в контексте", http.StatusInternalServerError)
+		RespondWithError(w, r, apperr.New(apperr.Unauthorized))
 		return
 	}
 
 	sessionIDStr := chi.URLParam(r, "sessionID")
 	sessionID, err := strconv.Atoi(sessionIDStr)
 	if err != nil {
-		http.Error(w, "Неверный ID сессии", http.StatusBadRequest)
+		RespondWithError(w, r, apperr.New(apperr.InvalidID))
 		return
 	}
 
 	isOwner, err := h.DB.CheckSessionOwnership(sessionID, user.ID)
 	if err != nil {
-		http.Error(w, "Ошибка сервера при проверке сессии", http.StatusInternalServerError)
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("проверка владельца сессии %d", sessionID))
 		return
 	}
 
 	if !isOwner {
-		http.Error(w, "Сессия не найдена", http.StatusNotFound)
+		RespondWithError(w, r, apperr.New(apperr.SessionNotFound))
 		return
 	}
 
 	logs, attachmentsMap, err := h.DB.GetSessionHistory(sessionID, 50)
 	if err != nil {
-		http.Error(w, "Ошибка получения истории", http.StatusInternalServerError)
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("получение истории сессии %d", sessionID))
+		return
+	}
+
+	logIDs := make([]int, len(logs))
+	for i, l := range logs {
+		logIDs[i] = l.ID
+	}
+	feedbackMap, err := h.DB.GetLogFeedback(user.ID, logIDs)
+	if err != nil {
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("получение оценок сессии %d", sessionID))
 		return
 	}
 
@@ -161,8 +194,12 @@ func (h *SessionHandler) GetHistory(w http.ResponseWriter, r *http.Request) {
 			UserQuery:     l.UserQuery,
 			FinalResponse: l.FinalResponse,
 			Timestamp:     l.Timestamp,
+			Pinned:        l.Pinned,
 			Attachments:   attachments,
 		}
+		if feedback, ok := feedbackMap[l.ID]; ok {
+			response[i].Feedback = &feedback
+		}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -172,21 +209,26 @@ func (h *SessionHandler) GetHistory(w http.ResponseWriter, r *http.Request) {
 func (h *SessionHandler) DeleteSession(w http.ResponseWriter, r *http.Request) {
 	user, ok := r.Context().Value(UserContextKey).(*models.User)
 	if !ok {
-		http.Error(w, "Пользователь не найден в контексте", http.StatusInternalServerError)
+		RespondWithError(w, r, apperr.New(apperr.Unauthorized))
 		return
 	}
 
 	sessionID, _ := strconv.Atoi(chi.URLParam(r, "sessionID"))
 	if sessionID == 0 {
-		http.Error(w, "Неверный ID сессии", http.StatusBadRequest)
+		RespondWithError(w, r, apperr.New(apperr.InvalidID))
 		return
 	}
 
-	err := h.DB.DeleteSession(sessionID, user.ID)
+	deleted, err := h.DB.DeleteSession(sessionID, user.ID)
 	if err != nil {
-		http.Error(w, "Ошибка удаления сессии", http.StatusInternalServerError)
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("удаление сессии %d", sessionID))
+		return
+	}
+	if !deleted {
+		RespondWithError(w, r, apperr.New(apperr.SessionNotFound))
 		return
 	}
+	h.Events.PublishToUser(user.ID, protocol.SessionDeletedEvent{SessionID: sessionID})
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -194,24 +236,24 @@ func (h *SessionHandler) DeleteSession(w http.ResponseWriter, r *http.Request) {
 func (h *SessionHandler) GetSession(w http.ResponseWriter, r *http.Request) {
 	user, ok := r.Context().Value(UserContextKey).(*models.User)
 	if !ok {
-		http.Error(w, "Пользователь не найден", http.StatusUnauthorized)
+		RespondWithError(w, r, apperr.New(apperr.Unauthorized))
 		return
 	}
 
 	sessionIDStr := chi.URLParam(r, "sessionID")
 	sessionID, err := strconv.Atoi(sessionIDStr)
 	if err != nil {
-		http.Error(w, "Неверный ID сессии", http.StatusBadRequest)
+		RespondWithError(w, r, apperr.New(apperr.InvalidID))
 		return
 	}
 
 	session, err := h.DB.GetSessionByID(sessionID, user.ID)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			http.Error(w, "Сессия не найдена", http.StatusNotFound)
+			RespondWithError(w, r, apperr.New(apperr.SessionNotFound))
 			return
 		}
-		http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+		RespondWithError(w, r, apperr.Wrap(apperr.Internal, err).WithDetail("получение сессии %d", sessionID))
 		return
 	}
 
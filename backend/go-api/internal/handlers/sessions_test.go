@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"egobackend/internal/database"
+	"egobackend/internal/database/storetest"
+	"egobackend/internal/engine/enginetest"
+	"egobackend/internal/models"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestDeleteSession(t *testing.T) {
+	store := database.NewMemory()
+	events := &enginetest.Recorder{}
+	h := &SessionHandler{DB: store, Events: events}
+	owner, stranger := storetest.NewUser(t, store), storetest.NewUser(t, store)
+	session, _, err := store.GetOrCreateSession("", "chat", owner.ID, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deleteAs := func(user *models.User) int {
+		routeCtx := chi.NewRouteContext()
+		routeCtx.URLParams.Add("sessionID", strconv.Itoa(session.ID))
+		ctx := context.WithValue(context.Background(), chi.RouteCtxKey, routeCtx)
+		ctx = context.WithValue(ctx, UserContextKey, user)
+		w := httptest.NewRecorder()
+		h.DeleteSession(w, httptest.NewRequest(http.MethodDelete, "/sessions/"+strconv.Itoa(session.ID), nil).WithContext(ctx))
+		return w.Code
+	}
+
+	if code := deleteAs(stranger); code != http.StatusNotFound {
+		t.Errorf("чужая сессия: status %d, want 404", code)
+	}
+	if code := deleteAs(owner); code != http.StatusNoContent {
+		t.Errorf("своя сессия: status %d, want 204", code)
+	}
+	if code := deleteAs(owner); code != http.StatusNotFound {
+		t.Errorf("повторное удаление: status %d, want 404", code)
+	}
+	if got := events.Types(); len(got) != 1 || got[0] != "session_deleted" {
+		t.Errorf("events = %v, want одно session_deleted", got)
+	}
+}
@@ -2,11 +2,49 @@ package handlers
 
 import (
 	"encoding/json"
+	"fmt"
+	"log"
+	"net"
 	"net/http"
+	"strings"
+
+	"egobackend/internal/apperr"
+	"egobackend/internal/i18n"
+	"egobackend/internal/models"
 )
 
-func RespondWithError(w http.ResponseWriter, code int, message string) {
-	RespondWithJSON(w, code, map[string]string{"message": message})
+// RespondWithError отдает клиенту код ошибки и сообщение на языке
+// пользователя. Внутренние подробности только логируются.
+func RespondWithError(w http.ResponseWriter, r *http.Request, err error) {
+	appErr := apperr.From(err)
+	status := appErr.Status()
+	if status >= http.StatusInternalServerError || appErr.Err != nil || appErr.Detail != "" {
+		log.Printf("!!! [HTTP] %s %s -> %d: %v", r.Method, r.URL.Path, status, appErr)
+	}
+	RespondWithJSON(w, status, models.ErrorResponse{
+		Code:    string(appErr.Code),
+		Message: appErr.Message(RequestLocale(r)),
+	})
+}
+
+// RequestLocale выбирает язык ответа: настройка пользователя, если он
+// авторизован и выбрал язык, иначе Accept-Language.
+func RequestLocale(r *http.Request) i18n.Locale {
+	if user, ok := r.Context().Value(UserContextKey).(*models.User); ok {
+		return UserLocale(user, r.Header.Get("Accept-Language"))
+	}
+	return i18n.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+}
+
+// UserLocale возвращает язык из настроек пользователя или, если он не
+// выбран, язык из заголовка acceptLanguage.
+func UserLocale(user *models.User, acceptLanguage string) i18n.Locale {
+	if user != nil && user.Locale.Valid {
+		if locale, ok := i18n.Lookup(user.Locale.String); ok {
+			return locale
+		}
+	}
+	return i18n.ParseAcceptLanguage(acceptLanguage)
 }
 
 func RespondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
@@ -16,3 +54,64 @@ func RespondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.WriteHeader(code)
 	w.Write(response)
 }
+
+// DefaultTrustedProxies — сети, из которых по умолчанию принимается
+// X-Real-IP: loopback и частные адреса, где обычно стоит nginx.
+const DefaultTrustedProxies = "127.0.0.0/8,::1/128,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,fc00::/7"
+
+var trustedProxies []*net.IPNet
+
+// SetTrustedProxies задает адреса обратных прокси списком CIDR или IP
+// через запятую. Вызывать до старта сервера.
+func SetTrustedProxies(list string) error {
+	var networks []*net.IPNet
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return fmt.Errorf("неверный адрес прокси %q: %w", item, err)
+		}
+		networks = append(networks, network)
+	}
+	trustedProxies = networks
+	return nil
+}
+
+// ClientIP возвращает адрес клиента без порта. X-Real-IP учитывается,
+// только если запрос пришел от доверенного прокси: иначе клиент мог бы
+// менять адрес в заголовке и обходить ограничения попыток входа.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(net.ParseIP(host)) {
+		return host
+	}
+	if realIP := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); realIP != nil {
+		return realIP.String()
+	}
+	return host
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
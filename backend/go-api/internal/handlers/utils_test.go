@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	if err := SetTrustedProxies("127.0.0.1, 172.16.0.0/12"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetTrustedProxies(DefaultTrustedProxies) })
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{"прямой клиент", "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"клиент подделывает заголовки", "203.0.113.7:5000", map[string]string{"X-Real-IP": "1.2.3.4", "True-Client-IP": "5.6.7.8"}, "203.0.113.7"},
+		{"адрес от прокси", "172.18.0.5:4000", map[string]string{"X-Real-IP": "198.51.100.1"}, "198.51.100.1"},
+		{"True-Client-IP от прокси не учитывается", "172.18.0.5:4000", map[string]string{"True-Client-IP": "5.6.7.8"}, "172.18.0.5"},
+		{"мусор в X-Real-IP", "127.0.0.1:4000", map[string]string{"X-Real-IP": "not-an-ip"}, "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/auth/login", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if got := ClientIP(r); got != tt.want {
+				t.Errorf("ClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if err := SetTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("неверный CIDR принят")
+	}
+}
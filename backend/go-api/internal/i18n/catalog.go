@@ -0,0 +1,97 @@
+package i18n
+
+// Ключи каталога. Сообщения об ошибках лежат под ключами "error.<код>",
+// где код совпадает с apperr.Code.
+const (
+	NewChatTitle         = "session.new_chat_title"
+	RunDone              = "run.done"
+	RunCancelled         = "run.cancelled"
+	PasswordResetSent    = "auth.password_reset_sent"
+	PasswordResetSubject = "mail.password_reset.subject"
+	PasswordResetBody    = "mail.password_reset.body"
+	VerifyEmailSubject   = "mail.verify_email.subject"
+	VerifyEmailBody      = "mail.verify_email.body"
+	ExportReadme         = "export.readme"
+)
+
+var catalog = map[string]map[Locale]string{
+	NewChatTitle:         {RU: "Новый чат", EN: "New chat"},
+	RunDone:              {RU: "Процесс завершен", EN: "Done"},
+	RunCancelled:         {RU: "Генерация отменена", EN: "Generation cancelled"},
+	PasswordResetSent:    {RU: "Если аккаунт существует, письмо со ссылкой отправлено", EN: "If the account exists, an email with a link has been sent"},
+	PasswordResetSubject: {RU: "Сброс пароля EGO", EN: "EGO password reset"},
+	PasswordResetBody: {
+		RU: "Чтобы задать новый пароль, перейдите по ссылке:\n\n%s\n\nСсылка действует 1 час. Если вы не запрашивали сброс, просто проигнорируйте это письмо.",
+		EN: "To set a new password, follow this link:\n\n%s\n\nThe link is valid for 1 hour. If you did not request a reset, just ignore this email.",
+	},
+	VerifyEmailSubject: {RU: "Подтверждение email в EGO", EN: "Confirm your EGO email"},
+	VerifyEmailBody: {
+		RU: "Чтобы подтвердить адрес, перейдите по ссылке:\n\n%s\n\nСсылка действует 48 часов.",
+		EN: "To confirm your address, follow this link:\n\n%s\n\nThe link is valid for 48 hours.",
+	},
+	ExportReadme: {
+		RU: "Выгрузка данных EGO для пользователя %s от %s.\n\naccount.json — данные аккаунта, memories.json — что EGO помнит о вас, presets.json — ваши пресеты инструкций.\nsessions/<id>/session.json — параметры чата, sessions/<id>/logs.json — сообщения.\nattachments/ — загруженные файлы, attachments/unlinked.json — файлы без сообщения.\n",
+		EN: "EGO data export for user %s, created %s.\n\naccount.json — account details, memories.json — what EGO remembers about you, presets.json — your instruction presets.\nsessions/<id>/session.json — chat settings, sessions/<id>/logs.json — messages.\nattachments/ — uploaded files, attachments/unlinked.json — files not linked to a message.\n",
+	},
+
+	// Названия и описания режимов — ключи "mode.<id>.name" и
+	// "mode.<id>.description", см. пакет modes.
+	"mode.default.name":         {RU: "Обычный", EN: "Default"},
+	"mode.default.description":  {RU: "Быстрый ответ с небольшим числом шагов мышления", EN: "Quick answer with a few thinking steps"},
+	"mode.deeper.name":          {RU: "Глубже", EN: "Deeper"},
+	"mode.deeper.description":   {RU: "Больше шагов мышления и длинная история чата", EN: "More thinking steps and a longer chat history"},
+	"mode.research.name":        {RU: "Исследование", EN: "Research"},
+	"mode.research.description": {RU: "Подробный поиск по источникам и самый большой бюджет", EN: "Thorough source search with the largest budget"},
+
+	"error.internal":               {RU: "Внутренняя ошибка сервера", EN: "Internal server error"},
+	"error.bad_request":            {RU: "Неверный формат запроса", EN: "Malformed request"},
+	"error.invalid_id":             {RU: "Неверный идентификатор", EN: "Invalid identifier"},
+	"error.nothing_to_update":      {RU: "Нет полей для обновления", EN: "No fields to update"},
+	"error.empty_query":            {RU: "Запрос не может быть пустым", EN: "Query cannot be empty"},
+	"error.unauthorized":           {RU: "Требуется авторизация", EN: "Authentication required"},
+	"error.token_missing":          {RU: "Токен авторизации отсутствует", EN: "Authorization token is missing"},
+	"error.invalid_token":          {RU: "Невалидный или просроченный токен", EN: "Invalid or expired token"},
+	"error.invalid_google_token":   {RU: "Невалидный токен Google", EN: "Invalid Google token"},
+	"error.forbidden":              {RU: "Доступ запрещен", EN: "Access denied"},
+	"error.admin_only":             {RU: "Доступ только для администраторов", EN: "Administrators only"},
+	"error.account_deleted":        {RU: "Аккаунт удален", EN: "Account has been deleted"},
+	"error.user_not_found":         {RU: "Пользователь не найден", EN: "User not found"},
+	"error.credentials_required":   {RU: "Имя пользователя и пароль не могут быть пустыми", EN: "Username and password are required"},
+	"error.invalid_credentials":    {RU: "Неверный логин или пароль", EN: "Invalid username or password"},
+	"error.wrong_password":         {RU: "Текущий пароль указан неверно", EN: "Current password is incorrect"},
+	"error.reauth_required":        {RU: "Подтвердите действие текущим паролем или входом через Google", EN: "Confirm with your current password or by signing in with Google"},
+	"error.password_too_short":     {RU: "Пароль должен содержать не менее %d символов", EN: "Password must be at least %d characters long"},
+	"error.username_taken":         {RU: "Пользователь с таким именем уже существует", EN: "Username is already taken"},
+	"error.email_taken":            {RU: "Пользователь с таким email уже существует", EN: "Email is already registered"},
+	"error.email_required":         {RU: "Для регистрации требуется email", EN: "Email is required to register"},
+	"error.email_invalid":          {RU: "Некорректный email", EN: "Invalid email address"},
+	"error.email_missing":          {RU: "У аккаунта не указан email", EN: "The account has no email address"},
+	"error.email_not_verified":     {RU: "Подтвердите email, чтобы войти", EN: "Please verify your email to sign in"},
+	"error.email_already_verified": {RU: "Email уже подтвержден", EN: "Email is already verified"},
+	"error.invalid_link":           {RU: "Ссылка недействительна или устарела", EN: "The link is invalid or has expired"},
+	"error.too_many_attempts":      {RU: "Слишком много попыток, попробуйте позже", EN: "Too many attempts, please try again later"},
+	"error.server_busy":            {RU: "Сервер перегружен, попробуйте позже", EN: "Server is busy, please try again later"},
+	"error.session_not_found":      {RU: "Сессия не найдена", EN: "Session not found"},
+	"error.log_not_found":          {RU: "Сообщение не найдено", EN: "Message not found"},
+	"error.lockout_not_found":      {RU: "Блокировка не найдена или уже снята", EN: "Lockout not found or already cleared"},
+	"error.memory_not_found":       {RU: "Запись в памяти не найдена", EN: "Memory not found"},
+	"error.memory_limit_reached":   {RU: "В памяти уже %d записей, удалите ненужные", EN: "Memory already holds %d entries, delete some first"},
+	"error.memory_too_long":        {RU: "Запись в памяти длиннее %d символов", EN: "Memory is longer than %d characters"},
+	"error.preset_not_found":       {RU: "Пресет не найден", EN: "Preset not found"},
+	"error.preset_name_required":   {RU: "Укажите название пресета", EN: "Preset name is required"},
+	"error.preset_too_long":        {RU: "Поле «%s» длиннее %d символов", EN: "Field \"%s\" is longer than %d characters"},
+	"error.unknown_mode":           {RU: "Неизвестный режим «%s»", EN: "Unknown mode \"%s\""},
+	"error.invalid_rating":         {RU: "Оценка должна быть 1 или -1", EN: "Rating must be 1 or -1"},
+	"error.unknown_reason":         {RU: "Неизвестная причина оценки «%s»", EN: "Unknown feedback reason \"%s\""},
+	"error.feedback_too_long":      {RU: "Комментарий длиннее %d символов", EN: "Comment is longer than %d characters"},
+	"error.invalid_time_window":    {RU: "Неверный период: укажите from и to в формате RFC 3339, from раньше to", EN: "Invalid time window: from and to must be RFC 3339 and from must be before to"},
+	"error.streaming_unsupported":  {RU: "Клиент не поддерживает стриминг", EN: "Streaming is not supported"},
+	"error.file_too_large":         {RU: "Файл «%s» больше допустимых %d МБ", EN: "File \"%s\" exceeds the %d MB limit"},
+	"error.quota_exceeded":         {RU: "Слишком много одновременных запросов, дождитесь завершения текущих", EN: "Too many concurrent requests, wait for the current ones to finish"},
+	"error.python_unavailable":     {RU: "Сервис генерации временно недоступен", EN: "Generation service is temporarily unavailable"},
+	"error.generation_failed":      {RU: "Не удалось сгенерировать ответ", EN: "Failed to generate a response"},
+	"error.tool_failed":            {RU: "Инструмент завершился с ошибкой", EN: "Tool call failed"},
+	"error.protocol_unsupported":   {RU: "Нет общей версии протокола с сервером", EN: "No protocol version in common with the server"},
+	"error.unsupported_locale":     {RU: "Язык «%s» не поддерживается", EN: "Locale \"%s\" is not supported"},
+	"error.run_id_required":        {RU: "Не указан run_id", EN: "run_id is required"},
+}
@@ -0,0 +1,92 @@
+// Package i18n хранит каталог строк, которые сервер показывает
+// пользователю, и выбирает язык: настройка пользователя, затем язык из
+// hello или Accept-Language, затем русский по умолчанию.
+package i18n
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type Locale string
+
+const (
+	RU Locale = "ru"
+	EN Locale = "en"
+
+	Default = RU
+)
+
+// Supported — языки, для которых в каталоге есть переводы.
+var Supported = []Locale{RU, EN}
+
+// Lookup приводит тег вида "en-US" к поддерживаемому языку.
+func Lookup(tag string) (Locale, bool) {
+	base, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+	base, _, _ = strings.Cut(base, "_")
+	for _, locale := range Supported {
+		if Locale(base) == locale {
+			return locale, true
+		}
+	}
+	return "", false
+}
+
+// ParseAcceptLanguage выбирает поддерживаемый язык из заголовка
+// Accept-Language с учетом весов q. Если подходящего нет, возвращает Default.
+func ParseAcceptLanguage(header string) Locale {
+	best, bestQ := Default, -1.0
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+		if locale, ok := Lookup(tag); ok && q > bestQ {
+			best, bestQ = locale, q
+		}
+	}
+	return best
+}
+
+// Has сообщает, есть ли ключ в каталоге.
+func Has(key string) bool {
+	_, ok := catalog[key]
+	return ok
+}
+
+// T возвращает перевод ключа. Если перевода на locale нет, берется
+// Default, если нет самого ключа — ключ как есть.
+func T(locale Locale, key string, args ...interface{}) string {
+	texts, ok := catalog[key]
+	if !ok {
+		return key
+	}
+	text, ok := texts[locale]
+	if !ok {
+		text = texts[Default]
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(text, args...)
+	}
+	return text
+}
+
+type contextKey struct{}
+
+// WithLocale запоминает язык пользователя в контексте, чтобы движок мог
+// отвечать на нужном языке.
+func WithLocale(ctx context.Context, locale Locale) context.Context {
+	return context.WithValue(ctx, contextKey{}, locale)
+}
+
+func FromContext(ctx context.Context) Locale {
+	if locale, ok := ctx.Value(contextKey{}).(Locale); ok {
+		return locale
+	}
+	return Default
+}
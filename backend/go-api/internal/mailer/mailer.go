@@ -0,0 +1,128 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// NewFromEnv выбирает SMTP, если задан SMTP_HOST, иначе пишет письма
+// в каталог MAIL_OUTPUT_DIR или просто в лог.
+func NewFromEnv() Mailer {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		log.Println("[MAIL] SMTP_HOST не задан, письма будут записываться локально.")
+		return &FileMailer{Dir: os.Getenv("MAIL_OUTPUT_DIR")}
+	}
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	return &SMTPMailer{
+		Host:     host,
+		Port:     port,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     os.Getenv("SMTP_FROM"),
+	}
+}
+
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	raw, err := buildRFC822(m.From, msg)
+	if err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(net.JoinHostPort(m.Host, m.Port), auth, m.From, []string{msg.To}, raw)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("не удалось отправить письмо через SMTP: %w", err)
+		}
+		log.Printf("[MAIL] Письмо '%s' отправлено на %s", msg.Subject, msg.To)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// FileMailer нужен для локальной разработки: письмо сохраняется в .eml файл
+// или, если каталог не задан, целиком выводится в лог.
+type FileMailer struct {
+	Dir string
+}
+
+func (m *FileMailer) Send(ctx context.Context, msg Message) error {
+	raw, err := buildRFC822("ego@localhost", msg)
+	if err != nil {
+		return err
+	}
+	if m.Dir == "" {
+		log.Printf("[MAIL] Письмо для %s:\n%s", msg.To, raw)
+		return nil
+	}
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return fmt.Errorf("не удалось создать каталог для писем: %w", err)
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405"), uuid.New().String())
+	path := filepath.Join(m.Dir, name)
+	if err := os.WriteFile(path, raw, 0o644); err != nil {
+		return fmt.Errorf("не удалось записать письмо: %w", err)
+	}
+	log.Printf("[MAIL] Письмо '%s' для %s сохранено в %s", msg.Subject, msg.To, path)
+	return nil
+}
+
+// buildRFC822 собирает письмо. Адреса вставляются в заголовки как есть,
+// поэтому перевод строки в них отклоняется: иначе через адрес можно было бы
+// дописать свои заголовки.
+func buildRFC822(from string, msg Message) ([]byte, error) {
+	if strings.ContainsAny(from, "\r\n") || strings.ContainsAny(msg.To, "\r\n") {
+		return nil, fmt.Errorf("перевод строки в адресе письма: %q", msg.To)
+	}
+	var b strings.Builder
+	b.WriteString("From: " + from + "\r\n")
+	b.WriteString("To: " + msg.To + "\r\n")
+	b.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", msg.Subject) + "\r\n")
+	b.WriteString("Date: " + time.Now().UTC().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=\"utf-8\"\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String()), nil
+}
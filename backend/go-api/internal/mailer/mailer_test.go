@@ -0,0 +1,26 @@
+package mailer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildRFC822RejectsHeaderInjection(t *testing.T) {
+	msg := Message{To: "victim@example.com\r\nBcc: all@example.com", Subject: "Тема", Body: "текст"}
+	if _, err := buildRFC822("ego@localhost", msg); err == nil {
+		t.Fatal("адрес с переводом строки принят")
+	}
+
+	msg = Message{To: "user@example.com", Subject: "Тема\r\nBcc: all@example.com", Body: "строка 1\nстрока 2"}
+	raw, err := buildRFC822("ego@localhost", msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers, body, _ := strings.Cut(string(raw), "\r\n\r\n")
+	if strings.Contains(headers, "\r\nBcc:") {
+		t.Errorf("тема дописала заголовок:\n%s", headers)
+	}
+	if body != "строка 1\r\nстрока 2" {
+		t.Errorf("body = %q", body)
+	}
+}
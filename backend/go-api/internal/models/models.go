@@ -7,13 +7,26 @@ import (
 )
 
 type User struct {
-	ID             int       `db:"id" json:"id"`
-	Username       string    `db:"username" json:"username"`
-	HashedPassword string    `db:"hashed_password" json:"-"`
-	Role           string    `db:"role" json:"role"`
-	CreatedAt      time.Time `db:"created_at" json:"created_at"`
+	ID             int            `db:"id" json:"id"`
+	Username       string         `db:"username" json:"username"`
+	HashedPassword string         `db:"hashed_password" json:"-"`
+	Role           string         `db:"role" json:"role"`
+	CreatedAt      time.Time      `db:"created_at" json:"created_at"`
+	Email          sql.NullString `db:"email" json:"-"`
+	EmailVerified  bool           `db:"email_verified" json:"email_verified"`
+	DeletedAt      sql.NullTime   `db:"deleted_at" json:"-"`
+	PurgeAfter     sql.NullTime   `db:"purge_after" json:"-"`
+	Locale         sql.NullString `db:"locale" json:"-"`
+	DefaultPreset  sql.NullInt64  `db:"default_preset_id" json:"-"`
+	// TokenVersion растет при каждой смене пароля и отзывает старые JWT.
+	TokenVersion int `db:"token_version" json:"-"`
 }
 
+const (
+	TokenPurposePasswordReset     = "password_reset"
+	TokenPurposeEmailVerification = "email_verification"
+)
+
 type S3Config struct {
 	Endpoint string
 	Region   string
@@ -40,20 +53,192 @@ type RequestLog struct {
 	PromptTokens     int       `db:"prompt_tokens"`
 	CompletionTokens int       `db:"completion_tokens"`
 	TotalTokens      int       `db:"total_tokens"`
-	AttachedFileIDs  string    `db:"attached_file_ids"`
+	Pinned           bool      `db:"pinned"`
 	Timestamp        time.Time `db:"timestamp"`
+	// Mode — режим, в котором получен ответ. У логов, сохраненных до
+	// появления колонки, он пуст.
+	Mode *string `db:"mode"`
+}
+
+// Виды шагов трассы рассуждения. Совпадают с type в ego_thoughts_json.
+const (
+	ThoughtStepThought     = "thought"
+	ThoughtStepToolOutput  = "tool_output"
+	ThoughtStepToolError   = "tool_error"
+	ThoughtStepSystemError = "system_error"
+)
+
+// ThoughtStep — шаг трассы рассуждения: мысль модели или вызов
+// инструмента. Шаги одной итерации мышления имеют общий Iteration.
+type ThoughtStep struct {
+	Position   int      `db:"position" json:"position"`
+	Iteration  int      `db:"iteration" json:"iteration"`
+	Kind       string   `db:"kind" json:"kind"`
+	Header     *string  `db:"header" json:"header,omitempty"`
+	Content    *string  `db:"content" json:"content,omitempty"`
+	Confidence *float64 `db:"confidence" json:"confidence,omitempty"`
+	ToolName   *string  `db:"tool_name" json:"tool_name,omitempty"`
+	Query      *string  `db:"query" json:"query,omitempty"`
+	Output     *string  `db:"output" json:"output,omitempty"`
+	DurationMS int64    `db:"duration_ms" json:"duration_ms"`
+	Error      *string  `db:"error" json:"error,omitempty"`
+}
+
+type TraceResponse struct {
+	LogID int64         `json:"log_id"`
+	Steps []ThoughtStep `json:"steps"`
+}
+
+const (
+	FeedbackPositive = 1
+	FeedbackNegative = -1
+
+	MaxFeedbackCommentRunes = 2000
+)
+
+// FeedbackReasons — допустимые теги оценки. Набор фиксирован, чтобы
+// причины можно было считать в статистике.
+var FeedbackReasons = []string{
+	"helpful", "accurate", "well_written",
+	"incorrect", "incomplete", "off_topic", "too_long", "too_short", "bad_tool_use", "unsafe", "other",
+}
+
+// LogFeedback — оценка ответа пользователем. У пользователя одна оценка на
+// сообщение, повторная отправка ее заменяет.
+type LogFeedback struct {
+	ID           int       `db:"id" json:"-"`
+	RequestLogID int       `db:"request_log_id" json:"log_id"`
+	UserID       int       `db:"user_id" json:"-"`
+	Rating       int       `db:"rating" json:"rating"`
+	Comment      *string   `db:"comment" json:"comment,omitempty"`
+	Reasons      []string  `db:"-" json:"reasons"`
+	CreatedAt    time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt    time.Time `db:"updated_at" json:"updated_at"`
+}
+
+type FeedbackRequest struct {
+	Rating  int      `json:"rating"`
+	Comment *string  `json:"comment"`
+	Reasons []string `json:"reasons"`
+}
+
+// FeedbackCounts — число оценок в группе.
+type FeedbackCounts struct {
+	Total    int `db:"total" json:"total"`
+	Positive int `db:"positive" json:"positive"`
+	Negative int `db:"negative" json:"negative"`
+}
+
+type ModeFeedback struct {
+	Mode string `db:"mode" json:"mode"`
+	FeedbackCounts
+}
+
+// ToolFeedback — оценки ответов, в которых вызывался инструмент. Оценка
+// ответа с несколькими инструментами учитывается у каждого из них, а
+// ответы без инструментов собраны под пустым именем.
+type ToolFeedback struct {
+	Tool string `db:"tool" json:"tool"`
+	FeedbackCounts
+}
+
+type ReasonFeedback struct {
+	Reason string `db:"reason" json:"reason"`
+	FeedbackCounts
+}
+
+// FeedbackStats — сводка оценок за окно [From, To).
+type FeedbackStats struct {
+	From    time.Time        `json:"from"`
+	To      time.Time        `json:"to"`
+	Total   FeedbackCounts   `json:"total"`
+	ByMode  []ModeFeedback   `json:"by_mode"`
+	ByTool  []ToolFeedback   `json:"by_tool"`
+	Reasons []ReasonFeedback `json:"reasons"`
+}
+
+// SessionSummary — сводка старых сообщений сессии, которые уже не
+// помещаются в историю. LogIDs — сообщения, вошедшие в сводку, по
+// возрастанию; Version растет с каждым сохранением сводки.
+type SessionSummary struct {
+	Summary string `db:"summary"`
+	Version int    `db:"summary_version"`
+	LogIDs  []int  `db:"-"`
+}
+
+const (
+	MemorySourceUser      = "user"
+	MemorySourceAssistant = "assistant"
+
+	MaxUserMemories = 200
+	MaxMemoryRunes  = 1000
+)
+
+// UserMemory — факт о пользователе, который модель видит во всех его
+// сессиях. Source показывает, кто его записал: сам пользователь или модель
+// через инструмент EgoMemory.
+type UserMemory struct {
+	ID        int       `db:"id" json:"id"`
+	UserID    int       `db:"user_id" json:"-"`
+	Content   string    `db:"content" json:"content"`
+	Source    string    `db:"source" json:"source"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt time.Time `db:"updated_at" json:"updated_at"`
+}
+
+type MemoryRequest struct {
+	Content string `json:"content"`
+}
+
+const (
+	MaxPresetNameRunes         = 100
+	MaxPresetInstructionsRunes = 10000
+)
+
+// InstructionPreset — именованный набор инструкций, который можно выбрать
+// при создании сессии. Shared-пресеты создают администраторы, и они видны
+// всем пользователям.
+type InstructionPreset struct {
+	ID           int       `db:"id" json:"id"`
+	UserID       int       `db:"user_id" json:"-"`
+	Name         string    `db:"name" json:"name"`
+	Instructions string    `db:"instructions" json:"instructions"`
+	Shared       bool      `db:"shared" json:"shared"`
+	CreatedAt    time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt    time.Time `db:"updated_at" json:"updated_at"`
+}
+
+// PresetResponse дополняет пресет тем, что зависит от пользователя: может
+// ли он его менять и выбран ли пресет по умолчанию.
+type PresetResponse struct {
+	InstructionPreset
+	Editable  bool `json:"editable"`
+	IsDefault bool `json:"is_default"`
 }
 
+type PresetRequest struct {
+	Name         *string `json:"name"`
+	Instructions *string `json:"instructions"`
+	Shared       *bool   `json:"shared"`
+}
+
+// Вложение создается в статусе pending до загрузки в S3 и становится
+// committed в одной транзакции с сохранением лога. Вложения, которые так и
+// остались pending, убирает фоновая сверка.
+const (
+	AttachmentStatusPending   = "pending"
+	AttachmentStatusCommitted = "committed"
+)
+
 type FileAttachment struct {
-	ID           int64         `db:"id"`
-	SessionID    int           `db:"session_id"`
-	UserID       int           `db:"user_id"`
-	RequestLogID sql.NullInt64 `db:"request_log_id"`
-	FileName     string        `db:"file_name"`
-	FileURI      string        `db:"file_uri"`
-	MimeType     string        `db:"mime_type"`
-	Status       string        `db:"status"`
-	CreatedAt    time.Time     `db:"created_at"`
+	ID        int64     `db:"id"`
+	SessionID int       `db:"session_id"`
+	UserID    int       `db:"user_id"`
+	FileName  string    `db:"file_name"`
+	FileURI   string    `db:"file_uri"`
+	MimeType  string    `db:"mime_type"`
+	Status    string    `db:"status"`
+	CreatedAt time.Time `db:"created_at"`
 }
 
 type FilePayload struct {
@@ -68,11 +253,21 @@ type StreamRequest struct {
 	SessionID           *int          `json:"session_id,omitempty"`
 	Files               []FilePayload `json:"files,omitempty"`
 	CustomInstructions  *string       `json:"custom_instructions,omitempty"`
+	PresetID            *int          `json:"preset_id,omitempty"`
 	IsRegeneration      bool          `json:"is_regeneration,omitempty"`
 	RequestLogIDToRegen int64         `json:"request_log_id_to_regen,omitempty"`
 	TempID              int64         `json:"temp_id,omitempty"`
 }
 
+type RunInfo struct {
+	RunID          string    `json:"run_id"`
+	TempID         int64     `json:"temp_id,omitempty"`
+	SessionID      *int      `json:"session_id,omitempty"`
+	Mode           string    `json:"mode"`
+	IsRegeneration bool      `json:"is_regeneration,omitempty"`
+	StartedAt      time.Time `json:"started_at"`
+}
+
 type ToolCall struct {
 	ToolName  string `json:"tool_name"`
 	ToolQuery string `json:"tool_query"`
@@ -88,15 +283,47 @@ type ThoughtResponse struct {
 	NextThoughtNeeded bool        `json:"nextThoughtNeeded"`
 }
 
+type TokenUsage struct {
+	PromptTokenCount     int `json:"promptTokenCount"`
+	CandidatesTokenCount int `json:"candidatesTokenCount"`
+	TotalTokenCount      int `json:"totalTokenCount"`
+}
+
 type ThoughtResponseWithData struct {
-	Thought          ThoughtResponse        `json:"thought"`
-	Usage            map[string]interface{} `json:"usage"`
-	UploadedFileURIs []string               `json:"uploaded_file_uris"`
+	Thought          ThoughtResponse `json:"thought"`
+	Usage            *TokenUsage     `json:"usage"`
+	UploadedFileURIs []string        `json:"uploaded_file_uris"`
 }
 
 type AuthRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Email    string `json:"email,omitempty"`
+}
+
+// DeleteAccountRequest подтверждает удаление аккаунта: нужен текущий
+// пароль или, для входа через Google, свежий токен Google.
+type DeleteAccountRequest struct {
+	CurrentPassword string `json:"current_password"`
+	GoogleToken     string `json:"google_token"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type PasswordResetRequest struct {
+	Login string `json:"login"`
+}
+
+type PasswordResetConfirmRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
 }
 
 type RefreshTokenRequest struct {
@@ -107,11 +334,30 @@ type RefreshResponse struct {
 	AccessToken string `json:"access_token"`
 }
 
+// ErrorResponse — тело ответа REST при ошибке. Code стабилен и подходит
+// для разбора на клиенте, Message локализован.
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
 type UserResponse struct {
-	ID        int       `json:"id"`
-	Username  string    `json:"username"`
-	Role      string    `json:"role"`
-	CreatedAt time.Time `json:"created_at"`
+	ID            int       `json:"id"`
+	Username      string    `json:"username"`
+	Role          string    `json:"role"`
+	CreatedAt     time.Time `json:"created_at"`
+	Email         string    `json:"email,omitempty"`
+	EmailVerified bool      `json:"email_verified"`
+	Locale        string    `json:"locale,omitempty"`
+	DefaultPreset *int      `json:"default_preset_id,omitempty"`
+}
+
+// UpdateProfileRequest меняет настройки пользователя. Пустая строка в
+// Locale сбрасывает язык к языку браузера, 0 в DefaultPresetID снимает
+// пресет по умолчанию.
+type UpdateProfileRequest struct {
+	Locale          *string `json:"locale"`
+	DefaultPresetID *int    `json:"default_preset_id"`
 }
 
 type SessionResponse struct {
@@ -132,7 +378,9 @@ type LogResponse struct {
 	UserQuery     string                   `json:"user_query"`
 	FinalResponse *string                  `json:"final_response"`
 	Timestamp     time.Time                `json:"timestamp"`
+	Pinned        bool                     `json:"pinned"`
 	Attachments   []FileAttachmentResponse `json:"attachments"`
+	Feedback      *LogFeedback             `json:"feedback"`
 }
 
 type GoogleAuthRequest struct {
@@ -147,6 +395,48 @@ type PythonRequest struct {
 	CustomInstructions *string       `json:"custom_instructions,omitempty"`
 	Files              []FilePayload `json:"files,omitempty"`
 	CachedFiles        []CachedFile  `json:"cached_files,omitempty"`
+	Memories           []string      `json:"memories,omitempty"`
+	AllowedTools       []string      `json:"allowed_tools,omitempty"`
+	Temperature        *float64      `json:"temperature,omitempty"`
+}
+
+// ModeResponse описывает режим для клиента: название и описание уже
+// переведены на язык пользователя.
+type ModeResponse struct {
+	ID                   string   `json:"id"`
+	Name                 string   `json:"name"`
+	Description          string   `json:"description"`
+	AllowedTools         []string `json:"allowed_tools"`
+	MaxThoughts          int      `json:"max_thoughts"`
+	HistoryBudget        int      `json:"history_budget"`
+	ThinkingTemperature  float64  `json:"thinking_temperature"`
+	SynthesisTemperature float64  `json:"synthesis_temperature"`
+}
+
+// TitleRequest — запрос к Python на короткое название сессии по первому
+// обмену репликами.
+type TitleRequest struct {
+	Query    string `json:"query"`
+	Response string `json:"response"`
+	Locale   string `json:"locale"`
+}
+
+type TitleResponse struct {
+	Title string      `json:"title"`
+	Usage *TokenUsage `json:"usage,omitempty"`
+}
+
+// SummaryRequest — запрос к Python на обновление сводки: к прежней сводке
+// добавляются сообщения, которые выпали из окна истории.
+type SummaryRequest struct {
+	PreviousSummary string `json:"previous_summary"`
+	ChatHistory     string `json:"chat_history"`
+	Locale          string `json:"locale"`
+}
+
+type SummaryResponse struct {
+	Summary string      `json:"summary"`
+	Usage   *TokenUsage `json:"usage,omitempty"`
 }
 
 type CachedFile struct {
@@ -154,6 +444,46 @@ type CachedFile struct {
 	MimeType string `json:"mime_type"`
 }
 
+type LoginLockout struct {
+	ID             int           `db:"id" json:"id"`
+	Scope          string        `db:"scope" json:"scope"`
+	Subject        string        `db:"subject" json:"subject"`
+	FailedAttempts int           `db:"failed_attempts" json:"failed_attempts"`
+	LockedUntil    time.Time     `db:"locked_until" json:"locked_until"`
+	CreatedAt      time.Time     `db:"created_at" json:"created_at"`
+	ClearedAt      sql.NullTime  `db:"cleared_at" json:"-"`
+	ClearedBy      sql.NullInt64 `db:"cleared_by" json:"-"`
+}
+
+type ExportLog struct {
+	ID               int                      `json:"id"`
+	UserQuery        string                   `json:"user_query"`
+	FinalResponse    *string                  `json:"final_response"`
+	Thoughts         json.RawMessage          `json:"thoughts,omitempty"`
+	PromptTokens     int                      `json:"prompt_tokens"`
+	CompletionTokens int                      `json:"completion_tokens"`
+	TotalTokens      int                      `json:"total_tokens"`
+	Timestamp        time.Time                `json:"timestamp"`
+	Attachments      []ExportAttachmentRecord `json:"attachments,omitempty"`
+	Feedback         *LogFeedback             `json:"feedback,omitempty"`
+}
+
+type ExportAttachmentRecord struct {
+	ID          int64     `json:"id"`
+	FileName    string    `json:"file_name"`
+	MimeType    string    `json:"mime_type"`
+	ArchivePath string    `json:"archive_path,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type AccountDeletionResponse struct {
+	DeletedAt  time.Time `json:"deleted_at"`
+	PurgeAfter time.Time `json:"purge_after"`
+}
+
+// UpdateLogRequest меняет текст запроса и/или закрепление сообщения.
+// Закрепленные сообщения всегда попадают в историю для модели.
 type UpdateLogRequest struct {
-	Query string `json:"query"`
+	Query  *string `json:"query"`
+	Pinned *bool   `json:"pinned"`
 }
@@ -0,0 +1,102 @@
+// Package modes — реестр режимов работы EGO. Режим определяет, какие
+// инструменты доступны модели, сколько шагов мышления ей дается, какой
+// бюджет истории и параметры синтеза ответа. Python получает только ID
+// режима и выбирает по нему промпты.
+package modes
+
+import (
+	"egobackend/internal/apperr"
+	"egobackend/internal/i18n"
+)
+
+const DefaultID = "default"
+
+// Synthesis — параметры генерации. Temperature передается в Python как есть.
+type Synthesis struct {
+	ThinkingTemperature  float64 `json:"thinking_temperature"`
+	SynthesisTemperature float64 `json:"synthesis_temperature"`
+}
+
+type Mode struct {
+	ID string
+	// AllowedTools — инструменты, которые модель может вызывать в этом
+	// режиме. Остальные вызовы отклоняются с tool_error.
+	AllowedTools []string
+	// MaxThoughts — сколько шагов мышления делается до синтеза.
+	MaxThoughts int
+	// HistoryBudget — примерный бюджет токенов на историю чата. Сводка
+	// старых сообщений и закрепленные сообщения входят в него же.
+	HistoryBudget int
+	Synthesis     Synthesis
+}
+
+var allTools = []string{"EgoSearch", "EgoWiki", "EgoCalc", "EgoCode", "AlterEgo", "EgoMemory"}
+
+var registry = []Mode{
+	{
+		ID:            DefaultID,
+		AllowedTools:  allTools,
+		MaxThoughts:   15,
+		HistoryBudget: 8000,
+		Synthesis:     Synthesis{ThinkingTemperature: 0.7, SynthesisTemperature: 0.8},
+	},
+	{
+		ID:            "deeper",
+		AllowedTools:  allTools,
+		MaxThoughts:   20,
+		HistoryBudget: 16000,
+		Synthesis:     Synthesis{ThinkingTemperature: 0.7, SynthesisTemperature: 0.8},
+	},
+	{
+		ID:            "research",
+		AllowedTools:  allTools,
+		MaxThoughts:   30,
+		HistoryBudget: 32000,
+		Synthesis:     Synthesis{ThinkingTemperature: 0.5, SynthesisTemperature: 0.6},
+	},
+}
+
+// All возвращает режимы в порядке показа в интерфейсе.
+func All() []Mode {
+	return registry
+}
+
+// Get ищет режим по ID.
+func Get(id string) (Mode, bool) {
+	for _, mode := range registry {
+		if mode.ID == id {
+			return mode, true
+		}
+	}
+	return Mode{}, false
+}
+
+// Resolve возвращает режим запроса. Пустой ID — режим по умолчанию,
+// неизвестный — ошибка unknown_mode, а не тихая подмена.
+func Resolve(id string) (Mode, error) {
+	if id == "" {
+		id = DefaultID
+	}
+	mode, ok := Get(id)
+	if !ok {
+		return Mode{}, apperr.New(apperr.UnknownMode, id)
+	}
+	return mode, nil
+}
+
+func (m Mode) AllowsTool(name string) bool {
+	for _, tool := range m.AllowedTools {
+		if tool == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (m Mode) Name(locale i18n.Locale) string {
+	return i18n.T(locale, "mode."+m.ID+".name")
+}
+
+func (m Mode) Description(locale i18n.Locale) string {
+	return i18n.T(locale, "mode."+m.ID+".description")
+}
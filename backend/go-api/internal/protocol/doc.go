@@ -0,0 +1,44 @@
+// Package protocol описывает WebSocket-протокол между фронтендом и Go API.
+//
+// Каждый кадр — JSON-объект с полем type. Клиент отправляет сообщения
+// hello, generate, cancel, resume, ping, subscribe и list_runs. Кадр без
+// type считается generate: так работают клиенты, написанные до появления
+// протокола.
+//
+// Сервер отвечает конвертом Envelope: type, data и, для событий
+// генерации, temp_id и run_id исходного запроса. Тип data однозначно
+// определяется type и описан структурами из events.go.
+//
+// Версия согласуется сообщением hello: клиент перечисляет поддерживаемые
+// версии, сервер выбирает наибольшую общую и присылает ее в ответном
+// hello. До hello сервер считает, что клиент говорит на версии 1.
+//
+// JSON Schema для фронтенда генерируется из этих структур:
+//
+//	go generate ./internal/protocol
+package protocol
+
+//go:generate go run ../../cmd/protoschema -o ../../../../frontend/src/lib/protocol.schema.json
+
+const Version = 1
+
+// CloseSlowConsumer — код close-фрейма, которым сервер закрывает
+// соединение, если клиент слишком долго не забирает события. Клиенту
+// стоит переподключиться и запросить resume для незавершенных генераций.
+const CloseSlowConsumer = 4008
+
+var SupportedVersions = []int{1}
+
+// Negotiate выбирает наибольшую версию, которую поддерживают обе стороны.
+// Ноль означает, что общей версии нет.
+func Negotiate(clientVersions []int) int {
+	best := 0
+	for _, v := range clientVersions {
+		for _, s := range SupportedVersions {
+			if v == s && v > best {
+				best = v
+			}
+		}
+	}
+	return best
+}
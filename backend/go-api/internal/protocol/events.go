@@ -0,0 +1,167 @@
+package protocol
+
+import (
+	"time"
+
+	"egobackend/internal/models"
+)
+
+// Envelope — единственная форма исходящего кадра.
+type Envelope struct {
+	Type   string      `json:"type"`
+	Data   interface{} `json:"data"`
+	TempID int64       `json:"temp_id,omitempty"`
+	RunID  string      `json:"run_id,omitempty"`
+}
+
+// Event — данные исходящего события. Тип кадра берется из EventType.
+type Event interface {
+	EventType() string
+}
+
+func NewEnvelope(event Event, tempID int64, runID string) Envelope {
+	if raw, ok := event.(RawEvent); ok {
+		return Envelope{Type: raw.Type, Data: raw.Data, TempID: tempID, RunID: runID}
+	}
+	return Envelope{Type: event.EventType(), Data: event, TempID: tempID, RunID: runID}
+}
+
+// RawEvent пропускает к клиенту события Python-сервиса, у которых нет
+// собственной структуры. В схему не попадает.
+type RawEvent struct {
+	Type string
+	Data interface{}
+}
+
+func (e RawEvent) EventType() string { return e.Type }
+
+type HelloEvent struct {
+	ProtocolVersion   int   `json:"protocol_version"`
+	SupportedVersions []int `json:"supported_versions"`
+	MaxRunsPerClient  int   `json:"max_runs_per_client"`
+	// Locale — язык, на котором сервер будет присылать сообщения.
+	Locale string `json:"locale"`
+}
+
+// ThoughtHeaderEvent передается строкой, а не объектом, для совместимости
+// с клиентами версии 1.
+type ThoughtHeaderEvent string
+
+type ToolCallEvent struct {
+	ToolName  string `json:"tool_name"`
+	ToolQuery string `json:"tool_query"`
+}
+
+type ToolOutputEvent struct {
+	Type     string `json:"type"`
+	ToolName string `json:"tool_name"`
+	Output   string `json:"output"`
+}
+
+type ToolErrorEvent struct {
+	Type     string `json:"type"`
+	ToolName string `json:"tool_name"`
+	Code     string `json:"code,omitempty"`
+	Error    string `json:"error"`
+}
+
+type ChunkEvent struct {
+	Text string `json:"text"`
+}
+
+type UsageUpdateEvent struct {
+	models.TokenUsage
+}
+
+type LogSavedEvent struct {
+	TempID    int64 `json:"temp_id"`
+	DBID      int64 `json:"db_id"`
+	SessionID int64 `json:"session_id"`
+}
+
+type LogUpdatedEvent struct {
+	TempID    int64 `json:"temp_id,omitempty"`
+	DBID      int64 `json:"db_id"`
+	SessionID int64 `json:"session_id"`
+}
+
+type SessionCreatedEvent struct {
+	models.ChatSession
+}
+
+type SessionUpdatedEvent struct {
+	models.ChatSession
+}
+
+type SessionDeletedEvent struct {
+	SessionID int `json:"session_id"`
+}
+
+type DoneEvent struct {
+	Message string `json:"message"`
+}
+
+// ErrorEvent несет стабильный код из пакета apperr и сообщение на языке
+// пользователя.
+type ErrorEvent struct {
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+type CancelledEvent struct {
+	Message string `json:"message"`
+}
+
+type PongEvent struct {
+	Nonce      string    `json:"nonce,omitempty"`
+	ServerTime time.Time `json:"server_time"`
+}
+
+type RunsEvent []models.RunInfo
+
+type RunSnapshotEvent struct {
+	models.RunInfo
+	ThoughtHeader string `json:"thought_header,omitempty"`
+	Text          string `json:"text"`
+}
+
+func (HelloEvent) EventType() string          { return "hello" }
+func (ThoughtHeaderEvent) EventType() string  { return "thought_header" }
+func (ToolCallEvent) EventType() string       { return "tool_call" }
+func (ToolOutputEvent) EventType() string     { return "tool_output" }
+func (ToolErrorEvent) EventType() string      { return "tool_error" }
+func (ChunkEvent) EventType() string          { return "chunk" }
+func (UsageUpdateEvent) EventType() string    { return "usage_update" }
+func (LogSavedEvent) EventType() string       { return "log_saved" }
+func (LogUpdatedEvent) EventType() string     { return "log_updated" }
+func (SessionCreatedEvent) EventType() string { return "session_created" }
+func (SessionUpdatedEvent) EventType() string { return "session_updated" }
+func (SessionDeletedEvent) EventType() string { return "session_deleted" }
+func (DoneEvent) EventType() string           { return "done" }
+func (ErrorEvent) EventType() string          { return "error" }
+func (CancelledEvent) EventType() string      { return "cancelled" }
+func (PongEvent) EventType() string           { return "pong" }
+func (RunsEvent) EventType() string           { return "runs" }
+func (RunSnapshotEvent) EventType() string    { return "run_snapshot" }
+
+// ServerEvents перечисляет все события сервера; по нему строится схема.
+var ServerEvents = []Event{
+	HelloEvent{},
+	ThoughtHeaderEvent(""),
+	ToolCallEvent{},
+	ToolOutputEvent{},
+	ToolErrorEvent{},
+	ChunkEvent{},
+	UsageUpdateEvent{},
+	LogSavedEvent{},
+	LogUpdatedEvent{},
+	SessionCreatedEvent{},
+	SessionUpdatedEvent{},
+	SessionDeletedEvent{},
+	DoneEvent{},
+	ErrorEvent{},
+	CancelledEvent{},
+	PongEvent{},
+	RunsEvent{},
+	RunSnapshotEvent{},
+}
@@ -0,0 +1,95 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"egobackend/internal/models"
+)
+
+const (
+	TypeHello     = "hello"
+	TypeGenerate  = "generate"
+	TypeCancel    = "cancel"
+	TypeResume    = "resume"
+	TypePing      = "ping"
+	TypeSubscribe = "subscribe"
+	TypeListRuns  = "list_runs"
+)
+
+type HelloMessage struct {
+	Type             string `json:"type"`
+	ProtocolVersions []int  `json:"protocol_versions"`
+	// Locale — язык интерфейса клиента. Используется, если пользователь не
+	// выбрал язык в настройках.
+	Locale string `json:"locale,omitempty"`
+}
+
+// GenerateMessage запускает генерацию. Поля запроса лежат на верхнем
+// уровне, как и в кадрах старых клиентов.
+type GenerateMessage struct {
+	Type string `json:"type,omitempty"`
+	models.StreamRequest
+}
+
+type CancelMessage struct {
+	Type  string `json:"type"`
+	RunID string `json:"run_id"`
+}
+
+type ResumeMessage struct {
+	Type  string `json:"type"`
+	RunID string `json:"run_id"`
+}
+
+type PingMessage struct {
+	Type  string `json:"type"`
+	Nonce string `json:"nonce,omitempty"`
+}
+
+// SubscribeMessage задает набор сессий, потоковые события которых
+// соединение хочет получать с других устройств. Пустой список
+// отменяет подписку.
+type SubscribeMessage struct {
+	Type       string `json:"type"`
+	SessionIDs []int  `json:"session_ids"`
+}
+
+type ListRunsMessage struct {
+	Type string `json:"type"`
+}
+
+// DecodeClientMessage разбирает входящий кадр в одну из структур этого
+// файла по значению поля type.
+func DecodeClientMessage(raw []byte) (interface{}, error) {
+	var head struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(raw, &head); err != nil {
+		return nil, err
+	}
+
+	var msg interface{}
+	switch head.Type {
+	case TypeHello:
+		msg = &HelloMessage{}
+	case "", TypeGenerate:
+		msg = &GenerateMessage{}
+	case TypeCancel:
+		msg = &CancelMessage{}
+	case TypeResume:
+		msg = &ResumeMessage{}
+	case TypePing:
+		msg = &PingMessage{}
+	case TypeSubscribe:
+		msg = &SubscribeMessage{}
+	case TypeListRuns:
+		msg = &ListRunsMessage{}
+	default:
+		return nil, fmt.Errorf("неизвестный тип сообщения: %s", head.Type)
+	}
+	if err := json.Unmarshal(raw, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
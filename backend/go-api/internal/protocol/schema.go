@@ -0,0 +1,162 @@
+package protocol
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+var clientMessages = []struct {
+	typ    string
+	sample interface{}
+}{
+	{TypeHello, HelloMessage{}},
+	{TypeGenerate, GenerateMessage{}},
+	{TypeCancel, CancelMessage{}},
+	{TypeResume, ResumeMessage{}},
+	{TypePing, PingMessage{}},
+	{TypeSubscribe, SubscribeMessage{}},
+	{TypeListRuns, ListRunsMessage{}},
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+	numberType     = reflect.TypeOf(json.Number(""))
+)
+
+// GenerateSchema строит JSON Schema (draft 2020-12) для всех сообщений
+// клиента и конвертов сервера по структурам пакета.
+func GenerateSchema() ([]byte, error) {
+	defs := map[string]interface{}{}
+
+	var clientRefs []interface{}
+	for _, m := range clientMessages {
+		name := reflect.TypeOf(m.sample).Name()
+		schema := typeSchema(reflect.TypeOf(m.sample))
+		props := schema["properties"].(map[string]interface{})
+		props["type"] = map[string]interface{}{"const": m.typ}
+		if m.typ != TypeGenerate {
+			schema["required"] = appendUnique(schema["required"], "type")
+		}
+		defs[name] = schema
+		clientRefs = append(clientRefs, ref(name))
+	}
+
+	var serverRefs []interface{}
+	for _, event := range ServerEvents {
+		name := reflect.TypeOf(event).Name()
+		defs[name] = map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"type":    map[string]interface{}{"const": event.EventType()},
+				"data":    typeSchema(reflect.TypeOf(event)),
+				"temp_id": map[string]interface{}{"type": "integer"},
+				"run_id":  map[string]interface{}{"type": "string"},
+			},
+			"required": []string{"type", "data"},
+		}
+		serverRefs = append(serverRefs, ref(name))
+	}
+
+	defs["ClientMessage"] = map[string]interface{}{"oneOf": clientRefs}
+	defs["ServerEnvelope"] = map[string]interface{}{"oneOf": serverRefs}
+
+	root := map[string]interface{}{
+		"$schema":            "https://json-schema.org/draft/2020-12/schema",
+		"$id":                "https://ego.local/protocol.schema.json",
+		"title":              "EGO WebSocket protocol",
+		"x-protocol-version": Version,
+		"$defs":              defs,
+		"anyOf":              []interface{}{ref("ClientMessage"), ref("ServerEnvelope")},
+	}
+	return json.MarshalIndent(root, "", "  ")
+}
+
+func ref(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/$defs/" + name}
+}
+
+func appendUnique(list interface{}, value string) []string {
+	existing, _ := list.([]string)
+	for _, v := range existing {
+		if v == value {
+			return existing
+		}
+	}
+	return append(existing, value)
+}
+
+func typeSchema(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == rawMessageType:
+		return map[string]interface{}{}
+	case t == numberType:
+		return map[string]interface{}{"type": []string{"number", "string"}}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		inner := typeSchema(t.Elem())
+		return map[string]interface{}{"anyOf": []interface{}{inner, map[string]interface{}{"type": "null"}}}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Struct:
+		props := map[string]interface{}{}
+		var required []string
+		collectFields(t, props, &required)
+		sort.Strings(required)
+		schema := map[string]interface{}{"type": "object", "properties": props}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	}
+	return map[string]interface{}{}
+}
+
+func collectFields(t reflect.Type, props map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" {
+			ft := field.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				collectFields(ft, props, required)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		props[name] = typeSchema(field.Type)
+		if !strings.Contains(opts, "omitempty") && field.Type.Kind() != reflect.Ptr {
+			*required = append(*required, name)
+		}
+	}
+}
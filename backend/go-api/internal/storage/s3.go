@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -97,3 +98,40 @@ func (s *S3Service) DownloadFile(ctx context.Context, key string) ([]byte, error
 	}
 	return body, nil
 }
+
+// OpenFile возвращает поток объекта без чтения в память. Закрывает вызывающий.
+func (s *S3Service) OpenFile(ctx context.Context, key string) (io.ReadCloser, error) {
+	result, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("не удалось получить объект %s из S3: %w", key, err)
+	}
+	return result.Body, nil
+}
+
+// ListFilesOlderThan обходит бакет и передает в fn ключи объектов старше
+// maxAge, по странице за раз. Ошибка fn останавливает обход.
+func (s *S3Service) ListFilesOlderThan(ctx context.Context, maxAge time.Duration, fn func(keys []string) error) error {
+	cutoff := time.Now().Add(-maxAge)
+	var fnErr error
+	err := s.client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		var keys []string
+		for _, object := range page.Contents {
+			if object.LastModified != nil && object.LastModified.Before(cutoff) {
+				keys = append(keys, aws.StringValue(object.Key))
+			}
+		}
+		if len(keys) > 0 {
+			fnErr = fn(keys)
+		}
+		return fnErr == nil
+	})
+	if err != nil {
+		return fmt.Errorf("не удалось получить список объектов S3: %w", err)
+	}
+	return fnErr
+}
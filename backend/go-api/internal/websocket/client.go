@@ -1,30 +1,95 @@
 package websocket
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"egobackend/internal/apperr"
 	"egobackend/internal/database"
 	"egobackend/internal/engine"
+	"egobackend/internal/i18n"
 	"egobackend/internal/models"
+	"egobackend/internal/protocol"
 	"egobackend/internal/storage"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
 type Client struct {
+	id        string
 	hub       *Hub
 	conn      *websocket.Conn
-	send      chan []byte
-	db        *database.DB
-	pyURL     string
+	db        database.Store
+	backends  engine.Backends
 	user      *models.User
 	s3Service *storage.S3Service
+	out       *outbox
 	mu        sync.Mutex
-	closed    bool
+	runs      map[string]*activeRun
+
+	protocolVersion int
+	locale          i18n.Locale
+	// localeFromUser — язык выбран в настройках и hello его не меняет.
+	localeFromUser bool
+	subscriptions  map[int]bool
+}
+
+// activeRun — генерация, которая выполняется на этом узле. Текст ответа
+// копится, чтобы переподключившееся устройство получило его в run_snapshot.
+type activeRun struct {
+	info   models.RunInfo
+	owner  *Client
+	cancel context.CancelFunc
+	mirror atomic.Bool
+
+	mu     sync.Mutex
+	header string
+	text   strings.Builder
+}
+
+func (r *activeRun) record(event protocol.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch e := event.(type) {
+	case protocol.ThoughtHeaderEvent:
+		r.header = string(e)
+	case protocol.ChunkEvent:
+		r.text.WriteString(e.Text)
+	case protocol.SessionCreatedEvent:
+		id := e.ID
+		r.info.SessionID = &id
+	}
+}
+
+func (r *activeRun) sessionID() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.info.SessionID == nil {
+		return 0
+	}
+	return *r.info.SessionID
+}
+
+func (r *activeRun) snapshot() protocol.RunSnapshotEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return protocol.RunSnapshotEvent{RunInfo: r.info, ThoughtHeader: r.header, Text: r.text.String()}
+}
+
+// sessionSyncEvents меняют список сессий или историю, поэтому всегда
+// дублируются на остальные устройства пользователя.
+var sessionSyncEvents = map[string]bool{
+	"session_created": true,
+	"log_saved":       true,
+	"log_updated":     true,
 }
 
 const (
@@ -40,21 +105,30 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin:     func(r *http.Request) bool { return true },
 }
 
-func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request, user *models.User, db *database.DB, pyURL string, s3Service *storage.S3Service) {
+func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request, user *models.User, db database.Store, backends engine.Backends, s3Service *storage.S3Service) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println("Upgrade error:", err)
 		return
 	}
 	client := &Client{
+		id:        uuid.New().String(),
 		hub:       hub,
 		conn:      conn,
-		send:      make(chan []byte, 256),
+		out:       newOutbox(),
 		user:      user,
 		db:        db,
-		pyURL:     pyURL,
+		backends:  backends,
 		s3Service: s3Service,
+		runs:      make(map[string]*activeRun),
+		locale:    i18n.ParseAcceptLanguage(r.Header.Get("Accept-Language")),
 	}
+	if user.Locale.Valid {
+		if locale, ok := i18n.Lookup(user.Locale.String); ok {
+			client.locale, client.localeFromUser = locale, true
+		}
+	}
+	client.subscriptions = make(map[int]bool)
 	client.hub.register <- client
 
 	go client.writePump()
@@ -95,13 +169,26 @@ func (c *Client) writePump() {
 	}()
 	for {
 		select {
-		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
+		case <-c.out.notify:
+			items, closed, code, text := c.out.drain()
+			for _, item := range items {
+				message, err := item.bytes()
+				if err != nil {
+					log.Printf("CRITICAL: Failed to marshal event to JSON: %v", err)
+					continue
+				}
+				c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+				if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+					return
+				}
 			}
-			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+			if closed {
+				c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+				closeMessage := []byte{}
+				if code != 0 {
+					closeMessage = websocket.FormatCloseMessage(code, text)
+				}
+				c.conn.WriteMessage(websocket.CloseMessage, closeMessage)
 				return
 			}
 		case <-ticker.C:
@@ -114,40 +201,194 @@ func (c *Client) writePump() {
 }
 
 func (c *Client) handleIncomingMessage(message []byte) {
-	var req models.StreamRequest
-	if err := json.Unmarshal(message, &req); err != nil {
-		c.sendEvent("error", map[string]string{"message": "Неверный формат запроса."})
+	decoded, err := protocol.DecodeClientMessage(message)
+	if err != nil {
+		c.sendError(apperr.Wrap(apperr.BadRequest, err), 0)
 		return
 	}
 
-	log.Printf("WS Запрос от %s (ID %d), Mode: %s -> делегируется Процессору", c.user.Username, c.user.ID, req.Mode)
+	switch msg := decoded.(type) {
+	case *protocol.HelloMessage:
+		c.handleHello(msg)
+	case *protocol.GenerateMessage:
+		c.handleGenerate(msg.StreamRequest)
+	case *protocol.CancelMessage:
+		c.routeRunControl("cancel", msg.RunID)
+	case *protocol.ResumeMessage:
+		c.routeRunControl("resume", msg.RunID)
+	case *protocol.PingMessage:
+		c.sendEvent(protocol.PongEvent{Nonce: msg.Nonce, ServerTime: time.Now().UTC()})
+	case *protocol.SubscribeMessage:
+		c.setSubscriptions(msg.SessionIDs)
+	case *protocol.ListRunsMessage:
+		c.sendEvent(c.listRuns())
+	}
+}
 
-	processor := engine.NewProcessor(c.db, c.pyURL, c.s3Service)
+func (c *Client) handleHello(msg *protocol.HelloMessage) {
+	version := protocol.Negotiate(msg.ProtocolVersions)
+	if version == 0 {
+		c.sendError(apperr.New(apperr.ProtocolUnsupported).WithDetail("версии клиента %v", msg.ProtocolVersions), 0)
+		return
+	}
+	c.mu.Lock()
+	c.protocolVersion = version
+	if locale, ok := i18n.Lookup(msg.Locale); ok && !c.localeFromUser {
+		c.locale = locale
+	}
+	locale := c.locale
+	c.mu.Unlock()
+	c.sendEvent(protocol.HelloEvent{
+		ProtocolVersion:   version,
+		SupportedVersions: protocol.SupportedVersions,
+		MaxRunsPerClient:  c.hub.maxRunsPerClient,
+		Locale:            string(locale),
+	})
+}
 
-	callback := func(eventType string, data interface{}) {
-		c.sendEvent(eventType, data)
+func (c *Client) routeRunControl(action, runID string) {
+	if runID == "" {
+		c.sendError(apperr.New(apperr.RunIDRequired), 0)
+		return
 	}
+	c.hub.routeRunControl(runControl{RunID: runID, UserID: c.user.ID, Action: action})
+}
 
-	processor.ProcessRequest(req, c.user, req.TempID, callback)
+func (c *Client) setSubscriptions(sessionIDs []int) {
+	subscriptions := make(map[int]bool, len(sessionIDs))
+	for _, id := range sessionIDs {
+		subscriptions[id] = true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subscriptions = subscriptions
 }
 
-func (c *Client) sendEvent(eventType string, data interface{}) {
+func (c *Client) isSubscribed(sessionID int) bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if c.closed {
+	return c.subscriptions[sessionID]
+}
+
+func (c *Client) handleGenerate(req models.StreamRequest) {
+	ctx, cancel := context.WithCancel(i18n.WithLocale(context.Background(), c.currentLocale()))
+	defer cancel()
+
+	run, ok := c.startRun(req, cancel)
+	if !ok {
+		c.sendError(apperr.New(apperr.QuotaExceeded).WithDetail("лимит %d генераций на соединение", c.hub.maxRunsPerClient), req.TempID)
 		return
 	}
+	defer c.finishRun(run)
 
-	eventData := map[string]interface{}{"type": eventType, "data": data}
-	jsonEvent, err := json.Marshal(eventData)
-	if err != nil {
-		log.Printf("CRITICAL: Failed to marshal event to JSON: %v", err)
-		return
+	log.Printf("WS Запрос от %s (ID %d), Mode: %s, run %s -> делегируется Процессору", c.user.Username, c.user.ID, req.Mode, run.info.RunID)
+
+	processor := engine.NewProcessor(c.db, c.backends, c.s3Service)
+	processor.Events = c.hub
+
+	callback := func(event protocol.Event) {
+		run.record(event)
+		envelope := protocol.NewEnvelope(event, run.info.TempID, run.info.RunID)
+		c.push(envelope)
+
+		fanout := userEvent{UserID: c.user.ID, ExcludeID: c.id, Type: envelope.Type}
+		switch {
+		case sessionSyncEvents[envelope.Type] || c.hub.syncStreams || run.mirror.Load():
+		case run.sessionID() != 0:
+			// Остальные устройства получат событие, только если подписаны на сессию.
+			fanout.SessionID = run.sessionID()
+		default:
+			return
+		}
+		payload, err := json.Marshal(envelope)
+		if err != nil {
+			log.Printf("CRITICAL: Failed to marshal event to JSON: %v", err)
+			return
+		}
+		fanout.Payload = payload
+		c.hub.publishUserEvent(fanout)
+	}
+
+	processor.ProcessRequest(ctx, req, c.user, req.TempID, callback)
+}
+
+func (c *Client) startRun(req models.StreamRequest, cancel context.CancelFunc) (*activeRun, bool) {
+	c.mu.Lock()
+	if c.hub.maxRunsPerClient > 0 && len(c.runs) >= c.hub.maxRunsPerClient {
+		c.mu.Unlock()
+		return nil, false
+	}
+	run := &activeRun{
+		info: models.RunInfo{
+			RunID:          uuid.New().String(),
+			TempID:         req.TempID,
+			SessionID:      req.SessionID,
+			Mode:           req.Mode,
+			IsRegeneration: req.IsRegeneration,
+			StartedAt:      time.Now().UTC(),
+		},
+		owner:  c,
+		cancel: cancel,
+	}
+	c.runs[run.info.RunID] = run
+	c.mu.Unlock()
+
+	c.hub.trackRun(run)
+	return run, true
+}
+
+func (c *Client) finishRun(run *activeRun) {
+	c.hub.untrackRun(run.info.RunID)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.runs, run.info.RunID)
+}
+
+func (c *Client) listRuns() protocol.RunsEvent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	runs := make(protocol.RunsEvent, 0, len(c.runs))
+	for _, run := range c.runs {
+		run.mu.Lock()
+		runs = append(runs, run.info)
+		run.mu.Unlock()
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].StartedAt.Before(runs[j].StartedAt) })
+	return runs
+}
+
+func (c *Client) sendEvent(event protocol.Event) {
+	c.push(protocol.NewEnvelope(event, 0, ""))
+}
+
+func (c *Client) sendError(err *apperr.Error, tempID int64) {
+	log.Printf("WS ошибка для %s: %v", c.user.Username, err)
+	event := protocol.ErrorEvent{Code: string(err.Code), Message: err.Message(c.currentLocale())}
+	c.push(protocol.NewEnvelope(event, tempID, ""))
+}
+
+func (c *Client) currentLocale() i18n.Locale {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.locale
+}
+
+// push ставит событие в очередь соединения, при необходимости дожидаясь
+// места. Клиента, который так и не освободил очередь, отключаем.
+func (c *Client) push(envelope protocol.Envelope) {
+	if err := c.out.push(envelope); err == errSlowConsumer {
+		c.disconnectSlowConsumer()
 	}
+}
 
-	select {
-	case c.send <- jsonEvent:
-	default:
-		log.Printf("Warning: send channel is full for client %s. Message dropped.", c.user.Username)
+// enqueue принимает готовые кадры от хаба и никогда не блокирует.
+func (c *Client) enqueue(eventType string, payload []byte) {
+	if err := c.out.offer(eventType, payload); err == errSlowConsumer {
+		c.disconnectSlowConsumer()
 	}
 }
+
+func (c *Client) disconnectSlowConsumer() {
+	log.Printf("Warning: client %s is too slow to receive events. Closing connection.", c.user.Username)
+	c.out.close(protocol.CloseSlowConsumer, "slow consumer")
+}
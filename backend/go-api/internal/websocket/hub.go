@@ -1,51 +1,198 @@
 package websocket
 
-import "log"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+
+	"egobackend/internal/backplane"
+	"egobackend/internal/protocol"
+)
+
+// userEvent и runControl путешествуют через backplane между узлами.
+// Событие с SessionID получают только соединения, подписанные на эту сессию.
+type userEvent struct {
+	UserID    int             `json:"user_id"`
+	ExcludeID string          `json:"exclude_id,omitempty"`
+	SessionID int             `json:"session_id,omitempty"`
+	Type      string          `json:"type"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+type runControl struct {
+	RunID  string `json:"run_id"`
+	UserID int    `json:"user_id"`
+	Action string `json:"action"`
+}
 
 type Hub struct {
-	clients    map[*Client]bool
-	broadcast  chan []byte
-	register   chan *Client
-	unregister chan *Client
+	maxRunsPerClient int
+	syncStreams      bool
+	backplane        backplane.Backplane
+	clients          map[int]map[*Client]bool
+	deliver          chan userEvent
+	register         chan *Client
+	unregister       chan *Client
+
+	runsMu sync.Mutex
+	runs   map[string]*activeRun
 }
 
-func NewHub() *Hub {
-	return &Hub{
-		broadcast:  make(chan []byte),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		clients:    make(map[*Client]bool),
+// NewHub создает хаб. maxRunsPerClient ограничивает число одновременных
+// генераций на одно соединение, 0 снимает ограничение. При syncStreams
+// на остальные устройства пользователя уходят и потоковые события
+// генерации, а не только изменения сессий.
+func NewHub(bp backplane.Backplane, maxRunsPerClient int, syncStreams bool) (*Hub, error) {
+	h := &Hub{
+		maxRunsPerClient: maxRunsPerClient,
+		syncStreams:      syncStreams,
+		backplane:        bp,
+		deliver:          make(chan userEvent, 256),
+		register:         make(chan *Client),
+		unregister:       make(chan *Client),
+		clients:          make(map[int]map[*Client]bool),
+		runs:             make(map[string]*activeRun),
 	}
+	if err := bp.Subscribe(backplane.ChannelUserEvents, h.onUserEvent); err != nil {
+		return nil, fmt.Errorf("не удалось подписаться на события пользователей: %w", err)
+	}
+	if err := bp.Subscribe(backplane.ChannelRunControl, h.onRunControl); err != nil {
+		return nil, fmt.Errorf("не удалось подписаться на управление генерациями: %w", err)
+	}
+	return h, nil
 }
 
 func (h *Hub) Run() {
 	for {
 		select {
 		case client := <-h.register:
-			h.clients[client] = true
-			log.Printf("Client %s connected. Total clients: %d", client.user.Username, len(h.clients))
+			userClients, ok := h.clients[client.user.ID]
+			if !ok {
+				userClients = make(map[*Client]bool)
+				h.clients[client.user.ID] = userClients
+			}
+			userClients[client] = true
+			log.Printf("Client %s connected. Connections for user on this node: %d", client.user.Username, len(userClients))
 		case client := <-h.unregister:
-			if _, ok := h.clients[client]; ok {
-				client.mu.Lock()
-				client.closed = true
-				client.mu.Unlock()
-				delete(h.clients, client)
-				close(client.send)
-
-				log.Printf("Client %s unregistered. Total clients: %d", client.user.Username, len(h.clients))
+			userClients := h.clients[client.user.ID]
+			if _, ok := userClients[client]; ok {
+				delete(userClients, client)
+				if len(userClients) == 0 {
+					delete(h.clients, client.user.ID)
+				}
+				client.out.close(0, "")
+
+				log.Printf("Client %s unregistered. Connections for user on this node: %d", client.user.Username, len(userClients))
 			}
-		case message := <-h.broadcast:
-			for client := range h.clients {
-				select {
-				case client.send <- message:
-				default:
-					client.mu.Lock()
-					client.closed = true
-					client.mu.Unlock()
-					delete(h.clients, client)
-					close(client.send)
+		case event := <-h.deliver:
+			for client := range h.clients[event.UserID] {
+				if client.id == event.ExcludeID {
+					continue
 				}
+				if event.SessionID != 0 && !client.isSubscribed(event.SessionID) {
+					continue
+				}
+				client.enqueue(event.Type, event.Payload)
 			}
 		}
 	}
 }
+
+// PublishToUser рассылает событие всем соединениям пользователя на всех
+// узлах. Используется REST-обработчиками.
+func (h *Hub) PublishToUser(userID int, event protocol.Event) {
+	payload, err := json.Marshal(protocol.NewEnvelope(event, 0, ""))
+	if err != nil {
+		log.Printf("CRITICAL: Failed to marshal hub event to JSON: %v", err)
+		return
+	}
+	h.publishUserEvent(userEvent{UserID: userID, Type: event.EventType(), Payload: payload})
+}
+
+func (h *Hub) publishUserEvent(event userEvent) {
+	message, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("CRITICAL: Failed to marshal user event: %v", err)
+		return
+	}
+	if err := h.backplane.Publish(context.Background(), backplane.ChannelUserEvents, message); err != nil {
+		log.Printf("!!! [HUB] Не удалось опубликовать событие пользователя %d: %v", event.UserID, err)
+	}
+}
+
+func (h *Hub) onUserEvent(payload []byte) {
+	var event userEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		log.Printf("!!! [HUB] Некорректное событие из backplane: %v", err)
+		return
+	}
+	h.deliver <- event
+}
+
+func (h *Hub) trackRun(run *activeRun) {
+	h.runsMu.Lock()
+	defer h.runsMu.Unlock()
+	h.runs[run.info.RunID] = run
+}
+
+func (h *Hub) untrackRun(runID string) {
+	h.runsMu.Lock()
+	defer h.runsMu.Unlock()
+	delete(h.runs, runID)
+}
+
+func (h *Hub) localRun(runID string) *activeRun {
+	h.runsMu.Lock()
+	defer h.runsMu.Unlock()
+	return h.runs[runID]
+}
+
+// routeRunControl выполняет команду сразу, если генерация идет на этом
+// узле, и иначе отправляет ее через backplane узлу-владельцу.
+func (h *Hub) routeRunControl(control runControl) {
+	if run := h.localRun(control.RunID); run != nil {
+		h.applyRunControl(run, control)
+		return
+	}
+	message, err := json.Marshal(control)
+	if err != nil {
+		log.Printf("CRITICAL: Failed to marshal run control: %v", err)
+		return
+	}
+	if err := h.backplane.Publish(context.Background(), backplane.ChannelRunControl, message); err != nil {
+		log.Printf("!!! [HUB] Не удалось переслать команду %s для run %s: %v", control.Action, control.RunID, err)
+	}
+}
+
+func (h *Hub) onRunControl(payload []byte) {
+	var control runControl
+	if err := json.Unmarshal(payload, &control); err != nil {
+		log.Printf("!!! [HUB] Некорректная команда из backplane: %v", err)
+		return
+	}
+	if run := h.localRun(control.RunID); run != nil {
+		h.applyRunControl(run, control)
+	}
+}
+
+func (h *Hub) applyRunControl(run *activeRun, control runControl) {
+	if run.owner.user.ID != control.UserID {
+		log.Printf("!!! [HUB] Пользователь %d попытался управлять чужой генерацией %s", control.UserID, control.RunID)
+		return
+	}
+	switch control.Action {
+	case "cancel":
+		log.Printf("[HUB] Отмена генерации %s по запросу пользователя %d", run.info.RunID, control.UserID)
+		run.cancel()
+	case "resume":
+		run.mirror.Store(true)
+		payload, err := json.Marshal(protocol.NewEnvelope(run.snapshot(), run.info.TempID, run.info.RunID))
+		if err != nil {
+			log.Printf("CRITICAL: Failed to marshal run snapshot: %v", err)
+			return
+		}
+		h.publishUserEvent(userEvent{UserID: control.UserID, ExcludeID: run.owner.id, Type: "run_snapshot", Payload: payload})
+	}
+}
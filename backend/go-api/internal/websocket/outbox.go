@@ -0,0 +1,178 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"egobackend/internal/protocol"
+)
+
+const (
+	// outboxSoftLimit — после него производитель ждет, пока writePump
+	// разгребет очередь. Критичные события лимит не учитывают.
+	outboxSoftLimit = 256
+	// outboxHardLimit защищает память от событий, которые приходят из хаба
+	// без ожидания.
+	outboxHardLimit = 1024
+	// slowConsumerTimeout — сколько производитель готов ждать места в
+	// очереди, прежде чем соединение будет закрыто.
+	slowConsumerTimeout = 15 * time.Second
+)
+
+var (
+	errOutboxClosed = errors.New("соединение закрыто")
+	errSlowConsumer = errors.New("клиент не успевает принимать события")
+)
+
+// criticalEvents никогда не отбрасываются и не ждут места в очереди:
+// без них клиент не узнает о завершении генерации или о новой записи.
+var criticalEvents = map[string]bool{
+	"done":            true,
+	"error":           true,
+	"cancelled":       true,
+	"log_saved":       true,
+	"log_updated":     true,
+	"session_created": true,
+}
+
+type outboxItem struct {
+	eventType string
+	envelope  *protocol.Envelope
+	payload   []byte
+}
+
+func (it *outboxItem) bytes() ([]byte, error) {
+	if it.payload != nil {
+		return it.payload, nil
+	}
+	return json.Marshal(it.envelope)
+}
+
+// outbox — очередь исходящих кадров одного соединения. Подряд идущие
+// chunk одной генерации склеиваются, пока writePump их не забрал.
+type outbox struct {
+	mu        sync.Mutex
+	items     []*outboxItem
+	freed     chan struct{}
+	notify    chan struct{}
+	closed    bool
+	closeCode int
+	closeText string
+}
+
+func newOutbox() *outbox {
+	return &outbox{
+		freed:  make(chan struct{}),
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// push ставит событие генерации в очередь. Если очередь переполнена,
+// вызывающий блокируется не дольше slowConsumerTimeout.
+func (o *outbox) push(envelope protocol.Envelope) error {
+	item := &outboxItem{eventType: envelope.Type, envelope: &envelope}
+	deadline := time.Now().Add(slowConsumerTimeout)
+	for {
+		o.mu.Lock()
+		if o.closed {
+			o.mu.Unlock()
+			return errOutboxClosed
+		}
+		if o.coalesceLocked(item) {
+			o.signalLocked()
+			o.mu.Unlock()
+			return nil
+		}
+		if criticalEvents[item.eventType] || len(o.items) < outboxSoftLimit {
+			o.appendLocked(item)
+			o.mu.Unlock()
+			return nil
+		}
+		freed := o.freed
+		o.mu.Unlock()
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return errSlowConsumer
+		}
+		timer := time.NewTimer(remaining)
+		select {
+		case <-freed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// offer никогда не блокирует: им пользуется хаб, который не может ждать
+// одного медленного клиента.
+func (o *outbox) offer(eventType string, payload []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return errOutboxClosed
+	}
+	if !criticalEvents[eventType] && len(o.items) >= outboxHardLimit {
+		return errSlowConsumer
+	}
+	o.appendLocked(&outboxItem{eventType: eventType, payload: payload})
+	return nil
+}
+
+func (o *outbox) coalesceLocked(item *outboxItem) bool {
+	if item.eventType != "chunk" || len(o.items) == 0 {
+		return false
+	}
+	last := o.items[len(o.items)-1]
+	if last.eventType != "chunk" || last.envelope == nil || last.envelope.RunID != item.envelope.RunID {
+		return false
+	}
+	prev, ok1 := last.envelope.Data.(protocol.ChunkEvent)
+	next, ok2 := item.envelope.Data.(protocol.ChunkEvent)
+	if !ok1 || !ok2 {
+		return false
+	}
+	last.envelope.Data = protocol.ChunkEvent{Text: prev.Text + next.Text}
+	return true
+}
+
+func (o *outbox) appendLocked(item *outboxItem) {
+	o.items = append(o.items, item)
+	o.signalLocked()
+}
+
+func (o *outbox) signalLocked() {
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+}
+
+// drain забирает все накопленные кадры и будит ждущих производителей.
+func (o *outbox) drain() (items []*outboxItem, closed bool, code int, text string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	items = o.items
+	o.items = nil
+	close(o.freed)
+	o.freed = make(chan struct{})
+	return items, o.closed, o.closeCode, o.closeText
+}
+
+// close помечает очередь закрытой. writePump отправит оставшиеся кадры
+// и close-фрейм с указанным кодом.
+func (o *outbox) close(code int, text string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return
+	}
+	o.closed = true
+	o.closeCode = code
+	o.closeText = text
+	close(o.freed)
+	o.freed = make(chan struct{})
+	o.signalLocked()
+}
@@ -0,0 +1,156 @@
+package websocket_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"egobackend/internal/backplane"
+	"egobackend/internal/engine/enginetest"
+	"egobackend/internal/models"
+	"egobackend/internal/protocol"
+	"egobackend/internal/websocket"
+
+	gorilla "github.com/gorilla/websocket"
+)
+
+type frame struct {
+	Type   string          `json:"type"`
+	Data   json.RawMessage `json:"data"`
+	TempID int64           `json:"temp_id"`
+	RunID  string          `json:"run_id"`
+}
+
+// dialWs поднимает /ws поверх harness и возвращает соединение после
+// обмена hello.
+func dialWs(t *testing.T, h *enginetest.Harness) *gorilla.Conn {
+	t.Helper()
+	hub, err := websocket.NewHub(backplane.NewMemory(), 3, false)
+	if err != nil {
+		t.Fatalf("NewHub: %v", err)
+	}
+	go hub.Run()
+	backends := h.Python.Backends(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		websocket.ServeWs(hub, w, r, h.User, h.DB, backends, nil)
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := gorilla.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	send(t, conn, protocol.HelloMessage{Type: protocol.TypeHello, ProtocolVersions: protocol.SupportedVersions, Locale: "ru"})
+	if hello := readFrame(t, conn); hello.Type != "hello" {
+		t.Fatalf("first frame = %s, want hello", hello.Type)
+	}
+	return conn
+}
+
+func send(t *testing.T, conn *gorilla.Conn, msg interface{}) {
+	t.Helper()
+	if err := conn.WriteJSON(msg); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+}
+
+func readFrame(t *testing.T, conn *gorilla.Conn) frame {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(20 * time.Second))
+	var f frame
+	if err := conn.ReadJSON(&f); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return f
+}
+
+// readRun читает кадры до конца запуска: done, error или cancelled.
+func readRun(t *testing.T, conn *gorilla.Conn) []frame {
+	t.Helper()
+	var frames []frame
+	for {
+		f := readFrame(t, conn)
+		frames = append(frames, f)
+		switch f.Type {
+		case "done", "error", "cancelled":
+			return frames
+		}
+	}
+}
+
+func frameTypes(frames []frame) []string {
+	types := make([]string, 0, len(frames))
+	for _, f := range frames {
+		types = append(types, f.Type)
+	}
+	return enginetest.CompactTypes(types)
+}
+
+func TestWsGenerate(t *testing.T) {
+	h := enginetest.NewHarness(t, enginetest.Script{
+		Thoughts: []enginetest.ThoughtStep{
+			enginetest.Thought("Ищу", true, models.ToolCall{ToolName: "EgoSearch", ToolQuery: "погода"}),
+			enginetest.Thought("Отвечаю", false),
+		},
+		Tools:     map[string][]enginetest.ToolStep{"EgoSearch": {{Result: "солнечно"}}},
+		Synthesis: []enginetest.StreamStep{{Chunks: []string{"Сегодня ", "солнечно."}}},
+	})
+	conn := dialWs(t, h)
+
+	send(t, conn, protocol.GenerateMessage{Type: protocol.TypeGenerate, StreamRequest: models.StreamRequest{Query: "Какая погода?", TempID: 42}})
+	frames := readRun(t, conn)
+
+	want := []string{"session_created", "thought_header", "tool_call", "tool_output", "thought_header", "chunk", "log_saved", "done"}
+	if got := frameTypes(frames); !reflect.DeepEqual(got, want) {
+		t.Fatalf("frames:\n got  %v\n want %v", got, want)
+	}
+	runID := frames[0].RunID
+	for _, f := range frames {
+		if f.TempID != 42 || f.RunID == "" || f.RunID != runID {
+			t.Errorf("frame %s: temp_id=%d run_id=%q", f.Type, f.TempID, f.RunID)
+		}
+	}
+
+	var session models.ChatSession
+	json.Unmarshal(frames[0].Data, &session)
+	logs := h.SessionLogs(t, session.ID)
+	if len(logs) != 1 || logs[0].FinalResponse == nil || *logs[0].FinalResponse != "Сегодня солнечно." {
+		t.Errorf("logs = %+v", logs)
+	}
+}
+
+func TestWsCancelSlowStream(t *testing.T) {
+	h := enginetest.NewHarness(t, enginetest.Script{
+		Thoughts:  []enginetest.ThoughtStep{enginetest.Thought("Отвечаю", false)},
+		Synthesis: []enginetest.StreamStep{{Chunks: []string{"Очень", " медленно"}, ChunkDelay: 10 * time.Second}},
+	})
+	conn := dialWs(t, h)
+
+	send(t, conn, protocol.GenerateMessage{Type: protocol.TypeGenerate, StreamRequest: models.StreamRequest{Query: "не торопись"}})
+	var frames []frame
+	for {
+		f := readFrame(t, conn)
+		frames = append(frames, f)
+		if f.Type == "chunk" {
+			send(t, conn, protocol.CancelMessage{Type: protocol.TypeCancel, RunID: f.RunID})
+			break
+		}
+	}
+	frames = append(frames, readRun(t, conn)...)
+
+	want := []string{"session_created", "thought_header", "chunk", "cancelled"}
+	if got := frameTypes(frames); !reflect.DeepEqual(got, want) {
+		t.Fatalf("frames:\n got  %v\n want %v", got, want)
+	}
+	var session models.ChatSession
+	json.Unmarshal(frames[0].Data, &session)
+	if logs := h.SessionLogs(t, session.ID); len(logs) != 0 {
+		t.Errorf("после отмены сохранено %d логов", len(logs))
+	}
+}
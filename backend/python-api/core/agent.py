@@ -9,6 +9,8 @@ from .prompts import (
     FINAL_SYNTHESIS_PROMPT_EN_DEFAULT,
     FINAL_SYNTHESIS_PROMPT_EN_DEEPER,
     FINAL_SYNTHESIS_PROMPT_EN_RESEARCH,
+    SESSION_TITLE_PROMPT_EN,
+    HISTORY_SUMMARY_PROMPT_EN,
 )
 from .tools import Tool
 from .llm_backend import LLMBackend
@@ -43,20 +45,28 @@ class EGO:
         except Exception:
             return ""
 
-    async def generate_thought(self, query: str, mode: str, chat_history: str, thoughts_history: str, prompt_parts_from_files: List[Any]):
+    def _format_memories(self, memories: List[str]) -> str:
+        if not memories:
+            return "(nothing yet)"
+        return "\n".join(f"- {memory}" for memory in memories)
+
+    async def generate_thought(self, query: str, mode: str, chat_history: str, thoughts_history: str, prompt_parts_from_files: List[Any], memories: List[str] = None, allowed_tools: List[str] = None, temperature: float = None):
         prompt_template = self.THINKING_PROMPTS.get(mode, self.THINKING_PROMPTS["default"])
         
         sys_inst = prompt_template.format(
+            user_memories=self._format_memories(memories),
             chat_history=chat_history, 
             thoughts_history=thoughts_history, 
             user_query=query
         )
+        if allowed_tools:
+            sys_inst += f"\n\nIn this mode you may call only these tools: {', '.join(allowed_tools)}. Calls to any other tool will fail."
         
         prompt_parts = [query] + prompt_parts_from_files
 
         response_text, usage = await self.backend.generate(
             prompt_parts=prompt_parts,
-            temp=0.7,
+            temp=temperature if temperature is not None else 0.7,
             sys_inst=sys_inst
         )
         
@@ -67,6 +77,24 @@ class EGO:
         
         return thought_json, usage
 
+    async def generate_title(self, query: str, response: str, locale: str):
+        language = {"ru": "Russian", "en": "English"}.get(locale, "the language of the user's message")
+        prompt = SESSION_TITLE_PROMPT_EN.format(language=language, user_query=query, response=response)
+
+        title, usage = await self.backend.generate(prompt_parts=[prompt], temp=0.3)
+        return title.strip().splitlines()[0] if title.strip() else "", usage
+
+    async def summarize_history(self, previous_summary: str, chat_history: str, locale: str):
+        language = {"ru": "Russian", "en": "English"}.get(locale, "the language of the conversation")
+        prompt = HISTORY_SUMMARY_PROMPT_EN.format(
+            language=language,
+            previous_summary=previous_summary or "(empty)",
+            chat_history=chat_history
+        )
+
+        summary, usage = await self.backend.generate(prompt_parts=[prompt], temp=0.2)
+        return summary.strip(), usage
+
     async def synthesize_stream(
         self,
         query: str,
@@ -74,7 +102,9 @@ class EGO:
         chat_history: str,
         thoughts_history: str,
         custom_instructions: str,
-        prompt_parts_from_files: List[Any]
+        prompt_parts_from_files: List[Any],
+        memories: List[str] = None,
+        temperature: float = None
     ) -> AsyncGenerator[str, None]:
         print("\n--- [EGO_SYNTH_STREAM] НАЧАЛО СИНТЕЗА ---")
         
@@ -82,6 +112,7 @@ class EGO:
         
         sys_inst = prompt_template.format(
             custom_instructions=custom_instructions or "",
+            user_memories=self._format_memories(memories),
             chat_history=chat_history,
             thoughts_history=thoughts_history,
             user_query=query,
@@ -92,7 +123,7 @@ class EGO:
         try:
             async for chunk in self.backend.generate_stream(
                 prompt_parts=prompt_parts,
-                temp=0.8,
+                temp=temperature if temperature is not None else 0.8,
                 sys_inst=sys_inst
             ):
                 print(f"--- [EGO_SYNTH_STREAM] ПОЛУЧЕН КУСОК ОТ БЭКЕНДА: {chunk!r} ---")
@@ -27,10 +27,27 @@ class EgoRequest(BaseModel):
     chat_history: str = ""
     thoughts_history: str = ""
     custom_instructions: Optional[str] = None
+    memories: List[str] = []
+    allowed_tools: List[str] = []
+    temperature: Optional[float] = None
 
 class ToolExecutionRequest(BaseModel):
     query: str
 
+class TitleRequest(BaseModel):
+    query: str
+    response: str = ""
+    locale: str = "ru"
+
+class SummaryRequest(BaseModel):
+    previous_summary: str = ""
+    chat_history: str
+    locale: str = "ru"
+
+@app.get("/health")
+async def health():
+    return {"status": "ok"}
+
 @app.post("/generate_thought")
 async def generate_thought(
     request_data: str = Form(...),
@@ -52,7 +69,10 @@ async def generate_thought(
             mode=request.mode,
             chat_history=request.chat_history,
             thoughts_history=request.thoughts_history,
-            prompt_parts_from_files=prompt_parts_from_files
+            prompt_parts_from_files=prompt_parts_from_files,
+            memories=request.memories,
+            allowed_tools=request.allowed_tools,
+            temperature=request.temperature
         )
 
         return {"thought": thought_json, "usage": usage}
@@ -72,6 +92,32 @@ async def execute_tool(tool_name: str, request: ToolExecutionRequest):
         print(f"!!! Ошибка в /execute_tool/{tool_name}: {e} !!!"); traceback.print_exc()
         raise HTTPException(status_code=500, detail=str(e))
 
+@app.post("/generate_title")
+async def generate_title(request: TitleRequest):
+    try:
+        title, usage = await ego_instance.generate_title(
+            query=request.query,
+            response=request.response,
+            locale=request.locale
+        )
+        return {"title": title, "usage": usage}
+    except Exception as e:
+        print(f"!!! Ошибка в /generate_title: {e} !!!"); traceback.print_exc()
+        raise HTTPException(status_code=500, detail=str(e))
+
+@app.post("/summarize_history")
+async def summarize_history(request: SummaryRequest):
+    try:
+        summary, usage = await ego_instance.summarize_history(
+            previous_summary=request.previous_summary,
+            chat_history=request.chat_history,
+            locale=request.locale
+        )
+        return {"summary": summary, "usage": usage}
+    except Exception as e:
+        print(f"!!! Ошибка в /summarize_history: {e} !!!"); traceback.print_exc()
+        raise HTTPException(status_code=500, detail=str(e))
+
 @app.post("/synthesize_stream")
 async def synthesize_stream(
     request_data: str = Form(...),
@@ -96,7 +142,9 @@ async def synthesize_stream(
                 chat_history=request.chat_history,
                 thoughts_history=request.thoughts_history,
                 custom_instructions=request.custom_instructions,
-                prompt_parts_from_files=prompt_parts_from_files
+                prompt_parts_from_files=prompt_parts_from_files,
+                memories=request.memories,
+                temperature=request.temperature
             ):
                 sse_event = {"type": "chunk", "data": {"text": text_chunk}}
                 json_event = json.dumps(sse_event)